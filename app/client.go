@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/umputun/secrets/v2/pkg/client"
+)
+
+// sendCmd is "secrets send", it encrypts content locally and stores it via API
+type sendCmd struct {
+	Server   string        `long:"server" env:"SECRETS_SERVER" default:"https://safesecret.info" description:"secrets server url"`
+	User     string        `long:"user" env:"SECRETS_USER" default:"secrets" description:"basic auth user, for servers with named users"`
+	Password string        `long:"password" env:"SECRETS_PASSWORD" description:"basic auth password, if the server requires auth"`
+	Token    string        `long:"token" env:"SECRETS_TOKEN" description:"API token, used instead of password"`
+	Timeout  time.Duration `long:"timeout" env:"SECRETS_TIMEOUT" default:"30s" description:"http client timeout"`
+	File     string        `short:"f" long:"file" description:"file to send, stdin used if not set"`
+	Exp      time.Duration `long:"exp" default:"1h" description:"secret lifetime"`
+	Pin      string        `long:"pin" env:"SECRETS_PIN" description:"pin or passphrase, random pin generated if not set"`
+	NoPin    bool          `long:"no-pin" description:"send without pin, the server must allow it"`
+	Views    int           `long:"views" default:"1" description:"how many times the secret can be read"`
+}
+
+// getCmd is "secrets get <link>", it loads the secret via API and decrypts it with the key from link fragment
+type getCmd struct {
+	Password string        `long:"password" env:"SECRETS_PASSWORD" description:"basic auth password, if the server requires auth"`
+	Timeout  time.Duration `long:"timeout" env:"SECRETS_TIMEOUT" default:"30s" description:"http client timeout"`
+	Pin      string        `long:"pin" env:"SECRETS_PIN" description:"pin or passphrase"`
+	NoPin    bool          `long:"no-pin" description:"get secret created without pin"`
+	Output   string        `short:"o" long:"output" description:"where to save a file secret, original file name used if not set"`
+	Args     struct {
+		Link string `positional-arg-name:"link" required:"yes"`
+	} `positional-args:"yes"`
+}
+
+// runSend encrypts content of the file or in, sends it and prints the link to out.
+// Generated pin is printed to errOut, so the link can be captured separately.
+func runSend(ctx context.Context, cmd sendCmd, in io.Reader, out, errOut io.Writer) error {
+	cl, err := client.New(client.Config{URL: cmd.Server, User: cmd.User, Password: cmd.Password, Token: cmd.Token,
+		Timeout: cmd.Timeout})
+	if err != nil {
+		return err
+	}
+	params, err := cl.Params(ctx)
+	if err != nil {
+		return fmt.Errorf("get server params: %w", err)
+	}
+
+	pin, generated, err := sendPin(cmd, params)
+	if err != nil {
+		return err
+	}
+
+	var secret *client.Secret
+	if cmd.File == "" {
+		text, readErr := io.ReadAll(in)
+		if readErr != nil {
+			return fmt.Errorf("read stdin: %w", readErr)
+		}
+		if len(bytes.TrimSpace(text)) == 0 {
+			return errors.New("nothing to send")
+		}
+		secret, err = cl.Create(ctx, client.Request{Message: string(text), Pin: pin, Exp: cmd.Exp, MaxViews: cmd.Views,
+			ClientEnc: true})
+	} else {
+		var req client.FileRequest
+		if req, err = fileRequest(cmd.File, params); err != nil {
+			return err
+		}
+		req.Pin, req.Exp, req.MaxViews, req.ClientEnc = pin, cmd.Exp, cmd.Views, true
+		secret, err = cl.CreateFile(ctx, req)
+	}
+	if err != nil {
+		return fmt.Errorf("send secret: %w", err)
+	}
+
+	_, _ = fmt.Fprintln(out, secret.Link)
+	if generated {
+		_, _ = fmt.Fprintf(errOut, "pin: %s\n", pin)
+	}
+	return nil
+}
+
+// runGet loads the secret by link and writes text to out, or saves file content.
+// Secrets created via API without client encryption are supported too, their links have no key fragment.
+func runGet(ctx context.Context, cmd getCmd, out, errOut io.Writer) error {
+	base, err := linkServer(cmd.Args.Link)
+	if err != nil {
+		return err
+	}
+	if cmd.Pin == "" && !cmd.NoPin {
+		// pin-less request to a secret with pin counts as wrong attempt, so make it explicit
+		return errors.New("pin required, set --pin or --no-pin for secrets without pin")
+	}
+
+	cl, err := client.New(client.Config{URL: base, Password: cmd.Password, Timeout: cmd.Timeout})
+	if err != nil {
+		return err
+	}
+	msg, err := cl.Retrieve(ctx, cmd.Args.Link, cmd.Pin)
+	if err != nil {
+		return fmt.Errorf("get secret: %w", err)
+	}
+	if msg.Blob != "" {
+		return errors.New("decryption key is missing, the link must include the # part")
+	}
+
+	if !msg.IsFile {
+		_, err = io.WriteString(out, msg.Text)
+		return err
+	}
+	fileName := cmd.Output
+	if fileName == "" {
+		fileName = filepath.Base(filepath.Clean("/" + msg.FileName)) // only the name, never a path from the sender
+	}
+	if fileName == "" || fileName == "/" || fileName == "." {
+		return fmt.Errorf("invalid file name %q, set --output", msg.FileName)
+	}
+	// exclusive create to never overwrite existing files, readable by the owner only
+	fh, err := os.OpenFile(fileName, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600) //nolint:gosec // file name is sanitized
+	if err != nil {
+		return fmt.Errorf("create file: %w", err)
+	}
+	if _, err = fh.Write(msg.Data); err != nil {
+		_ = fh.Close()
+		return fmt.Errorf("write file: %w", err)
+	}
+	if err = fh.Close(); err != nil {
+		return fmt.Errorf("close file: %w", err)
+	}
+	_, _ = fmt.Fprintf(errOut, "saved %s, %d bytes\n", fileName, len(msg.Data))
+	return nil
+}
+
+// sendPin returns pin to use, generates random numeric pin if not set and pin is required
+func sendPin(cmd sendCmd, params client.Params) (pin string, generated bool, err error) {
+	switch {
+	case cmd.NoPin && cmd.Pin != "":
+		return "", false, errors.New("--pin and --no-pin can't be used together")
+	case cmd.NoPin && !params.AllowNoPin:
+		return "", false, errors.New("server doesn't allow secrets without pin")
+	case cmd.NoPin:
+		return "", false, nil
+	case cmd.Pin != "":
+		return cmd.Pin, false, nil
+	case params.Passphrase:
+		return "", false, errors.New("server uses passphrases, set --pin")
+	}
+
+	digits := make([]byte, params.PinSize)
+	for i := range digits {
+		n, err := rand.Int(rand.Reader, big.NewInt(10))
+		if err != nil {
+			return "", false, fmt.Errorf("generate pin: %w", err)
+		}
+		digits[i] = byte('0' + n.Int64())
+	}
+	return string(digits), true, nil
+}
+
+// fileRequest reads the file to send, checks it against server limits
+func fileRequest(file string, params client.Params) (client.FileRequest, error) {
+	if !params.FilesEnabled {
+		return client.FileRequest{}, errors.New("server doesn't allow files")
+	}
+	data, err := os.ReadFile(file) //nolint:gosec // file to send is set by user
+	if err != nil {
+		return client.FileRequest{}, fmt.Errorf("read file: %w", err)
+	}
+	if params.MaxFileSize > 0 && int64(len(data)) > params.MaxFileSize {
+		return client.FileRequest{}, fmt.Errorf("file is too large, %d bytes, max %d", len(data), params.MaxFileSize)
+	}
+	contentType := mime.TypeByExtension(filepath.Ext(file))
+	if contentType == "" {
+		contentType = http.DetectContentType(data)
+	}
+	return client.FileRequest{Name: filepath.Base(file), ContentType: contentType, Data: data}, nil
+}
+
+// linkServer returns server base url of secret link like https://example.com/message/<key>#<aes-key>
+func linkServer(link string) (string, error) {
+	u, err := url.Parse(link)
+	if err != nil {
+		return "", fmt.Errorf("parse link: %w", err)
+	}
+	dir, msgKey := path.Split(strings.TrimSuffix(u.Path, "/"))
+	if u.Scheme == "" || u.Host == "" || msgKey == "" || !strings.HasSuffix(dir, "/message/") {
+		return "", fmt.Errorf("invalid secret link %q", link)
+	}
+	return u.Scheme + "://" + u.Host + strings.TrimSuffix(dir, "/message/"), nil
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/umputun/secrets/v2/app/messager"
+	"github.com/umputun/secrets/v2/app/server"
+	"github.com/umputun/secrets/v2/app/store"
+)
+
+func TestRunSend(t *testing.T) {
+	url, _ := prepClientServer(t, server.Config{PinSize: 5, AllowNoPin: true, EnableFiles: true, MaxFileSize: 1024})
+	noFilesURL, _ := prepClientServer(t, server.Config{PinSize: 5})
+	dir := t.TempDir()
+	file := filepath.Join(dir, "notes.txt")
+	require.NoError(t, os.WriteFile(file, []byte("file content"), 0o600))
+	bigFile := filepath.Join(dir, "big.bin")
+	require.NoError(t, os.WriteFile(bigFile, make([]byte, 1025), 0o600))
+
+	tbl := []struct {
+		name    string
+		cmd     sendCmd
+		in      string
+		wantPin bool   // random pin printed to errOut
+		wantErr string // error substring, empty for success
+	}{
+		{name: "stdin with pin", cmd: sendCmd{Server: url, Pin: "12345"}, in: "my secret"},
+		{name: "stdin with generated pin", cmd: sendCmd{Server: url}, in: "my secret", wantPin: true},
+		{name: "stdin without pin", cmd: sendCmd{Server: url, NoPin: true}, in: "my secret"},
+		{name: "file", cmd: sendCmd{Server: url, Pin: "12345", File: file}},
+		{name: "empty stdin", cmd: sendCmd{Server: url, Pin: "12345"}, in: " \n", wantErr: "nothing to send"},
+		{name: "pin and no-pin", cmd: sendCmd{Server: url, Pin: "12345", NoPin: true}, in: "x",
+			wantErr: "--pin and --no-pin can't be used together"},
+		{name: "no-pin not allowed", cmd: sendCmd{Server: noFilesURL, NoPin: true}, in: "x",
+			wantErr: "server doesn't allow secrets without pin"},
+		{name: "files disabled", cmd: sendCmd{Server: noFilesURL, Pin: "12345", File: file},
+			wantErr: "server doesn't allow files"},
+		{name: "missing file", cmd: sendCmd{Server: url, Pin: "12345", File: filepath.Join(dir, "nope.txt")},
+			wantErr: "read file"},
+		{name: "file too large", cmd: sendCmd{Server: url, Pin: "12345", File: bigFile}, wantErr: "file is too large"},
+		{name: "expiration above limit", cmd: sendCmd{Server: url, Pin: "12345", Exp: 100 * time.Hour}, in: "x",
+			wantErr: "send secret"},
+	}
+
+	for _, tc := range tbl {
+		t.Run(tc.name, func(t *testing.T) {
+			if tc.cmd.Exp == 0 {
+				tc.cmd.Exp = time.Hour
+			}
+			tc.cmd.Views, tc.cmd.Timeout = 1, 5*time.Second
+			out, errOut := bytes.Buffer{}, bytes.Buffer{}
+			err := runSend(t.Context(), tc.cmd, strings.NewReader(tc.in), &out, &errOut)
+			if tc.wantErr != "" {
+				require.ErrorContains(t, err, tc.wantErr)
+				assert.Empty(t, out.String())
+				return
+			}
+			require.NoError(t, err)
+			assert.Regexp(t, "^"+regexp.QuoteMeta(url)+"/message/[^#]+#.+\n$", out.String(), "link with key fragment")
+			if !tc.wantPin {
+				assert.Empty(t, errOut.String())
+				return
+			}
+			assert.Regexp(t, `^pin: \d{5}\n$`, errOut.String())
+		})
+	}
+}
+
+func TestRunGet(t *testing.T) {
+	url, _ := prepClientServer(t, server.Config{PinSize: 5, AllowNoPin: true, EnableFiles: true, MaxFileSize: 1024})
+	file := filepath.Join(t.TempDir(), "notes.txt")
+	require.NoError(t, os.WriteFile(file, []byte("file content"), 0o600))
+	dir := t.TempDir() // files of get saved here
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "existing.txt"), []byte("keep me"), 0o600))
+
+	// send makes a new secret for each case, as a secret is gone after read
+	send := func(t *testing.T, cmd sendCmd, in string) string {
+		t.Helper()
+		cmd.Server, cmd.Exp, cmd.Views, cmd.Timeout = url, time.Hour, 1, 5*time.Second
+		out := bytes.Buffer{}
+		require.NoError(t, runSend(t.Context(), cmd, strings.NewReader(in), &out, &bytes.Buffer{}))
+		return strings.TrimSpace(out.String())
+	}
+
+	tbl := []struct {
+		name     string
+		send     sendCmd
+		in       string
+		link     func(link string) string // changes sent link, nil to keep it
+		cmd      getCmd
+		wantOut  string
+		wantFile string // name of saved file in dir, relative to dir
+		wantErr  string
+	}{
+		{name: "text", send: sendCmd{Pin: "12345"}, in: "my secret\n", cmd: getCmd{Pin: "12345"}, wantOut: "my secret\n"},
+		{name: "text without pin", send: sendCmd{NoPin: true}, in: "open", cmd: getCmd{NoPin: true}, wantOut: "open"},
+		{name: "file to output", send: sendCmd{Pin: "12345", File: file}, cmd: getCmd{Pin: "12345", Output: "out.txt"},
+			wantFile: "out.txt"},
+		{name: "file with sent name", send: sendCmd{Pin: "12345", File: file}, cmd: getCmd{Pin: "12345"},
+			wantFile: "notes.txt"},
+		{name: "existing file kept", send: sendCmd{Pin: "12345", File: file}, cmd: getCmd{Pin: "12345", Output: "existing.txt"},
+			wantErr: "create file"},
+		{name: "pin not set", send: sendCmd{Pin: "12345"}, in: "x", cmd: getCmd{}, wantErr: "pin required"},
+		{name: "wrong pin", send: sendCmd{Pin: "12345"}, in: "x", cmd: getCmd{Pin: "54321"}, wantErr: "get secret"},
+		{name: "link without key", send: sendCmd{Pin: "12345"}, in: "x", cmd: getCmd{Pin: "12345"},
+			link:    func(link string) string { return link[:strings.Index(link, "#")] },
+			wantErr: "decryption key is missing"},
+		{name: "invalid link", send: sendCmd{Pin: "12345"}, in: "x", cmd: getCmd{Pin: "12345"},
+			link:    func(link string) string { return strings.Replace(link, "/message/", "/msg/", 1) },
+			wantErr: "invalid secret link"},
+	}
+
+	t.Chdir(dir)
+	for _, tc := range tbl {
+		t.Run(tc.name, func(t *testing.T) {
+			link := send(t, tc.send, tc.in)
+			if tc.link != nil {
+				link = tc.link(link)
+			}
+			tc.cmd.Args.Link, tc.cmd.Timeout = link, 5*time.Second
+			out, errOut := bytes.Buffer{}, bytes.Buffer{}
+			err := runGet(t.Context(), tc.cmd, &out, &errOut)
+			if tc.wantErr != "" {
+				require.ErrorContains(t, err, tc.wantErr)
+				assert.Empty(t, out.String())
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.wantOut, out.String())
+			if tc.wantFile == "" {
+				return
+			}
+			data, err := os.ReadFile(filepath.Join(dir, tc.wantFile))
+			require.NoError(t, err)
+			assert.Equal(t, "file content", string(data))
+			assert.Equal(t, "saved "+tc.wantFile+", 12 bytes\n", errOut.String())
+		})
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, "existing.txt"))
+	require.NoError(t, err)
+	assert.Equal(t, "keep me", string(data), "existing file not overwritten")
+}
+
+func TestLinkServer(t *testing.T) {
+	tbl := []struct {
+		link, want, wantErr string
+	}{
+		{link: "https://example.com/message/abc#key", want: "https://example.com"},
+		{link: "https://example.com/secrets/message/abc", want: "https://example.com/secrets"},
+		{link: "http://127.0.0.1:8080/message/abc/#key", want: "http://127.0.0.1:8080"},
+		{link: "example.com/message/abc", wantErr: "invalid secret link"},
+		{link: "https://example.com/message/", wantErr: "invalid secret link"},
+		{link: "https://example.com/abc", wantErr: "invalid secret link"},
+		{link: "https://example.com/%zz", wantErr: "parse link"},
+	}
+	for _, tc := range tbl {
+		t.Run(tc.link, func(t *testing.T) {
+			base, err := linkServer(tc.link)
+			if tc.wantErr != "" {
+				require.ErrorContains(t, err, tc.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.want, base)
+		})
+	}
+}
+
+// prepClientServer starts secrets server with in-memory store and returns its url and the store,
+// options applied to the server before start. The server makes links pointing to itself,
+// so they can be passed to get command as is.
+func prepClientServer(t *testing.T, cfg server.Config,
+	opts ...func(srv server.Server, eng *store.SQLite) server.Server) (string, *store.SQLite) {
+	t.Helper()
+	eng := store.NewInMemory(time.Minute)
+	t.Cleanup(func() { _ = eng.Close() })
+	msgr := messager.New(eng, messager.Crypt{Key: "123456789012345678901234567"}, messager.Params{
+		MaxDuration: 10 * time.Hour, MaxPinAttempts: 3, MaxFileSize: cfg.MaxFileSize,
+	})
+	ts := httptest.NewUnstartedServer(nil)
+	cfg.Domain, cfg.Protocol, cfg.MaxPinAttempts, cfg.MaxExpire = []string{ts.Listener.Addr().String()}, "http", 3, 10*time.Hour
+	srv, err := server.New(msgr, "test", cfg)
+	require.NoError(t, err)
+	for _, opt := range opts {
+		srv = opt(srv, eng)
+	}
+	ts.Config.Handler = srv.Handler()
+	ts.Start()
+	t.Cleanup(ts.Close)
+	return ts.URL, eng
+}
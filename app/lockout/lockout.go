@@ -0,0 +1,166 @@
+// Package lockout protects passwords from brute-force. Failed login attempts are counted per client, by hashed IP,
+// and globally for all clients together. After the allowed number of failures the client, or everybody for
+// the global counter, is locked out for the delay doubled with each further failure, up to the max delay.
+// Counters are kept in the store, so restart doesn't reset them. Failures of a client are forgotten a day after
+// the last one, global failures are counted in a sliding window of the delay times the allowed global failures.
+package lockout
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"time"
+
+	log "github.com/go-pkgz/lgr"
+
+	"github.com/umputun/secrets/v2/app/store"
+)
+
+// forgetAfter is how long failures are remembered after the last one, longer than any lockout
+const forgetAfter = 24 * time.Hour
+
+// globalKeyPrefix is the store key prefix of failures counters of all clients, one counter per window
+const globalKeyPrefix = "global:"
+
+// Store is a persistent storage of failure counters, implemented by all store engines
+type Store interface {
+	IncFailures(ctx context.Context, key string, ts, expires time.Time) (*store.Failures, error)
+	LoadFailures(ctx context.Context, key string) (*store.Failures, error)
+	RemoveFailures(ctx context.Context, key string) error
+}
+
+// Params of lockout
+type Params struct {
+	Attempts       int           // failures of a client before it's locked out, 0 disables per-client lockout
+	GlobalAttempts int           // failures of all clients before everybody is locked out, 0 disables global lockout
+	Delay          time.Duration // first lockout, doubled with each further failure
+	MaxDelay       time.Duration // longest lockout
+}
+
+// Guard counts failed login attempts and tells how long a client is locked out
+type Guard struct {
+	store  Store
+	params Params
+	now    func() time.Time
+}
+
+// New makes Guard with the store and params
+func New(s Store, p Params) *Guard {
+	p.MaxDelay = max(p.MaxDelay, p.Delay)
+	return &Guard{store: s, params: p, now: time.Now}
+}
+
+// Check returns time left until the client with the hashed ip can try to log in again, 0 if not locked out.
+// Store errors don't lock anybody out, login stays possible.
+func (g *Guard) Check(ctx context.Context, ip string) time.Duration {
+	now := g.now()
+	var wait time.Duration
+	if g.params.Attempts > 0 {
+		if f, err := g.store.LoadFailures(ctx, "ip:"+ip); err == nil {
+			wait = g.lockedUntil(f, g.params.Attempts).Sub(now)
+		}
+	}
+	if g.params.GlobalAttempts > 0 {
+		f := g.globalFailures(ctx, now, nil)
+		wait = max(wait, g.lockedUntil(f, g.params.GlobalAttempts).Sub(now))
+	}
+	return wait
+}
+
+// Fail counts failed login attempt of the client with the hashed ip, and returns the time left until
+// the client can try again if the failure locked it out, 0 otherwise
+func (g *Guard) Fail(ctx context.Context, ip string) time.Duration {
+	now := g.now()
+	var wait time.Duration
+	if g.params.Attempts > 0 {
+		f, err := g.store.IncFailures(ctx, "ip:"+ip, now, now.Add(max(forgetAfter, g.params.MaxDelay)))
+		if err != nil {
+			log.Printf("[WARN] can't count login failure, %v", err)
+		} else {
+			wait = g.lockedFor(f, g.params.Attempts, now)
+		}
+	}
+	if g.params.GlobalAttempts > 0 {
+		window := g.globalWindow()
+		start := now.Truncate(window)
+		// kept while it's the previous window, and as long as the lockout it may cause
+		cur, err := g.store.IncFailures(ctx, globalKey(start), now, maxTime(start.Add(2*window), now.Add(g.params.MaxDelay)))
+		if err != nil {
+			log.Printf("[WARN] can't count global login failure, %v", err)
+		} else {
+			wait = max(wait, g.lockedFor(g.globalFailures(ctx, now, cur), g.params.GlobalAttempts, now))
+		}
+	}
+	return wait
+}
+
+// Reset forgets failures of the client with the hashed ip after successful login, global failures are kept
+// and decay with time only, otherwise a single valid login would hide guessing spread over many addresses
+func (g *Guard) Reset(ctx context.Context, ip string) {
+	if g.params.Attempts <= 0 {
+		return
+	}
+	if err := g.store.RemoveFailures(ctx, "ip:"+ip); err != nil && !errors.Is(err, store.ErrLoadRejected) {
+		log.Printf("[WARN] can't reset login failures, %v", err)
+	}
+}
+
+// globalWindow is the sliding window of global failures, all clients together can fail once per delay on average
+func (g *Guard) globalWindow() time.Duration {
+	return max(g.params.Delay, time.Second) * time.Duration(g.params.GlobalAttempts)
+}
+
+// globalFailures returns failures of all clients in the sliding window ending now. Failures are counted per fixed
+// window, and the count is the one of the current window plus the one of the previous window, weighted by its part
+// still inside the sliding window. Current is the counter of the current window, loaded from the store if nil.
+func (g *Guard) globalFailures(ctx context.Context, now time.Time, current *store.Failures) *store.Failures {
+	window := g.globalWindow()
+	start := now.Truncate(window)
+	if current == nil {
+		current, _ = g.store.LoadFailures(ctx, globalKey(start)) // nil if not found or expired
+	}
+	res := &store.Failures{Key: globalKey(start)}
+	if prev, err := g.store.LoadFailures(ctx, globalKey(start.Add(-window))); err == nil {
+		weight := 1 - float64(now.Sub(start))/float64(window)
+		res.Count, res.Last = int(float64(prev.Count)*weight), prev.Last
+	}
+	if current != nil {
+		res.Count += current.Count
+		res.Last = current.Last
+	}
+	return res
+}
+
+// lockedFor returns the lockout caused by the failure just counted, 0 if not locked out
+func (g *Guard) lockedFor(f *store.Failures, attempts int, now time.Time) time.Duration {
+	d := g.lockedUntil(f, attempts).Sub(now)
+	if d <= 0 {
+		return 0
+	}
+	log.Printf("[WARN] login locked out for %v after %d failures, key=%s", d, f.Count, f.Key)
+	return d
+}
+
+// lockedUntil returns the end of lockout caused by the failures, the last failure time if not locked out
+func (g *Guard) lockedUntil(f *store.Failures, attempts int) time.Time {
+	if f.Count < attempts {
+		return f.Last
+	}
+	delay := g.params.Delay
+	for i := attempts; i < f.Count && delay < g.params.MaxDelay; i++ {
+		delay *= 2
+	}
+	return f.Last.Add(min(delay, g.params.MaxDelay))
+}
+
+// globalKey returns the store key of global failures counter of the window starting at start
+func globalKey(start time.Time) string {
+	return globalKeyPrefix + strconv.FormatInt(start.Unix(), 10)
+}
+
+func maxTime(a, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+	return b
+}
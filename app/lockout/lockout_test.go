@@ -0,0 +1,109 @@
+package lockout
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/umputun/secrets/v2/app/store"
+)
+
+func TestGuard_Backoff(t *testing.T) {
+	eng := store.NewInMemory(time.Minute)
+	defer eng.Close()
+	now := time.Now().Truncate(time.Second)
+	g := New(eng, Params{Attempts: 3, Delay: time.Minute, MaxDelay: 5 * time.Minute})
+	g.now = func() time.Time { return now }
+	ctx := t.Context()
+
+	assert.Zero(t, g.Check(ctx, "ip1"))
+	assert.Zero(t, g.Fail(ctx, "ip1"))
+	assert.Zero(t, g.Fail(ctx, "ip1"))
+	assert.Zero(t, g.Check(ctx, "ip1"))
+
+	// third failure locks out
+	assert.Equal(t, time.Minute, g.Fail(ctx, "ip1"))
+	now = now.Add(20 * time.Second)
+	assert.Equal(t, 40*time.Second, g.Check(ctx, "ip1"))
+	assert.Zero(t, g.Check(ctx, "ip2"), "other clients not affected")
+
+	// each further failure doubles the delay, up to the max
+	for _, want := range []time.Duration{2 * time.Minute, 4 * time.Minute, 5 * time.Minute, 5 * time.Minute} {
+		now = now.Add(g.Check(ctx, "ip1"))
+		assert.Zero(t, g.Check(ctx, "ip1"))
+		assert.Equal(t, want, g.Fail(ctx, "ip1"))
+	}
+
+	// failures survive restart, new guard on the same store
+	g2 := New(eng, Params{Attempts: 3, Delay: time.Minute, MaxDelay: 5 * time.Minute})
+	g2.now = g.now
+	assert.Equal(t, 5*time.Minute, g2.Check(ctx, "ip1"))
+
+	// successful login forgets failures
+	now = now.Add(5 * time.Minute)
+	g.Reset(ctx, "ip1")
+	assert.Zero(t, g.Fail(ctx, "ip1"))
+	assert.Zero(t, g.Check(ctx, "ip1"))
+}
+
+func TestGuard_Global(t *testing.T) {
+	eng := store.NewInMemory(time.Minute)
+	defer eng.Close()
+	now := time.Now().Truncate(time.Hour).Add(time.Hour) // start of global window, counters expire in real time
+	g := New(eng, Params{Attempts: 10, GlobalAttempts: 4, Delay: time.Minute, MaxDelay: time.Hour})
+	g.now = func() time.Time { return now }
+	ctx := t.Context()
+
+	for _, ip := range []string{"ip1", "ip2", "ip3"} {
+		assert.Zero(t, g.Fail(ctx, ip))
+	}
+	g.Reset(ctx, "ip3")
+	assert.Equal(t, time.Minute, g.Fail(ctx, "ip4"), "global failures not reset by login")
+	assert.Equal(t, time.Minute, g.Check(ctx, "ip5"), "everybody locked out")
+
+	now = now.Add(time.Minute)
+	assert.Zero(t, g.Check(ctx, "ip5"))
+	assert.Equal(t, 2*time.Minute, g.Fail(ctx, "ip5"))
+}
+
+func TestGuard_GlobalDecay(t *testing.T) {
+	eng := store.NewInMemory(time.Minute)
+	defer eng.Close()
+	now := time.Now().Truncate(time.Hour).Add(time.Hour) // start of global window, counters expire in real time
+	// 4 failures allowed in 4m window
+	g := New(eng, Params{GlobalAttempts: 4, Delay: time.Minute, MaxDelay: time.Hour})
+	g.now = func() time.Time { return now }
+	ctx := t.Context()
+
+	for _, ip := range []string{"ip1", "ip2", "ip3"} {
+		assert.Zero(t, g.Fail(ctx, ip))
+	}
+
+	// half of the previous window is out of the sliding window, so are half of its failures
+	now = now.Add(6 * time.Minute)
+	assert.Zero(t, g.Check(ctx, "ip4"))
+	assert.Zero(t, g.Fail(ctx, "ip4"), "1 of old failures and 1 new")
+	assert.Zero(t, g.Fail(ctx, "ip5"), "1 of old failures and 2 new")
+	assert.Equal(t, time.Minute, g.Fail(ctx, "ip6"), "1 of old failures and 3 new")
+
+	// all failures are out of the sliding window
+	now = now.Add(10 * time.Minute)
+	assert.Zero(t, g.Check(ctx, "ip7"))
+	for _, ip := range []string{"ip7", "ip8", "ip9"} {
+		assert.Zero(t, g.Fail(ctx, ip))
+	}
+}
+
+func TestGuard_Disabled(t *testing.T) {
+	eng := store.NewInMemory(time.Minute)
+	defer eng.Close()
+	g := New(eng, Params{Delay: time.Minute, MaxDelay: time.Hour})
+	for range 10 {
+		assert.Zero(t, g.Fail(t.Context(), "ip1"))
+	}
+	assert.Zero(t, g.Check(t.Context(), "ip1"))
+	_, err := eng.LoadFailures(t.Context(), "ip:ip1")
+	require.ErrorIs(t, err, store.ErrLoadRejected, "nothing counted")
+}
@@ -2,9 +2,16 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"fmt"
+	"net"
+	"net/http"
 	"os"
 	"os/signal"
+	"slices"
+	"strings"
 	"syscall"
 	"time"
 
@@ -12,28 +19,46 @@ import (
 	"github.com/umputun/go-flags"
 
 	"github.com/umputun/secrets/v2/app/email"
+	"github.com/umputun/secrets/v2/app/lockout"
 	"github.com/umputun/secrets/v2/app/messager"
+	"github.com/umputun/secrets/v2/app/passkey"
 	"github.com/umputun/secrets/v2/app/server"
+	"github.com/umputun/secrets/v2/app/sessions"
+	"github.com/umputun/secrets/v2/app/sso"
 	"github.com/umputun/secrets/v2/app/store"
+	"github.com/umputun/secrets/v2/app/tokens"
+	"github.com/umputun/secrets/v2/app/totp"
+	"github.com/umputun/secrets/v2/app/users"
+	"github.com/umputun/secrets/v2/app/webhook"
 )
 
 var opts struct {
-	Engine         string        `short:"e" long:"engine" env:"ENGINE" description:"storage engine" choice:"MEMORY" choice:"SQLITE" default:"MEMORY"`
-	SignKey        string        `short:"k" long:"key" env:"SIGN_KEY" description:"sign key" required:"true"`
+	Engine         string        `short:"e" long:"engine" env:"ENGINE" description:"storage engine" choice:"MEMORY" choice:"SQLITE" choice:"POSTGRES" choice:"REDIS" default:"MEMORY"`
+	SignKey        string        `short:"k" long:"key" env:"SIGN_KEY" description:"sign key (required for server)"`
+	KeyID          string        `long:"key-id" env:"KEY_ID" default:"1" description:"id of the sign key, stored with encrypted messages"`
+	RetiredKeys    []string      `long:"retired-key" env:"RETIRED_KEYS" env-delim:"," description:"retired sign key as id:key, used to read older messages"`
+	LogKey         string        `long:"log-key" env:"LOG_KEY" description:"key for ip hashing in logs, sign key used if not set"`
+	KDF            string        `long:"kdf" env:"KDF" description:"key derivation for new secrets" choice:"argon2id" choice:"hkdf" default:"argon2id"`
 	PinSize        int           `long:"pinsize" env:"PIN_SIZE" default:"5" description:"pin size"`
 	MaxExpire      time.Duration `long:"expire" env:"MAX_EXPIRE" default:"24h" description:"max lifetime"`
 	MaxPinAttempts int           `long:"pinattempts" env:"PIN_ATTEMPTS" default:"3" description:"max attempts to enter pin"`
+	MaxViews       int           `long:"max-views" env:"MAX_VIEWS" default:"1" description:"max views allowed per message"`
+	Retention      time.Duration `long:"status-retention" env:"STATUS_RETENTION" default:"168h" description:"how long message status kept after removal"`
 	SQLiteDB       string        `long:"sqlite" env:"SQLITE_FILE" default:"/tmp/secrets.db" description:"sqlite database file"`
+	PostgresDSN    string        `long:"postgres" env:"POSTGRES_DSN" description:"postgres connection string (DSN or URL)"`
+	RedisURL       string        `long:"redis" env:"REDIS_URL" default:"redis://localhost:6379/0" description:"redis (or valkey) url"`
 	WebRoot        string        `long:"web" env:"WEB" description:"web ui location (dev mode, uses embedded files if not set)"`
 	Branding       string        `long:"branding" env:"BRANDING" default:"Safe Secrets" description:"application branding/title"`
 	BrandingURL    string        `long:"branding-url" env:"BRANDING_URL" default:"https://safesecret.info" description:"branding link URL for emails"`
 	Dbg            bool          `long:"dbg" description:"debug mode"`
-	Domain         []string      `short:"d" long:"domain" env:"DOMAIN" env-delim:"," description:"site domain(s)" required:"true"`
+	Domain         []string      `short:"d" long:"domain" env:"DOMAIN" env-delim:"," description:"site domain(s) (required for server)"`
 	Protocol       string        `short:"p" long:"protocol" env:"PROTOCOL" description:"site protocol" choice:"http" choice:"https" default:"https" required:"true"`
 	Listen         string        `long:"listen" env:"LISTEN" default:":8080" description:"server listen address (ip:port or :port)"`
 
 	ProxySecurityHeaders bool `long:"proxy-security-headers" env:"PROXY_SECURITY_HEADERS" description:"disable security headers (when proxy handles them)"`
 	AllowNoPin           bool `long:"allow-no-pin" env:"ALLOW_NO_PIN" description:"allow creating secrets without PIN protection"`
+	Passphrase           bool `long:"passphrase" env:"PASSPHRASE" description:"use passphrases of any characters instead of numeric pins"`
+	MinEntropy           int  `long:"min-entropy" env:"MIN_ENTROPY" default:"40" description:"min passphrase entropy in bits"`
 
 	Files struct {
 		Enabled bool  `long:"enabled" env:"ENABLED" description:"enable file uploads"`
@@ -42,7 +67,41 @@ var opts struct {
 
 	Auth struct {
 		Hash       string        `long:"hash" env:"HASH" description:"bcrypt hash of password (enables auth if set)"`
-		SessionTTL time.Duration `long:"session-ttl" env:"SESSION_TTL" default:"168h" description:"session lifetime"`
+		Htpasswd   string        `long:"htpasswd" env:"HTPASSWD" description:"htpasswd file of named users with bcrypt hashes, reloaded on SIGHUP"`
+		UsersDB    bool          `long:"users-db" env:"USERS_DB" description:"named users from users table of the storage engine"`
+		SessionTTL time.Duration `long:"session-ttl" env:"SESSION_TTL" default:"168h" description:"session lifetime, extended on activity"`
+		SessionKey string        `long:"session-key" env:"SESSION_KEY" description:"key signing session cookies, derived from password hash if not set"`
+		Passkey    bool          `long:"passkey" env:"PASSKEY" description:"enable passkey login, first passkey registered with setup link of passkey command"`
+
+		OIDC struct {
+			Issuer         string   `long:"issuer" env:"ISSUER" description:"OpenID Connect issuer url (enables SSO login if set)"`
+			ClientID       string   `long:"client-id" env:"CLIENT_ID" description:"client id registered with the provider"`
+			ClientSecret   string   `long:"client-secret" env:"CLIENT_SECRET" description:"client secret, empty for public client"`
+			AllowedDomains []string `long:"allowed-domain" env:"ALLOWED_DOMAINS" env-delim:"," description:"email domain allowed to log in"`
+			AllowedGroups  []string `long:"allowed-group" env:"ALLOWED_GROUPS" env-delim:"," description:"group allowed to log in"`
+			GroupsClaim    string   `long:"groups-claim" env:"GROUPS_CLAIM" default:"groups" description:"ID token claim with groups"`
+		} `group:"oidc" namespace:"oidc" env-namespace:"OIDC"`
+
+		LDAP struct {
+			URL                string        `long:"url" env:"URL" description:"LDAP server url, ldap://host:389 or ldaps://host:636 (enables auth if set)"`
+			StartTLS           bool          `long:"starttls" env:"STARTTLS" description:"upgrade ldap:// connection with StartTLS"`
+			CACert             string        `long:"ca-cert" env:"CA_CERT" description:"PEM file with CA certificates of the server, system roots if not set"`
+			InsecureSkipVerify bool          `long:"insecure" env:"INSECURE_SKIP_VERIFY" description:"skip certificate verification"`
+			BindDN             string        `long:"bind-dn" env:"BIND_DN" description:"DN of service account searching users, anonymous if not set"`
+			BindPassword       string        `long:"bind-password" env:"BIND_PASSWORD" description:"password of service account"`
+			BaseDN             string        `long:"base-dn" env:"BASE_DN" description:"search base of users"`
+			UserFilter         string        `long:"user-filter" env:"USER_FILTER" default:"(sAMAccountName=%s)" description:"user filter, %s is user name"`
+			GroupFilter        string        `long:"group-filter" env:"GROUP_FILTER" description:"filter users have to match too, like (memberOf=<group dn>)"`
+			PoolSize           int           `long:"pool-size" env:"POOL_SIZE" default:"4" description:"max open connections"`
+			Timeout            time.Duration `long:"timeout" env:"TIMEOUT" default:"10s" description:"connect and request timeout"`
+		} `group:"ldap" namespace:"ldap" env-namespace:"LDAP"`
+
+		Lockout struct {
+			Attempts       int           `long:"attempts" env:"ATTEMPTS" default:"5" description:"failed logins of a client before lockout, 0 disables"`
+			GlobalAttempts int           `long:"global-attempts" env:"GLOBAL_ATTEMPTS" default:"0" description:"failed logins of all clients in a window of delay times this number before everybody is locked out, 0 disables"`
+			Delay          time.Duration `long:"delay" env:"DELAY" default:"1m" description:"first lockout, doubled with each further failure"`
+			MaxDelay       time.Duration `long:"max-delay" env:"MAX_DELAY" default:"1h" description:"longest lockout"`
+		} `group:"lockout" namespace:"lockout" env-namespace:"LOCKOUT"`
 	} `group:"auth" namespace:"auth" env-namespace:"AUTH"`
 
 	Email struct {
@@ -59,32 +118,75 @@ var opts struct {
 		Timeout            time.Duration `long:"timeout" env:"TIMEOUT" default:"30s" description:"connection timeout"`
 		Template           string        `long:"template" env:"TEMPLATE" description:"path to custom email template file"`
 	} `group:"email" namespace:"email" env-namespace:"EMAIL"`
+
+	Webhook struct {
+		URLs          []string      `long:"url" env:"URL" env-delim:"," description:"url notified on every message event"`
+		Secret        string        `long:"secret" env:"SECRET" description:"hmac key for webhook signatures"`
+		AllowCallback bool          `long:"allow-callback" env:"ALLOW_CALLBACK" description:"allow per-message callback url set via API"`
+		Retries       int           `long:"retries" env:"RETRIES" default:"3" description:"delivery retries of failed webhook"`
+		Timeout       time.Duration `long:"timeout" env:"TIMEOUT" default:"5s" description:"webhook request timeout"`
+	} `group:"webhook" namespace:"webhook" env-namespace:"WEBHOOK"`
+
+	Migrate migrateCmd `command:"migrate" description:"apply pending sqlite schema migrations and exit"`
+	Rekey   struct{}   `command:"rekey" description:"re-encrypt stored messages under the active sign key and exit"`
+	Send    sendCmd    `command:"send" description:"encrypt stdin or file, send it to secrets server and print the link"`
+	Get     getCmd     `command:"get" description:"get secret by link, decrypt and print it or save the file"`
+	Token   tokenCmd   `command:"token" description:"manage named API tokens"`
+	User    userCmd    `command:"user" description:"manage named users of the storage engine, used with --auth.users-db"`
+	Session sessionCmd `command:"session" description:"manage login sessions of the web ui"`
+	TOTP    totpCmd    `command:"totp" description:"manage second login factor, TOTP codes of authenticator app"`
+	Passkey passkeyCmd `command:"passkey" description:"manage passkeys of password-less login"`
 }
 
 var revision string
 
 func main() {
-	if _, err := flags.Parse(&opts); err != nil {
+	p := flags.NewParser(&opts, flags.Default)
+	p.SubcommandsOptional = true // no command means run the server
+	if _, err := p.Parse(); err != nil {
 		os.Exit(1)
 	}
-	if os.Getenv("GO_FLAGS_COMPLETION") == "" {
+	cmdName := ""
+	for cmd := p.Active; cmd != nil; cmd = cmd.Active {
+		cmdName = strings.TrimSpace(cmdName + " " + cmd.Name)
+	}
+	quiet := p.Active != nil && slices.Contains([]string{"send", "get", "token", "user", "session", "totp", "passkey"}, p.Active.Name)
+	if os.Getenv("GO_FLAGS_COMPLETION") == "" && !quiet { // client and token output may be piped, keep it clean
 		fmt.Printf("secrets %s\n", revision)
 	}
 
-	setupLog(opts.Dbg)
+	if quiet {
+		setupLog(opts.Dbg, log.Out(os.Stderr)) // stdout is for the secret, link or token only
+	} else {
+		setupLog(opts.Dbg)
+	}
 
-	// validate sign key has sufficient entropy (minimum 16 bytes)
-	if len(opts.SignKey) < 16 {
-		log.Fatalf("[ERROR] sign key must be at least 16 bytes, got %d", len(opts.SignKey))
+	if cmdName != "" {
+		if err := runCommand(context.Background(), cmdName); err != nil {
+			log.Fatalf("[ERROR] %s failed, %v", cmdName, err)
+		}
+		return
 	}
 
-	dataStore := getEngine(opts.Engine, opts.SQLiteDB)
-	crypter := messager.Crypt{Key: messager.MakeSignKey(opts.SignKey, opts.PinSize)}
-	params := messager.Params{MaxDuration: opts.MaxExpire, MaxPinAttempts: opts.MaxPinAttempts, MaxFileSize: opts.Files.MaxSize}
+	crypter, err := makeCrypter()
+	if err != nil {
+		log.Fatalf("[ERROR] %v", err)
+	}
+	dataStore := getEngine(opts.Engine, opts.SQLiteDB, opts.PostgresDSN, opts.RedisURL)
+	params := messager.Params{MaxDuration: opts.MaxExpire, MaxPinAttempts: opts.MaxPinAttempts, MaxFileSize: opts.Files.MaxSize,
+		MaxViews: opts.MaxViews, Retention: opts.Retention}
 
 	if opts.Auth.Hash != "" {
 		log.Printf("[INFO]  authentication enabled (session TTL: %v)", opts.Auth.SessionTTL)
 	}
+	namedUsers, err := makeUsers(dataStore)
+	if err != nil {
+		log.Fatalf("[ERROR] can't setup users, %v", err)
+	}
+	ssoProvider, err := makeSSO()
+	if err != nil {
+		log.Fatalf("[ERROR] can't setup sso, %v", err)
+	}
 
 	// create email sender if enabled
 	var emailSender *email.Sender
@@ -112,22 +214,40 @@ func main() {
 		}
 	}
 
-	srv, err := server.New(messager.New(dataStore, crypter, params), revision, server.Config{
+	msgProc := messager.New(dataStore, crypter, params)
+	tokenStore, hasTokens := dataStore.(tokens.Store)
+	sessionStore, hasSessions := dataStore.(sessions.Store)
+	lockoutStore, hasLockout := dataStore.(lockout.Store)
+	totpStore, hasTOTP := dataStore.(totp.Store)
+	var dispatcher *webhook.Dispatcher
+	if len(opts.Webhook.URLs) > 0 || opts.Webhook.AllowCallback {
+		if dispatcher, err = makeWebhooks(dataStore, msgProc); err != nil {
+			log.Fatalf("[ERROR] can't setup webhooks, %v", err)
+		}
+	}
+
+	srv, err := server.New(msgProc, revision, server.Config{
 		Domain:                 opts.Domain,
 		Protocol:               opts.Protocol,
 		Listen:                 opts.Listen,
 		PinSize:                opts.PinSize,
 		MaxPinAttempts:         opts.MaxPinAttempts,
+		MaxViews:               opts.MaxViews,
+		Passphrase:             opts.Passphrase,
+		MinEntropy:             opts.MinEntropy,
 		MaxExpire:              opts.MaxExpire,
 		WebRoot:                opts.WebRoot,
 		Branding:               opts.Branding,
 		SignKey:                opts.SignKey,
+		LogKey:                 opts.LogKey,
 		EnableFiles:            opts.Files.Enabled,
 		MaxFileSize:            opts.Files.MaxSize,
 		AuthHash:               opts.Auth.Hash,
 		SessionTTL:             opts.Auth.SessionTTL,
+		SessionKey:             opts.Auth.SessionKey,
 		EmailEnabled:           opts.Email.Enabled,
 		AllowNoPin:             opts.AllowNoPin,
+		AllowCallback:          opts.Webhook.AllowCallback,
 		DisableSecurityHeaders: opts.ProxySecurityHeaders,
 	})
 	if err != nil {
@@ -136,25 +256,395 @@ func main() {
 	if emailSender != nil {
 		srv = srv.WithEmail(emailSender)
 	}
+	if hasTokens {
+		srv = srv.WithTokens(tokens.New(tokenStore))
+	}
+	if hasSessions {
+		srv = srv.WithSessions(sessions.New(sessionStore, opts.Auth.SessionTTL))
+	}
+	if hasLockout && (opts.Auth.Lockout.Attempts > 0 || opts.Auth.Lockout.GlobalAttempts > 0) {
+		srv = srv.WithLockout(lockout.New(lockoutStore, lockout.Params{Attempts: opts.Auth.Lockout.Attempts,
+			GlobalAttempts: opts.Auth.Lockout.GlobalAttempts, Delay: opts.Auth.Lockout.Delay, MaxDelay: opts.Auth.Lockout.MaxDelay}))
+	}
+	if hasTOTP {
+		srv = srv.WithTOTP(totp.New(totpStore, totpIssuer()))
+	}
+	if ssoProvider != nil {
+		srv = srv.WithSSO(ssoProvider)
+	}
+	if opts.Auth.Passkey {
+		passkeyStore, hasPasskeys := dataStore.(passkey.Store)
+		if !hasPasskeys {
+			log.Fatalf("[ERROR] engine %s doesn't support passkeys", opts.Engine)
+		}
+		passkeys, pkErr := makePasskeys(passkeyStore)
+		if pkErr != nil {
+			log.Fatalf("[ERROR] can't setup passkeys, %v", pkErr)
+		}
+		log.Printf("[INFO]  passkey login enabled, domain %s", opts.Domain[0])
+		srv = srv.WithPasskeys(passkeys)
+	}
 
 	// setup graceful shutdown with signal handling
 	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 	defer stop()
 
+	if namedUsers != nil {
+		srv = srv.WithUsers(namedUsers)
+	}
+	if usersFile, ok := namedUsers.(*users.File); ok {
+		go reloadOnHup(ctx, usersFile)
+	}
+
 	if err = srv.Run(ctx); err != nil {
 		log.Printf("[ERROR] failed, %+v", err)
 	}
 
+	if ldapUsers, ok := namedUsers.(*users.LDAP); ok {
+		ldapUsers.Close()
+	}
+
+	if dispatcher != nil {
+		dispatcher.Close() // stop pending retries, after the server so all events are sent
+	}
+
 	// cleanup storage on shutdown
 	if closeErr := dataStore.Close(); closeErr != nil {
 		log.Printf("[WARN] failed to close storage: %v", closeErr)
 	}
 }
 
-func getEngine(engineType, sqliteFile string) messager.Engine {
+// makeWebhooks sets up lifecycle event notifications of messages.
+// Expired events of messages removed by engine are sent only for engines with cleanup hook, redis expires keys silently.
+func makeWebhooks(dataStore messager.Engine, msgProc *messager.MessageProc) (*webhook.Dispatcher, error) {
+	dispatcher, err := webhook.New(webhook.Config{
+		URLs:    opts.Webhook.URLs,
+		Secret:  opts.Webhook.Secret,
+		Retries: opts.Webhook.Retries,
+		Timeout: opts.Webhook.Timeout,
+		IP:      server.HashedIPFromContext,
+	})
+	if err != nil {
+		return nil, err
+	}
+	msgProc.WithNotifier(dispatcher)
+	if eng, ok := dataStore.(interface{ OnExpired(fn store.ExpiredFunc) }); ok {
+		eng.OnExpired(msgProc.NotifyExpired)
+	}
+	log.Printf("[INFO]  webhooks enabled (urls: %d, callbacks: %v)", len(opts.Webhook.URLs), opts.Webhook.AllowCallback)
+	return dispatcher, nil
+}
+
+// makeUsers loads named users from htpasswd file, makes users table of the store or LDAP checker, nil if not enabled
+func makeUsers(dataStore messager.Engine) (server.Users, error) {
+	sources := 0
+	for _, enabled := range []bool{opts.Auth.Htpasswd != "", opts.Auth.UsersDB, opts.Auth.LDAP.URL != ""} {
+		if enabled {
+			sources++
+		}
+	}
+	if sources > 1 {
+		return nil, errors.New("only one of --auth.htpasswd, --auth.users-db and --auth.ldap.url can be used")
+	}
+
+	switch {
+	case opts.Auth.Htpasswd != "":
+		f, err := users.NewFile(opts.Auth.Htpasswd)
+		if err != nil {
+			return nil, err //nolint:wrapcheck // already wrapped by users
+		}
+		log.Printf("[INFO]  named users enabled, file %s", opts.Auth.Htpasswd)
+		return f, nil
+	case opts.Auth.UsersDB:
+		userStore, ok := dataStore.(users.Store)
+		if !ok || opts.Engine == "MEMORY" {
+			return nil, fmt.Errorf("engine %s can't keep users", opts.Engine)
+		}
+		log.Printf("[INFO]  named users enabled, users table of %s engine", opts.Engine)
+		return users.NewTable(userStore), nil
+	case opts.Auth.LDAP.URL != "":
+		return makeLDAP()
+	default:
+		return nil, nil //nolint:nilnil // named users are optional
+	}
+}
+
+// makeLDAP makes checker of users in LDAP or Active Directory
+func makeLDAP() (*users.LDAP, error) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12, InsecureSkipVerify: opts.Auth.LDAP.InsecureSkipVerify} //nolint:gosec // opt-in
+	if opts.Auth.LDAP.CACert != "" {
+		pem, err := os.ReadFile(opts.Auth.LDAP.CACert)
+		if err != nil {
+			return nil, fmt.Errorf("read ldap ca cert: %w", err)
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in %s", opts.Auth.LDAP.CACert)
+		}
+	}
+	l, err := users.NewLDAP(users.LDAPConfig{
+		URL:          opts.Auth.LDAP.URL,
+		StartTLS:     opts.Auth.LDAP.StartTLS,
+		TLS:          tlsConfig,
+		BindDN:       opts.Auth.LDAP.BindDN,
+		BindPassword: opts.Auth.LDAP.BindPassword,
+		BaseDN:       opts.Auth.LDAP.BaseDN,
+		UserFilter:   opts.Auth.LDAP.UserFilter,
+		GroupFilter:  opts.Auth.LDAP.GroupFilter,
+		PoolSize:     opts.Auth.LDAP.PoolSize,
+		Timeout:      opts.Auth.LDAP.Timeout,
+	})
+	if err != nil {
+		return nil, err //nolint:wrapcheck // already descriptive
+	}
+	if strings.HasPrefix(opts.Auth.LDAP.URL, "ldap://") && !opts.Auth.LDAP.StartTLS {
+		log.Printf("[WARN] ldap passwords are sent in plain text, use ldaps:// or --auth.ldap.starttls")
+	}
+	log.Printf("[INFO]  named users enabled, ldap %s", opts.Auth.LDAP.URL)
+	return l, nil
+}
+
+// makeSSO discovers OpenID Connect provider, nil if not enabled. Callback url is on the first domain.
+func makeSSO() (*sso.Provider, error) {
+	if opts.Auth.OIDC.Issuer == "" {
+		return nil, nil //nolint:nilnil // sso is optional
+	}
+	if len(opts.Domain) == 0 {
+		return nil, errors.New("domain required for sso callback url")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	p, err := sso.New(ctx, sso.Config{
+		Issuer:         opts.Auth.OIDC.Issuer,
+		ClientID:       opts.Auth.OIDC.ClientID,
+		ClientSecret:   opts.Auth.OIDC.ClientSecret,
+		RedirectURL:    fmt.Sprintf("%s://%s/auth/sso/callback", opts.Protocol, opts.Domain[0]),
+		AllowedDomains: opts.Auth.OIDC.AllowedDomains,
+		AllowedGroups:  opts.Auth.OIDC.AllowedGroups,
+		GroupsClaim:    opts.Auth.OIDC.GroupsClaim,
+		HTTPClient:     &http.Client{Timeout: 10 * time.Second},
+	})
+	if err != nil {
+		return nil, err //nolint:wrapcheck // already wrapped by sso
+	}
+	if len(opts.Auth.OIDC.AllowedDomains) == 0 && len(opts.Auth.OIDC.AllowedGroups) == 0 {
+		log.Printf("[WARN] sso allows any user of %s, set allowed domains or groups", opts.Auth.OIDC.Issuer)
+	}
+	log.Printf("[INFO]  sso enabled, issuer %s", opts.Auth.OIDC.Issuer)
+	return p, nil
+}
+
+// reloadOnHup reloads users file on SIGHUP, so users can be changed without restart
+func reloadOnHup(ctx context.Context, f *users.File) {
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGHUP)
+	defer signal.Stop(sigCh)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-sigCh:
+			if err := f.Reload(); err != nil {
+				log.Printf("[WARN] can't reload users, previous users kept: %v", err)
+			}
+		}
+	}
+}
+
+// runCommand executes cli subcommand instead of the server
+func runCommand(ctx context.Context, name string) error {
+	switch name {
+	case "migrate":
+		return runMigrate(ctx, os.Stdout, opts.SQLiteDB, opts.Migrate.DryRun)
+	case "rekey":
+		crypter, err := makeCrypter()
+		if err != nil {
+			return err
+		}
+		dataStore := getEngine(opts.Engine, opts.SQLiteDB, opts.PostgresDSN, opts.RedisURL)
+		defer dataStore.Close()
+		return runRekey(ctx, os.Stdout, messager.New(dataStore, crypter, messager.Params{}))
+	case "send":
+		return runSend(ctx, opts.Send, os.Stdin, os.Stdout, os.Stderr)
+	case "get":
+		return runGet(ctx, opts.Get, os.Stdout, os.Stderr)
+	case "token create", "token list", "token revoke":
+		if opts.Engine == "MEMORY" {
+			return errors.New("tokens kept by memory engine are lost on exit, use persistent engine")
+		}
+		dataStore := getEngine(opts.Engine, opts.SQLiteDB, opts.PostgresDSN, opts.RedisURL)
+		defer dataStore.Close()
+		tokenStore, ok := dataStore.(tokens.Store)
+		if !ok {
+			return fmt.Errorf("engine %s doesn't support tokens", opts.Engine)
+		}
+		m := tokens.New(tokenStore)
+		switch name {
+		case "token create":
+			return runTokenCreate(ctx, m, opts.Token.Create, os.Stdout)
+		case "token list":
+			return runTokenList(ctx, m, os.Stdout)
+		default:
+			return runTokenRevoke(ctx, m, opts.Token.Revoke.Args.Ref, os.Stdout)
+		}
+	case "session list", "session revoke", "session revoke-all":
+		if opts.Engine == "MEMORY" {
+			return errors.New("sessions kept by memory engine are visible to the running server only, use persistent engine")
+		}
+		dataStore := getEngine(opts.Engine, opts.SQLiteDB, opts.PostgresDSN, opts.RedisURL)
+		defer dataStore.Close()
+		sessionStore, ok := dataStore.(sessions.Store)
+		if !ok {
+			return fmt.Errorf("engine %s doesn't support sessions", opts.Engine)
+		}
+		m := sessions.New(sessionStore, opts.Auth.SessionTTL)
+		switch name {
+		case "session list":
+			return runSessionList(ctx, m, os.Stdout)
+		case "session revoke":
+			return runSessionRevoke(ctx, m, opts.Session.Revoke.Args.ID, os.Stdout)
+		default:
+			return runSessionRevokeAll(ctx, m, os.Stdout)
+		}
+	case "totp enroll", "totp disable":
+		if opts.Engine == "MEMORY" {
+			return errors.New("second factor kept by memory engine is lost on exit, use persistent engine")
+		}
+		dataStore := getEngine(opts.Engine, opts.SQLiteDB, opts.PostgresDSN, opts.RedisURL)
+		defer dataStore.Close()
+		totpStore, ok := dataStore.(totp.Store)
+		if !ok {
+			return fmt.Errorf("engine %s doesn't support second factor", opts.Engine)
+		}
+		m := totp.New(totpStore, totpIssuer())
+		if name == "totp enroll" {
+			return runTOTPEnroll(ctx, m, opts.TOTP.Enroll, os.Stdout)
+		}
+		return runTOTPDisable(ctx, m, opts.TOTP.Disable.User, os.Stdout)
+	case "passkey setup", "passkey list", "passkey remove":
+		if opts.Engine == "MEMORY" {
+			return errors.New("passkeys kept by memory engine are lost on exit, use persistent engine")
+		}
+		dataStore := getEngine(opts.Engine, opts.SQLiteDB, opts.PostgresDSN, opts.RedisURL)
+		defer dataStore.Close()
+		passkeyStore, ok := dataStore.(passkey.Store)
+		if !ok {
+			return fmt.Errorf("engine %s doesn't support passkeys", opts.Engine)
+		}
+		m, err := makePasskeys(passkeyStore)
+		if err != nil {
+			return err
+		}
+		switch name {
+		case "passkey setup":
+			return runPasskeySetup(ctx, m, opts.Passkey.Setup, os.Stdout)
+		case "passkey list":
+			return runPasskeyList(ctx, m, opts.Passkey.List.User, os.Stdout)
+		default:
+			return runPasskeyRemove(ctx, m, opts.Passkey.Remove.Args.ID, os.Stdout)
+		}
+	case "user set", "user list", "user remove":
+		if opts.Engine == "MEMORY" {
+			return errors.New("users kept by memory engine are lost on exit, use persistent engine")
+		}
+		dataStore := getEngine(opts.Engine, opts.SQLiteDB, opts.PostgresDSN, opts.RedisURL)
+		defer dataStore.Close()
+		userStore, ok := dataStore.(users.Store)
+		if !ok {
+			return fmt.Errorf("engine %s doesn't support users", opts.Engine)
+		}
+		tbl := users.NewTable(userStore)
+		switch name {
+		case "user set":
+			return runUserSet(ctx, tbl, opts.User.Set.Args.Name, os.Stdin, os.Stdout)
+		case "user list":
+			return runUserList(ctx, tbl, os.Stdout)
+		default:
+			return runUserRemove(ctx, tbl, opts.User.Remove.Args.Name, os.Stdout)
+		}
+	default:
+		return fmt.Errorf("unknown command %q", name)
+	}
+}
+
+// makePasskeys makes passkey manager bound to the first site domain, browsers offer its passkeys
+// on this domain and its subdomains only
+func makePasskeys(s passkey.Store) (*passkey.Manager, error) {
+	if len(opts.Domain) == 0 {
+		return nil, errors.New("domain required for passkeys")
+	}
+	rpID := opts.Domain[0]
+	if host, _, err := net.SplitHostPort(rpID); err == nil {
+		rpID = host
+	}
+	origins := make([]string, 0, len(opts.Domain))
+	for _, d := range opts.Domain {
+		origins = append(origins, fmt.Sprintf("%s://%s", opts.Protocol, d))
+	}
+	return passkey.New(s, passkey.Params{RPID: rpID, Origins: origins, Name: opts.Branding}) //nolint:wrapcheck // already wrapped
+}
+
+// totpIssuer returns service name shown by authenticator apps next to the code, the site domain if set
+func totpIssuer() string {
+	if len(opts.Domain) > 0 {
+		return opts.Domain[0]
+	}
+	return "secrets"
+}
+
+// makeCrypter makes crypter with the keyring from sign key options
+func makeCrypter() (messager.Crypt, error) {
+	// validate sign key has sufficient entropy (minimum 16 bytes)
+	if len(opts.SignKey) < 16 {
+		return messager.Crypt{}, fmt.Errorf("sign key must be at least 16 bytes, got %d", len(opts.SignKey))
+	}
+	if opts.KeyID == "" || len(opts.KeyID) > 255 {
+		return messager.Crypt{}, fmt.Errorf("key id must be 1-255 bytes, got %d", len(opts.KeyID))
+	}
+	kdf, err := messager.ParseKDF(opts.KDF)
+	if err != nil {
+		return messager.Crypt{}, err
+	}
+
+	retired := map[string]string{}
+	for _, rk := range opts.RetiredKeys {
+		id, key, ok := strings.Cut(rk, ":")
+		if !ok || id == "" || len(id) > 255 || len(key) < 16 {
+			return messager.Crypt{}, fmt.Errorf("retired key %q must be id:key with 1-255 bytes id and at least 16 bytes key",
+				id)
+		}
+		if _, dup := retired[id]; dup || id == opts.KeyID {
+			return messager.Crypt{}, fmt.Errorf("duplicate key id %q", id)
+		}
+		retired[id] = key
+	}
+	if len(retired) > 0 {
+		log.Printf("[INFO] sign key %q active, %d retired key(s)", opts.KeyID, len(retired))
+	}
+
+	return messager.Crypt{Key: messager.MakeSignKey(opts.SignKey, opts.PinSize), SignKey: opts.SignKey,
+		KeyID: opts.KeyID, Retired: retired, KDF: kdf}, nil
+}
+
+func getEngine(engineType, sqliteFile, postgresDSN, redisURL string) messager.Engine {
 	switch engineType {
 	case "MEMORY":
 		return store.NewInMemory(time.Minute * 5)
+	case "POSTGRES":
+		if postgresDSN == "" {
+			log.Fatalf("[ERROR] postgres engine requires --postgres connection string")
+		}
+		pgStore, err := store.NewPostgres(postgresDSN, time.Minute*5)
+		if err != nil {
+			log.Fatalf("[ERROR] can't connect to postgres, %v", err)
+		}
+		return pgStore
+	case "REDIS":
+		redisStore, err := store.NewRedis(redisURL)
+		if err != nil {
+			log.Fatalf("[ERROR] can't connect to redis, %v", err)
+		}
+		return redisStore
 	default: // SQLITE - validated by go-flags choice constraint
 		sqliteStore, err := store.NewSQLite(sqliteFile, time.Minute*5)
 		if err != nil {
@@ -164,10 +654,10 @@ func getEngine(engineType, sqliteFile string) messager.Engine {
 	}
 }
 
-func setupLog(dbg bool) {
+func setupLog(dbg bool, extra ...log.Option) {
 	if dbg {
-		log.Setup(log.Debug, log.CallerFile, log.Msec, log.LevelBraces)
+		log.Setup(append([]log.Option{log.Debug, log.CallerFile, log.Msec, log.LevelBraces}, extra...)...)
 		return
 	}
-	log.Setup(log.Msec, log.LevelBraces)
+	log.Setup(append([]log.Option{log.Msec, log.LevelBraces}, extra...)...)
 }
@@ -1,21 +1,41 @@
 package messager
 
 import (
+	"crypto/hkdf"
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/base64"
 	"errors"
 	"fmt"
 	"io"
+	"slices"
 	"strings"
 
+	"golang.org/x/crypto/argon2"
 	"golang.org/x/crypto/nacl/secretbox"
 )
 
 // Crypt data with a global key + pin.
 // It provides NaCl secretbox encryption (XSalsa20-Poly1305) for data
 // needed to prevent storing it in naked form even in_memory storage.
+//
+// Encrypt makes versioned blobs, "$" followed by base64 of the envelope with two secretbox layers:
+//
+//	outer: version (1 byte) | key id length (1 byte) | key id | salt (16 bytes) | nonce (24 bytes) | sealed inner
+//	inner: kdf id (1 byte) | salt (16 bytes) | nonce (24 bytes) | sealed data
+//
+// The inner layer is keyed by the pin with the kdf, the outer one by the sign key with hkdf.
+// Key id tells which sign key of the keyring made the outer layer, so the blob can be
+// re-encrypted under another sign key (see Rewrap) without the pin.
+//
+// Decrypt also reads blobs made before key ids (version 1, single layer keyed by sign key and pin)
+// and legacy unversioned blobs. Such blobs don't tell the sign key, so all keys of the keyring are tried.
 type Crypt struct {
-	Key string
+	Key     string            // sign key truncated by MakeSignKey, used for legacy blobs only
+	SignKey string            // active sign key, Key used if not set
+	KeyID   string            // id of the active sign key, written to the envelope
+	Retired map[string]string // retired sign keys by id, used to read and rewrap older blobs only
+	KDF     KDF               // kdf for new blobs, KDFArgon2id if not set
 }
 
 // Request for both Encrypt and Decrypt
@@ -24,51 +44,333 @@ type Request struct {
 	Data []byte
 }
 
-// Encrypt encrypts data with secretbox and returns base64-encoded result
+// KDF defines key derivation function, the value is stored in the envelope
+type KDF byte
+
+// enum of supported kdf ids, never change released values
+const (
+	KDFArgon2id KDF = 1 // argon2id with time=2, memory=19MiB, threads=1
+	KDFHKDF     KDF = 2 // hkdf-sha256, for high-entropy sign keys where stretching is not needed
+)
+
+// ErrNoRewrap returned by Rewrap for blobs made before key ids, these can't be re-encrypted without pin
+var ErrNoRewrap = errors.New("blob format can't be re-encrypted without pin")
+
+const (
+	envelopePrefix = "$" // not in base64 alphabet, so legacy blobs never start with it
+	envelopeV1     = 1   // single layer, key derived from sign key and pin
+	envelopeV2     = 2   // pin layer wrapped by sign key layer with key id
+	saltSize       = 16
+	nonceSize      = 24
+	layerSize      = saltSize + nonceSize + secretbox.Overhead // salt, nonce and box overhead of each layer
+	maxKeyIDLen    = 255
+)
+
+// ParseKDF returns KDF by name, argon2id or hkdf
+func ParseKDF(name string) (KDF, error) {
+	switch strings.ToLower(name) {
+	case "argon2id":
+		return KDFArgon2id, nil
+	case "hkdf":
+		return KDFHKDF, nil
+	default:
+		return 0, fmt.Errorf("unknown kdf %q", name)
+	}
+}
+
+// Encrypt encrypts data with secretbox and returns versioned envelope
 func (c Crypt) Encrypt(req Request) ([]byte, error) {
-	keyWithPin := fmt.Sprintf("%s%s", c.Key, req.Pin)
-	if len(keyWithPin) != 32 {
-		return nil, fmt.Errorf("key+pin should be 32 bytes, got %d", len(keyWithPin))
+	kdf := c.KDF
+	if kdf == 0 {
+		kdf = KDFArgon2id
+	}
+	signKey := c.activeKey()
+	if signKey == "" {
+		return nil, errors.New("sign key is not set")
+	}
+	if len(c.KeyID) > maxKeyIDLen {
+		return nil, fmt.Errorf("key id is longer than %d bytes", maxKeyIDLen)
 	}
 
-	naclKey := new([32]byte)
-	copy(naclKey[:], keyWithPin[:32])
-	nonce := new([24]byte)
-	if _, err := io.ReadFull(rand.Reader, nonce[:]); err != nil {
-		return nil, fmt.Errorf("could not read from random: %w", err)
+	inner, err := seal([]byte{byte(kdf)}, req.Data, func(salt []byte) (*[32]byte, error) {
+		return deriveKey(kdf, salt, []byte(req.Pin))
+	})
+	if err != nil {
+		return nil, err
 	}
-	out := make([]byte, 24)
-	copy(out, nonce[:])
-	sealed := secretbox.Seal(out, req.Data, nonce, naclKey)
-	return []byte(base64.StdEncoding.EncodeToString(sealed)), nil
+	return c.sealOuter(c.KeyID, signKey, inner)
 }
 
-// Decrypt decrypts base64-encoded data with secretbox
+// Decrypt decrypts versioned envelope or legacy base64-encoded data with secretbox
 func (c Crypt) Decrypt(req Request) ([]byte, error) {
-	keyWithPin := fmt.Sprintf("%s%s", c.Key, req.Pin)
-	if len(keyWithPin) != 32 {
-		return nil, errors.New("key+pin should be 32 bytes")
+	if !strings.HasPrefix(string(req.Data), envelopePrefix) {
+		return c.decryptLegacy(req)
 	}
 
-	naclKey := new([32]byte)
-	copy(naclKey[:], keyWithPin[:32])
+	envelope, err := decodeEnvelope(req.Data)
+	if err != nil {
+		return nil, err
+	}
+
+	switch envelope[0] {
+	case envelopeV1:
+		return c.decryptV1(envelope[1:], req.Pin)
+	case envelopeV2:
+		inner, err := c.openOuter(envelope[1:])
+		if err != nil {
+			return nil, err
+		}
+		if len(inner) < 1+layerSize {
+			return nil, errors.New("envelope too short")
+		}
+		return open(inner[1:], func(salt []byte) (*[32]byte, error) {
+			return deriveKey(KDF(inner[0]), salt, []byte(req.Pin))
+		})
+	default:
+		return nil, fmt.Errorf("unsupported envelope version %d", envelope[0])
+	}
+}
+
+// Rewrap re-encrypts the sign key layer of the blob with the active key, the pin layer is kept as-is.
+// Returns the blob and false if it is already under the active key, ErrNoRewrap for blobs made before key ids.
+func (c Crypt) Rewrap(data []byte) (result []byte, rewrapped bool, err error) {
+	if !strings.HasPrefix(string(data), envelopePrefix) {
+		return nil, false, ErrNoRewrap
+	}
+	envelope, err := decodeEnvelope(data)
+	if err != nil {
+		return nil, false, err
+	}
+	if envelope[0] != envelopeV2 {
+		return nil, false, ErrNoRewrap
+	}
+
+	keyID, _, err := parseKeyID(envelope[1:])
+	if err != nil {
+		return nil, false, err
+	}
+	if keyID == c.KeyID {
+		return data, false, nil
+	}
+
+	inner, err := c.openOuter(envelope[1:])
+	if err != nil {
+		return nil, false, err
+	}
+	signKey := c.activeKey()
+	if signKey == "" {
+		return nil, false, errors.New("sign key is not set")
+	}
+	if result, err = c.sealOuter(c.KeyID, signKey, inner); err != nil {
+		return nil, false, err
+	}
+	return result, true, nil
+}
+
+// sealOuter wraps inner layer with the sign key and makes the final encoded blob
+func (c Crypt) sealOuter(keyID, signKey string, inner []byte) ([]byte, error) {
+	header := append([]byte{envelopeV2, byte(len(keyID))}, keyID...)
+	outer, err := seal(header, inner, func(salt []byte) (*[32]byte, error) {
+		return deriveKey(KDFHKDF, salt, []byte(signKey))
+	})
+	if err != nil {
+		return nil, err
+	}
+	return []byte(envelopePrefix + base64.StdEncoding.EncodeToString(outer)), nil
+}
+
+// openOuter finds the sign key by id from the envelope and opens the outer layer, returns inner layer
+func (c Crypt) openOuter(envelope []byte) ([]byte, error) {
+	keyID, rest, err := parseKeyID(envelope)
+	if err != nil {
+		return nil, err
+	}
+	signKey, ok := c.keyByID(keyID)
+	if !ok {
+		return nil, fmt.Errorf("unknown key id %q", keyID)
+	}
+	return open(rest, func(salt []byte) (*[32]byte, error) {
+		return deriveKey(KDFHKDF, salt, []byte(signKey))
+	})
+}
+
+// decryptV1 decrypts single layer envelope made before key ids, tries all sign keys
+func (c Crypt) decryptV1(envelope []byte, pin string) ([]byte, error) {
+	if len(envelope) < 1+layerSize {
+		return nil, errors.New("envelope too short")
+	}
+	kdf := KDF(envelope[0])
+	var err error
+	for _, signKey := range c.allKeys() {
+		var res []byte
+		res, err = open(envelope[1:], func(salt []byte) (*[32]byte, error) {
+			return deriveKey(kdf, salt, []byte(signKey+pin))
+		})
+		if err == nil {
+			return res, nil
+		}
+	}
+	if err == nil {
+		return nil, errors.New("sign key is not set")
+	}
+	return nil, err
+}
+
+// decryptLegacy decrypts unversioned base64-encoded data, with key made by concatenation of
+// truncated sign key and pin. Tries Key first and then retired keys truncated to fit the pin.
+func (c Crypt) decryptLegacy(req Request) ([]byte, error) {
+	legacyKeys := []string{}
+	if len(c.Key)+len(req.Pin) == 32 {
+		legacyKeys = append(legacyKeys, c.Key)
+	}
+	for _, id := range c.retiredIDs() {
+		if c.Retired[id] != "" && len(req.Pin) < 32 {
+			legacyKeys = append(legacyKeys, MakeSignKey(c.Retired[id], len(req.Pin)))
+		}
+	}
+	if len(legacyKeys) == 0 {
+		return nil, errors.New("key+pin should be 32 bytes")
+	}
 
 	sealed, err := base64.StdEncoding.DecodeString(string(req.Data))
 	if err != nil {
 		return nil, fmt.Errorf("failed to decode: %w", err)
 	}
+	if len(sealed) < nonceSize {
+		return nil, errors.New("data too short")
+	}
+	nonce := new([nonceSize]byte)
+	copy(nonce[:], sealed[:nonceSize])
+
+	for _, key := range legacyKeys {
+		naclKey := new([32]byte)
+		copy(naclKey[:], key+req.Pin)
+		if decrypted, ok := secretbox.Open(nil, sealed[nonceSize:], nonce, naclKey); ok {
+			return decrypted, nil
+		}
+	}
+	return nil, errors.New("failed to decrypt")
+}
+
+// activeKey returns sign key used for new blobs
+func (c Crypt) activeKey() string {
+	if c.SignKey != "" {
+		return c.SignKey
+	}
+	return c.Key
+}
+
+// keyByID returns active or retired sign key with the given id
+func (c Crypt) keyByID(id string) (string, bool) {
+	if id == c.KeyID && c.activeKey() != "" {
+		return c.activeKey(), true
+	}
+	key, ok := c.Retired[id]
+	return key, ok && key != ""
+}
+
+// allKeys returns active key followed by retired keys ordered by id
+func (c Crypt) allKeys() []string {
+	res := []string{}
+	if key := c.activeKey(); key != "" {
+		res = append(res, key)
+	}
+	for _, id := range c.retiredIDs() {
+		if c.Retired[id] != "" {
+			res = append(res, c.Retired[id])
+		}
+	}
+	return res
+}
+
+// retiredIDs returns sorted ids of retired keys
+func (c Crypt) retiredIDs() []string {
+	ids := make([]string, 0, len(c.Retired))
+	for id := range c.Retired {
+		ids = append(ids, id)
+	}
+	slices.Sort(ids)
+	return ids
+}
+
+// seal encrypts data with a random salt and nonce, key made by keyFn from the salt.
+// Returns header | salt | nonce | sealed data.
+func seal(header, data []byte, keyFn func(salt []byte) (*[32]byte, error)) ([]byte, error) {
+	res := make([]byte, len(header)+saltSize+nonceSize, len(header)+layerSize+len(data))
+	copy(res, header)
+	if _, err := io.ReadFull(rand.Reader, res[len(header):]); err != nil {
+		return nil, fmt.Errorf("could not read from random: %w", err)
+	}
+
+	naclKey, err := keyFn(res[len(header) : len(header)+saltSize])
+	if err != nil {
+		return nil, err
+	}
+	nonce := new([nonceSize]byte)
+	copy(nonce[:], res[len(header)+saltSize:])
+	return secretbox.Seal(res, data, nonce, naclKey), nil
+}
 
-	nonce := new([24]byte)
-	copy(nonce[:], sealed[:24])
+// open decrypts salt | nonce | sealed data layer, key made by keyFn from the salt
+func open(layer []byte, keyFn func(salt []byte) (*[32]byte, error)) ([]byte, error) {
+	if len(layer) < layerSize {
+		return nil, errors.New("envelope too short")
+	}
+	naclKey, err := keyFn(layer[:saltSize])
+	if err != nil {
+		return nil, err
+	}
+	nonce := new([nonceSize]byte)
+	copy(nonce[:], layer[saltSize:saltSize+nonceSize])
 
-	decrypted, ok := secretbox.Open(nil, sealed[24:], nonce, naclKey)
+	decrypted, ok := secretbox.Open(nil, layer[saltSize+nonceSize:], nonce, naclKey)
 	if !ok {
 		return nil, errors.New("failed to decrypt")
 	}
 	return decrypted, nil
 }
 
-// MakeSignKey creates 32-pin bytes signKey for AES256
+// deriveKey makes NaCl key from the secret with the given kdf and salt
+func deriveKey(kdf KDF, salt, secret []byte) (*[32]byte, error) {
+	naclKey := new([32]byte)
+	switch kdf {
+	case KDFArgon2id:
+		copy(naclKey[:], argon2.IDKey(secret, salt, 2, 19*1024, 1, 32))
+	case KDFHKDF:
+		key, err := hkdf.Key(sha256.New, secret, salt, "secrets message key", 32)
+		if err != nil {
+			return nil, fmt.Errorf("derive key: %w", err)
+		}
+		copy(naclKey[:], key)
+	default:
+		return nil, fmt.Errorf("unsupported kdf %d", kdf)
+	}
+	return naclKey, nil
+}
+
+// decodeEnvelope strips prefix and decodes base64 envelope
+func decodeEnvelope(data []byte) ([]byte, error) {
+	envelope, err := base64.StdEncoding.DecodeString(string(data[len(envelopePrefix):]))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode: %w", err)
+	}
+	if len(envelope) == 0 {
+		return nil, errors.New("envelope too short")
+	}
+	return envelope, nil
+}
+
+// parseKeyID reads length-prefixed key id, returns it with the rest of the envelope
+func parseKeyID(envelope []byte) (keyID string, rest []byte, err error) {
+	if len(envelope) < 1 || len(envelope) < 1+int(envelope[0]) {
+		return "", nil, errors.New("envelope too short")
+	}
+	idLen := int(envelope[0])
+	return string(envelope[1 : 1+idLen]), envelope[1+idLen:], nil
+}
+
+// MakeSignKey creates 32-pin bytes signKey for AES256.
+// Used for legacy blobs only, new ones derive keys from the full sign key and the pin (or passphrase) separately.
 func MakeSignKey(signKey string, pinSize int) (result string) {
 	if len(signKey) >= 32-pinSize {
 		return signKey[:32-pinSize]
@@ -23,6 +23,9 @@ var _ Crypter = &CrypterMock{}
 //			EncryptFunc: func(req Request) ([]byte, error) {
 //				panic("mock out the Encrypt method")
 //			},
+//			RewrapFunc: func(data []byte) ([]byte, bool, error) {
+//				panic("mock out the Rewrap method")
+//			},
 //		}
 //
 //		// use mockedCrypter in code that requires Crypter
@@ -36,6 +39,9 @@ type CrypterMock struct {
 	// EncryptFunc mocks the Encrypt method.
 	EncryptFunc func(req Request) ([]byte, error)
 
+	// RewrapFunc mocks the Rewrap method.
+	RewrapFunc func(data []byte) ([]byte, bool, error)
+
 	// calls tracks calls to the methods.
 	calls struct {
 		// Decrypt holds details about calls to the Decrypt method.
@@ -48,9 +54,15 @@ type CrypterMock struct {
 			// Req is the req argument value.
 			Req Request
 		}
+		// Rewrap holds details about calls to the Rewrap method.
+		Rewrap []struct {
+			// Data is the data argument value.
+			Data []byte
+		}
 	}
 	lockDecrypt sync.RWMutex
 	lockEncrypt sync.RWMutex
+	lockRewrap  sync.RWMutex
 }
 
 // Decrypt calls DecryptFunc.
@@ -116,3 +128,35 @@ func (mock *CrypterMock) EncryptCalls() []struct {
 	mock.lockEncrypt.RUnlock()
 	return calls
 }
+
+// Rewrap calls RewrapFunc.
+func (mock *CrypterMock) Rewrap(data []byte) ([]byte, bool, error) {
+	if mock.RewrapFunc == nil {
+		panic("CrypterMock.RewrapFunc: method is nil but Crypter.Rewrap was just called")
+	}
+	callInfo := struct {
+		Data []byte
+	}{
+		Data: data,
+	}
+	mock.lockRewrap.Lock()
+	mock.calls.Rewrap = append(mock.calls.Rewrap, callInfo)
+	mock.lockRewrap.Unlock()
+	return mock.RewrapFunc(data)
+}
+
+// RewrapCalls gets all the calls that were made to Rewrap.
+// Check the length with:
+//
+//	len(mockedCrypter.RewrapCalls())
+func (mock *CrypterMock) RewrapCalls() []struct {
+	Data []byte
+} {
+	var calls []struct {
+		Data []byte
+	}
+	mock.lockRewrap.RLock()
+	calls = mock.calls.Rewrap
+	mock.lockRewrap.RUnlock()
+	return calls
+}
@@ -1,8 +1,9 @@
 package messager
 
 import (
-	"errors"
+	"encoding/base64"
 	"strconv"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -15,7 +16,6 @@ func TestCrypt(t *testing.T) {
 	tbl := []struct {
 		data string
 		pin  string
-		err  error
 	}{
 		{
 			data: "abcdefg",
@@ -40,17 +40,16 @@ func TestCrypt(t *testing.T) {
 		{
 			data: "dfasdfasd asdfasdfa asdfasdf asdfasdfasdf asdfasdf",
 			pin:  "abcd",
-			err:  errors.New("key+pin should be 32 bytes, got 31"),
+		},
+		{
+			data: "dfasdfasd asdfasdfa asdfasdf asdfasdfasdf asdfasdf",
+			pin:  "",
 		},
 	}
 
 	for i, tt := range tbl {
 		t.Run(strconv.Itoa(i), func(t *testing.T) {
 			r1, err := c.Encrypt(Request{Data: []byte(tt.data), Pin: tt.pin})
-			if tt.err != nil {
-				require.EqualError(t, err, tt.err.Error())
-				return
-			}
 			require.NoError(t, err)
 			t.Logf("%x", r1)
 
@@ -61,6 +60,190 @@ func TestCrypt(t *testing.T) {
 	}
 }
 
+func TestCrypt_KDF(t *testing.T) {
+	for _, kdf := range []KDF{KDFArgon2id, KDFHKDF} {
+		t.Run(strconv.Itoa(int(kdf)), func(t *testing.T) {
+			c := Crypt{Key: "123456789012345678901234567", SignKey: "full-sign-key-1234567890", KeyID: "k1", KDF: kdf}
+			r1, err := c.Encrypt(Request{Data: []byte("secret data"), Pin: "12345"})
+			require.NoError(t, err)
+			require.True(t, strings.HasPrefix(string(r1), "$"), "versioned blob should start with $")
+
+			envelope, err := base64.StdEncoding.DecodeString(string(r1[1:]))
+			require.NoError(t, err)
+			assert.Equal(t, byte(2), envelope[0], "version")
+			assert.Equal(t, []byte{2, 'k', '1'}, envelope[1:4], "key id")
+
+			r2, err := c.Encrypt(Request{Data: []byte("secret data"), Pin: "12345"})
+			require.NoError(t, err)
+			assert.NotEqual(t, r1, r2, "random salt and nonce should make different blobs")
+
+			res, err := c.Decrypt(Request{Data: r1, Pin: "12345"})
+			require.NoError(t, err)
+			assert.Equal(t, "secret data", string(res))
+
+			// kdf is taken from the envelope, not from Crypt
+			other := c
+			other.KDF = 0
+			res, err = other.Decrypt(Request{Data: r1, Pin: "12345"})
+			require.NoError(t, err)
+			assert.Equal(t, "secret data", string(res))
+
+			_, err = c.Decrypt(Request{Data: r1, Pin: "54321"})
+			require.EqualError(t, err, "failed to decrypt", "wrong pin")
+
+			other = c
+			other.SignKey = "another-sign-key-1234567890"
+			_, err = other.Decrypt(Request{Data: r1, Pin: "12345"})
+			require.EqualError(t, err, "failed to decrypt", "wrong sign key")
+		})
+	}
+}
+
+func TestCrypt_DecryptV1(t *testing.T) {
+	// made by single layer Crypt.Encrypt (envelope version 1) with SignKey "full-sign-key-1234567890" and pin "12345"
+	argonBlob := []byte("$AQFnpBzfBfDA7bThwLAfuYRVfnHeG3mXTW2p9D5cpGHzp/WW04ODMz6MB8Cux9SN39zby59+7J9nOaH/TLNwDdrLe9FdMFxjZckK")
+	hkdfBlob := []byte("$AQKH5PATZDfRTF3RVTQNPdhlctZbpoeF2WvXXdHqpsZh3QhcE8CSTWoJ+NoYjpg52rINIOTotyQ/Wb7T6DrCvaaSgOZeZYZPbtNT")
+
+	c := Crypt{SignKey: "full-sign-key-1234567890", KeyID: "1"}
+	for _, blob := range [][]byte{argonBlob, hkdfBlob} {
+		res, err := c.Decrypt(Request{Data: blob, Pin: "12345"})
+		require.NoError(t, err)
+		assert.Equal(t, "v1 secret message", string(res))
+
+		_, err = c.Decrypt(Request{Data: blob, Pin: "54321"})
+		require.EqualError(t, err, "failed to decrypt")
+	}
+
+	// sign key rotated, old one is retired
+	rotated := Crypt{SignKey: "new-sign-key-1234567890", KeyID: "2", Retired: map[string]string{"1": "full-sign-key-1234567890"}}
+	res, err := rotated.Decrypt(Request{Data: argonBlob, Pin: "12345"})
+	require.NoError(t, err)
+	assert.Equal(t, "v1 secret message", string(res))
+
+	_, _, err = rotated.Rewrap(argonBlob)
+	require.ErrorIs(t, err, ErrNoRewrap)
+}
+
+func TestCrypt_DecryptLegacy(t *testing.T) {
+	// made by unversioned Crypt.Encrypt with Key "123456789012345678901234567" and pin "12345"
+	legacy := []byte("OAq74PorwhlCSb6TfFnNYkJ5kKl3+MNSfAbmy3vj6sd54d2KFsdE66jP+pQgZPGiz+FvllsawBxlu8p92A==")
+
+	c := Crypt{Key: "123456789012345678901234567", SignKey: "123456789012345678901234567890"}
+	res, err := c.Decrypt(Request{Data: legacy, Pin: "12345"})
+	require.NoError(t, err)
+	assert.Equal(t, "legacy secret message", string(res))
+
+	_, err = c.Decrypt(Request{Data: legacy, Pin: "54321"})
+	require.EqualError(t, err, "failed to decrypt")
+
+	_, err = c.Decrypt(Request{Data: legacy, Pin: "1234"})
+	require.EqualError(t, err, "key+pin should be 32 bytes")
+
+	_, err = c.Decrypt(Request{Data: []byte("c2hvcnQ="), Pin: "12345"})
+	require.EqualError(t, err, "data too short")
+
+	// sign key rotated, legacy key made from the retired one
+	rotated := Crypt{Key: MakeSignKey("new-sign-key-1234567890", 5), SignKey: "new-sign-key-1234567890", KeyID: "2",
+		Retired: map[string]string{"1": "123456789012345678901234567890"}}
+	res, err = rotated.Decrypt(Request{Data: legacy, Pin: "12345"})
+	require.NoError(t, err)
+	assert.Equal(t, "legacy secret message", string(res))
+
+	_, _, err = rotated.Rewrap(legacy)
+	require.ErrorIs(t, err, ErrNoRewrap)
+}
+
+func TestCrypt_KeyRotation(t *testing.T) {
+	oldCrypt := Crypt{SignKey: "old-sign-key-1234567890", KeyID: "2025"}
+	blob, err := oldCrypt.Encrypt(Request{Data: []byte("in-flight secret"), Pin: "12345"})
+	require.NoError(t, err)
+
+	newCrypt := Crypt{SignKey: "new-sign-key-1234567890", KeyID: "2026", Retired: map[string]string{"2025": "old-sign-key-1234567890"}}
+	res, err := newCrypt.Decrypt(Request{Data: blob, Pin: "12345"})
+	require.NoError(t, err, "old blob readable with retired key")
+	assert.Equal(t, "in-flight secret", string(res))
+
+	noRetired := Crypt{SignKey: "new-sign-key-1234567890", KeyID: "2026"}
+	_, err = noRetired.Decrypt(Request{Data: blob, Pin: "12345"})
+	require.EqualError(t, err, `unknown key id "2025"`)
+
+	// rewrap moves the blob to the active key without pin
+	rewrapped, ok, err := newCrypt.Rewrap(blob)
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.NotEqual(t, blob, rewrapped)
+
+	res, err = noRetired.Decrypt(Request{Data: rewrapped, Pin: "12345"})
+	require.NoError(t, err, "rewrapped blob readable without retired key")
+	assert.Equal(t, "in-flight secret", string(res))
+	_, err = noRetired.Decrypt(Request{Data: rewrapped, Pin: "54321"})
+	require.EqualError(t, err, "failed to decrypt", "pin still required")
+
+	// already under the active key
+	same, ok, err := newCrypt.Rewrap(rewrapped)
+	require.NoError(t, err)
+	assert.False(t, ok)
+	assert.Equal(t, rewrapped, same)
+
+	// retired key is not known
+	_, _, err = noRetired.Rewrap(blob)
+	require.EqualError(t, err, `unknown key id "2025"`)
+}
+
+func TestCrypt_DecryptBadEnvelope(t *testing.T) {
+	c := Crypt{Key: "123456789012345678901234567"}
+	blob, err := c.Encrypt(Request{Data: []byte("data"), Pin: "12345"})
+	require.NoError(t, err)
+	envelope, err := base64.StdEncoding.DecodeString(string(blob[1:]))
+	require.NoError(t, err)
+
+	encode := func(b []byte) []byte { return []byte("$" + base64.StdEncoding.EncodeToString(b)) }
+	badVersion := append([]byte{}, envelope...)
+	badVersion[0] = 99
+	badKeyID := append([]byte{}, envelope...)
+	badKeyID[1] = 200
+
+	// inner layer with unknown kdf, wrapped properly by the sign key
+	inner := append([]byte{99}, make([]byte, layerSize)...)
+	badKDF, err := c.sealOuter("", c.Key, inner)
+	require.NoError(t, err)
+
+	tbl := []struct {
+		data []byte
+		err  string
+	}{
+		{data: []byte("$not base64!"), err: "failed to decode: illegal base64 data at input byte 3"},
+		{data: []byte("$"), err: "envelope too short"},
+		{data: encode(envelope[:20]), err: "envelope too short"},
+		{data: encode(badVersion), err: "unsupported envelope version 99"},
+		{data: encode(badKeyID), err: "envelope too short"},
+		{data: encode([]byte{1, 99}), err: "envelope too short"},
+		{data: badKDF, err: "unsupported kdf 99"},
+	}
+	for i, tt := range tbl {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			_, err := c.Decrypt(Request{Data: tt.data, Pin: "12345"})
+			require.EqualError(t, err, tt.err)
+		})
+	}
+
+	_, err = Crypt{}.Encrypt(Request{Data: []byte("data"), Pin: "12345"})
+	require.EqualError(t, err, "sign key is not set")
+}
+
+func TestParseKDF(t *testing.T) {
+	kdf, err := ParseKDF("argon2id")
+	require.NoError(t, err)
+	assert.Equal(t, KDFArgon2id, kdf)
+
+	kdf, err = ParseKDF("HKDF")
+	require.NoError(t, err)
+	assert.Equal(t, KDFHKDF, kdf)
+
+	_, err = ParseKDF("md5")
+	require.EqualError(t, err, `unknown kdf "md5"`)
+}
+
 func TestMakeSignKey(t *testing.T) {
 	tbl := []struct {
 		key     string
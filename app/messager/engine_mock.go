@@ -23,18 +23,36 @@ var _ Engine = &EngineMock{}
 //			CloseFunc: func() error {
 //				panic("mock out the Close method")
 //			},
+//			ConsumeFunc: func(ctx context.Context, key string, verify func(msg *store.Message) error) (*store.Message, error) {
+//				panic("mock out the Consume method")
+//			},
 //			IncErrFunc: func(ctx context.Context, key string) (int, error) {
 //				panic("mock out the IncErr method")
 //			},
+//			KeysFunc: func(ctx context.Context) ([]string, error) {
+//				panic("mock out the Keys method")
+//			},
 //			LoadFunc: func(ctx context.Context, key string) (*store.Message, error) {
 //				panic("mock out the Load method")
 //			},
+//			LoadTombstoneFunc: func(ctx context.Context, key string) (*store.Tombstone, error) {
+//				panic("mock out the LoadTombstone method")
+//			},
 //			RemoveFunc: func(ctx context.Context, key string) error {
 //				panic("mock out the Remove method")
 //			},
 //			SaveFunc: func(ctx context.Context, msg *store.Message) error {
 //				panic("mock out the Save method")
 //			},
+//			SaveTombstoneFunc: func(ctx context.Context, t *store.Tombstone) error {
+//				panic("mock out the SaveTombstone method")
+//			},
+//			UpdateDataFunc: func(ctx context.Context, key string, oldData []byte, newData []byte) error {
+//				panic("mock out the UpdateData method")
+//			},
+//			UpdateTombstoneFunc: func(ctx context.Context, key string, u store.TombstoneUpdate) error {
+//				panic("mock out the UpdateTombstone method")
+//			},
 //		}
 //
 //		// use mockedEngine in code that requires Engine
@@ -45,23 +63,50 @@ type EngineMock struct {
 	// CloseFunc mocks the Close method.
 	CloseFunc func() error
 
+	// ConsumeFunc mocks the Consume method.
+	ConsumeFunc func(ctx context.Context, key string, verify func(msg *store.Message) error) (*store.Message, error)
+
 	// IncErrFunc mocks the IncErr method.
 	IncErrFunc func(ctx context.Context, key string) (int, error)
 
+	// KeysFunc mocks the Keys method.
+	KeysFunc func(ctx context.Context) ([]string, error)
+
 	// LoadFunc mocks the Load method.
 	LoadFunc func(ctx context.Context, key string) (*store.Message, error)
 
+	// LoadTombstoneFunc mocks the LoadTombstone method.
+	LoadTombstoneFunc func(ctx context.Context, key string) (*store.Tombstone, error)
+
 	// RemoveFunc mocks the Remove method.
 	RemoveFunc func(ctx context.Context, key string) error
 
 	// SaveFunc mocks the Save method.
 	SaveFunc func(ctx context.Context, msg *store.Message) error
 
+	// SaveTombstoneFunc mocks the SaveTombstone method.
+	SaveTombstoneFunc func(ctx context.Context, t *store.Tombstone) error
+
+	// UpdateDataFunc mocks the UpdateData method.
+	UpdateDataFunc func(ctx context.Context, key string, oldData []byte, newData []byte) error
+
+	// UpdateTombstoneFunc mocks the UpdateTombstone method.
+	UpdateTombstoneFunc func(ctx context.Context, key string, u store.TombstoneUpdate) error
+
 	// calls tracks calls to the methods.
 	calls struct {
 		// Close holds details about calls to the Close method.
 		Close []struct {
 		}
+		// Consume holds details about calls to the Consume method.
+		Consume []struct {
+			// Ctx is the ctx argument value.
+			Ctx context.Context
+			// Key is the key argument value.
+			Key string
+			// Verify is the verify argument value.
+			Verify func(msg *store.Message) error
+		}
 		// IncErr holds details about calls to the IncErr method.
 		IncErr []struct {
 			// Ctx is the ctx argument value.
@@ -69,6 +114,11 @@ type EngineMock struct {
 			// Key is the key argument value.
 			Key string
 		}
+		// Keys holds details about calls to the Keys method.
+		Keys []struct {
+			// Ctx is the ctx argument value.
+			Ctx context.Context
+		}
 		// Load holds details about calls to the Load method.
 		Load []struct {
 			// Ctx is the ctx argument value.
@@ -76,6 +126,13 @@ type EngineMock struct {
 			// Key is the key argument value.
 			Key string
 		}
+		// LoadTombstone holds details about calls to the LoadTombstone method.
+		LoadTombstone []struct {
+			// Ctx is the ctx argument value.
+			Ctx context.Context
+			// Key is the key argument value.
+			Key string
+		}
 		// Remove holds details about calls to the Remove method.
 		Remove []struct {
 			// Ctx is the ctx argument value.
@@ -90,12 +147,45 @@ type EngineMock struct {
 			// Msg is the msg argument value.
 			Msg *store.Message
 		}
+		// SaveTombstone holds details about calls to the SaveTombstone method.
+		SaveTombstone []struct {
+			// Ctx is the ctx argument value.
+			Ctx context.Context
+			// T is the t argument value.
+			T *store.Tombstone
+		}
+		// UpdateData holds details about calls to the UpdateData method.
+		UpdateData []struct {
+			// Ctx is the ctx argument value.
+			Ctx context.Context
+			// Key is the key argument value.
+			Key string
+			// OldData is the oldData argument value.
+			OldData []byte
+			// NewData is the newData argument value.
+			NewData []byte
+		}
+		// UpdateTombstone holds details about calls to the UpdateTombstone method.
+		UpdateTombstone []struct {
+			// Ctx is the ctx argument value.
+			Ctx context.Context
+			// Key is the key argument value.
+			Key string
+			// U is the u argument value.
+			U store.TombstoneUpdate
+		}
 	}
-	lockClose  sync.RWMutex
-	lockIncErr sync.RWMutex
-	lockLoad   sync.RWMutex
-	lockRemove sync.RWMutex
-	lockSave   sync.RWMutex
+	lockClose           sync.RWMutex
+	lockConsume         sync.RWMutex
+	lockIncErr          sync.RWMutex
+	lockKeys            sync.RWMutex
+	lockLoad            sync.RWMutex
+	lockLoadTombstone   sync.RWMutex
+	lockRemove          sync.RWMutex
+	lockSave            sync.RWMutex
+	lockSaveTombstone   sync.RWMutex
+	lockUpdateData      sync.RWMutex
+	lockUpdateTombstone sync.RWMutex
 }
 
 // Close calls CloseFunc.
@@ -125,6 +215,46 @@ func (mock *EngineMock) CloseCalls() []struct {
 	return calls
 }
 
+// Consume calls ConsumeFunc.
+func (mock *EngineMock) Consume(ctx context.Context, key string, verify func(msg *store.Message) error) (*store.Message, error) {
+	if mock.ConsumeFunc == nil {
+		panic("EngineMock.ConsumeFunc: method is nil but Engine.Consume was just called")
+	}
+	callInfo := struct {
+		Ctx    context.Context
+		Key    string
+		Verify func(msg *store.Message) error
+	}{
+		Ctx:    ctx,
+		Key:    key,
+		Verify: verify,
+	}
+	mock.lockConsume.Lock()
+	mock.calls.Consume = append(mock.calls.Consume, callInfo)
+	mock.lockConsume.Unlock()
+	return mock.ConsumeFunc(ctx, key, verify)
+}
+
+// ConsumeCalls gets all the calls that were made to Consume.
+// Check the length with:
+//
+//	len(mockedEngine.ConsumeCalls())
+func (mock *EngineMock) ConsumeCalls() []struct {
+	Ctx    context.Context
+	Key    string
+	Verify func(msg *store.Message) error
+} {
+	var calls []struct {
+		Ctx    context.Context
+		Key    string
+		Verify func(msg *store.Message) error
+	}
+	mock.lockConsume.RLock()
+	calls = mock.calls.Consume
+	mock.lockConsume.RUnlock()
+	return calls
+}
+
 // IncErr calls IncErrFunc.
 func (mock *EngineMock) IncErr(ctx context.Context, key string) (int, error) {
 	if mock.IncErrFunc == nil {
@@ -161,6 +291,38 @@ func (mock *EngineMock) IncErrCalls() []struct {
 	return calls
 }
 
+// Keys calls KeysFunc.
+func (mock *EngineMock) Keys(ctx context.Context) ([]string, error) {
+	if mock.KeysFunc == nil {
+		panic("EngineMock.KeysFunc: method is nil but Engine.Keys was just called")
+	}
+	callInfo := struct {
+		Ctx context.Context
+	}{
+		Ctx: ctx,
+	}
+	mock.lockKeys.Lock()
+	mock.calls.Keys = append(mock.calls.Keys, callInfo)
+	mock.lockKeys.Unlock()
+	return mock.KeysFunc(ctx)
+}
+
+// KeysCalls gets all the calls that were made to Keys.
+// Check the length with:
+//
+//	len(mockedEngine.KeysCalls())
+func (mock *EngineMock) KeysCalls() []struct {
+	Ctx context.Context
+} {
+	var calls []struct {
+		Ctx context.Context
+	}
+	mock.lockKeys.RLock()
+	calls = mock.calls.Keys
+	mock.lockKeys.RUnlock()
+	return calls
+}
+
 // Load calls LoadFunc.
 func (mock *EngineMock) Load(ctx context.Context, key string) (*store.Message, error) {
 	if mock.LoadFunc == nil {
@@ -197,6 +359,42 @@ func (mock *EngineMock) LoadCalls() []struct {
 	return calls
 }
 
+// LoadTombstone calls LoadTombstoneFunc.
+func (mock *EngineMock) LoadTombstone(ctx context.Context, key string) (*store.Tombstone, error) {
+	if mock.LoadTombstoneFunc == nil {
+		panic("EngineMock.LoadTombstoneFunc: method is nil but Engine.LoadTombstone was just called")
+	}
+	callInfo := struct {
+		Ctx context.Context
+		Key string
+	}{
+		Ctx: ctx,
+		Key: key,
+	}
+	mock.lockLoadTombstone.Lock()
+	mock.calls.LoadTombstone = append(mock.calls.LoadTombstone, callInfo)
+	mock.lockLoadTombstone.Unlock()
+	return mock.LoadTombstoneFunc(ctx, key)
+}
+
+// LoadTombstoneCalls gets all the calls that were made to LoadTombstone.
+// Check the length with:
+//
+//	len(mockedEngine.LoadTombstoneCalls())
+func (mock *EngineMock) LoadTombstoneCalls() []struct {
+	Ctx context.Context
+	Key string
+} {
+	var calls []struct {
+		Ctx context.Context
+		Key string
+	}
+	mock.lockLoadTombstone.RLock()
+	calls = mock.calls.LoadTombstone
+	mock.lockLoadTombstone.RUnlock()
+	return calls
+}
+
 // Remove calls RemoveFunc.
 func (mock *EngineMock) Remove(ctx context.Context, key string) error {
 	if mock.RemoveFunc == nil {
@@ -268,3 +466,123 @@ func (mock *EngineMock) SaveCalls() []struct {
 	mock.lockSave.RUnlock()
 	return calls
 }
+
+// SaveTombstone calls SaveTombstoneFunc.
+func (mock *EngineMock) SaveTombstone(ctx context.Context, t *store.Tombstone) error {
+	if mock.SaveTombstoneFunc == nil {
+		panic("EngineMock.SaveTombstoneFunc: method is nil but Engine.SaveTombstone was just called")
+	}
+	callInfo := struct {
+		Ctx context.Context
+		T   *store.Tombstone
+	}{
+		Ctx: ctx,
+		T:   t,
+	}
+	mock.lockSaveTombstone.Lock()
+	mock.calls.SaveTombstone = append(mock.calls.SaveTombstone, callInfo)
+	mock.lockSaveTombstone.Unlock()
+	return mock.SaveTombstoneFunc(ctx, t)
+}
+
+// SaveTombstoneCalls gets all the calls that were made to SaveTombstone.
+// Check the length with:
+//
+//	len(mockedEngine.SaveTombstoneCalls())
+func (mock *EngineMock) SaveTombstoneCalls() []struct {
+	Ctx context.Context
+	T   *store.Tombstone
+} {
+	var calls []struct {
+		Ctx context.Context
+		T   *store.Tombstone
+	}
+	mock.lockSaveTombstone.RLock()
+	calls = mock.calls.SaveTombstone
+	mock.lockSaveTombstone.RUnlock()
+	return calls
+}
+
+// UpdateData calls UpdateDataFunc.
+func (mock *EngineMock) UpdateData(ctx context.Context, key string, oldData []byte, newData []byte) error {
+	if mock.UpdateDataFunc == nil {
+		panic("EngineMock.UpdateDataFunc: method is nil but Engine.UpdateData was just called")
+	}
+	callInfo := struct {
+		Ctx     context.Context
+		Key     string
+		OldData []byte
+		NewData []byte
+	}{
+		Ctx:     ctx,
+		Key:     key,
+		OldData: oldData,
+		NewData: newData,
+	}
+	mock.lockUpdateData.Lock()
+	mock.calls.UpdateData = append(mock.calls.UpdateData, callInfo)
+	mock.lockUpdateData.Unlock()
+	return mock.UpdateDataFunc(ctx, key, oldData, newData)
+}
+
+// UpdateDataCalls gets all the calls that were made to UpdateData.
+// Check the length with:
+//
+//	len(mockedEngine.UpdateDataCalls())
+func (mock *EngineMock) UpdateDataCalls() []struct {
+	Ctx     context.Context
+	Key     string
+	OldData []byte
+	NewData []byte
+} {
+	var calls []struct {
+		Ctx     context.Context
+		Key     string
+		OldData []byte
+		NewData []byte
+	}
+	mock.lockUpdateData.RLock()
+	calls = mock.calls.UpdateData
+	mock.lockUpdateData.RUnlock()
+	return calls
+}
+
+// UpdateTombstone calls UpdateTombstoneFunc.
+func (mock *EngineMock) UpdateTombstone(ctx context.Context, key string, u store.TombstoneUpdate) error {
+	if mock.UpdateTombstoneFunc == nil {
+		panic("EngineMock.UpdateTombstoneFunc: method is nil but Engine.UpdateTombstone was just called")
+	}
+	callInfo := struct {
+		Ctx context.Context
+		Key string
+		U   store.TombstoneUpdate
+	}{
+		Ctx: ctx,
+		Key: key,
+		U:   u,
+	}
+	mock.lockUpdateTombstone.Lock()
+	mock.calls.UpdateTombstone = append(mock.calls.UpdateTombstone, callInfo)
+	mock.lockUpdateTombstone.Unlock()
+	return mock.UpdateTombstoneFunc(ctx, key, u)
+}
+
+// UpdateTombstoneCalls gets all the calls that were made to UpdateTombstone.
+// Check the length with:
+//
+//	len(mockedEngine.UpdateTombstoneCalls())
+func (mock *EngineMock) UpdateTombstoneCalls() []struct {
+	Ctx context.Context
+	Key string
+	U   store.TombstoneUpdate
+} {
+	var calls []struct {
+		Ctx context.Context
+		Key string
+		U   store.TombstoneUpdate
+	}
+	mock.lockUpdateTombstone.RLock()
+	calls = mock.calls.UpdateTombstone
+	mock.lockUpdateTombstone.RUnlock()
+	return calls
+}
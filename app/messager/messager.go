@@ -6,6 +6,11 @@ package messager
 
 import (
 	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"strings"
@@ -15,6 +20,7 @@ import (
 	"golang.org/x/crypto/bcrypt"
 
 	"github.com/umputun/secrets/v2/app/store"
+	"github.com/umputun/secrets/v2/app/webhook"
 )
 
 //go:generate moq -out crypt_mock.go -fmt goimports . Crypter
@@ -31,6 +37,8 @@ var (
 	ErrFileTooLarge   = errors.New("file too large")
 	ErrBadFileName    = errors.New("invalid file name")
 	ErrBadContentType = errors.New("invalid content type")
+	ErrMaxViews       = errors.New("bad max views")
+	ErrBadToken       = errors.New("wrong management token")
 )
 
 // filePrefix marks file messages.
@@ -41,8 +49,9 @@ const filePrefix = "!!FILE!!"
 // MessageProc creates and save messages and retrieve per key
 type MessageProc struct {
 	Params
-	crypt  Crypter
-	engine Engine
+	crypt    Crypter
+	engine   Engine
+	notifier Notifier // optional, nil if lifecycle events not sent out
 }
 
 // Params to customize limits
@@ -50,6 +59,8 @@ type Params struct {
 	MaxDuration    time.Duration
 	MaxPinAttempts int
 	MaxFileSize    int64
+	MaxViews       int           // max allowed views of a single message
+	Retention      time.Duration // how long message status kept after its removal or expiration
 }
 
 // MsgReq contains data for message creation
@@ -57,8 +68,10 @@ type MsgReq struct {
 	Duration      time.Duration
 	Pin           string
 	Message       string
-	ClientEnc     bool // true for client-side encryption (UI), false for server-side (API)
-	AllowEmptyPin bool // true to allow creating messages without PIN protection
+	ClientEnc     bool   // true for client-side encryption (UI), false for server-side (API)
+	AllowEmptyPin bool   // true to allow creating messages without PIN protection
+	MaxViews      int    // successful reads before removal, 0 means single read
+	Callback      string // url notified about the message events, optional
 }
 
 // FileRequest contains data for file message creation
@@ -68,23 +81,67 @@ type FileRequest struct {
 	FileName    string
 	ContentType string
 	Data        []byte
+	MaxViews    int    // successful reads before removal, 0 means single read
+	Callback    string // url notified about the message events, optional
+}
+
+// StatusActive reported for messages not removed yet, other states are from store tombstones
+const StatusActive = "active"
+
+// MsgStatus is non-sensitive lifecycle data of a message reported to the sender
+type MsgStatus struct {
+	Key      string
+	State    string // active, or one of tombstone states: opened, expired, burned, revoked
+	Created  time.Time
+	Exp      time.Time
+	Closed   time.Time // when the message was opened, burned or revoked, zero otherwise
+	Errors   int       // failed pin attempts
+	Views    int
+	MaxViews int
 }
 
 // Crypter interface wraps crypt methods
 type Crypter interface {
 	Encrypt(req Request) (result []byte, err error)
 	Decrypt(req Request) (result []byte, err error)
+	Rewrap(data []byte) (result []byte, rewrapped bool, err error)
 }
 
-// Engine defines interface to save, load, remove and inc errors count for messages
+// Engine defines interface to save, load, consume, remove and inc errors count for messages.
+// Consume must load, verify and remove the message atomically, so a message can't be consumed twice.
+// For a message with views left Consume counts the view instead of removal.
+// Keys and UpdateData used by Rekey, UpdateData must not change message updated or removed meanwhile.
+// Tombstones keep message status after the removal and should be removed by engine after Tombstone.Purge.
+// UpdateTombstone must apply the change atomically, as views and wrong pins of a message may come concurrently.
 type Engine interface {
 	Save(ctx context.Context, msg *store.Message) (err error)
 	Load(ctx context.Context, key string) (result *store.Message, err error)
+	Consume(ctx context.Context, key string, verify func(msg *store.Message) error) (result *store.Message, err error)
 	IncErr(ctx context.Context, key string) (count int, err error)
 	Remove(ctx context.Context, key string) (err error)
+	Keys(ctx context.Context) (keys []string, err error)
+	UpdateData(ctx context.Context, key string, oldData, newData []byte) (err error)
+	SaveTombstone(ctx context.Context, t *store.Tombstone) (err error)
+	LoadTombstone(ctx context.Context, key string) (result *store.Tombstone, err error)
+	UpdateTombstone(ctx context.Context, key string, u store.TombstoneUpdate) (err error)
 	Close() error
 }
 
+// Notifier sends out message lifecycle events, implemented by webhook.Dispatcher.
+// Send must not block, ctx carries the request data like hashed client ip.
+type Notifier interface {
+	Send(ctx context.Context, e webhook.Event)
+}
+
+// RekeyStats reports results of Rekey
+type RekeyStats struct {
+	Total     int // messages found
+	Rewrapped int // re-encrypted under the active sign key
+	Current   int // already under the active sign key
+	Skipped   int // client-side encrypted, made before key ids or consumed while rekeying
+	Failed    int // failed to re-encrypt or update
+}
+
 // New makes MessageProc with the engine and crypt
 func New(engine Engine, crypter Crypter, params Params) *MessageProc {
 	if params.MaxDuration == 0 {
@@ -96,6 +153,12 @@ func New(engine Engine, crypter Crypter, params Params) *MessageProc {
 	if params.MaxFileSize == 0 {
 		params.MaxFileSize = 1024 * 1024 // 1MB default
 	}
+	if params.MaxViews == 0 {
+		params.MaxViews = 1 // single read if nothing defined
+	}
+	if params.Retention == 0 {
+		params.Retention = time.Hour * 24 * 7 // keep status for a week if nothing defined
+	}
 	log.Printf("[INFO] created messager with %+v", params)
 
 	return &MessageProc{
@@ -105,6 +168,12 @@ func New(engine Engine, crypter Crypter, params Params) *MessageProc {
 	}
 }
 
+// WithNotifier sets notifier for message lifecycle events
+func (p *MessageProc) WithNotifier(n Notifier) *MessageProc {
+	p.notifier = n
+	return p
+}
+
 // MakeMessage creates and saves a message from the request.
 // If ClientEnc is true, data is stored as-is (client handles encryption).
 // If ClientEnc is false, data is encrypted server-side with pin.
@@ -129,13 +198,22 @@ func (p MessageProc) MakeMessage(ctx context.Context, req MsgReq) (result *store
 		return nil, ErrDuration
 	}
 
+	maxViews := max(req.MaxViews, 1)
+	if maxViews > p.MaxViews {
+		log.Printf("[WARN] can't use max views, %d > %d", maxViews, p.MaxViews)
+		return nil, ErrMaxViews
+	}
+
 	exp := time.Now().Add(req.Duration)
 	result = &store.Message{
 		Key:       store.GenerateID(),
 		Exp:       exp,
 		PinHash:   pinHash,
 		ClientEnc: req.ClientEnc,
+		MaxViews:  maxViews,
+		Callback:  req.Callback,
 	}
+	result.MgmtToken, result.MgmtHash = makeMgmtToken()
 
 	// client-side encryption: store data as-is
 	if req.ClientEnc {
@@ -150,42 +228,65 @@ func (p MessageProc) MakeMessage(ctx context.Context, req MsgReq) (result *store
 	if err = p.engine.Save(ctx, result); err != nil {
 		return nil, fmt.Errorf("save message: %w", err)
 	}
+	p.saveTombstone(ctx, result)
+	p.notify(ctx, webhook.EventCreated, result)
 	return result, nil
 }
 
-// LoadMessage gets from engine, verifies Message with pin and decrypts content.
-// It also removes accessed messages and invalidate them on multiple wrong pins.
+// LoadMessage consumes Message from engine, verifies it with pin and decrypts content.
+// Verification and removal are done by engine atomically, so only one caller can get the message,
+// or MaxViews callers for a message with multiple views. The message is removed after the last view.
+// It also invalidates messages on multiple wrong pins.
 // Message decrypted by this function will be returned naked to consumer.
 func (p MessageProc) LoadMessage(ctx context.Context, key, pin string) (msg *store.Message, err error) {
-	msg, err = p.engine.Load(ctx, key)
-	if err != nil {
-		return nil, fmt.Errorf("load message: %w", err)
-	}
+	msg, err = p.engine.Consume(ctx, key, func(m *store.Message) error {
+		if time.Now().After(m.Exp) {
+			return ErrExpired
+		}
+		if !p.checkHash(m, pin) {
+			return ErrBadPin
+		}
+		return nil
+	})
 
-	if time.Now().After(msg.Exp) {
+	switch {
+	case errors.Is(err, ErrExpired):
 		log.Printf("[WARN] expired %s on %v", msg.Key, msg.Exp)
 		_ = p.engine.Remove(ctx, key)
+		p.notify(ctx, webhook.EventExpired, msg)
 		return nil, ErrExpired
-	}
-
-	if !p.checkHash(msg, pin) {
+	case errors.Is(err, ErrBadPin):
 		count, e := p.engine.IncErr(ctx, key)
 		if e != nil {
 			return nil, ErrBadPin
 		}
 		log.Printf("[WARN] wrong pin provided for %s (%d times)", key, count)
+		p.notify(ctx, webhook.EventPinFailed, msg)
 		if count >= p.MaxPinAttempts {
 			_ = p.engine.Remove(ctx, key)
+			p.updateTombstone(ctx, key, p.closeTombstone(store.TombstoneUpdate{Errors: count}, store.StateBurned))
+			p.notify(ctx, webhook.EventBurned, msg)
 			return nil, ErrBadPin
 		}
+		p.updateTombstone(ctx, key, store.TombstoneUpdate{Errors: count})
+		if msg != nil {
+			msg.Errors = count // wrong pins so far, to report attempts left
+		}
 		return msg, ErrBadPinAttempt
+	case err != nil:
+		return nil, fmt.Errorf("load message: %w", err)
+	}
+
+	// message already removed by Consume at this point, or its view counted
+	viewed := store.TombstoneUpdate{Views: msg.Views}
+	if msg.ViewsLeft() <= 0 {
+		viewed = p.closeTombstone(viewed, store.StateOpened)
 	}
+	p.updateTombstone(ctx, key, viewed)
+	p.notify(ctx, webhook.EventAccessed, msg)
 
 	// client-side encrypted messages: return data as-is (client handles decryption)
 	if msg.ClientEnc {
-		if rmErr := p.engine.Remove(ctx, key); rmErr != nil {
-			log.Printf("[WARN] failed to remove, %v", rmErr)
-		}
 		return msg, nil
 	}
 
@@ -201,14 +302,9 @@ func (p MessageProc) LoadMessage(ctx context.Context, key, pin string) (msg *sto
 	r, err := p.crypt.Decrypt(Request{Data: dataToDecrypt, Pin: pin})
 	if err != nil {
 		log.Printf("[WARN] can't decrypt, %v", err)
-		_ = p.engine.Remove(ctx, key)
 		return nil, ErrBadPin
 	}
 
-	if err := p.engine.Remove(ctx, key); err != nil {
-		log.Printf("[WARN] failed to remove, %v", err)
-	}
-
 	// for file messages, prepend !!FILE!! to decrypted result for ParseFileHeader compatibility
 	// decrypted result is: filename!!content-type!!\n<binary>
 	if isFile {
@@ -240,6 +336,109 @@ func (p MessageProc) makeHash(pin string) (result string, err error) {
 	return string(hashedPin), nil
 }
 
+// Revoke removes the message before its expiration. It is authorized by the management token
+// returned on creation, messages made without the token can't be revoked.
+func (p MessageProc) Revoke(ctx context.Context, key, token string) error {
+	msg, err := p.engine.Load(ctx, key)
+	if err != nil {
+		return fmt.Errorf("load message: %w", err)
+	}
+	if !validToken(msg.MgmtHash, token) {
+		log.Printf("[WARN] revoke rejected for %s, wrong management token", key)
+		return ErrBadToken
+	}
+	if err = p.engine.Remove(ctx, key); err != nil {
+		return fmt.Errorf("remove message: %w", err)
+	}
+	p.updateTombstone(ctx, key, p.closeTombstone(store.TombstoneUpdate{}, store.StateRevoked))
+	log.Printf("[INFO] revoked %s", key)
+	return nil
+}
+
+// Status returns lifecycle data of the message, authorized by the management token returned on creation.
+// It is available while the message exists and for Retention after it was removed or expired.
+func (p MessageProc) Status(ctx context.Context, key, token string) (*MsgStatus, error) {
+	t, err := p.engine.LoadTombstone(ctx, key)
+	if err != nil {
+		return nil, fmt.Errorf("load status: %w", err)
+	}
+	if !validToken(t.MgmtHash, token) {
+		log.Printf("[WARN] status rejected for %s, wrong management token", key)
+		return nil, ErrBadToken
+	}
+
+	res := &MsgStatus{Key: t.Key, State: t.State, Created: t.Created, Exp: t.Exp, Closed: t.Closed,
+		Errors: t.Errors, Views: t.Views, MaxViews: t.MaxViews}
+	if msg, err := p.engine.Load(ctx, key); err == nil && time.Now().Before(msg.Exp) {
+		res.State, res.Errors, res.Views = StatusActive, msg.Errors, msg.Views
+	}
+	return res, nil
+}
+
+// saveTombstone records status of the just created message. Its state is expired from the start, so a message
+// removed by engine on expiration leaves the right status without any further updates.
+// Failure is not critical for the message itself and only logged.
+func (p MessageProc) saveTombstone(ctx context.Context, msg *store.Message) {
+	t := store.Tombstone{Key: msg.Key, MgmtHash: msg.MgmtHash, State: store.StateExpired, Created: time.Now(),
+		Exp: msg.Exp, Purge: msg.Exp.Add(p.Retention), MaxViews: max(msg.MaxViews, 1)}
+	if err := p.engine.SaveTombstone(ctx, &t); err != nil {
+		log.Printf("[WARN] can't save status of %s, %v", msg.Key, err)
+	}
+}
+
+// updateTombstone changes the message status. Engine applies the change atomically, so concurrent views
+// and wrong pins can't overwrite each other. Messages made before tombstones have no status and skipped.
+func (p MessageProc) updateTombstone(ctx context.Context, key string, u store.TombstoneUpdate) {
+	if err := p.engine.UpdateTombstone(ctx, key, u); err != nil && !errors.Is(err, store.ErrLoadRejected) {
+		log.Printf("[WARN] can't update status of %s, %v", key, err)
+	}
+}
+
+// closeTombstone adds the final state of removed message to the update, the status is kept for Retention from now
+func (p MessageProc) closeTombstone(u store.TombstoneUpdate, state string) store.TombstoneUpdate {
+	u.State, u.Closed = state, time.Now()
+	u.Purge = u.Closed.Add(p.Retention)
+	return u
+}
+
+// NotifyExpired sends expired event for the message removed by engine cleanup, set as the engine's expired hook
+func (p MessageProc) NotifyExpired(msg *store.Message) {
+	p.notify(context.Background(), webhook.EventExpired, msg)
+}
+
+// notify sends lifecycle event of the message if notifier set
+func (p MessageProc) notify(ctx context.Context, eventType string, msg *store.Message) {
+	if p.notifier == nil || msg == nil {
+		return
+	}
+	p.notifier.Send(ctx, webhook.Event{Type: eventType, Key: msg.Key, Exp: msg.Exp, Callback: msg.Callback})
+}
+
+// validToken checks the management token against its stored hash, messages without the hash can't be managed
+func validToken(hash, token string) bool {
+	if hash == "" || token == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(hash), []byte(mgmtHash(token))) == 1
+}
+
+// makeMgmtToken generates a random management token and its hash.
+// The token is random enough to be hashed with plain sha256, no need for bcrypt here.
+func makeMgmtToken() (token, hash string) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic("crypto/rand failed: " + err.Error())
+	}
+	token = base64.RawURLEncoding.EncodeToString(b)
+	return token, mgmtHash(token)
+}
+
+// mgmtHash returns hex-encoded sha256 of the management token
+func mgmtHash(token string) string {
+	h := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(h[:])
+}
+
 // IsFile checks if a message with given key is a file message (without decrypting).
 // Returns false if message doesn't exist, is not a file, or is client-encrypted.
 // For client-encrypted messages, server can't inspect the opaque blob.
@@ -265,6 +464,60 @@ func (p MessageProc) HasPin(ctx context.Context, key string) (bool, error) {
 	return msg.PinHash != "", nil
 }
 
+// Rekey re-encrypts all stored server-side encrypted messages under the active sign key.
+// Only the sign key layer is replaced, so no pin needed. Messages made before key ids can't be
+// re-encrypted and skipped, they stay readable as long as their sign key is in the keyring.
+func (p MessageProc) Rekey(ctx context.Context) (RekeyStats, error) {
+	keys, err := p.engine.Keys(ctx)
+	if err != nil {
+		return RekeyStats{}, fmt.Errorf("list messages: %w", err)
+	}
+
+	stats := RekeyStats{Total: len(keys)}
+	for _, key := range keys {
+		if ctx.Err() != nil {
+			return stats, ctx.Err()
+		}
+		msg, err := p.engine.Load(ctx, key)
+		if err != nil || msg.ClientEnc {
+			stats.Skipped++ // consumed meanwhile or client-side encrypted, server has no sign key layer there
+			continue
+		}
+
+		// file prefix is not encrypted, rewrap the blob after it
+		prefix, blob := "", msg.Data
+		if IsFileMessage(msg.Data) {
+			prefix, blob = filePrefix, msg.Data[len(filePrefix):]
+		}
+
+		rewrapped, ok, err := p.crypt.Rewrap(blob)
+		switch {
+		case errors.Is(err, ErrNoRewrap):
+			stats.Skipped++
+			continue
+		case err != nil:
+			log.Printf("[WARN] can't rekey %s, %v", key, err)
+			stats.Failed++
+			continue
+		case !ok:
+			stats.Current++
+			continue
+		}
+
+		err = p.engine.UpdateData(ctx, key, msg.Data, append([]byte(prefix), rewrapped...))
+		switch {
+		case errors.Is(err, store.ErrLoadRejected):
+			stats.Skipped++ // consumed or removed meanwhile
+		case err != nil:
+			log.Printf("[WARN] can't update %s, %v", key, err)
+			stats.Failed++
+		default:
+			stats.Rewrapped++
+		}
+	}
+	return stats, nil
+}
+
 // MakeFileMessage creates a message from file data with unencrypted prefix for metadata.
 // Format: !!FILE!!filename!!content-type!!\n<encrypted binary>
 // This function is for API file uploads only (server-side encryption).
@@ -298,6 +551,12 @@ func (p MessageProc) MakeFileMessage(ctx context.Context, req FileRequest) (resu
 		return nil, ErrDuration
 	}
 
+	maxViews := max(req.MaxViews, 1)
+	if maxViews > p.MaxViews {
+		log.Printf("[WARN] can't use max views, %d > %d", maxViews, p.MaxViews)
+		return nil, ErrMaxViews
+	}
+
 	pinHash, err := p.makeHash(req.Pin)
 	if err != nil {
 		log.Printf("[ERROR] can't hash pin, %v", err)
@@ -321,14 +580,19 @@ func (p MessageProc) MakeFileMessage(ctx context.Context, req FileRequest) (resu
 
 	exp := time.Now().Add(req.Duration)
 	result = &store.Message{
-		Key:     store.GenerateID(),
-		Exp:     exp,
-		PinHash: pinHash,
-		Data:    fullData,
-	}
+		Key:      store.GenerateID(),
+		Exp:      exp,
+		PinHash:  pinHash,
+		Data:     fullData,
+		MaxViews: maxViews,
+		Callback: req.Callback,
+	}
+	result.MgmtToken, result.MgmtHash = makeMgmtToken()
 	if err = p.engine.Save(ctx, result); err != nil {
 		return nil, fmt.Errorf("save file message: %w", err)
 	}
+	p.saveTombstone(ctx, result)
+	p.notify(ctx, webhook.EventCreated, result)
 	return result, nil
 }
 
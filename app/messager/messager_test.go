@@ -3,7 +3,9 @@ package messager
 import (
 	"context"
 	"errors"
+	"fmt"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -11,6 +13,7 @@ import (
 	"github.com/stretchr/testify/require"
 
 	"github.com/umputun/secrets/v2/app/store"
+	"github.com/umputun/secrets/v2/app/webhook"
 )
 
 func TestMessageProc_NewDefault(t *testing.T) {
@@ -22,6 +25,7 @@ func TestMessageProc_NewDefault(t *testing.T) {
 
 func TestMessageProc_MakeMessage(t *testing.T) {
 	s := &EngineMock{
+		SaveTombstoneFunc: func(ctx context.Context, t *store.Tombstone) error { return nil },
 		SaveFunc: func(ctx context.Context, msg *store.Message) error {
 			return nil
 		},
@@ -41,12 +45,14 @@ func TestMessageProc_MakeMessage(t *testing.T) {
 	assert.Contains(t, r.PinHash, "$2a$")
 
 	assert.Len(t, s.SaveCalls(), 1)
+	assert.Len(t, s.SaveTombstoneCalls(), 1)
 	assert.Len(t, c.EncryptCalls(), 1)
 }
 
 func TestMessageProc_MakeMessage_EmptyPinAllowed(t *testing.T) {
 	s := &EngineMock{
-		SaveFunc: func(ctx context.Context, msg *store.Message) error { return nil },
+		SaveTombstoneFunc: func(ctx context.Context, t *store.Tombstone) error { return nil },
+		SaveFunc:          func(ctx context.Context, msg *store.Message) error { return nil },
 	}
 	c := &CrypterMock{
 		EncryptFunc: func(req Request) ([]byte, error) { return []byte("encrypted blah"), nil },
@@ -148,7 +154,10 @@ func TestMessageProc_MakeMessage_CrypterError(t *testing.T) {
 
 func TestMessageProc_LoadMessage_Err(t *testing.T) {
 	s := &EngineMock{
-		LoadFunc: func(ctx context.Context, key string) (*store.Message, error) {
+		UpdateTombstoneFunc: func(ctx context.Context, key string, u store.TombstoneUpdate) error {
+			return store.ErrLoadRejected // message made before tombstones
+		},
+		ConsumeFunc: func(ctx context.Context, key string, verify func(msg *store.Message) error) (*store.Message, error) {
 			return nil, errors.New("load error")
 		},
 	}
@@ -160,7 +169,7 @@ func TestMessageProc_LoadMessage_Err(t *testing.T) {
 
 	require.ErrorContains(t, err, "load error")
 
-	assert.Len(t, s.LoadCalls(), 1)
+	assert.Len(t, s.ConsumeCalls(), 1)
 	assert.Empty(t, s.RemoveCalls())
 	assert.Empty(t, s.IncErrCalls())
 	assert.Empty(t, c.DecryptCalls())
@@ -168,13 +177,14 @@ func TestMessageProc_LoadMessage_Err(t *testing.T) {
 
 func TestMessageProc_LoadMessage_ExpiredErr(t *testing.T) {
 	s := &EngineMock{
-		LoadFunc: func(ctx context.Context, key string) (*store.Message, error) {
-			return &store.Message{
-				Data:    []byte("data"),
-				PinHash: "some-hash",
-				Exp:     time.Now().Add(-1 * time.Minute),
-			}, nil
+		UpdateTombstoneFunc: func(ctx context.Context, key string, u store.TombstoneUpdate) error {
+			return store.ErrLoadRejected // message made before tombstones
 		},
+		ConsumeFunc: consumeFunc(&store.Message{
+			Data:    []byte("data"),
+			PinHash: "some-hash",
+			Exp:     time.Now().Add(-1 * time.Minute),
+		}),
 		RemoveFunc: func(ctx context.Context, key string) error {
 			return nil
 		},
@@ -188,7 +198,7 @@ func TestMessageProc_LoadMessage_ExpiredErr(t *testing.T) {
 
 	require.EqualError(t, err, "message expired")
 
-	assert.Len(t, s.LoadCalls(), 1)
+	assert.Len(t, s.ConsumeCalls(), 1)
 	assert.Len(t, s.RemoveCalls(), 1)
 	assert.Empty(t, s.IncErrCalls())
 	assert.Empty(t, c.DecryptCalls())
@@ -196,13 +206,14 @@ func TestMessageProc_LoadMessage_ExpiredErr(t *testing.T) {
 
 func TestMessageProc_LoadMessage_BadPin(t *testing.T) {
 	s := &EngineMock{
-		LoadFunc: func(ctx context.Context, key string) (*store.Message, error) {
-			return &store.Message{
-				Data:    []byte("data"),
-				PinHash: "some-hash",
-				Exp:     time.Now().Add(1 * time.Minute),
-			}, nil
+		UpdateTombstoneFunc: func(ctx context.Context, key string, u store.TombstoneUpdate) error {
+			return store.ErrLoadRejected // message made before tombstones
 		},
+		ConsumeFunc: consumeFunc(&store.Message{
+			Data:    []byte("data"),
+			PinHash: "some-hash",
+			Exp:     time.Now().Add(1 * time.Minute),
+		}),
 
 		IncErrFunc: func(ctx context.Context, key string) (int, error) {
 			return 0, errors.New("inc error")
@@ -217,7 +228,7 @@ func TestMessageProc_LoadMessage_BadPin(t *testing.T) {
 
 	require.EqualError(t, err, "wrong pin")
 
-	assert.Len(t, s.LoadCalls(), 1)
+	assert.Len(t, s.ConsumeCalls(), 1)
 	assert.Empty(t, s.RemoveCalls())
 	assert.Len(t, s.IncErrCalls(), 1)
 	assert.Empty(t, c.DecryptCalls())
@@ -225,13 +236,14 @@ func TestMessageProc_LoadMessage_BadPin(t *testing.T) {
 
 func TestMessageProc_LoadMessage_BadPin_MaxAttempts(t *testing.T) {
 	s := &EngineMock{
-		LoadFunc: func(ctx context.Context, key string) (*store.Message, error) {
-			return &store.Message{
-				Data:    []byte("data"),
-				PinHash: "some-hash",
-				Exp:     time.Now().Add(1 * time.Minute),
-			}, nil
+		UpdateTombstoneFunc: func(ctx context.Context, key string, u store.TombstoneUpdate) error {
+			return store.ErrLoadRejected // message made before tombstones
 		},
+		ConsumeFunc: consumeFunc(&store.Message{
+			Data:    []byte("data"),
+			PinHash: "some-hash",
+			Exp:     time.Now().Add(1 * time.Minute),
+		}),
 		RemoveFunc: func(ctx context.Context, key string) error {
 			return nil
 		},
@@ -249,7 +261,7 @@ func TestMessageProc_LoadMessage_BadPin_MaxAttempts(t *testing.T) {
 
 	require.EqualError(t, err, "wrong pin")
 
-	assert.Len(t, s.LoadCalls(), 1)
+	assert.Len(t, s.ConsumeCalls(), 1)
 	assert.Len(t, s.RemoveCalls(), 1)
 	assert.Len(t, s.IncErrCalls(), 1)
 	assert.Empty(t, c.DecryptCalls())
@@ -263,9 +275,10 @@ func TestMessageProc_LoadMessage_BadPinAttempt(t *testing.T) {
 	}
 
 	s := &EngineMock{
-		LoadFunc: func(ctx context.Context, key string) (*store.Message, error) {
-			return msg, nil
+		UpdateTombstoneFunc: func(ctx context.Context, key string, u store.TombstoneUpdate) error {
+			return store.ErrLoadRejected // message made before tombstones
 		},
+		ConsumeFunc: consumeFunc(msg),
 		IncErrFunc: func(ctx context.Context, key string) (int, error) {
 			return 1, nil
 		},
@@ -281,7 +294,7 @@ func TestMessageProc_LoadMessage_BadPinAttempt(t *testing.T) {
 
 	assert.Equal(t, r, msg)
 
-	assert.Len(t, s.LoadCalls(), 1)
+	assert.Len(t, s.ConsumeCalls(), 1)
 	assert.Empty(t, s.RemoveCalls())
 	assert.Len(t, s.IncErrCalls(), 1)
 	assert.Empty(t, c.DecryptCalls())
@@ -289,16 +302,14 @@ func TestMessageProc_LoadMessage_BadPinAttempt(t *testing.T) {
 
 func TestMessageProc_LoadMessage_DecryptError(t *testing.T) {
 	s := &EngineMock{
-		LoadFunc: func(ctx context.Context, key string) (*store.Message, error) {
-			return &store.Message{
-				Data:    []byte("data"),
-				PinHash: "$2a$10$2d9OIFG2.zuVIiZznlpy/uJoTl4quQPbDSFnHbi0LuYDILuxHYkDu",
-				Exp:     time.Now().Add(1 * time.Minute),
-			}, nil
-		},
-		RemoveFunc: func(ctx context.Context, key string) error {
-			return nil
+		UpdateTombstoneFunc: func(ctx context.Context, key string, u store.TombstoneUpdate) error {
+			return store.ErrLoadRejected // message made before tombstones
 		},
+		ConsumeFunc: consumeFunc(&store.Message{
+			Data:    []byte("data"),
+			PinHash: "$2a$10$2d9OIFG2.zuVIiZznlpy/uJoTl4quQPbDSFnHbi0LuYDILuxHYkDu",
+			Exp:     time.Now().Add(1 * time.Minute),
+		}),
 	}
 
 	c := &CrypterMock{
@@ -313,24 +324,22 @@ func TestMessageProc_LoadMessage_DecryptError(t *testing.T) {
 
 	require.EqualError(t, err, "wrong pin")
 
-	assert.Len(t, s.LoadCalls(), 1)
-	assert.Len(t, s.RemoveCalls(), 1)
+	assert.Len(t, s.ConsumeCalls(), 1)
+	assert.Empty(t, s.RemoveCalls(), "message removed by Consume")
 	assert.Empty(t, s.IncErrCalls())
 	assert.Len(t, c.DecryptCalls(), 1)
 }
 
 func TestMessageProc_LoadMessage(t *testing.T) {
 	s := &EngineMock{
-		LoadFunc: func(ctx context.Context, key string) (*store.Message, error) {
-			return &store.Message{
-				Data:    []byte("data"),
-				PinHash: "$2a$10$2d9OIFG2.zuVIiZznlpy/uJoTl4quQPbDSFnHbi0LuYDILuxHYkDu",
-				Exp:     time.Now().Add(1 * time.Minute),
-			}, nil
-		},
-		RemoveFunc: func(ctx context.Context, key string) error {
-			return nil
+		UpdateTombstoneFunc: func(ctx context.Context, key string, u store.TombstoneUpdate) error {
+			return store.ErrLoadRejected // message made before tombstones
 		},
+		ConsumeFunc: consumeFunc(&store.Message{
+			Data:    []byte("data"),
+			PinHash: "$2a$10$2d9OIFG2.zuVIiZznlpy/uJoTl4quQPbDSFnHbi0LuYDILuxHYkDu",
+			Exp:     time.Now().Add(1 * time.Minute),
+		}),
 	}
 
 	c := &CrypterMock{
@@ -348,23 +357,23 @@ func TestMessageProc_LoadMessage(t *testing.T) {
 	assert.Equal(t, 0, r.Errors)
 	assert.Contains(t, r.PinHash, "$2a$")
 
-	assert.Len(t, s.LoadCalls(), 1)
-	assert.Len(t, s.RemoveCalls(), 1)
+	assert.Len(t, s.ConsumeCalls(), 1)
+	assert.Empty(t, s.RemoveCalls(), "message removed by Consume")
 	assert.Empty(t, s.IncErrCalls())
 	assert.Len(t, c.DecryptCalls(), 1)
 }
 
 func TestMessageProc_LoadMessage_NoPinMessage(t *testing.T) {
 	s := &EngineMock{
-		LoadFunc: func(ctx context.Context, key string) (*store.Message, error) {
-			return &store.Message{
-				Data:      []byte("client-encrypted-blob"),
-				PinHash:   "", // no PIN
-				Exp:       time.Now().Add(1 * time.Minute),
-				ClientEnc: true,
-			}, nil
+		UpdateTombstoneFunc: func(ctx context.Context, key string, u store.TombstoneUpdate) error {
+			return store.ErrLoadRejected // message made before tombstones
 		},
-		RemoveFunc: func(ctx context.Context, key string) error { return nil },
+		ConsumeFunc: consumeFunc(&store.Message{
+			Data:      []byte("client-encrypted-blob"),
+			PinHash:   "", // no PIN
+			Exp:       time.Now().Add(1 * time.Minute),
+			ClientEnc: true,
+		}),
 	}
 	c := &CrypterMock{}
 
@@ -374,21 +383,22 @@ func TestMessageProc_LoadMessage_NoPinMessage(t *testing.T) {
 	require.NoError(t, err)
 	assert.Equal(t, "client-encrypted-blob", string(r.Data))
 	assert.Empty(t, r.PinHash)
-	assert.Len(t, s.LoadCalls(), 1)
-	assert.Len(t, s.RemoveCalls(), 1)
+	assert.Len(t, s.ConsumeCalls(), 1)
+	assert.Empty(t, s.RemoveCalls(), "message removed by Consume")
 	assert.Empty(t, c.DecryptCalls(), "no decryption for client-enc")
 }
 
 func TestMessageProc_LoadMessage_NoPinMessage_WithPinProvided(t *testing.T) {
 	s := &EngineMock{
-		LoadFunc: func(ctx context.Context, key string) (*store.Message, error) {
-			return &store.Message{
-				Data:      []byte("client-encrypted-blob"),
-				PinHash:   "", // no PIN stored
-				Exp:       time.Now().Add(1 * time.Minute),
-				ClientEnc: true,
-			}, nil
+		UpdateTombstoneFunc: func(ctx context.Context, key string, u store.TombstoneUpdate) error {
+			return store.ErrLoadRejected // message made before tombstones
 		},
+		ConsumeFunc: consumeFunc(&store.Message{
+			Data:      []byte("client-encrypted-blob"),
+			PinHash:   "", // no PIN stored
+			Exp:       time.Now().Add(1 * time.Minute),
+			ClientEnc: true,
+		}),
 		IncErrFunc: func(ctx context.Context, key string) (int, error) { return 1, nil },
 	}
 	c := &CrypterMock{}
@@ -400,6 +410,43 @@ func TestMessageProc_LoadMessage_NoPinMessage_WithPinProvided(t *testing.T) {
 	assert.Len(t, s.IncErrCalls(), 1)
 }
 
+func TestMessageProc_LoadMessage_Concurrent(t *testing.T) {
+	eng := store.NewInMemory(time.Minute)
+	defer eng.Close()
+	m := New(eng, Crypt{Key: "123456789012345678901234567"}, Params{MaxPinAttempts: 3, MaxDuration: time.Hour})
+
+	for _, clientEnc := range []bool{false, true} {
+		t.Run(fmt.Sprintf("client_enc=%v", clientEnc), func(t *testing.T) {
+			msg, err := m.MakeMessage(t.Context(), MsgReq{Duration: time.Minute, Message: "read once", Pin: "12345", ClientEnc: clientEnc})
+			require.NoError(t, err)
+
+			const numGoroutines = 20
+			var wg sync.WaitGroup
+			var mu sync.Mutex
+			var results []string
+			failed := 0
+			wg.Add(numGoroutines)
+			for range numGoroutines {
+				go func() {
+					defer wg.Done()
+					r, err := m.LoadMessage(t.Context(), msg.Key, "12345")
+					mu.Lock()
+					defer mu.Unlock()
+					if err != nil {
+						failed++
+						return
+					}
+					results = append(results, string(r.Data))
+				}()
+			}
+			wg.Wait()
+
+			assert.Equal(t, []string{"read once"}, results, "exactly one retrieval should succeed")
+			assert.Equal(t, numGoroutines-1, failed)
+		})
+	}
+}
+
 func TestMessageProc_HasPin(t *testing.T) {
 	tests := []struct {
 		name    string
@@ -437,7 +484,8 @@ func TestMessageProc_HasPin(t *testing.T) {
 
 func TestMessageProc_MakeFileMessage(t *testing.T) {
 	s := &EngineMock{
-		SaveFunc: func(ctx context.Context, msg *store.Message) error { return nil },
+		SaveTombstoneFunc: func(ctx context.Context, t *store.Tombstone) error { return nil },
+		SaveFunc:          func(ctx context.Context, msg *store.Message) error { return nil },
 	}
 	c := &CrypterMock{
 		EncryptFunc: func(req Request) ([]byte, error) { return []byte("encrypted-blob"), nil },
@@ -472,6 +520,12 @@ func TestMessageProc_MakeFileMessage(t *testing.T) {
 	assert.Contains(t, encryptInput, "file content")
 
 	assert.Len(t, s.SaveCalls(), 1)
+	assert.Equal(t, 1, r.MaxViews, "single read by default")
+
+	r, err = m.MakeFileMessage(t.Context(), FileRequest{Duration: time.Second * 30, Pin: "12345", FileName: "test.pdf",
+		Data: []byte("file content"), MaxViews: 1, Callback: "https://example.com/hook"})
+	require.NoError(t, err)
+	assert.Equal(t, "https://example.com/hook", r.Callback)
 }
 
 func TestMessageProc_LoadFileMessage(t *testing.T) {
@@ -480,14 +534,14 @@ func TestMessageProc_LoadFileMessage(t *testing.T) {
 	storedData := []byte("!!FILE!!encrypted-blob")
 
 	s := &EngineMock{
-		LoadFunc: func(ctx context.Context, key string) (*store.Message, error) {
-			return &store.Message{
-				Data:    storedData,
-				PinHash: "$2a$10$2d9OIFG2.zuVIiZznlpy/uJoTl4quQPbDSFnHbi0LuYDILuxHYkDu",
-				Exp:     time.Now().Add(1 * time.Minute),
-			}, nil
+		UpdateTombstoneFunc: func(ctx context.Context, key string, u store.TombstoneUpdate) error {
+			return store.ErrLoadRejected // message made before tombstones
 		},
-		RemoveFunc: func(ctx context.Context, key string) error { return nil },
+		ConsumeFunc: consumeFunc(&store.Message{
+			Data:    storedData,
+			PinHash: "$2a$10$2d9OIFG2.zuVIiZznlpy/uJoTl4quQPbDSFnHbi0LuYDILuxHYkDu",
+			Exp:     time.Now().Add(1 * time.Minute),
+		}),
 	}
 
 	c := &CrypterMock{
@@ -513,8 +567,8 @@ func TestMessageProc_LoadFileMessage(t *testing.T) {
 	assert.Equal(t, "application/pdf", contentType)
 	assert.Equal(t, "file binary content", string(r.Data[dataStart:]))
 
-	assert.Len(t, s.LoadCalls(), 1)
-	assert.Len(t, s.RemoveCalls(), 1)
+	assert.Len(t, s.ConsumeCalls(), 1)
+	assert.Empty(t, s.RemoveCalls(), "message removed by Consume")
 	assert.Len(t, c.DecryptCalls(), 1)
 }
 
@@ -537,6 +591,7 @@ func TestMessageProc_MakeFileMessage_Errors(t *testing.T) {
 		{name: "filename with tab", req: FileRequest{Duration: time.Second, Pin: "123", FileName: "test\tfile.txt", ContentType: "text/plain", Data: []byte("x")}, wantErr: ErrBadFileName},
 		{name: "file too large", req: FileRequest{Duration: time.Second, Pin: "123", FileName: "f.txt", ContentType: "text/plain", Data: make([]byte, 2048)}, wantErr: ErrFileTooLarge},
 		{name: "bad duration", req: FileRequest{Duration: time.Hour, Pin: "123", FileName: "f.txt", ContentType: "text/plain", Data: []byte("x")}, wantErr: ErrDuration},
+		{name: "max views above limit", req: FileRequest{Duration: time.Second, Pin: "123", FileName: "f.txt", ContentType: "text/plain", Data: []byte("x"), MaxViews: 2}, wantErr: ErrMaxViews},
 		{name: "content-type with delimiter", req: FileRequest{Duration: time.Second, Pin: "123", FileName: "f.txt", ContentType: "text/plain!!", Data: []byte("x")}, wantErr: ErrBadContentType},
 		{name: "content-type with newline", req: FileRequest{Duration: time.Second, Pin: "123", FileName: "f.txt", ContentType: "text/plain\n", Data: []byte("x")}, wantErr: ErrBadContentType},
 		{name: "content-type with carriage return", req: FileRequest{Duration: time.Second, Pin: "123", FileName: "f.txt", ContentType: "text/plain\r", Data: []byte("x")}, wantErr: ErrBadContentType},
@@ -570,7 +625,8 @@ func TestMessageProc_MakeFileMessage_CrypterError(t *testing.T) {
 
 func TestMessageProc_MakeFileMessage_SaveError(t *testing.T) {
 	s := &EngineMock{
-		SaveFunc: func(ctx context.Context, msg *store.Message) error { return errors.New("storage error") },
+		SaveTombstoneFunc: func(ctx context.Context, t *store.Tombstone) error { return nil },
+		SaveFunc:          func(ctx context.Context, msg *store.Message) error { return errors.New("storage error") },
 	}
 	c := &CrypterMock{
 		EncryptFunc: func(req Request) ([]byte, error) { return []byte("encrypted"), nil },
@@ -671,7 +727,8 @@ func TestParseFileHeader(t *testing.T) {
 
 func TestMessageProc_MakeMessage_ClientEnc(t *testing.T) {
 	s := &EngineMock{
-		SaveFunc: func(ctx context.Context, msg *store.Message) error { return nil },
+		SaveTombstoneFunc: func(ctx context.Context, t *store.Tombstone) error { return nil },
+		SaveFunc:          func(ctx context.Context, msg *store.Message) error { return nil },
 	}
 	c := &CrypterMock{
 		EncryptFunc: func(req Request) ([]byte, error) {
@@ -693,7 +750,8 @@ func TestMessageProc_MakeMessage_ClientEnc(t *testing.T) {
 
 func TestMessageProc_MakeMessage_ServerEnc(t *testing.T) {
 	s := &EngineMock{
-		SaveFunc: func(ctx context.Context, msg *store.Message) error { return nil },
+		SaveTombstoneFunc: func(ctx context.Context, t *store.Tombstone) error { return nil },
+		SaveFunc:          func(ctx context.Context, msg *store.Message) error { return nil },
 	}
 	c := &CrypterMock{
 		EncryptFunc: func(req Request) ([]byte, error) {
@@ -714,16 +772,16 @@ func TestMessageProc_MakeMessage_ServerEnc(t *testing.T) {
 func TestMessageProc_LoadMessage_ClientEnc(t *testing.T) {
 	storedData := []byte("client-encrypted-blob")
 	s := &EngineMock{
-		LoadFunc: func(ctx context.Context, key string) (*store.Message, error) {
-			return &store.Message{
-				Key:       "test-key",
-				Data:      storedData,
-				PinHash:   "$2a$10$2d9OIFG2.zuVIiZznlpy/uJoTl4quQPbDSFnHbi0LuYDILuxHYkDu", // hash of "123456"
-				Exp:       time.Now().Add(1 * time.Minute),
-				ClientEnc: true,
-			}, nil
+		UpdateTombstoneFunc: func(ctx context.Context, key string, u store.TombstoneUpdate) error {
+			return store.ErrLoadRejected // message made before tombstones
 		},
-		RemoveFunc: func(ctx context.Context, key string) error { return nil },
+		ConsumeFunc: consumeFunc(&store.Message{
+			Key:       "test-key",
+			Data:      storedData,
+			PinHash:   "$2a$10$2d9OIFG2.zuVIiZznlpy/uJoTl4quQPbDSFnHbi0LuYDILuxHYkDu", // hash of "123456"
+			Exp:       time.Now().Add(1 * time.Minute),
+			ClientEnc: true,
+		}),
 	}
 	c := &CrypterMock{
 		DecryptFunc: func(req Request) ([]byte, error) {
@@ -737,23 +795,23 @@ func TestMessageProc_LoadMessage_ClientEnc(t *testing.T) {
 
 	require.NoError(t, err)
 	assert.Equal(t, "client-encrypted-blob", string(r.Data), "data should be returned as-is")
-	assert.Len(t, s.LoadCalls(), 1)
-	assert.Len(t, s.RemoveCalls(), 1, "message should still be removed after access")
+	assert.Len(t, s.ConsumeCalls(), 1)
+	assert.Empty(t, s.RemoveCalls(), "message should be removed by Consume, not by separate Remove")
 	assert.Empty(t, c.DecryptCalls(), "decrypt should not be called")
 }
 
 func TestMessageProc_LoadMessage_ServerEnc(t *testing.T) {
 	s := &EngineMock{
-		LoadFunc: func(ctx context.Context, key string) (*store.Message, error) {
-			return &store.Message{
-				Key:       "test-key",
-				Data:      []byte("server-encrypted-data"),
-				PinHash:   "$2a$10$2d9OIFG2.zuVIiZznlpy/uJoTl4quQPbDSFnHbi0LuYDILuxHYkDu", // hash of "123456"
-				Exp:       time.Now().Add(1 * time.Minute),
-				ClientEnc: false,
-			}, nil
+		UpdateTombstoneFunc: func(ctx context.Context, key string, u store.TombstoneUpdate) error {
+			return store.ErrLoadRejected // message made before tombstones
 		},
-		RemoveFunc: func(ctx context.Context, key string) error { return nil },
+		ConsumeFunc: consumeFunc(&store.Message{
+			Key:       "test-key",
+			Data:      []byte("server-encrypted-data"),
+			PinHash:   "$2a$10$2d9OIFG2.zuVIiZznlpy/uJoTl4quQPbDSFnHbi0LuYDILuxHYkDu", // hash of "123456"
+			Exp:       time.Now().Add(1 * time.Minute),
+			ClientEnc: false,
+		}),
 	}
 	c := &CrypterMock{
 		DecryptFunc: func(req Request) ([]byte, error) {
@@ -766,7 +824,369 @@ func TestMessageProc_LoadMessage_ServerEnc(t *testing.T) {
 
 	require.NoError(t, err)
 	assert.Equal(t, "decrypted plaintext", string(r.Data), "data should be decrypted")
-	assert.Len(t, s.LoadCalls(), 1)
-	assert.Len(t, s.RemoveCalls(), 1)
+	assert.Len(t, s.ConsumeCalls(), 1)
+	assert.Empty(t, s.RemoveCalls(), "message removed by Consume")
 	assert.Len(t, c.DecryptCalls(), 1, "decrypt should be called")
 }
+
+// consumeFunc makes ConsumeFunc for EngineMock, verifying msg the same way real engine does
+func consumeFunc(msg *store.Message) func(ctx context.Context, key string, verify func(msg *store.Message) error) (*store.Message, error) {
+	return func(ctx context.Context, key string, verify func(msg *store.Message) error) (*store.Message, error) {
+		return msg, verify(msg)
+	}
+}
+
+func TestMessageProc_Rekey(t *testing.T) {
+	eng := store.NewInMemory(time.Minute)
+	defer eng.Close()
+	ctx := t.Context()
+
+	oldCrypt := Crypt{SignKey: "old-sign-key-1234567890", KeyID: "old"}
+	old := New(eng, oldCrypt, Params{MaxPinAttempts: 3, MaxDuration: time.Hour, MaxFileSize: 1024})
+	text, err := old.MakeMessage(ctx, MsgReq{Duration: time.Minute, Message: "text secret", Pin: "12345"})
+	require.NoError(t, err)
+	file, err := old.MakeFileMessage(ctx, FileRequest{Duration: time.Minute, Pin: "12345", FileName: "a.txt",
+		ContentType: "text/plain", Data: []byte("file secret")})
+	require.NoError(t, err)
+	clientEnc, err := old.MakeMessage(ctx, MsgReq{Duration: time.Minute, Message: "client blob", Pin: "12345", ClientEnc: true})
+	require.NoError(t, err)
+
+	newCrypt := Crypt{SignKey: "new-sign-key-1234567890", KeyID: "new", Retired: map[string]string{"old": oldCrypt.SignKey}}
+	current := New(eng, newCrypt, Params{MaxPinAttempts: 3, MaxDuration: time.Hour, MaxFileSize: 1024})
+	fresh, err := current.MakeMessage(ctx, MsgReq{Duration: time.Minute, Message: "fresh secret", Pin: "12345"})
+	require.NoError(t, err)
+
+	stats, err := current.Rekey(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, RekeyStats{Total: 4, Rewrapped: 2, Current: 1, Skipped: 1}, stats)
+
+	// all server-side messages readable without the retired key now
+	rotated := New(eng, Crypt{SignKey: newCrypt.SignKey, KeyID: "new"}, Params{MaxPinAttempts: 3, MaxDuration: time.Hour})
+	msg, err := rotated.LoadMessage(ctx, text.Key, "12345")
+	require.NoError(t, err)
+	assert.Equal(t, "text secret", string(msg.Data))
+	msg, err = rotated.LoadMessage(ctx, fresh.Key, "12345")
+	require.NoError(t, err)
+	assert.Equal(t, "fresh secret", string(msg.Data))
+	msg, err = rotated.LoadMessage(ctx, file.Key, "12345")
+	require.NoError(t, err)
+	assert.Equal(t, "!!FILE!!a.txt!!text/plain!!\nfile secret", string(msg.Data))
+	msg, err = rotated.LoadMessage(ctx, clientEnc.Key, "12345")
+	require.NoError(t, err)
+	assert.Equal(t, "client blob", string(msg.Data))
+}
+
+func TestMessageProc_Rekey_Errors(t *testing.T) {
+	msgs := map[string]*store.Message{
+		"legacy":   {Key: "legacy", Data: []byte("legacy-blob")},
+		"bad":      {Key: "bad", Data: []byte("bad-blob")},
+		"consumed": {Key: "consumed", Data: []byte("old-blob")},
+		"failed":   {Key: "failed", Data: []byte("old-blob")},
+	}
+	s := &EngineMock{
+		KeysFunc: func(ctx context.Context) ([]string, error) {
+			return []string{"legacy", "bad", "consumed", "failed", "gone"}, nil
+		},
+		LoadFunc: func(ctx context.Context, key string) (*store.Message, error) {
+			if msg, ok := msgs[key]; ok {
+				return msg, nil
+			}
+			return nil, store.ErrLoadRejected
+		},
+		UpdateDataFunc: func(ctx context.Context, key string, oldData, newData []byte) error {
+			if key == "consumed" {
+				return store.ErrLoadRejected
+			}
+			return errors.New("db error")
+		},
+	}
+	c := &CrypterMock{
+		RewrapFunc: func(data []byte) ([]byte, bool, error) {
+			switch string(data) {
+			case "legacy-blob":
+				return nil, false, ErrNoRewrap
+			case "bad-blob":
+				return nil, false, errors.New("unknown key id")
+			default:
+				return []byte("new-blob"), true, nil
+			}
+		},
+	}
+
+	m := New(s, c, Params{})
+	stats, err := m.Rekey(t.Context())
+	require.NoError(t, err)
+	assert.Equal(t, RekeyStats{Total: 5, Skipped: 3, Failed: 2}, stats)
+	require.Len(t, s.UpdateDataCalls(), 2)
+	assert.Equal(t, []byte("old-blob"), s.UpdateDataCalls()[0].OldData)
+	assert.Equal(t, []byte("new-blob"), s.UpdateDataCalls()[0].NewData)
+
+	s.KeysFunc = func(ctx context.Context) ([]string, error) { return nil, errors.New("db error") }
+	_, err = m.Rekey(t.Context())
+	require.EqualError(t, err, "list messages: db error")
+}
+
+func TestMessageProc_MaxViews(t *testing.T) {
+	eng := store.NewInMemory(time.Minute)
+	defer eng.Close()
+	m := New(eng, Crypt{Key: "123456789012345678901234567"}, Params{MaxPinAttempts: 3, MaxDuration: time.Hour, MaxViews: 3})
+	ctx := t.Context()
+
+	_, err := m.MakeMessage(ctx, MsgReq{Duration: time.Minute, Message: "too many", Pin: "12345", MaxViews: 4})
+	require.ErrorIs(t, err, ErrMaxViews)
+
+	msg, err := m.MakeMessage(ctx, MsgReq{Duration: time.Minute, Message: "on-call secret", Pin: "12345", MaxViews: 3})
+	require.NoError(t, err)
+	assert.Equal(t, 3, msg.MaxViews)
+
+	for i := 1; i <= 3; i++ {
+		res, err := m.LoadMessage(ctx, msg.Key, "12345")
+		require.NoError(t, err, "view %d", i)
+		assert.Equal(t, "on-call secret", string(res.Data))
+		assert.Equal(t, i, res.Views)
+	}
+	_, err = m.LoadMessage(ctx, msg.Key, "12345")
+	require.ErrorIs(t, err, store.ErrLoadRejected, "removed after the last view")
+
+	// default is a single view
+	msg, err = m.MakeMessage(ctx, MsgReq{Duration: time.Minute, Message: "once", Pin: "12345"})
+	require.NoError(t, err)
+	assert.Equal(t, 1, msg.MaxViews)
+	_, err = m.LoadMessage(ctx, msg.Key, "12345")
+	require.NoError(t, err)
+	_, err = m.LoadMessage(ctx, msg.Key, "12345")
+	require.ErrorIs(t, err, store.ErrLoadRejected)
+
+	// max views not allowed by default params
+	single := New(eng, Crypt{Key: "123456789012345678901234567"}, Params{})
+	_, err = single.MakeMessage(ctx, MsgReq{Duration: time.Minute, Message: "twice", Pin: "12345", MaxViews: 2})
+	require.ErrorIs(t, err, ErrMaxViews)
+}
+
+func TestMessageProc_Revoke(t *testing.T) {
+	eng := store.NewInMemory(time.Minute)
+	defer eng.Close()
+	m := New(eng, Crypt{Key: "123456789012345678901234567"}, Params{MaxPinAttempts: 3, MaxDuration: time.Hour})
+	ctx := t.Context()
+
+	msg, err := m.MakeMessage(ctx, MsgReq{Duration: time.Minute, Message: "wrong chat", Pin: "12345"})
+	require.NoError(t, err)
+	require.NotEmpty(t, msg.MgmtToken)
+	assert.Equal(t, mgmtHash(msg.MgmtToken), msg.MgmtHash)
+
+	stored, err := eng.Load(ctx, msg.Key)
+	require.NoError(t, err)
+	assert.Empty(t, stored.MgmtToken, "plain token not stored")
+	assert.Equal(t, msg.MgmtHash, stored.MgmtHash)
+
+	require.ErrorIs(t, m.Revoke(ctx, msg.Key, "bad-token"), ErrBadToken)
+	require.ErrorIs(t, m.Revoke(ctx, msg.Key, ""), ErrBadToken)
+	require.NoError(t, m.Revoke(ctx, msg.Key, msg.MgmtToken))
+
+	_, err = m.LoadMessage(ctx, msg.Key, "12345")
+	require.ErrorIs(t, err, store.ErrLoadRejected, "revoked message removed")
+	require.ErrorIs(t, m.Revoke(ctx, msg.Key, msg.MgmtToken), store.ErrLoadRejected)
+
+	// file messages get the token too
+	fileMsg, err := m.MakeFileMessage(ctx, FileRequest{Duration: time.Minute, Pin: "12345", FileName: "a.txt",
+		ContentType: "text/plain", Data: []byte("file data")})
+	require.NoError(t, err)
+	require.NotEmpty(t, fileMsg.MgmtToken)
+	require.NoError(t, m.Revoke(ctx, fileMsg.Key, fileMsg.MgmtToken))
+
+	// messages made without the token can't be revoked
+	require.NoError(t, eng.Save(ctx, &store.Message{Key: "legacy", Exp: time.Now().Add(time.Minute), Data: []byte("data")}))
+	require.ErrorIs(t, m.Revoke(ctx, "legacy", ""), ErrBadToken)
+	require.ErrorIs(t, m.Revoke(ctx, "legacy", msg.MgmtToken), ErrBadToken)
+}
+
+func TestMessageProc_Status(t *testing.T) {
+	eng := store.NewInMemory(time.Minute)
+	defer eng.Close()
+	m := New(eng, Crypt{Key: "123456789012345678901234567"}, Params{MaxPinAttempts: 2, MaxDuration: time.Hour,
+		MaxViews: 2, Retention: time.Hour})
+	ctx := t.Context()
+
+	t.Run("opened", func(t *testing.T) {
+		msg, err := m.MakeMessage(ctx, MsgReq{Duration: time.Minute, Message: "new password", Pin: "12345", MaxViews: 2})
+		require.NoError(t, err)
+
+		_, err = m.Status(ctx, msg.Key, "bad-token")
+		require.ErrorIs(t, err, ErrBadToken)
+
+		st, err := m.Status(ctx, msg.Key, msg.MgmtToken)
+		require.NoError(t, err)
+		assert.Equal(t, StatusActive, st.State)
+		assert.Equal(t, 2, st.MaxViews)
+		assert.WithinDuration(t, time.Now(), st.Created, time.Second)
+		assert.WithinDuration(t, msg.Exp, st.Exp, time.Second)
+		assert.True(t, st.Closed.IsZero())
+
+		failed, err := m.LoadMessage(ctx, msg.Key, "00000")
+		require.ErrorIs(t, err, ErrBadPinAttempt)
+		assert.Equal(t, 1, failed.Errors, "wrong pins reported with the attempt")
+		_, err = m.LoadMessage(ctx, msg.Key, "12345")
+		require.NoError(t, err)
+		st, err = m.Status(ctx, msg.Key, msg.MgmtToken)
+		require.NoError(t, err)
+		assert.Equal(t, StatusActive, st.State, "one view left")
+		assert.Equal(t, 1, st.Errors)
+		assert.Equal(t, 1, st.Views)
+
+		_, err = m.LoadMessage(ctx, msg.Key, "12345")
+		require.NoError(t, err)
+		st, err = m.Status(ctx, msg.Key, msg.MgmtToken)
+		require.NoError(t, err)
+		assert.Equal(t, store.StateOpened, st.State)
+		assert.Equal(t, 1, st.Errors)
+		assert.Equal(t, 2, st.Views)
+		assert.WithinDuration(t, time.Now(), st.Closed, time.Second)
+	})
+
+	t.Run("burned", func(t *testing.T) {
+		msg, err := m.MakeMessage(ctx, MsgReq{Duration: time.Minute, Message: "secret", Pin: "12345"})
+		require.NoError(t, err)
+		for range 2 {
+			_, _ = m.LoadMessage(ctx, msg.Key, "00000")
+		}
+		st, err := m.Status(ctx, msg.Key, msg.MgmtToken)
+		require.NoError(t, err)
+		assert.Equal(t, store.StateBurned, st.State)
+		assert.Equal(t, 2, st.Errors)
+		assert.Equal(t, 0, st.Views)
+	})
+
+	t.Run("revoked", func(t *testing.T) {
+		msg, err := m.MakeMessage(ctx, MsgReq{Duration: time.Minute, Message: "secret", Pin: "12345"})
+		require.NoError(t, err)
+		require.NoError(t, m.Revoke(ctx, msg.Key, msg.MgmtToken))
+		st, err := m.Status(ctx, msg.Key, msg.MgmtToken)
+		require.NoError(t, err)
+		assert.Equal(t, store.StateRevoked, st.State)
+	})
+
+	t.Run("expired", func(t *testing.T) {
+		msg, err := m.MakeMessage(ctx, MsgReq{Duration: time.Millisecond, Message: "secret", Pin: "12345"})
+		require.NoError(t, err)
+		time.Sleep(10 * time.Millisecond)
+		st, err := m.Status(ctx, msg.Key, msg.MgmtToken)
+		require.NoError(t, err)
+		assert.Equal(t, store.StateExpired, st.State, "expired, but not removed yet")
+
+		_, err = m.LoadMessage(ctx, msg.Key, "12345")
+		require.ErrorIs(t, err, ErrExpired)
+		st, err = m.Status(ctx, msg.Key, msg.MgmtToken)
+		require.NoError(t, err)
+		assert.Equal(t, store.StateExpired, st.State)
+		assert.True(t, st.Closed.IsZero())
+	})
+
+	t.Run("unknown", func(t *testing.T) {
+		_, err := m.Status(ctx, "nonexistent", "token")
+		require.ErrorIs(t, err, store.ErrLoadRejected)
+	})
+}
+
+func TestMessageProc_StatusConcurrent(t *testing.T) {
+	eng := store.NewInMemory(time.Minute)
+	defer eng.Close()
+	m := New(eng, Crypt{Key: "123456789012345678901234567"}, Params{MaxPinAttempts: 2, MaxDuration: time.Hour,
+		MaxViews: 2, Retention: time.Hour})
+	ctx := t.Context()
+
+	// both views, or both wrong pins, at once, the last status update must not be lost
+	load := func(key, pin string) {
+		var wg sync.WaitGroup
+		for range 2 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				_, _ = m.LoadMessage(ctx, key, pin)
+			}()
+		}
+		wg.Wait()
+	}
+
+	for range 5 {
+		msg, err := m.MakeMessage(ctx, MsgReq{Duration: time.Minute, Message: "secret", Pin: "12345", MaxViews: 2})
+		require.NoError(t, err)
+		load(msg.Key, "12345")
+		st, err := m.Status(ctx, msg.Key, msg.MgmtToken)
+		require.NoError(t, err)
+		assert.Equal(t, store.StateOpened, st.State)
+		assert.Equal(t, 2, st.Views)
+		assert.False(t, st.Closed.IsZero())
+
+		msg, err = m.MakeMessage(ctx, MsgReq{Duration: time.Minute, Message: "secret", Pin: "12345", MaxViews: 2})
+		require.NoError(t, err)
+		load(msg.Key, "00000")
+		st, err = m.Status(ctx, msg.Key, msg.MgmtToken)
+		require.NoError(t, err)
+		assert.Equal(t, store.StateBurned, st.State)
+		assert.Equal(t, 2, st.Errors)
+	}
+}
+
+func TestMessageProc_Notify(t *testing.T) {
+	eng := store.NewInMemory(time.Minute)
+	defer eng.Close()
+	rec := &notifyRecorder{}
+	m := New(eng, Crypt{Key: "123456789012345678901234567"}, Params{MaxPinAttempts: 2, MaxDuration: time.Hour,
+		MaxViews: 2}).WithNotifier(rec)
+	ctx := t.Context()
+
+	msg, err := m.MakeMessage(ctx, MsgReq{Duration: time.Minute, Message: "wrong chat", Pin: "12345", MaxViews: 2,
+		Callback: "https://example.com/hook"})
+	require.NoError(t, err)
+	_, err = m.LoadMessage(ctx, msg.Key, "11111")
+	require.ErrorIs(t, err, ErrBadPinAttempt)
+	_, err = m.LoadMessage(ctx, msg.Key, "12345")
+	require.NoError(t, err)
+	_, err = m.LoadMessage(ctx, msg.Key, "11111")
+	require.ErrorIs(t, err, ErrBadPin)
+
+	assert.Equal(t, []string{webhook.EventCreated, webhook.EventPinFailed, webhook.EventAccessed,
+		webhook.EventPinFailed, webhook.EventBurned}, rec.types())
+	for _, e := range rec.events {
+		assert.Equal(t, msg.Key, e.Key)
+		assert.Equal(t, "https://example.com/hook", e.Callback)
+		assert.Equal(t, msg.Exp.Unix(), e.Exp.Unix())
+	}
+
+	// expired on access
+	rec.events = nil
+	msg, err = m.MakeMessage(ctx, MsgReq{Duration: time.Millisecond, Message: "wrong chat", Pin: "12345"})
+	require.NoError(t, err)
+	time.Sleep(5 * time.Millisecond)
+	_, err = m.LoadMessage(ctx, msg.Key, "12345")
+	require.ErrorIs(t, err, ErrExpired)
+	assert.Equal(t, []string{webhook.EventCreated, webhook.EventExpired}, rec.types())
+	assert.Empty(t, rec.events[0].Callback)
+
+	// expired by engine cleanup
+	rec.events = nil
+	m.NotifyExpired(&store.Message{Key: "expired-key", Exp: time.Now()})
+	require.Len(t, rec.events, 1)
+	assert.Equal(t, webhook.Event{Type: webhook.EventExpired, Key: "expired-key", Exp: rec.events[0].Exp}, rec.events[0])
+
+	// no notifier set
+	m = New(eng, Crypt{Key: "123456789012345678901234567"}, Params{MaxDuration: time.Hour})
+	msg, err = m.MakeMessage(ctx, MsgReq{Duration: time.Minute, Message: "wrong chat", Pin: "12345"})
+	require.NoError(t, err)
+	m.NotifyExpired(msg)
+}
+
+// notifyRecorder collects sent events, all calls made synchronously by MessageProc
+type notifyRecorder struct {
+	events []webhook.Event
+}
+
+func (n *notifyRecorder) Send(_ context.Context, e webhook.Event) { n.events = append(n.events, e) }
+
+func (n *notifyRecorder) types() []string {
+	res := make([]string, 0, len(n.events))
+	for _, e := range n.events {
+		res = append(res, e.Type)
+	}
+	return res
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/umputun/secrets/v2/app/store"
+)
+
+// migrateCmd applies pending sqlite schema migrations, or only prints them in dry-run mode
+type migrateCmd struct {
+	DryRun bool `long:"dry-run" description:"print pending migrations without applying them"`
+}
+
+// runMigrate migrates sqlite database file and reports the steps to out.
+// Before applying, the database is copied to a backup file, restoring it rolls the migrations back.
+func runMigrate(ctx context.Context, out io.Writer, dbFile string, dryRun bool) error {
+	if !dryRun {
+		pending, err := store.MigrateSQLite(ctx, dbFile, true)
+		if err != nil {
+			return fmt.Errorf("check %s: %w", dbFile, err)
+		}
+		if len(pending) > 0 {
+			backup, err := store.BackupSQLite(ctx, dbFile)
+			if err != nil {
+				return fmt.Errorf("backup %s: %w", dbFile, err)
+			}
+			if backup != "" {
+				_, _ = fmt.Fprintf(out, "sqlite database %s backed up to %s\n", dbFile, backup)
+			}
+		}
+	}
+
+	migrations, err := store.MigrateSQLite(ctx, dbFile, dryRun)
+	if err != nil {
+		for _, m := range migrations {
+			_, _ = fmt.Fprintf(out, "applied %d: %s\n", m.Version, m.Name)
+		}
+		return fmt.Errorf("migrate %s: %w", dbFile, err)
+	}
+
+	if len(migrations) == 0 {
+		_, _ = fmt.Fprintf(out, "sqlite database %s is up to date\n", dbFile)
+		return nil
+	}
+
+	action := "applied"
+	if dryRun {
+		action = "pending"
+		_, _ = fmt.Fprintf(out, "sqlite database %s, %d pending migration(s):\n", dbFile, len(migrations))
+	}
+	for _, m := range migrations {
+		_, _ = fmt.Fprintf(out, "%s %d: %s\n", action, m.Version, m.Name)
+	}
+	return nil
+}
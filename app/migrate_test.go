@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/umputun/secrets/v2/app/store"
+)
+
+func TestRunMigrate(t *testing.T) {
+	dbFile := filepath.Join(t.TempDir(), "secrets.db")
+
+	// database made before schema versioning
+	db, err := sql.Open("sqlite", dbFile)
+	require.NoError(t, err)
+	_, err = db.Exec(`CREATE TABLE messages (id TEXT PRIMARY KEY, exp INTEGER NOT NULL, data BLOB NOT NULL,
+		pin_hash TEXT NOT NULL, errors INTEGER DEFAULT 0)`)
+	require.NoError(t, err)
+	require.NoError(t, db.Close())
+
+	out := bytes.Buffer{}
+	require.NoError(t, runMigrate(t.Context(), &out, dbFile, true))
+	assert.Contains(t, out.String(), "pending migration(s):")
+	assert.Contains(t, out.String(), "pending 2: add client_enc column")
+	assert.NotContains(t, out.String(), "backed up", "dry run makes no backup")
+	_, err = os.Stat(dbFile + ".bak-v0")
+	require.ErrorIs(t, err, os.ErrNotExist)
+
+	out.Reset()
+	require.NoError(t, runMigrate(t.Context(), &out, dbFile, false))
+	assert.Contains(t, out.String(), "sqlite database "+dbFile+" backed up to "+dbFile+".bak-v0\n")
+	assert.Contains(t, out.String(), "applied 2: add client_enc column")
+
+	// backup keeps the database as it was before migration
+	pending, err := store.MigrateSQLite(t.Context(), dbFile+".bak-v0", true)
+	require.NoError(t, err)
+	assert.Equal(t, 1, pending[0].Version)
+
+	out.Reset()
+	require.NoError(t, runMigrate(t.Context(), &out, dbFile, false))
+	assert.Equal(t, "sqlite database "+dbFile+" is up to date\n", out.String(), "no backup without pending migrations")
+
+	t.Run("new database", func(t *testing.T) {
+		newFile := filepath.Join(t.TempDir(), "new.db")
+		out := bytes.Buffer{}
+		require.NoError(t, runMigrate(t.Context(), &out, newFile, false))
+		assert.NotContains(t, out.String(), "backed up")
+		assert.Contains(t, out.String(), "applied 1: create messages table")
+		s, err := store.NewSQLite(newFile, time.Minute)
+		require.NoError(t, err)
+		require.NoError(t, s.Close())
+	})
+
+	t.Run("existing backup", func(t *testing.T) {
+		oldFile := filepath.Join(t.TempDir(), "old.db")
+		db, err := sql.Open("sqlite", oldFile)
+		require.NoError(t, err)
+		_, err = db.Exec("CREATE TABLE messages (id TEXT PRIMARY KEY, exp INTEGER NOT NULL, data BLOB NOT NULL, pin_hash TEXT NOT NULL)")
+		require.NoError(t, err)
+		require.NoError(t, db.Close())
+		require.NoError(t, os.WriteFile(oldFile+".bak-v0", []byte("old backup"), 0o600))
+
+		out := bytes.Buffer{}
+		err = runMigrate(t.Context(), &out, oldFile, false)
+		require.ErrorContains(t, err, "already exists")
+		pending, err := store.MigrateSQLite(t.Context(), oldFile, true)
+		require.NoError(t, err)
+		assert.Equal(t, 1, pending[0].Version, "nothing applied without backup")
+		data, err := os.ReadFile(oldFile + ".bak-v0")
+		require.NoError(t, err)
+		assert.Equal(t, "old backup", string(data))
+	})
+}
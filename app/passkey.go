@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"text/tabwriter"
+	"time"
+
+	"github.com/umputun/secrets/v2/app/passkey"
+)
+
+// passkeyCmd is "secrets passkey", it manages passkeys of password-less login stored by the engine
+type passkeyCmd struct {
+	Setup  passkeySetupCmd  `command:"setup" description:"print one-time link registering passkey of the user"`
+	List   passkeyListCmd   `command:"list" description:"list registered passkeys"`
+	Remove passkeyRemoveCmd `command:"remove" description:"remove passkey by id"`
+}
+
+type passkeySetupCmd struct {
+	User string        `long:"user" default:"secrets" description:"user name, new or one with password"`
+	TTL  time.Duration `long:"ttl" default:"1h" description:"lifetime of the link"`
+}
+
+type passkeyListCmd struct {
+	User string `long:"user" description:"passkeys of this user only"`
+}
+
+type passkeyRemoveCmd struct {
+	Args struct {
+		ID string `positional-arg-name:"id" required:"yes"`
+	} `positional-args:"yes"`
+}
+
+// runPasskeySetup prints link registering the first passkey of the user, the link works once
+func runPasskeySetup(ctx context.Context, m *passkey.Manager, cmd passkeySetupCmd, out io.Writer) error {
+	if len(opts.Domain) == 0 {
+		return errors.New("domain required to make setup link")
+	}
+	if cmd.TTL <= 0 {
+		return fmt.Errorf("ttl must be positive, got %v", cmd.TTL)
+	}
+	token, err := m.Setup(ctx, cmd.User, cmd.TTL)
+	if err != nil {
+		return err //nolint:wrapcheck // already wrapped by manager
+	}
+	_, _ = fmt.Fprintf(out, "open to register passkey of %s, the link works once and expires in %v:\n", cmd.User, cmd.TTL)
+	_, _ = fmt.Fprintf(out, "%s://%s/passkey?setup=%s\n", opts.Protocol, opts.Domain[0], token)
+	return nil
+}
+
+// runPasskeyList prints passkeys table to out
+func runPasskeyList(ctx context.Context, m *passkey.Manager, user string, out io.Writer) error {
+	list, err := m.List(ctx, user)
+	if err != nil {
+		return err //nolint:wrapcheck // already wrapped by manager
+	}
+	if len(list) == 0 {
+		_, _ = fmt.Fprintln(out, "no passkeys")
+		return nil
+	}
+	tw := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	_, _ = fmt.Fprintln(tw, "ID\tUSER\tNAME\tCREATED\tLAST USED")
+	for _, p := range list {
+		lastUsed := "never"
+		if !p.LastUsed.IsZero() {
+			lastUsed = p.LastUsed.Format(time.DateTime)
+		}
+		_, _ = fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", p.ID, p.User, p.Name, p.Created.Format(time.DateTime), lastUsed)
+	}
+	if err = tw.Flush(); err != nil {
+		return fmt.Errorf("write passkeys: %w", err)
+	}
+	return nil
+}
+
+// runPasskeyRemove removes passkey by id, its sessions end unless the user still has a password or another passkey
+func runPasskeyRemove(ctx context.Context, m *passkey.Manager, id string, out io.Writer) error {
+	err := m.Remove(ctx, id)
+	if errors.Is(err, passkey.ErrNotFound) {
+		return fmt.Errorf("no passkey with id %q", id)
+	}
+	if err != nil {
+		return err //nolint:wrapcheck // already wrapped by manager
+	}
+	_, _ = fmt.Fprintf(out, "passkey %s removed\n", id)
+	return nil
+}
@@ -0,0 +1,353 @@
+// Package passkey implements WebAuthn passkeys as password-less login of message creators.
+// The first passkey of a user is registered with a one-time setup link made by CLI, more can be added
+// by the user logged in. Credentials are kept by the store. State of a registration or login between
+// its begin and finish is returned to the caller, which keeps it until the browser responds.
+package passkey
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	log "github.com/go-pkgz/lgr"
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+
+	"github.com/umputun/secrets/v2/app/store"
+)
+
+const (
+	ceremonyTimeout = 5 * time.Minute // time to complete registration or login in the browser
+	setupTokenSize  = 32
+	maxNameLen      = 64
+	defaultName     = "passkey"
+)
+
+// Errors
+var (
+	ErrInvalid      = errors.New("passkey not accepted")
+	ErrSetupInvalid = errors.New("setup link invalid or expired")
+	ErrNotFound     = errors.New("passkey not found")
+)
+
+// Store is a persistent storage of passkeys and their setup links, implemented by all store engines
+type Store interface {
+	SavePasskey(ctx context.Context, p *store.Passkey) error
+	LoadPasskey(ctx context.Context, id string) (*store.Passkey, error)
+	ListPasskeys(ctx context.Context, user string) ([]store.Passkey, error)
+	RemovePasskey(ctx context.Context, id string) error
+	SavePasskeySetup(ctx context.Context, ps *store.PasskeySetup) error
+	LoadPasskeySetup(ctx context.Context, hash string) (*store.PasskeySetup, error)
+	RemovePasskeySetup(ctx context.Context, hash string) error
+}
+
+// Params of the relying party, passkeys are bound to its id and accepted from its origins only
+type Params struct {
+	RPID    string   // domain of the service without port, e.g. secrets.example.com
+	Origins []string // origins of the web UI, e.g. https://secrets.example.com
+	Name    string   // name of the service shown by the browser
+}
+
+// Manager registers passkeys and verifies passkey logins
+type Manager struct {
+	store Store
+	wa    *webauthn.WebAuthn
+	now   func() time.Time
+}
+
+// Registration completes registration started by BeginRegistration
+type Registration struct {
+	User  string
+	Name  string // label of the passkey, e.g. the device
+	Setup string // token of the setup link, used up by the registration; empty for the user logged in
+	State []byte // returned by BeginRegistration
+}
+
+// New makes Manager with the store, user verification (PIN or biometrics) is required for all passkeys
+func New(s Store, p Params) (*Manager, error) {
+	timeout := webauthn.TimeoutConfig{Enforce: true, Timeout: ceremonyTimeout, TimeoutUVD: ceremonyTimeout}
+	wa, err := webauthn.New(&webauthn.Config{
+		RPID:          p.RPID,
+		RPDisplayName: p.Name,
+		RPOrigins:     p.Origins,
+		AuthenticatorSelection: protocol.AuthenticatorSelection{
+			ResidentKey:        protocol.ResidentKeyRequirementRequired,
+			RequireResidentKey: protocol.ResidentKeyRequired(),
+			UserVerification:   protocol.VerificationRequired,
+		},
+		Timeouts: webauthn.TimeoutsConfig{Login: timeout, Registration: timeout},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("make webauthn: %w", err)
+	}
+	return &Manager{store: s, wa: wa, now: time.Now}, nil
+}
+
+// Setup makes a one-time token of passkey registration for the user, valid for ttl
+func (m *Manager) Setup(ctx context.Context, user string, ttl time.Duration) (string, error) {
+	if err := validUser(user); err != nil {
+		return "", err
+	}
+	b := make([]byte, setupTokenSize)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("generate setup token: %w", err)
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+	if err := m.store.SavePasskeySetup(ctx, &store.PasskeySetup{Hash: hash(token), User: user,
+		Expires: m.now().Add(ttl)}); err != nil {
+		return "", fmt.Errorf("save passkey setup: %w", err)
+	}
+	log.Printf("[INFO] passkey setup link made, user=%s, expires in %v", user, ttl)
+	return token, nil
+}
+
+// SetupUser returns the user of valid setup token, ErrSetupInvalid if it's unknown, used or expired
+func (m *Manager) SetupUser(ctx context.Context, token string) (string, error) {
+	if token == "" {
+		return "", ErrSetupInvalid
+	}
+	ps, err := m.store.LoadPasskeySetup(ctx, hash(token))
+	if err != nil {
+		return "", ErrSetupInvalid
+	}
+	return ps.User, nil
+}
+
+// BeginRegistration starts registration of a new passkey for the user. Returns options for
+// navigator.credentials.create and the state to pass to FinishRegistration.
+func (m *Manager) BeginRegistration(ctx context.Context, user string) (options, state []byte, err error) {
+	if err = validUser(user); err != nil {
+		return nil, nil, err
+	}
+	u, err := m.user(ctx, user)
+	if err != nil {
+		return nil, nil, err
+	}
+	creation, session, err := m.wa.BeginRegistration(u,
+		webauthn.WithResidentKeyRequirement(protocol.ResidentKeyRequirementRequired),
+		webauthn.WithExclusions(webauthn.Credentials(u.creds).CredentialDescriptors()))
+	if err != nil {
+		return nil, nil, fmt.Errorf("begin registration: %w", err)
+	}
+	return marshalCeremony(creation, session)
+}
+
+// FinishRegistration verifies response of the browser to registration and stores the new passkey.
+// The setup token of the registration is used up, so the link can't register another passkey.
+func (m *Manager) FinishRegistration(ctx context.Context, reg Registration, response io.Reader) (*store.Passkey, error) {
+	var session webauthn.SessionData
+	if err := json.Unmarshal(reg.State, &session); err != nil {
+		return nil, fmt.Errorf("%w, bad state: %v", ErrInvalid, err)
+	}
+	parsed, err := protocol.ParseCredentialCreationResponseBody(response)
+	if err != nil {
+		return nil, fmt.Errorf("%w, bad response: %v", ErrInvalid, err)
+	}
+	u, err := m.user(ctx, reg.User)
+	if err != nil {
+		return nil, err
+	}
+	cred, err := m.wa.CreateCredential(u, session, parsed)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalid, describe(err))
+	}
+	id := base64.RawURLEncoding.EncodeToString(cred.ID)
+	if _, err = m.store.LoadPasskey(ctx, id); err == nil {
+		return nil, fmt.Errorf("%w, registered already", ErrInvalid)
+	}
+
+	if reg.Setup != "" {
+		if setupUser, err := m.SetupUser(ctx, reg.Setup); err != nil || setupUser != reg.User {
+			return nil, ErrSetupInvalid
+		}
+		if err = m.store.RemovePasskeySetup(ctx, hash(reg.Setup)); err != nil {
+			return nil, ErrSetupInvalid // used by concurrent registration
+		}
+	}
+
+	data, err := json.Marshal(cred)
+	if err != nil {
+		return nil, fmt.Errorf("marshal credential: %w", err)
+	}
+	name := strings.TrimSpace(reg.Name)
+	if name == "" {
+		name = defaultName
+	}
+	if r := []rune(name); len(r) > maxNameLen {
+		name = string(r[:maxNameLen])
+	}
+	pk := &store.Passkey{ID: id, User: reg.User, Name: name, Credential: data, Created: m.now()}
+	if err = m.store.SavePasskey(ctx, pk); err != nil {
+		return nil, fmt.Errorf("save passkey: %w", err)
+	}
+	log.Printf("[INFO] passkey registered, user=%s, name=%q, id=%s", pk.User, pk.Name, pk.ID)
+	return pk, nil
+}
+
+// BeginLogin starts login with any passkey of the service, the browser offers the ones it has.
+// Returns options for navigator.credentials.get and the state to pass to FinishLogin.
+func (m *Manager) BeginLogin(_ context.Context) (options, state []byte, err error) {
+	assertion, session, err := m.wa.BeginDiscoverableLogin(webauthn.WithUserVerification(protocol.VerificationRequired))
+	if err != nil {
+		return nil, nil, fmt.Errorf("begin login: %w", err)
+	}
+	return marshalCeremony(assertion, session)
+}
+
+// FinishLogin verifies response of the browser to login and returns the user of the passkey.
+// Sign counter of the passkey is stored, a passkey with the counter going back is rejected as cloned.
+func (m *Manager) FinishLogin(ctx context.Context, state []byte, response io.Reader) (string, error) {
+	var session webauthn.SessionData
+	if err := json.Unmarshal(state, &session); err != nil {
+		return "", fmt.Errorf("%w, bad state: %v", ErrInvalid, err)
+	}
+	parsed, err := protocol.ParseCredentialRequestResponseBody(response)
+	if err != nil {
+		return "", fmt.Errorf("%w, bad response: %v", ErrInvalid, err)
+	}
+
+	var pk *store.Passkey
+	lookup := func(rawID, userHandle []byte) (webauthn.User, error) {
+		p, err := m.store.LoadPasskey(ctx, base64.RawURLEncoding.EncodeToString(rawID))
+		if err != nil {
+			return nil, ErrNotFound
+		}
+		if !bytes.Equal(userHandle, userID(p.User)) {
+			return nil, errors.New("user handle mismatch")
+		}
+		pk = p
+		return m.user(ctx, p.User)
+	}
+	_, cred, err := m.wa.ValidatePasskeyLogin(lookup, session, parsed)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrInvalid, describe(err))
+	}
+	if cred.Authenticator.CloneWarning {
+		log.Printf("[WARN] passkey rejected, sign counter went back, possibly cloned, user=%s, id=%s", pk.User, pk.ID)
+		return "", fmt.Errorf("%w, sign counter went back", ErrInvalid)
+	}
+
+	if pk.Credential, err = json.Marshal(cred); err != nil {
+		return "", fmt.Errorf("marshal credential: %w", err)
+	}
+	pk.LastUsed = m.now()
+	if err = m.store.SavePasskey(ctx, pk); err != nil {
+		return "", fmt.Errorf("save passkey: %w", err)
+	}
+	return pk.User, nil
+}
+
+// Registered checks if the user has any passkey. Store error is returned, so the caller can fail closed.
+func (m *Manager) Registered(ctx context.Context, user string) (bool, error) {
+	list, err := m.store.ListPasskeys(ctx, user)
+	if err != nil {
+		return false, fmt.Errorf("list passkeys: %w", err)
+	}
+	return len(list) > 0, nil
+}
+
+// List returns passkeys of the user, or of all users if empty, oldest first
+func (m *Manager) List(ctx context.Context, user string) ([]store.Passkey, error) {
+	list, err := m.store.ListPasskeys(ctx, user)
+	if err != nil {
+		return nil, fmt.Errorf("list passkeys: %w", err)
+	}
+	return list, nil
+}
+
+// Remove deletes passkey by its id, ErrNotFound if there is no such passkey
+func (m *Manager) Remove(ctx context.Context, id string) error {
+	if err := m.store.RemovePasskey(ctx, id); err != nil {
+		if errors.Is(err, store.ErrLoadRejected) {
+			return ErrNotFound
+		}
+		return fmt.Errorf("remove passkey: %w", err)
+	}
+	log.Printf("[INFO] passkey removed, id=%s", id)
+	return nil
+}
+
+// user loads passkeys of the user as the owner seen by webauthn library
+func (m *Manager) user(ctx context.Context, name string) (*owner, error) {
+	list, err := m.store.ListPasskeys(ctx, name)
+	if err != nil {
+		return nil, fmt.Errorf("list passkeys: %w", err)
+	}
+	res := &owner{name: name}
+	for _, p := range list {
+		var cred webauthn.Credential
+		if err = json.Unmarshal(p.Credential, &cred); err != nil {
+			log.Printf("[WARN] skip broken passkey %s of %s, %v", p.ID, name, err)
+			continue
+		}
+		res.creds = append(res.creds, cred)
+	}
+	return res, nil
+}
+
+// owner is a user with passkeys, implements webauthn.User
+type owner struct {
+	name  string
+	creds []webauthn.Credential
+}
+
+func (o *owner) WebAuthnID() []byte                         { return userID(o.name) }
+func (o *owner) WebAuthnName() string                       { return o.name }
+func (o *owner) WebAuthnDisplayName() string                { return o.name }
+func (o *owner) WebAuthnCredentials() []webauthn.Credential { return o.creds }
+
+// userID returns user handle kept by the authenticator along with the passkey. It's derived from the name,
+// so the user of a passkey is known without extra mapping, and the handle doesn't expose the name.
+func userID(name string) []byte {
+	h := sha256.Sum256([]byte("secrets-passkey:" + name))
+	return h[:]
+}
+
+// validUser rejects names which can't own a passkey, colon is reserved for SSO users
+func validUser(name string) error {
+	if name == "" {
+		return errors.New("user required")
+	}
+	if strings.Contains(name, ":") {
+		return fmt.Errorf("user %q can't have passkey", name)
+	}
+	return nil
+}
+
+// marshalCeremony encodes options for the browser and state of the ceremony kept by the caller
+func marshalCeremony(options any, session *webauthn.SessionData) (opts, state []byte, err error) {
+	if opts, err = json.Marshal(options); err != nil {
+		return nil, nil, fmt.Errorf("marshal options: %w", err)
+	}
+	if state, err = json.Marshal(session); err != nil {
+		return nil, nil, fmt.Errorf("marshal state: %w", err)
+	}
+	return opts, state, nil
+}
+
+// describe returns details of webauthn protocol error, its message alone is too generic
+func describe(err error) string {
+	var perr *protocol.Error
+	if !errors.As(err, &perr) || perr.Details == "" {
+		return err.Error()
+	}
+	if perr.DevInfo != "" {
+		return perr.Details + ", " + perr.DevInfo
+	}
+	return perr.Details
+}
+
+// hash returns hex-encoded sha256 of the setup token, random enough to skip bcrypt
+func hash(token string) string {
+	h := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(h[:])
+}
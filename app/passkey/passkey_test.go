@@ -0,0 +1,287 @@
+package passkey
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-webauthn/webauthn/protocol/webauthncbor"
+	"github.com/go-webauthn/webauthn/protocol/webauthncose"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/umputun/secrets/v2/app/store"
+)
+
+func TestManager_Setup(t *testing.T) {
+	eng := store.NewInMemory(time.Minute)
+	defer eng.Close()
+	m := newManager(t, eng)
+
+	token, err := m.Setup(t.Context(), "secrets", time.Hour)
+	require.NoError(t, err)
+	assert.Len(t, token, 43)
+	user, err := m.SetupUser(t.Context(), token)
+	require.NoError(t, err)
+	assert.Equal(t, "secrets", user)
+
+	_, err = m.SetupUser(t.Context(), "unknown")
+	require.ErrorIs(t, err, ErrSetupInvalid)
+	_, err = m.SetupUser(t.Context(), "")
+	require.ErrorIs(t, err, ErrSetupInvalid)
+	expired, err := m.Setup(t.Context(), "bob", -time.Second)
+	require.NoError(t, err)
+	_, err = m.SetupUser(t.Context(), expired)
+	require.ErrorIs(t, err, ErrSetupInvalid)
+
+	_, err = m.Setup(t.Context(), "", time.Hour)
+	require.Error(t, err)
+	_, err = m.Setup(t.Context(), "sso:bob@example.com", time.Hour)
+	require.Error(t, err, "sso users log in with sso only")
+}
+
+func TestManager_Register(t *testing.T) {
+	eng := store.NewInMemory(time.Minute)
+	defer eng.Close()
+	m := newManager(t, eng)
+	ctx := t.Context()
+	auth := newAuthenticator(t, "https://secrets.example.com")
+
+	token, err := m.Setup(ctx, "secrets", time.Hour)
+	require.NoError(t, err)
+	options, state, err := m.BeginRegistration(ctx, "secrets")
+	require.NoError(t, err)
+	assert.Contains(t, string(options), `"residentKey":"required"`)
+	assert.Contains(t, string(options), `"userVerification":"required"`)
+
+	response := auth.create(t, options)
+	_, err = m.FinishRegistration(ctx, Registration{User: "bob", Setup: token, State: state}, strings.NewReader(response))
+	require.ErrorIs(t, err, ErrInvalid, "state of another user")
+	_, err = m.FinishRegistration(ctx, Registration{User: "secrets", Setup: "bad", State: state}, strings.NewReader(response))
+	require.ErrorIs(t, err, ErrSetupInvalid)
+
+	pk, err := m.FinishRegistration(ctx, Registration{User: "secrets", Name: " laptop ", Setup: token, State: state},
+		strings.NewReader(response))
+	require.NoError(t, err)
+	assert.Equal(t, "secrets", pk.User)
+	assert.Equal(t, "laptop", pk.Name)
+	assert.Equal(t, base64.RawURLEncoding.EncodeToString(auth.credID), pk.ID)
+	_, err = m.SetupUser(ctx, token)
+	require.ErrorIs(t, err, ErrSetupInvalid, "setup link used up")
+
+	// setup link works once
+	options, state, err = m.BeginRegistration(ctx, "secrets")
+	require.NoError(t, err)
+	assert.Contains(t, string(options), `"excludeCredentials":[{"type":"public-key","id":"`+pk.ID+`"}]`)
+	auth2 := newAuthenticator(t, "https://secrets.example.com")
+	_, err = m.FinishRegistration(ctx, Registration{User: "secrets", Setup: token, State: state},
+		strings.NewReader(auth2.create(t, options)))
+	require.ErrorIs(t, err, ErrSetupInvalid)
+
+	// user logged in adds another one without setup link, name is optional
+	options, state, err = m.BeginRegistration(ctx, "secrets")
+	require.NoError(t, err)
+	pk2, err := m.FinishRegistration(ctx, Registration{User: "secrets", State: state}, strings.NewReader(auth2.create(t, options)))
+	require.NoError(t, err)
+	assert.Equal(t, "passkey", pk2.Name)
+
+	// wrong origin
+	options, state, err = m.BeginRegistration(ctx, "secrets")
+	require.NoError(t, err)
+	evil := newAuthenticator(t, "https://evil.example.com")
+	_, err = m.FinishRegistration(ctx, Registration{User: "secrets", State: state}, strings.NewReader(evil.create(t, options)))
+	require.ErrorIs(t, err, ErrInvalid)
+
+	list, err := m.List(ctx, "secrets")
+	require.NoError(t, err)
+	require.Len(t, list, 2)
+	ok, err := m.Registered(ctx, "secrets")
+	require.NoError(t, err)
+	assert.True(t, ok)
+	ok, err = m.Registered(ctx, "bob")
+	require.NoError(t, err)
+	assert.False(t, ok)
+
+	require.NoError(t, m.Remove(ctx, pk.ID))
+	require.ErrorIs(t, m.Remove(ctx, pk.ID), ErrNotFound)
+	_, _, err = m.BeginRegistration(ctx, "sso:bob@example.com")
+	require.Error(t, err)
+}
+
+func TestManager_Login(t *testing.T) {
+	eng := store.NewInMemory(time.Minute)
+	defer eng.Close()
+	m := newManager(t, eng)
+	ctx := t.Context()
+	auth := newAuthenticator(t, "https://secrets.example.com")
+
+	options, state, err := m.BeginRegistration(ctx, "alice")
+	require.NoError(t, err)
+	_, err = m.FinishRegistration(ctx, Registration{User: "alice", State: state}, strings.NewReader(auth.create(t, options)))
+	require.NoError(t, err)
+
+	options, state, err = m.BeginLogin(ctx)
+	require.NoError(t, err)
+	assert.Contains(t, string(options), `"userVerification":"required"`)
+	assert.NotContains(t, string(options), "allowCredentials", "browser offers any passkey of the service")
+	response := auth.get(t, options)
+	user, err := m.FinishLogin(ctx, state, strings.NewReader(response))
+	require.NoError(t, err)
+	assert.Equal(t, "alice", user)
+	pk, err := eng.LoadPasskey(ctx, base64.RawURLEncoding.EncodeToString(auth.credID))
+	require.NoError(t, err)
+	assert.False(t, pk.LastUsed.IsZero())
+	assert.Contains(t, string(pk.Credential), `"signCount":1`)
+
+	// response can't be used with another challenge
+	_, state, err = m.BeginLogin(ctx)
+	require.NoError(t, err)
+	_, err = m.FinishLogin(ctx, state, strings.NewReader(response))
+	require.ErrorIs(t, err, ErrInvalid)
+
+	// sign counter going back means cloned passkey
+	options, state, err = m.BeginLogin(ctx)
+	require.NoError(t, err)
+	auth.counter = 0
+	_, err = m.FinishLogin(ctx, state, strings.NewReader(auth.get(t, options)))
+	require.ErrorIs(t, err, ErrInvalid)
+
+	// unknown passkey
+	options, state, err = m.BeginLogin(ctx)
+	require.NoError(t, err)
+	unknown := newAuthenticator(t, "https://secrets.example.com")
+	unknown.userHandle = auth.userHandle
+	_, err = m.FinishLogin(ctx, state, strings.NewReader(unknown.get(t, options)))
+	require.ErrorIs(t, err, ErrInvalid)
+
+	_, err = m.FinishLogin(ctx, []byte("junk"), strings.NewReader(response))
+	require.ErrorIs(t, err, ErrInvalid)
+	_, err = m.FinishLogin(ctx, state, strings.NewReader("junk"))
+	require.ErrorIs(t, err, ErrInvalid)
+}
+
+func newManager(t *testing.T, s Store) *Manager {
+	t.Helper()
+	m, err := New(s, Params{RPID: "secrets.example.com", Origins: []string{"https://secrets.example.com"}, Name: "secrets"})
+	require.NoError(t, err)
+	return m
+}
+
+// authenticator is a software passkey for tests, makes ES256 credentials with "none" attestation
+type authenticator struct {
+	key        *ecdsa.PrivateKey
+	credID     []byte
+	userHandle []byte
+	counter    uint32
+	origin     string
+}
+
+func newAuthenticator(t *testing.T, origin string) *authenticator {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	credID := make([]byte, 16)
+	_, err = rand.Read(credID)
+	require.NoError(t, err)
+	return &authenticator{key: key, credID: credID, origin: origin}
+}
+
+// create responds to registration options as navigator.credentials.create does
+func (a *authenticator) create(t *testing.T, options []byte) string {
+	t.Helper()
+	var opts struct {
+		PublicKey struct {
+			Challenge string `json:"challenge"`
+			RP        struct {
+				ID string `json:"id"`
+			} `json:"rp"`
+			User struct {
+				ID string `json:"id"`
+			} `json:"user"`
+		} `json:"publicKey"`
+	}
+	require.NoError(t, json.Unmarshal(options, &opts))
+	handle, err := base64.RawURLEncoding.DecodeString(opts.PublicKey.User.ID)
+	require.NoError(t, err)
+	a.userHandle = handle
+
+	ecdh, err := a.key.PublicKey.ECDH()
+	require.NoError(t, err)
+	point := ecdh.Bytes() // uncompressed, 0x04 || x || y
+	coseKey, err := webauthncbor.Marshal(webauthncose.EC2PublicKeyData{
+		PublicKeyData: webauthncose.PublicKeyData{KeyType: int64(webauthncose.EllipticKey),
+			Algorithm: int64(webauthncose.AlgES256)},
+		Curve: int64(webauthncose.P256), XCoord: point[1:33], YCoord: point[33:]})
+	require.NoError(t, err)
+
+	authData := a.authData(opts.PublicKey.RP.ID, 0x45) // user present, verified, attested credential data
+	authData = append(authData, make([]byte, 16)...)   // zero aaguid
+	authData = binary.BigEndian.AppendUint16(authData, uint16(len(a.credID)))
+	authData = append(authData, a.credID...)
+	authData = append(authData, coseKey...)
+	attObj, err := webauthncbor.Marshal(map[string]any{"fmt": "none", "attStmt": map[string]any{}, "authData": authData})
+	require.NoError(t, err)
+
+	return a.respond(t, map[string]any{
+		"clientDataJSON":    a.clientData(t, "webauthn.create", opts.PublicKey.Challenge),
+		"attestationObject": b64(attObj),
+	})
+}
+
+// get responds to login options as navigator.credentials.get does, the counter goes up with each login
+func (a *authenticator) get(t *testing.T, options []byte) string {
+	t.Helper()
+	var opts struct {
+		PublicKey struct {
+			Challenge string `json:"challenge"`
+			RPID      string `json:"rpId"`
+		} `json:"publicKey"`
+	}
+	require.NoError(t, json.Unmarshal(options, &opts))
+	a.counter++
+	authData := a.authData(opts.PublicKey.RPID, 0x05) // user present and verified
+	clientData := a.clientData(t, "webauthn.get", opts.PublicKey.Challenge)
+	raw, err := base64.RawURLEncoding.DecodeString(clientData)
+	require.NoError(t, err)
+	clientHash := sha256.Sum256(raw)
+	digest := sha256.Sum256(append(append([]byte{}, authData...), clientHash[:]...))
+	sig, err := ecdsa.SignASN1(rand.Reader, a.key, digest[:])
+	require.NoError(t, err)
+
+	return a.respond(t, map[string]any{
+		"clientDataJSON":    clientData,
+		"authenticatorData": b64(authData),
+		"signature":         b64(sig),
+		"userHandle":        b64(a.userHandle),
+	})
+}
+
+func (a *authenticator) authData(rpID string, flags byte) []byte {
+	rpHash := sha256.Sum256([]byte(rpID))
+	res := append(rpHash[:], flags)
+	return binary.BigEndian.AppendUint32(res, a.counter)
+}
+
+func (a *authenticator) clientData(t *testing.T, typ, challenge string) string {
+	t.Helper()
+	data, err := json.Marshal(map[string]any{"type": typ, "challenge": challenge, "origin": a.origin, "crossOrigin": false})
+	require.NoError(t, err)
+	return b64(data)
+}
+
+func (a *authenticator) respond(t *testing.T, response map[string]any) string {
+	t.Helper()
+	data, err := json.Marshal(map[string]any{"id": b64(a.credID), "rawId": b64(a.credID), "type": "public-key",
+		"response": response})
+	require.NoError(t, err)
+	return string(data)
+}
+
+func b64(b []byte) string { return base64.RawURLEncoding.EncodeToString(b) }
@@ -0,0 +1,23 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/umputun/secrets/v2/app/messager"
+)
+
+// runRekey re-encrypts stored messages under the active sign key and reports results to out
+func runRekey(ctx context.Context, out io.Writer, m *messager.MessageProc) error {
+	stats, err := m.Rekey(ctx)
+	_, _ = fmt.Fprintf(out, "messages: %d, re-encrypted: %d, already current: %d, skipped: %d, failed: %d\n",
+		stats.Total, stats.Rewrapped, stats.Current, stats.Skipped, stats.Failed)
+	if err != nil {
+		return fmt.Errorf("rekey: %w", err)
+	}
+	if stats.Failed > 0 {
+		return fmt.Errorf("failed to re-encrypt %d message(s)", stats.Failed)
+	}
+	return nil
+}
@@ -0,0 +1,195 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"time"
+
+	log "github.com/go-pkgz/lgr"
+	"github.com/go-pkgz/rest"
+
+	"github.com/umputun/secrets/v2/app/messager"
+	"github.com/umputun/secrets/v2/app/store"
+	"github.com/umputun/secrets/v2/app/tokens"
+)
+
+// error codes of API v2 responses
+const (
+	codeBadRequest        = "bad_request"
+	codeInvalidPin        = "invalid_pin"
+	codeUnauthorized      = "unauthorized"
+	codeForbidden         = "forbidden"
+	codeTooManyAttempts   = "too_many_attempts"
+	codeWrongPin          = "wrong_pin"
+	codeAttemptsExhausted = "pin_attempts_exhausted"
+	codeExpired           = "expired"
+	codeFilesDisabled     = "files_disabled"
+	codeTooLarge          = "too_large"
+	codeInternal          = "internal"
+)
+
+// pinHeader passes pin of v2 retrieval, alternative to pin in the request body
+const pinHeader = "X-Secrets-Pin"
+
+// POST /v2/message, same request as v1
+func (s Server) saveMessageV2Ctrl(w http.ResponseWriter, r *http.Request) {
+	caller, apiErr := s.checkAPIAuth(w, r, tokens.ScopeCreateText)
+	if apiErr != nil {
+		sendErrorV2(w, r, apiErr)
+		return
+	}
+	request := apiMsgRequest{}
+	if err := rest.DecodeJSON(r, &request); err != nil {
+		sendErrorV2(w, r, &apiError{status: http.StatusBadRequest, code: codeBadRequest, msg: "can't decode request", err: err})
+		return
+	}
+	msg, apiErr := s.makeAPIMessage(r, request, caller)
+	if apiErr != nil {
+		sendErrorV2(w, r, apiErr)
+		return
+	}
+	_ = rest.EncodeJSON(w, http.StatusCreated, withExpV2(rest.JSON{"key": msg.Key, "max_views": msg.MaxViews,
+		"token": msg.MgmtToken}, msg.Exp))
+}
+
+// POST /v2/message/{key}, pin passed in X-Secrets-Pin header or {"pin": "..."} body, none for PIN-less message
+func (s Server) getMessageV2Ctrl(w http.ResponseWriter, r *http.Request) {
+	key, pin, apiErr := s.retrievalReqV2(r)
+	if apiErr != nil {
+		sendErrorV2(w, r, apiErr)
+		return
+	}
+
+	// make sure loading takes constant time on any branch to prevent timing attacks
+	st := time.Now()
+	msg, err := s.messager.LoadMessage(r.Context(), key, pin)
+	if elapsed := time.Since(st); elapsed < 100*time.Millisecond {
+		time.Sleep(100*time.Millisecond - elapsed)
+	}
+	if err != nil {
+		apiErr = s.loadErrorV2(msg, err)
+		log.Printf("[INFO] accessed message %s, type=unknown, status=%d (%s), ip=%s", key, apiErr.status, apiErr.code,
+			GetHashedIP(r))
+		sendErrorV2(w, r, apiErr)
+		return
+	}
+
+	res, msgType, apiErr := s.messageResponse(msg)
+	if apiErr != nil {
+		sendErrorV2(w, r, apiErr)
+		return
+	}
+	_ = rest.EncodeJSON(w, http.StatusOK, withExpV2(res, msg.Exp))
+	log.Printf("[INFO] accessed message %s, type=%s, status=200 (success), ip=%s", key, msgType, GetHashedIP(r))
+}
+
+// POST /v2/file, same multipart form as v1
+func (s Server) saveFileV2Ctrl(w http.ResponseWriter, r *http.Request) {
+	caller, apiErr := s.checkAPIAuth(w, r, tokens.ScopeCreateFile)
+	if apiErr != nil {
+		sendErrorV2(w, r, apiErr)
+		return
+	}
+	msg, apiErr := s.makeAPIFileMessage(w, r, caller)
+	if apiErr != nil {
+		sendErrorV2(w, r, apiErr)
+		return
+	}
+	_ = rest.EncodeJSON(w, http.StatusCreated, withExpV2(rest.JSON{"key": msg.Key, "max_views": max(msg.MaxViews, 1),
+		"token": msg.MgmtToken}, msg.Exp))
+}
+
+// POST /v2/file/{key}, pin passed the same way as for message, responds with the file content as binary download
+func (s Server) getFileV2Ctrl(w http.ResponseWriter, r *http.Request) {
+	key, pin, apiErr := s.retrievalReqV2(r)
+	if apiErr != nil {
+		sendErrorV2(w, r, apiErr)
+		return
+	}
+	if !s.cfg.EnableFiles {
+		sendErrorV2(w, r, &apiError{status: http.StatusForbidden, code: codeFilesDisabled, msg: "file downloads disabled",
+			err: errors.New("file downloads disabled")})
+		return
+	}
+
+	msg, err := s.loadFileMessage(r.Context(), key, pin)
+	if err != nil {
+		apiErr = s.loadErrorV2(msg, err)
+		log.Printf("[INFO] accessed message %s, type=file, status=%d (%s), ip=%s", key, apiErr.status, apiErr.code,
+			GetHashedIP(r))
+		sendErrorV2(w, r, apiErr)
+		return
+	}
+	if apiErr = writeFile(w, msg); apiErr != nil {
+		sendErrorV2(w, r, apiErr)
+		return
+	}
+	log.Printf("[INFO] accessed message %s, type=file, status=200 (success), ip=%s", key, GetHashedIP(r))
+}
+
+// retrievalReqV2 returns key and pin of v2 retrieval request, pin from the header takes precedence over the body.
+// Empty pin is allowed for PIN-less messages only.
+func (s Server) retrievalReqV2(r *http.Request) (key, pin string, apiErr *apiError) {
+	key, pin = r.PathValue("key"), r.Header.Get(pinHeader)
+	if pin == "" {
+		body := struct {
+			Pin string `json:"pin"`
+		}{}
+		if err := json.NewDecoder(io.LimitReader(r.Body, 4096)).Decode(&body); err != nil && !errors.Is(err, io.EOF) {
+			return "", "", &apiError{status: http.StatusBadRequest, code: codeBadRequest, msg: "can't decode request", err: err}
+		}
+		pin = body.Pin
+	}
+	if key == "" {
+		return "", "", &apiError{status: http.StatusBadRequest, code: codeBadRequest, msg: "no key passed",
+			err: errors.New("no key passed")}
+	}
+	if pin == "" && !s.cfg.AllowNoPin {
+		return "", "", &apiError{status: http.StatusBadRequest, code: codeInvalidPin, msg: "pin required",
+			err: errors.New("no pin passed")}
+	}
+	if pin != "" {
+		if err := s.checkAPIPin(pin, false); err != nil {
+			return "", "", &apiError{status: http.StatusBadRequest, code: codeInvalidPin, msg: err.Error(), err: err}
+		}
+	}
+	return key, pin, nil
+}
+
+// loadErrorV2 maps error of message loading to v2 error, msg is set by messager for wrong pin attempts
+func (s Server) loadErrorV2(msg *store.Message, err error) *apiError {
+	switch {
+	case errors.Is(err, messager.ErrBadPinAttempt):
+		res := &apiError{status: http.StatusExpectationFailed, code: codeWrongPin, msg: "wrong pin", err: err}
+		if msg != nil {
+			res.attemptsLeft = max(s.cfg.MaxPinAttempts-msg.Errors, 0)
+		}
+		return res
+	case errors.Is(err, messager.ErrBadPin):
+		return &apiError{status: http.StatusGone, code: codeAttemptsExhausted,
+			msg: "wrong pin, no attempts left, message deleted", err: err}
+	case errors.Is(err, messager.ErrExpired), errors.Is(err, store.ErrLoadRejected):
+		return &apiError{status: http.StatusNotFound, code: codeExpired, msg: "message expired or deleted", err: err}
+	default:
+		return &apiError{status: http.StatusBadRequest, code: codeBadRequest, msg: err.Error(), err: err}
+	}
+}
+
+// sendErrorV2 responds with {"error": "message", "code": "code"}, wrong pin errors have attempts_left as well
+func sendErrorV2(w http.ResponseWriter, r *http.Request, e *apiError) {
+	log.Printf("[INFO] %s - %s - %d - %s [caused by %v]", e.msg, GetHashedIP(r), e.status, r.URL.Path, e.err)
+	res := rest.JSON{"error": e.msg, "code": e.code}
+	if e.code == codeWrongPin {
+		res["attempts_left"] = e.attemptsLeft
+	}
+	_ = rest.EncodeJSON(w, e.status, res)
+}
+
+// withExpV2 adds expiration to v2 response, as seconds left in exp and as RFC3339 UTC time in expires_at
+func withExpV2(res rest.JSON, exp time.Time) rest.JSON {
+	res["exp"] = max(int(time.Until(exp).Seconds()), 0)
+	res["expires_at"] = exp.UTC().Format(time.RFC3339)
+	return res
+}
@@ -0,0 +1,242 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServer_APIv2_Message(t *testing.T) {
+	ts, eng := prepServer(t, Config{AllowNoPin: true})
+	client := http.Client{Timeout: 5 * time.Second}
+
+	save := func(t *testing.T, body string) (key string) {
+		t.Helper()
+		resp, err := client.Post(ts.URL+"/api/v2/message", "application/json", strings.NewReader(body))
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusCreated, resp.StatusCode)
+		res := map[string]any{}
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&res))
+		assert.InDelta(t, 600, res["exp"], 2)
+		expiresAt, err := time.Parse(time.RFC3339, res["expires_at"].(string))
+		require.NoError(t, err)
+		assert.WithinDuration(t, time.Now().Add(10*time.Minute), expiresAt, 2*time.Second)
+		assert.NotEmpty(t, res["token"])
+		return res["key"].(string)
+	}
+	load := func(t *testing.T, key, pinHdr, body string) (status int, res map[string]any) {
+		t.Helper()
+		req, err := http.NewRequest(http.MethodPost, ts.URL+"/api/v2/message/"+key, strings.NewReader(body))
+		require.NoError(t, err)
+		if pinHdr != "" {
+			req.Header.Set(pinHeader, pinHdr)
+		}
+		resp, err := client.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		res = map[string]any{}
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&res))
+		return resp.StatusCode, res
+	}
+
+	t.Run("pin in header", func(t *testing.T) {
+		key := save(t, `{"message": "hdr secret", "exp": 600, "pin": "12345"}`)
+		status, res := load(t, key, "12345", "")
+		require.Equal(t, http.StatusOK, status)
+		assert.Equal(t, "hdr secret", res["message"])
+		assert.InDelta(t, 600, res["exp"], 2)
+		assert.NotEmpty(t, res["expires_at"])
+	})
+
+	t.Run("pin in body", func(t *testing.T) {
+		key := save(t, `{"message": "body secret", "exp": 600, "pin": "12345"}`)
+		status, res := load(t, key, "", `{"pin": "12345"}`)
+		require.Equal(t, http.StatusOK, status)
+		assert.Equal(t, "body secret", res["message"])
+	})
+
+	t.Run("no pin for pin-less message", func(t *testing.T) {
+		msg, err := eng.Load(t.Context(), save(t, `{"message": "`+strings.Repeat("A", 40)+`", "exp": 600, "client_enc": true}`))
+		require.NoError(t, err)
+		status, res := load(t, msg.Key, "", "")
+		require.Equal(t, http.StatusOK, status)
+		assert.Equal(t, true, res["client_enc"])
+	})
+
+	t.Run("wrong pin counts attempts", func(t *testing.T) {
+		key := save(t, `{"message": "my secret", "exp": 600, "pin": "12345"}`)
+		status, res := load(t, key, "11111", "")
+		require.Equal(t, http.StatusExpectationFailed, status)
+		assert.Equal(t, map[string]any{"error": "wrong pin", "code": "wrong_pin", "attempts_left": 2.0}, res)
+
+		status, res = load(t, key, "", `{"pin": "11111"}`)
+		require.Equal(t, http.StatusExpectationFailed, status)
+		assert.Equal(t, 1.0, res["attempts_left"])
+
+		status, res = load(t, key, "11111", "")
+		require.Equal(t, http.StatusGone, status)
+		assert.Equal(t, "pin_attempts_exhausted", res["code"])
+		assert.NotContains(t, res, "attempts_left")
+
+		status, res = load(t, key, "12345", "")
+		require.Equal(t, http.StatusNotFound, status)
+		assert.Equal(t, "expired", res["code"])
+	})
+
+	t.Run("unknown key", func(t *testing.T) {
+		status, res := load(t, "nokeynokeyno", "12345", "")
+		require.Equal(t, http.StatusNotFound, status)
+		assert.Equal(t, "expired", res["code"])
+	})
+
+	t.Run("invalid pin", func(t *testing.T) {
+		status, res := load(t, "nokeynokeyno", "123", "")
+		require.Equal(t, http.StatusBadRequest, status)
+		assert.Equal(t, "invalid_pin", res["code"])
+	})
+
+	t.Run("bad body", func(t *testing.T) {
+		status, res := load(t, "nokeynokeyno", "", `{"pin": `)
+		require.Equal(t, http.StatusBadRequest, status)
+		assert.Equal(t, "bad_request", res["code"])
+	})
+
+	t.Run("bad create request", func(t *testing.T) {
+		resp, err := client.Post(ts.URL+"/api/v2/message", "application/json",
+			strings.NewReader(`{"message": "my secret", "exp": 600, "pin": "12"}`))
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+		res := map[string]any{}
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&res))
+		assert.Equal(t, "invalid_pin", res["code"])
+		assert.Equal(t, "incorrect pin size", res["error"])
+	})
+
+	t.Run("pin required without allow-no-pin", func(t *testing.T) {
+		tsPin, _ := prepServer(t, Config{})
+		resp, err := client.Post(tsPin.URL+"/api/v2/message/nokeynokeyno", "application/json", http.NoBody)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+		res := map[string]any{}
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&res))
+		assert.Equal(t, "invalid_pin", res["code"])
+	})
+
+	t.Run("get method not allowed", func(t *testing.T) {
+		resp, err := client.Get(ts.URL + "/api/v2/message/nokeynokeyno")
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+	})
+}
+
+func TestServer_APIv2_File(t *testing.T) {
+	ts, _ := prepServer(t, Config{EnableFiles: true, MaxFileSize: 4096})
+	client := http.Client{Timeout: 5 * time.Second}
+
+	upload := func(t *testing.T, url string, data []byte) (status int, res map[string]any) {
+		t.Helper()
+		body := &bytes.Buffer{}
+		mw := multipart.NewWriter(body)
+		require.NoError(t, mw.WriteField("exp", "600"))
+		require.NoError(t, mw.WriteField("pin", "12345"))
+		fw, err := mw.CreateFormFile("file", "key.bin")
+		require.NoError(t, err)
+		_, err = fw.Write(data)
+		require.NoError(t, err)
+		require.NoError(t, mw.Close())
+		resp, err := client.Post(url+"/api/v2/file", mw.FormDataContentType(), body)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		res = map[string]any{}
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&res))
+		return resp.StatusCode, res
+	}
+	binData := []byte{0x00, 0xff, 0xfe, 'k', 0x0a}
+
+	t.Run("upload and download", func(t *testing.T) {
+		status, res := upload(t, ts.URL, binData)
+		require.Equal(t, http.StatusCreated, status)
+		assert.InDelta(t, 600, res["exp"], 2)
+		assert.NotEmpty(t, res["expires_at"])
+
+		req, err := http.NewRequest(http.MethodPost, ts.URL+"/api/v2/file/"+res["key"].(string), http.NoBody)
+		require.NoError(t, err)
+		req.Header.Set(pinHeader, "12345")
+		resp, err := client.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, `attachment; filename="key.bin"`, resp.Header.Get("Content-Disposition"))
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		assert.Equal(t, binData, body)
+	})
+
+	t.Run("wrong pin", func(t *testing.T) {
+		status, res := upload(t, ts.URL, binData)
+		require.Equal(t, http.StatusCreated, status)
+		resp, err := client.Post(ts.URL+"/api/v2/file/"+res["key"].(string), "application/json",
+			strings.NewReader(`{"pin": "11111"}`))
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusExpectationFailed, resp.StatusCode)
+		errRes := map[string]any{}
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&errRes))
+		assert.Equal(t, map[string]any{"error": "wrong pin", "code": "wrong_pin", "attempts_left": 2.0}, errRes)
+	})
+
+	t.Run("too large", func(t *testing.T) {
+		status, res := upload(t, ts.URL, make([]byte, 4097))
+		require.Equal(t, http.StatusRequestEntityTooLarge, status)
+		assert.Equal(t, "too_large", res["code"])
+	})
+
+	t.Run("files disabled", func(t *testing.T) {
+		tsNoFiles, _ := prepServer(t, Config{})
+		status, res := upload(t, tsNoFiles.URL, binData)
+		require.Equal(t, http.StatusForbidden, status)
+		assert.Equal(t, "files_disabled", res["code"])
+
+		req, err := http.NewRequest(http.MethodPost, tsNoFiles.URL+"/api/v2/file/nokeynokeyno", http.NoBody)
+		require.NoError(t, err)
+		req.Header.Set(pinHeader, "12345")
+		resp, err := client.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusForbidden, resp.StatusCode)
+	})
+}
+
+func TestServer_APIv2_Auth(t *testing.T) {
+	ts, _ := prepServer(t, Config{AuthHash: testBcryptHash(t, "passwd")})
+	client := http.Client{Timeout: 5 * time.Second}
+
+	body := `{"message": "my secret", "exp": 600, "pin": "12345"}`
+	resp, err := client.Post(ts.URL+"/api/v2/message", "application/json", strings.NewReader(body))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	res := map[string]any{}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&res))
+	assert.Equal(t, "unauthorized", res["code"])
+
+	req, err := http.NewRequest(http.MethodPost, ts.URL+"/api/v2/message", strings.NewReader(body))
+	require.NoError(t, err)
+	req.SetBasicAuth(authUser, "passwd")
+	resp2, err := client.Do(req)
+	require.NoError(t, err)
+	defer resp2.Body.Close()
+	assert.Equal(t, http.StatusCreated, resp2.StatusCode)
+}
@@ -3,7 +3,7 @@ package assets
 
 import "embed"
 
-// Files is embedded static files
+// Files is embedded static files, templates and openapi spec
 //
-//go:embed "html" "static"
+//go:embed "html" "static" "openapi.json"
 var Files embed.FS
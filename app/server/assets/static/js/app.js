@@ -637,6 +637,15 @@ function showSuccessCard(title, message) {
         '<a href="/" class="main-btn">Create New Secret</a></div>';
 }
 
+// removalNote describes what happened to the message on the server after this read
+function removalNote(resp) {
+    const viewsLeft = parseInt(resp.headers.get('X-Views-Left') || '0', 10);
+    if (viewsLeft > 0) {
+        return 'It can be opened ' + viewsLeft + ' more time(s) before it is deleted from the server.';
+    }
+    return 'It has been permanently deleted from the server.';
+}
+
 async function handleClientDecryption(cryptoKey) {
     const form = document.getElementById('decrypt-form');
     const btn = document.getElementById('decrypt-btn');
@@ -667,7 +676,7 @@ async function handleClientDecryption(cryptoKey) {
                 document.getElementById('message-container').innerHTML =
                     '<div class="card decoded-message">' +
                     '<div class="card-header"><h2 class="card-title">Decrypted Message</h2>' +
-                    '<p class="card-description">This message has been permanently deleted from the server.</p></div>' +
+                    '<p class="card-description">' + removalNote(resp) + '</p></div>' +
                     '<div class="form-group"><textarea id="decoded-msg-text" readonly class="message-output">' +
                     escapeHtml(result.text) + '</textarea></div>' +
                     '<div class="form-row two-cols">' +
@@ -686,7 +695,7 @@ async function handleClientDecryption(cryptoKey) {
                     '<div class="card success-card"><div class="card-header">' +
                     '<h2 class="card-title">File Downloaded</h2></div>' +
                     '<p class="success-message">The file "<span id="downloaded-filename"></span>" has been decrypted and downloaded. ' +
-                    'It has been permanently deleted from the server.</p>' +
+                    removalNote(resp) + '</p>' +
                     '<a href="/" class="main-btn">Create New Secret</a></div>';
                 document.getElementById('downloaded-filename').textContent = result.filename;
             }
@@ -779,6 +788,105 @@ async function handleFileDownload() {
     }
 }
 
+// ============================================================================
+// passkey handlers (login popup and passkey registration page)
+// ============================================================================
+
+function setupPasskeyHandlers() {
+    document.body.addEventListener('click', function(evt) {
+        const btn = evt.target.closest('[data-action="passkey-login"], [data-action="passkey-register"]');
+        if (!btn) return;
+
+        if (btn.dataset.action === 'passkey-login') {
+            passkeyCeremony(btn, '/passkey/login/begin', function(options) {
+                const opts = options.publicKey;
+                opts.challenge = b64urlToBuffer(opts.challenge);
+                (opts.allowCredentials || []).forEach(function(c) { c.id = b64urlToBuffer(c.id); });
+                return navigator.credentials.get({publicKey: opts});
+            });
+            return;
+        }
+        passkeyCeremony(btn, '/passkey/register/begin', function(options) {
+            const opts = options.publicKey;
+            opts.challenge = b64urlToBuffer(opts.challenge);
+            opts.user.id = b64urlToBuffer(opts.user.id);
+            (opts.excludeCredentials || []).forEach(function(c) { c.id = b64urlToBuffer(c.id); });
+            return navigator.credentials.create({publicKey: opts});
+        });
+    });
+}
+
+// passkeyCeremony gets options from the server, asks the browser for passkey and submits its response with the form
+async function passkeyCeremony(btn, beginURL, ceremony) {
+    const form = btn.closest('form');
+    if (!window.PublicKeyCredential) {
+        showFormError(form, 'This browser does not support passkeys');
+        return;
+    }
+
+    btn.disabled = true;
+    try {
+        const resp = await fetch(beginURL, {
+            method: 'POST',
+            body: new URLSearchParams(new FormData(form)),
+            credentials: 'same-origin'
+        });
+        const data = await resp.json();
+        if (!resp.ok) throw new Error(data.error || 'Passkey is not available');
+
+        const cred = await ceremony(data);
+        form.querySelector('input[name="credential"]').value = JSON.stringify(encodeCredential(cred));
+        htmx.trigger(form, 'submit');
+    } catch (err) {
+        showFormError(form, err.name === 'NotAllowedError' ? 'Passkey cancelled or timed out' : err.message);
+        btn.disabled = false;
+    }
+}
+
+// encodeCredential makes JSON of PublicKeyCredential, binary fields are base64url encoded
+function encodeCredential(cred) {
+    const r = cred.response;
+    const response = {clientDataJSON: bufferToB64url(r.clientDataJSON)};
+    if (r.attestationObject) {
+        response.attestationObject = bufferToB64url(r.attestationObject);
+        if (r.getTransports) response.transports = r.getTransports();
+    } else {
+        response.authenticatorData = bufferToB64url(r.authenticatorData);
+        response.signature = bufferToB64url(r.signature);
+        if (r.userHandle) response.userHandle = bufferToB64url(r.userHandle);
+    }
+    return {
+        id: cred.id,
+        rawId: bufferToB64url(cred.rawId),
+        type: cred.type,
+        authenticatorAttachment: cred.authenticatorAttachment || undefined,
+        clientExtensionResults: cred.getClientExtensionResults ? cred.getClientExtensionResults() : {},
+        response: response
+    };
+}
+
+function showFormError(form, msg) {
+    let el = form.querySelector('.form-error');
+    if (!el) {
+        el = document.createElement('div');
+        el.className = 'form-error';
+        form.prepend(el);
+    }
+    el.textContent = msg;
+}
+
+function b64urlToBuffer(str) {
+    const b64 = str.replace(/-/g, '+').replace(/_/g, '/');
+    const bin = atob(b64 + '==='.slice((b64.length + 3) % 4));
+    return Uint8Array.from(bin, function(c) { return c.charCodeAt(0); }).buffer;
+}
+
+function bufferToB64url(buf) {
+    let bin = '';
+    new Uint8Array(buf).forEach(function(b) { bin += String.fromCharCode(b); });
+    return btoa(bin).replace(/\+/g, '-').replace(/\//g, '_').replace(/=+$/, '');
+}
+
 // ============================================================================
 // utility functions
 // ============================================================================
@@ -808,4 +916,5 @@ document.addEventListener('DOMContentLoaded', function() {
     setupFileUploadHandlers();
     setupEncryptionHandlers();
     setupDecryptionHandlers();
+    setupPasskeyHandlers();
 });
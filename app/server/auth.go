@@ -1,10 +1,13 @@
 package server
 
 import (
+	"context"
 	"crypto/hmac"
 	"crypto/sha256"
 	"crypto/subtle"
 	"encoding/base64"
+	"errors"
+	"fmt"
 	"net/http"
 	"strconv"
 	"strings"
@@ -13,6 +16,9 @@ import (
 	log "github.com/go-pkgz/lgr"
 	"github.com/google/uuid"
 	"golang.org/x/crypto/bcrypt"
+
+	"github.com/umputun/secrets/v2/app/sessions"
+	"github.com/umputun/secrets/v2/app/store"
 )
 
 const (
@@ -20,19 +26,117 @@ const (
 	authUser       = "secrets" // hardcoded username for basic auth
 )
 
+// authEnabled checks if creating messages requires login, with the password of "secrets" user, one of named users,
+// SSO or passkey
+func (s Server) authEnabled() bool {
+	return s.passwordEnabled() || s.sso != nil || s.passkeys != nil
+}
+
+// passwordEnabled checks if login with password is possible, SSO may be the only way to log in
+func (s Server) passwordEnabled() bool {
+	return s.cfg.AuthHash != "" || s.users != nil
+}
+
 // isAuthenticated checks if the request has a valid session cookie
-func (s Server) isAuthenticated(r *http.Request) bool {
+func (s Server) isAuthenticated(w http.ResponseWriter, r *http.Request) bool {
+	_, ok := s.sessionUser(w, r)
+	return ok
+}
+
+// sessionUser returns the user of valid session cookie. Session of a user removed since login is rejected.
+func (s Server) sessionUser(w http.ResponseWriter, r *http.Request) (string, bool) {
 	cookie, err := r.Cookie(authCookieName)
 	if err != nil {
-		return false
+		return "", false
+	}
+	user, ok := s.checkSession(w, r, cookie.Value)
+	if !ok || !s.userExists(r.Context(), user) {
+		return "", false
+	}
+	return user, true
+}
+
+// checkSession validates session token of the cookie and returns its user. Without the session store the token
+// expires SessionTTL after login. Stored session has to be active, and its cookie is extended along with it.
+func (s Server) checkSession(w http.ResponseWriter, r *http.Request, token string) (string, bool) {
+	if s.sessions == nil {
+		return s.validateSessionToken(token)
+	}
+	tokenID, _, user, ok := s.parseSessionToken(token)
+	if !ok {
+		return "", false
+	}
+	sess, err := s.sessions.Check(r.Context(), tokenID)
+	if err != nil || sess.User != user {
+		return "", false
 	}
-	return s.validateSessionToken(cookie.Value)
+	s.writeSessionCookie(w, token, int(time.Until(sess.Expires).Round(time.Second).Seconds()))
+	return user, true
 }
 
-// checkBasicAuth validates basic auth credentials for API access
-func (s Server) checkBasicAuth(r *http.Request) bool {
+// checkBasicAuth validates basic auth credentials for API access and returns the user.
+// retryAfter is set if the client is locked out after too many failed attempts.
+// Valid credentials of user with second factor are not a complete login, so they don't reset failed attempts,
+// the caller rejects them.
+func (s Server) checkBasicAuth(r *http.Request) (user string, retryAfter time.Duration, ok bool) {
 	username, password, ok := r.BasicAuth()
 	if !ok {
+		return "", 0, false
+	}
+	complete := !s.totpBlocksBasicAuth(r.Context(), username)
+	ok, retryAfter = s.guardLogin(r, func() bool { return s.checkCredentials(r.Context(), username, password) }, complete)
+	if !ok {
+		log.Printf("[WARN] basic auth failed, ip=%s", GetHashedIP(r))
+		return "", retryAfter, false
+	}
+	return username, 0, true
+}
+
+// guardLogin runs the credentials check unless the client is locked out after too many failed attempts.
+// Returns time left until the client can try again if it is locked out, including lockout started by this failure.
+// Failures are forgotten on success of the complete login only, the password alone doesn't reset failed second factor.
+func (s Server) guardLogin(r *http.Request, check func() bool, complete bool) (ok bool, retryAfter time.Duration) {
+	if s.lockout == nil {
+		return check(), 0
+	}
+	ip := GetHashedIP(r)
+	if wait := s.lockout.Check(r.Context(), ip); wait > 0 {
+		return false, wait
+	}
+	if check() {
+		if complete {
+			s.lockout.Reset(r.Context(), ip)
+		}
+		return true, 0
+	}
+	return false, s.lockout.Fail(r.Context(), ip)
+}
+
+// setRetryAfter sets Retry-After header for locked out client, in whole seconds rounded up
+func setRetryAfter(w http.ResponseWriter, wait time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int((wait+time.Second-1)/time.Second)))
+}
+
+// lockedOutMsg makes a message for locked out client, time to wait is rounded up, so it's not too early to retry
+func lockedOutMsg(wait time.Duration) string {
+	unit := time.Second
+	if wait > time.Minute {
+		unit = time.Minute
+	}
+	return "too many failed attempts, try again in " + humanDuration((wait + unit - 1).Truncate(unit))
+}
+
+// checkCredentials verifies password of named user, or of "secrets" user against AuthHash
+func (s Server) checkCredentials(ctx context.Context, username, password string) bool {
+	if s.users != nil && username != authUser {
+		return s.users.Check(ctx, username, password)
+	}
+	return s.checkAdminPassword(username, password)
+}
+
+// checkAdminPassword verifies credentials of "secrets" user, the only one allowed to manage tokens
+func (s Server) checkAdminPassword(username, password string) bool {
+	if s.cfg.AuthHash == "" {
 		return false
 	}
 
@@ -42,11 +146,93 @@ func (s Server) checkBasicAuth(r *http.Request) bool {
 	// bcrypt password check (already constant-time)
 	passwordCorrect := bcrypt.CompareHashAndPassword([]byte(s.cfg.AuthHash), []byte(password)) == nil
 
-	if !usernameCorrect || !passwordCorrect {
-		log.Printf("[WARN] basic auth failed, ip=%s", GetHashedIP(r))
-		return false
+	return usernameCorrect && passwordCorrect
+}
+
+// userExists checks if the user of a session can still log in, with the password or a passkey
+func (s Server) userExists(ctx context.Context, username string) bool {
+	switch {
+	case strings.HasPrefix(username, ssoUserPrefix):
+		return s.sso != nil
+	case username == authUser && s.cfg.AuthHash != "":
+		return true
+	case username != authUser && s.users != nil && s.users.Exists(ctx, username):
+		return true
+	}
+	return s.passkeyRegistered(ctx, username)
+}
+
+// apiCaller is authorized creator of a message via API
+type apiCaller struct {
+	user  string       // basic auth user, empty if auth disabled or token used
+	token *store.Token // named API token, nil if not used
+}
+
+// String returns the caller for audit logs, "-" if auth disabled
+func (c apiCaller) String() string {
+	switch {
+	case c.token != nil:
+		return "token:" + c.token.Name
+	case c.user != "":
+		return c.user
+	default:
+		return "-"
+	}
+}
+
+// checkAPIAuth authorizes API request creating a message. Bearer token is checked whenever passed and must have
+// the scope, otherwise basic auth is required if auth is enabled.
+func (s Server) checkAPIAuth(w http.ResponseWriter, r *http.Request, scope string) (apiCaller, *apiError) {
+	unauthorized := &apiError{status: http.StatusUnauthorized, code: codeUnauthorized, msg: "authentication required",
+		err: errors.New("unauthorized")}
+
+	if bearer, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		if s.tokens == nil {
+			return apiCaller{}, unauthorized
+		}
+		token, err := s.tokens.Check(r.Context(), bearer)
+		if err != nil {
+			log.Printf("[WARN] token auth failed, ip=%s", GetHashedIP(r))
+			w.Header().Set("WWW-Authenticate", `Bearer realm="secrets"`)
+			return apiCaller{}, unauthorized
+		}
+		if !token.HasScope(scope) {
+			return apiCaller{}, &apiError{status: http.StatusForbidden, code: codeForbidden,
+				msg: "token has no " + scope + " scope", err: fmt.Errorf("token %s has no %s scope", token.ID, scope)}
+		}
+		return apiCaller{token: token}, nil
+	}
+
+	if !s.authEnabled() {
+		return apiCaller{}, nil
+	}
+	// second factor is checked after the password, so it can't be used to probe for users with it
+	user, retryAfter, ok := s.checkBasicAuth(r)
+	if ok && s.totpBlocksBasicAuth(r.Context(), user) {
+		log.Printf("[WARN] basic auth rejected, user=%s has second factor, ip=%s", user, GetHashedIP(r))
+		w.Header().Set("WWW-Authenticate", `Bearer realm="secrets"`)
+		return apiCaller{}, &apiError{status: http.StatusUnauthorized, code: codeUnauthorized,
+			msg: "basic auth not allowed with second factor, use API token", err: errors.New("basic auth with second factor")}
+	}
+	if ok {
+		return apiCaller{user: user}, nil
+	}
+	if retryAfter > 0 {
+		setRetryAfter(w, retryAfter)
+		return apiCaller{}, &apiError{status: http.StatusTooManyRequests, code: codeTooManyAttempts,
+			msg: lockedOutMsg(retryAfter), err: errors.New("locked out")}
 	}
-	return true
+	w.Header().Set("WWW-Authenticate", `Basic realm="secrets"`)
+	return apiCaller{}, unauthorized
+}
+
+// checkTokenExp rejects expiration above the limit of caller's token, basic auth has no own limit
+func (c apiCaller) checkTokenExp(exp time.Duration) *apiError {
+	if c.token == nil || c.token.MaxExp == 0 || exp <= c.token.MaxExp {
+		return nil
+	}
+	return &apiError{status: http.StatusForbidden, code: codeForbidden, msg: "expiration exceeds token limit",
+		err: fmt.Errorf("exp %v exceeds max %v of token %s", exp, c.token.MaxExp, c.token.ID)}
 }
 
 // loginCtrl handles login form submission
@@ -57,26 +243,52 @@ func (s Server) loginCtrl(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// single password mode has no user name field, it's the password of "secrets" user
+	username := strings.TrimSpace(r.PostForm.Get("username"))
+	if username == "" || s.users == nil {
+		username = authUser
+	}
 	password := r.PostForm.Get("password")
 
-	// validate password against bcrypt hash
-	if err := bcrypt.CompareHashAndPassword([]byte(s.cfg.AuthHash), []byte(password)); err != nil {
-		log.Printf("[WARN] login failed, ip=%s", GetHashedIP(r))
-		s.renderLoginPopup(w, r, "invalid password")
+	needTOTP, err := s.totpRequired(r.Context(), username)
+	if err != nil {
+		log.Printf("[ERROR] can't check second factor, %v", err)
+		s.renderLoginPopupWithStatus(w, r, "can't check second factor, try again later", http.StatusInternalServerError)
+		return
+	}
+	ok, retryAfter := s.guardLogin(r, func() bool { return s.checkCredentials(r.Context(), username, password) }, !needTOTP)
+	if retryAfter > 0 {
+		log.Printf("[WARN] login rejected, locked out, user=%q, ip=%s", username, GetHashedIP(r))
+		setRetryAfter(w, retryAfter)
+		s.renderLoginPopupWithStatus(w, r, lockedOutMsg(retryAfter), http.StatusTooManyRequests)
+		return
+	}
+	if !ok {
+		log.Printf("[WARN] login failed, user=%q, ip=%s", username, GetHashedIP(r))
+		errMsg := "invalid password"
+		if s.users != nil {
+			errMsg = "invalid user name or password"
+		}
+		s.renderLoginPopup(w, r, errMsg)
 		return
 	}
 
-	log.Printf("[INFO] login success, ip=%s", GetHashedIP(r))
-	// authentication successful, set session cookie
-	http.SetCookie(w, &http.Cookie{
-		Name:     authCookieName,
-		Value:    s.generateSessionToken(),
-		Path:     "/",
-		HttpOnly: true,
-		Secure:   s.cfg.Protocol == "https",
-		SameSite: http.SameSiteStrictMode,
-		MaxAge:   int(s.cfg.SessionTTL.Seconds()),
-	})
+	if needTOTP {
+		log.Printf("[INFO] login password accepted, second factor required, user=%s, ip=%s", username, GetHashedIP(r))
+		s.renderLoginStep(w, r, s.signTOTPPending(username), "", http.StatusOK)
+		return
+	}
+	s.completeLogin(w, r, username)
+}
+
+// completeLogin starts session of the user authenticated with all factors and closes login popup
+func (s Server) completeLogin(w http.ResponseWriter, r *http.Request, username string) {
+	if err := s.setSessionCookie(w, r, username); err != nil {
+		log.Printf("[ERROR] can't create session, %v", err)
+		s.renderLoginPopupWithStatus(w, r, "can't create session, try again later", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("[INFO] login success, user=%s, ip=%s", username, GetHashedIP(r))
 
 	// close popup and trigger form resubmit
 	w.Header().Set("HX-Trigger", "submitSecretForm")
@@ -85,19 +297,46 @@ func (s Server) loginCtrl(w http.ResponseWriter, r *http.Request) {
 	_, _ = w.Write([]byte(`<div id="popup"></div>`))
 }
 
-// logoutCtrl handles logout
-// GET /logout
-func (s Server) logoutCtrl(w http.ResponseWriter, r *http.Request) {
-	// clear the auth cookie
+// setSessionCookie starts session of authenticated user and sets its cookie.
+// With the session store the session is saved along with hashed IP and user agent of the request.
+func (s Server) setSessionCookie(w http.ResponseWriter, r *http.Request, user string) error {
+	if s.sessions == nil {
+		s.writeSessionCookie(w, s.generateSessionToken(user), int(s.cfg.SessionTTL.Seconds()))
+		return nil
+	}
+	tokenID, sess, err := s.sessions.Create(r.Context(), user, GetHashedIP(r), r.UserAgent())
+	if err != nil {
+		return fmt.Errorf("create session: %w", err)
+	}
+	s.writeSessionCookie(w, s.signSessionToken(tokenID, user), int(time.Until(sess.Expires).Round(time.Second).Seconds()))
+	return nil
+}
+
+// writeSessionCookie sets session cookie with the token, negative maxAge deletes the cookie
+func (s Server) writeSessionCookie(w http.ResponseWriter, token string, maxAge int) {
 	http.SetCookie(w, &http.Cookie{
 		Name:     authCookieName,
-		Value:    "",
+		Value:    token,
 		Path:     "/",
 		HttpOnly: true,
 		Secure:   s.cfg.Protocol == "https",
 		SameSite: http.SameSiteStrictMode,
-		MaxAge:   -1, // delete cookie
+		MaxAge:   maxAge,
 	})
+}
+
+// logoutCtrl handles logout, stored session is removed so its cookie can't be used anymore
+// GET /logout
+func (s Server) logoutCtrl(w http.ResponseWriter, r *http.Request) {
+	if cookie, err := r.Cookie(authCookieName); err == nil && s.sessions != nil {
+		if tokenID, _, user, ok := s.parseSessionToken(cookie.Value); ok {
+			if err = s.sessions.Remove(r.Context(), tokenID); err != nil && !errors.Is(err, sessions.ErrInvalid) {
+				log.Printf("[WARN] can't remove session, %v", err)
+			}
+			log.Printf("[INFO] logout, user=%s, ip=%s", user, GetHashedIP(r))
+		}
+	}
+	s.writeSessionCookie(w, "", -1) // delete cookie
 
 	// redirect to home
 	http.Redirect(w, r, "/", http.StatusSeeOther)
@@ -114,75 +353,100 @@ func (s Server) renderLoginPopup(w http.ResponseWriter, r *http.Request, errorMs
 }
 
 func (s Server) renderLoginPopupWithStatus(w http.ResponseWriter, r *http.Request, errorMsg string, status int) {
+	s.renderLoginStep(w, r, "", errorMsg, status)
+}
+
+// renderLoginStep renders login popup, the second factor step of pending login if set, the password step otherwise
+func (s Server) renderLoginStep(w http.ResponseWriter, r *http.Request, pending, errorMsg string, status int) {
 	data := struct {
-		Error string
-		Theme string
+		Error    string
+		Theme    string
+		Users    bool   // ask for user name
+		Password bool   // show password form
+		SSO      bool   // show SSO login link
+		Passkey  bool   // show passkey login button
+		Pending  string // signed login waiting for the second factor, shows code form instead of password
 	}{
-		Error: errorMsg,
-		Theme: getTheme(r),
+		Error:    errorMsg,
+		Theme:    getTheme(r),
+		Users:    s.users != nil,
+		Password: s.passwordEnabled(),
+		SSO:      s.sso != nil,
+		Passkey:  s.passkeys != nil,
+		Pending:  pending,
 	}
 	s.render(w, status, "login-popup.tmpl.html", "login-popup", data)
 }
 
-// generateSessionToken creates a secure session token
-// format: uuid.timestamp.signature
-func (s Server) generateSessionToken() string {
-	tokenID := uuid.NewString()
-	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
-
-	// use AuthHash as part of the signing key (derived from signKey in practice)
-	secret := s.sessionSecret()
+// generateSessionToken creates a secure session token of the user, not backed by the session store
+func (s Server) generateSessionToken(user string) string {
+	return s.signSessionToken(uuid.NewString(), user)
+}
 
-	h := hmac.New(sha256.New, secret)
-	h.Write([]byte(tokenID))
-	h.Write([]byte(timestamp))
-	signature := base64.StdEncoding.EncodeToString(h.Sum(nil))
+// signSessionToken makes signed session token with the id, which is session token of the store if used
+// format: id.timestamp.user.signature, user is base64url encoded
+func (s Server) signSessionToken(tokenID, user string) string {
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	userB64 := base64.RawURLEncoding.EncodeToString([]byte(user))
+	return tokenID + "." + timestamp + "." + userB64 + "." + s.signSession(tokenID, timestamp, userB64)
+}
 
-	return tokenID + "." + timestamp + "." + signature
+// validateSessionToken validates a session token and its expiration SessionTTL after issue, returns its user
+func (s Server) validateSessionToken(token string) (string, bool) {
+	_, issued, user, ok := s.parseSessionToken(token)
+	if !ok || time.Since(issued) > s.cfg.SessionTTL {
+		return "", false
+	}
+	return user, true
 }
 
-// validateSessionToken validates a session token
-func (s Server) validateSessionToken(token string) bool {
+// parseSessionToken checks signature of a session token and returns its parts, expiration is not checked
+func (s Server) parseSessionToken(token string) (tokenID string, issued time.Time, user string, ok bool) {
 	parts := strings.Split(token, ".")
-	if len(parts) != 3 {
-		return false
+	if len(parts) != 4 {
+		return "", time.Time{}, "", false
 	}
 
-	tokenID := parts[0]
-	timestamp := parts[1]
-	signatureB64 := parts[2]
-
-	// recreate signature
-	secret := s.sessionSecret()
-	h := hmac.New(sha256.New, secret)
-	h.Write([]byte(tokenID))
-	h.Write([]byte(timestamp))
-	expectedSignature := h.Sum(nil)
+	tokenID, timestamp, userB64, signatureB64 := parts[0], parts[1], parts[2], parts[3]
 
 	// decode provided signature
 	signature, err := base64.StdEncoding.DecodeString(signatureB64)
 	if err != nil {
-		return false
+		return "", time.Time{}, "", false
 	}
+	expectedSignature, _ := base64.StdEncoding.DecodeString(s.signSession(tokenID, timestamp, userB64))
 
 	// constant-time comparison
 	if subtle.ConstantTimeCompare(signature, expectedSignature) != 1 {
-		return false
+		return "", time.Time{}, "", false
 	}
 
-	// check expiration
 	timestampInt, err := strconv.ParseInt(timestamp, 10, 64)
 	if err != nil {
-		return false
+		return "", time.Time{}, "", false
 	}
+	userName, err := base64.RawURLEncoding.DecodeString(userB64)
+	if err != nil || len(userName) == 0 {
+		return "", time.Time{}, "", false
+	}
+	return tokenID, time.Unix(timestampInt, 0), string(userName), true
+}
 
-	tokenTime := time.Unix(timestampInt, 0)
-	return time.Since(tokenTime) <= s.cfg.SessionTTL
+// signSession returns base64 signature of session token parts
+func (s Server) signSession(parts ...string) string {
+	h := hmac.New(sha256.New, s.sessionSecret())
+	h.Write([]byte(strings.Join(parts, ".")))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
 }
 
-// sessionSecret returns the secret key for session signing,
-// derived from AuthHash to avoid requiring extra config
+// sessionSecret returns the secret key for session signing. SessionKey is used if set, so the key can be rotated
+// on its own. Otherwise it's derived from AuthHash and SignKey to avoid requiring extra config, and changes
+// with the password. SignKey keeps it secret with named users only and no AuthHash.
 func (s Server) sessionSecret() []byte {
-	h := sha256.Sum256([]byte(s.cfg.AuthHash))
+	if s.cfg.SessionKey != "" {
+		h := sha256.Sum256([]byte("session:" + s.cfg.SessionKey))
+		return h[:]
+	}
+	h := sha256.Sum256([]byte(s.cfg.AuthHash + ":" + s.cfg.SignKey))
 	return h[:]
 }
@@ -2,6 +2,8 @@ package server
 
 import (
 	"context"
+	"encoding/base64"
+	"io"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
@@ -14,9 +16,11 @@ import (
 	"golang.org/x/crypto/bcrypt"
 
 	"github.com/umputun/secrets/v2/app/email"
+	"github.com/umputun/secrets/v2/app/lockout"
 	"github.com/umputun/secrets/v2/app/messager"
 	"github.com/umputun/secrets/v2/app/server/mocks"
 	"github.com/umputun/secrets/v2/app/store"
+	"github.com/umputun/secrets/v2/app/users"
 )
 
 // helper to generate bcrypt hash for testing
@@ -49,20 +53,20 @@ func TestServer_isAuthenticated(t *testing.T) {
 
 	t.Run("no cookie returns false", func(t *testing.T) {
 		req := httptest.NewRequest(http.MethodGet, "/", http.NoBody)
-		assert.False(t, srv.isAuthenticated(req))
+		assert.False(t, srv.isAuthenticated(httptest.NewRecorder(), req))
 	})
 
 	t.Run("invalid cookie returns false", func(t *testing.T) {
 		req := httptest.NewRequest(http.MethodGet, "/", http.NoBody)
 		req.AddCookie(&http.Cookie{Name: authCookieName, Value: "invalid-token"})
-		assert.False(t, srv.isAuthenticated(req))
+		assert.False(t, srv.isAuthenticated(httptest.NewRecorder(), req))
 	})
 
 	t.Run("valid cookie returns true", func(t *testing.T) {
-		token := srv.generateSessionToken()
+		token := srv.generateSessionToken(authUser)
 		req := httptest.NewRequest(http.MethodGet, "/", http.NoBody)
 		req.AddCookie(&http.Cookie{Name: authCookieName, Value: token})
-		assert.True(t, srv.isAuthenticated(req))
+		assert.True(t, srv.isAuthenticated(httptest.NewRecorder(), req))
 	})
 
 	t.Run("expired token returns false", func(t *testing.T) {
@@ -83,12 +87,12 @@ func TestServer_isAuthenticated(t *testing.T) {
 		)
 		require.NoError(t, err)
 
-		token := shortSrv.generateSessionToken()
+		token := shortSrv.generateSessionToken(authUser)
 		time.Sleep(10 * time.Millisecond) // wait for expiration
 
 		req := httptest.NewRequest(http.MethodGet, "/", http.NoBody)
 		req.AddCookie(&http.Cookie{Name: authCookieName, Value: token})
-		assert.False(t, shortSrv.isAuthenticated(req))
+		assert.False(t, shortSrv.isAuthenticated(httptest.NewRecorder(), req))
 	})
 }
 
@@ -114,25 +118,30 @@ func TestServer_checkBasicAuth(t *testing.T) {
 
 	t.Run("no auth header returns false", func(t *testing.T) {
 		req := httptest.NewRequest(http.MethodGet, "/", http.NoBody)
-		assert.False(t, srv.checkBasicAuth(req))
+		_, _, ok := srv.checkBasicAuth(req)
+		assert.False(t, ok)
 	})
 
 	t.Run("wrong username returns false", func(t *testing.T) {
 		req := httptest.NewRequest(http.MethodGet, "/", http.NoBody)
 		req.SetBasicAuth("wronguser", "secret123")
-		assert.False(t, srv.checkBasicAuth(req))
+		_, _, ok := srv.checkBasicAuth(req)
+		assert.False(t, ok)
 	})
 
 	t.Run("wrong password returns false", func(t *testing.T) {
 		req := httptest.NewRequest(http.MethodGet, "/", http.NoBody)
 		req.SetBasicAuth("secrets", "wrongpassword")
-		assert.False(t, srv.checkBasicAuth(req))
+		_, _, ok := srv.checkBasicAuth(req)
+		assert.False(t, ok)
 	})
 
 	t.Run("correct credentials return true", func(t *testing.T) {
 		req := httptest.NewRequest(http.MethodGet, "/", http.NoBody)
 		req.SetBasicAuth("secrets", "secret123")
-		assert.True(t, srv.checkBasicAuth(req))
+		user, _, ok := srv.checkBasicAuth(req)
+		assert.True(t, ok)
+		assert.Equal(t, "secrets", user)
 	})
 }
 
@@ -501,14 +510,14 @@ func TestServer_generateSessionToken(t *testing.T) {
 	require.NoError(t, err)
 
 	t.Run("generates valid token format", func(t *testing.T) {
-		token := srv.generateSessionToken()
+		token := srv.generateSessionToken(authUser)
 		parts := strings.Split(token, ".")
-		assert.Len(t, parts, 3, "token should have 3 parts: uuid.timestamp.signature")
+		assert.Len(t, parts, 4, "token should have 4 parts: uuid.timestamp.user.signature")
 	})
 
 	t.Run("tokens are unique", func(t *testing.T) {
-		token1 := srv.generateSessionToken()
-		token2 := srv.generateSessionToken()
+		token1 := srv.generateSessionToken(authUser)
+		token2 := srv.generateSessionToken(authUser)
 		assert.NotEqual(t, token1, token2)
 	})
 }
@@ -534,28 +543,38 @@ func TestServer_validateSessionToken(t *testing.T) {
 	require.NoError(t, err)
 
 	t.Run("valid token is accepted", func(t *testing.T) {
-		token := srv.generateSessionToken()
-		assert.True(t, srv.validateSessionToken(token))
+		token := srv.generateSessionToken("bob")
+		user, ok := srv.validateSessionToken(token)
+		assert.True(t, ok)
+		assert.Equal(t, "bob", user)
 	})
 
 	t.Run("empty token is rejected", func(t *testing.T) {
-		assert.False(t, srv.validateSessionToken(""))
+		_, ok := srv.validateSessionToken("")
+		assert.False(t, ok)
 	})
 
 	t.Run("malformed token is rejected", func(t *testing.T) {
-		assert.False(t, srv.validateSessionToken("not-a-valid-token"))
-		assert.False(t, srv.validateSessionToken("only.two"))
-		assert.False(t, srv.validateSessionToken("uuid.invalid-timestamp.sig"))
-		assert.False(t, srv.validateSessionToken("uuid.123.!!!invalid-base64!!!"))
+		for _, token := range []string{"not-a-valid-token", "only.two", "uuid.invalid-timestamp.c2VjcmV0cw.sig",
+			"uuid.123.c2VjcmV0cw.!!!invalid-base64!!!", "uuid.123.sig"} {
+			_, ok := srv.validateSessionToken(token)
+			assert.False(t, ok, token)
+		}
 	})
 
 	t.Run("tampered token is rejected", func(t *testing.T) {
-		token := srv.generateSessionToken()
+		token := srv.generateSessionToken(authUser)
 		// tamper with the signature
 		parts := strings.Split(token, ".")
-		parts[2] = "tamperedsignature"
-		tamperedToken := strings.Join(parts, ".")
-		assert.False(t, srv.validateSessionToken(tamperedToken))
+		parts[3] = "tamperedsignature"
+		_, ok := srv.validateSessionToken(strings.Join(parts, "."))
+		assert.False(t, ok)
+
+		// another user with the same signature
+		parts = strings.Split(token, ".")
+		parts[2] = base64.RawURLEncoding.EncodeToString([]byte("admin"))
+		_, ok = srv.validateSessionToken(strings.Join(parts, "."))
+		assert.False(t, ok)
 	})
 
 	t.Run("token from different secret is rejected", func(t *testing.T) {
@@ -575,8 +594,24 @@ func TestServer_validateSessionToken(t *testing.T) {
 		)
 		require.NoError(t, err)
 
-		token := differentSrv.generateSessionToken()
-		assert.False(t, srv.validateSessionToken(token))
+		token := differentSrv.generateSessionToken(authUser)
+		_, ok := srv.validateSessionToken(token)
+		assert.False(t, ok)
+	})
+
+	t.Run("session key independent of password", func(t *testing.T) {
+		keyed := Server{cfg: Config{AuthHash: hash, SessionKey: "session-key-1", SessionTTL: time.Hour}}
+		token := keyed.generateSessionToken(authUser)
+		_, ok := srv.validateSessionToken(token)
+		assert.False(t, ok, "not signed with key derived from password")
+
+		keyed.cfg.AuthHash = testBcryptHash(t, "new-password")
+		_, ok = keyed.validateSessionToken(token)
+		assert.True(t, ok, "password change keeps sessions")
+
+		keyed.cfg.SessionKey = "session-key-2"
+		_, ok = keyed.validateSessionToken(token)
+		assert.False(t, ok, "key rotation ends sessions")
 	})
 }
 
@@ -753,3 +788,179 @@ func TestServer_EmailEndpointsRequireAuth(t *testing.T) {
 		assert.Equal(t, http.StatusOK, resp.StatusCode)
 	})
 }
+
+func TestServer_Users(t *testing.T) {
+	var tbl *users.Table // users of the last made server
+	newServer := func(t *testing.T, authHash string) *httptest.Server {
+		t.Helper()
+		withUsers := func(srv Server, eng *store.SQLite) Server {
+			tbl = users.NewTable(eng)
+			require.NoError(t, tbl.Set(t.Context(), "bob", "bob-pass"))
+			require.NoError(t, tbl.Set(t.Context(), "alice", "alice-pass"))
+			return srv.WithUsers(tbl)
+		}
+		ts, _ := prepServer(t, Config{AuthHash: authHash, SessionTTL: time.Hour, SignKey: "sign-key-1234567890"},
+			withUsers, withTestTokens)
+		return ts
+	}
+	login := func(t *testing.T, ts *httptest.Server, user, password string) *http.Cookie {
+		t.Helper()
+		form := url.Values{"username": {user}, "password": {password}}
+		resp, err := http.Post(ts.URL+"/login", "application/x-www-form-urlencoded", strings.NewReader(form.Encode()))
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		for _, c := range resp.Cookies() {
+			if c.Name == authCookieName {
+				return c
+			}
+		}
+		return nil
+	}
+	generateLink := func(t *testing.T, ts *httptest.Server, cookie *http.Cookie) int {
+		t.Helper()
+		form := url.Values{"message": {"ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnop"}, "pin": {"12345"}, "exp": {"10"},
+			"expUnit": {"m"}}
+		req, err := http.NewRequest(http.MethodPost, ts.URL+"/generate-link", strings.NewReader(form.Encode()))
+		require.NoError(t, err)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("HX-Request", "true")
+		if cookie != nil {
+			req.AddCookie(cookie)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		return resp.StatusCode
+	}
+	apiStatus := func(t *testing.T, ts *httptest.Server, method, path, user, password string) int {
+		t.Helper()
+		req, err := http.NewRequest(method, ts.URL+path, strings.NewReader(`{"message": "test", "exp": 600, "pin": "12345"}`))
+		require.NoError(t, err)
+		req.SetBasicAuth(user, password)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	t.Run("named users only", func(t *testing.T) {
+		ts := newServer(t, "")
+
+		resp, err := http.Get(ts.URL + "/login-popup")
+		require.NoError(t, err)
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Contains(t, string(body), `name="username"`)
+
+		assert.Equal(t, http.StatusUnauthorized, generateLink(t, ts, nil), "auth enabled by users")
+		assert.Nil(t, login(t, ts, "bob", "alice-pass"))
+		assert.Nil(t, login(t, ts, "secrets", ""), "no admin password")
+		cookie := login(t, ts, "bob", "bob-pass")
+		require.NotNil(t, cookie)
+		assert.Equal(t, http.StatusOK, generateLink(t, ts, cookie))
+
+		assert.Equal(t, http.StatusCreated, apiStatus(t, ts, http.MethodPost, "/api/v1/message", "alice", "alice-pass"))
+		assert.Equal(t, http.StatusUnauthorized, apiStatus(t, ts, http.MethodPost, "/api/v1/message", "alice", "bob-pass"))
+		assert.Equal(t, http.StatusForbidden, apiStatus(t, ts, http.MethodGet, "/api/v1/tokens", "alice", "alice-pass"),
+			"token management needs admin password")
+
+		// removed user loses the session
+		require.NoError(t, tbl.Remove(t.Context(), "bob"))
+		assert.Equal(t, http.StatusUnauthorized, generateLink(t, ts, cookie))
+	})
+
+	t.Run("named users with admin password", func(t *testing.T) {
+		ts := newServer(t, testBcryptHash(t, "admin-pass"))
+
+		cookie := login(t, ts, "secrets", "admin-pass")
+		require.NotNil(t, cookie)
+		assert.Equal(t, http.StatusOK, generateLink(t, ts, cookie))
+		require.NotNil(t, login(t, ts, "alice", "alice-pass"))
+
+		assert.Equal(t, http.StatusOK, apiStatus(t, ts, http.MethodGet, "/api/v1/tokens", "secrets", "admin-pass"))
+		assert.Equal(t, http.StatusUnauthorized, apiStatus(t, ts, http.MethodGet, "/api/v1/tokens", "alice", "alice-pass"))
+	})
+}
+
+func TestServer_Lockout(t *testing.T) {
+	var logSecret string
+	keepLogSecret := func(srv Server, _ *store.SQLite) Server { logSecret = srv.logSecret; return srv }
+	ts, eng := prepServer(t, Config{AuthHash: testBcryptHash(t, "passwd"), SessionTTL: time.Hour},
+		withTestTokens, withTestLockout(2), keepLogSecret)
+	client := http.Client{Timeout: 5 * time.Second}
+
+	login := func(t *testing.T, password string) (resp *http.Response, body string) {
+		t.Helper()
+		req, err := http.NewRequest(http.MethodPost, ts.URL+"/login", strings.NewReader(url.Values{"password": {password}}.Encode()))
+		require.NoError(t, err)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		resp, err = client.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		data, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp, string(data)
+	}
+	api := func(t *testing.T, method, path, body string) (resp *http.Response, res string) {
+		t.Helper()
+		req, err := http.NewRequest(method, ts.URL+path, strings.NewReader(body))
+		require.NoError(t, err)
+		req.SetBasicAuth(authUser, "passwd")
+		resp, err = client.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		data, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp, string(data)
+	}
+
+	resp, body := login(t, "wrong")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Contains(t, body, "invalid password")
+	assert.Empty(t, resp.Header.Get("Retry-After"))
+
+	// second failure locks out
+	resp, body = login(t, "wrong")
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	assert.Equal(t, "60", resp.Header.Get("Retry-After"))
+	assert.Contains(t, body, "too many failed attempts, try again in 1 minute")
+	assert.Contains(t, body, `id="popup"`, "rendered as login popup")
+
+	// correct password is not checked during lockout
+	resp, body = login(t, "passwd")
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	assert.Contains(t, body, "too many failed attempts")
+	assert.Empty(t, resp.Cookies())
+
+	msg := `{"message": "secret", "exp": 600, "pin": "12345"}`
+	resp, body = api(t, http.MethodPost, "/api/v1/message", msg)
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	assert.NotEmpty(t, resp.Header.Get("Retry-After"))
+	assert.Contains(t, body, "too many failed attempts")
+
+	resp, body = api(t, http.MethodPost, "/api/v2/message", msg)
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	assert.Contains(t, body, `"code":"too_many_attempts"`)
+
+	resp, _ = api(t, http.MethodGet, "/api/v1/tokens", "")
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	assert.NotEmpty(t, resp.Header.Get("Retry-After"))
+
+	// lockout is over, failures before successful login forgotten
+	require.NoError(t, eng.RemoveFailures(t.Context(), "ip:"+hashIP("127.0.0.1", logSecret)))
+	resp, _ = login(t, "wrong")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	resp, _ = login(t, "passwd")
+	assert.Equal(t, "submitSecretForm", resp.Header.Get("HX-Trigger"))
+	resp, body = login(t, "wrong")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Contains(t, body, "invalid password")
+}
+
+// withTestLockout adds lockout guard over the test server store, locking out after given failed attempts
+func withTestLockout(attempts int) testServerOpt {
+	return func(srv Server, eng *store.SQLite) Server {
+		return srv.WithLockout(lockout.New(eng, lockout.Params{Attempts: attempts, Delay: time.Minute, MaxDelay: time.Hour}))
+	}
+}
@@ -35,7 +35,12 @@ func HashedIP(secret string) func(http.Handler) http.Handler {
 
 // GetHashedIP retrieves hashed IP from context
 func GetHashedIP(r *http.Request) string {
-	if ip, ok := r.Context().Value(hashedIPKey).(string); ok {
+	return HashedIPFromContext(r.Context())
+}
+
+// HashedIPFromContext retrieves hashed IP set by HashedIP middleware, "-" if not set
+func HashedIPFromContext(ctx context.Context) string {
+	if ip, ok := ctx.Value(hashedIPKey).(string); ok {
 		return ip
 	}
 	return "-"
@@ -59,14 +64,15 @@ func Logger(l log.L) func(http.Handler) http.Handler {
 				q = qun
 			}
 
-			// hide key and pin in message paths
-			if strings.Contains(q, "/message/") {
+			// hide key and pin in message and file paths, keys are at least 12 chars
+			if strings.Contains(q, "/message/") || strings.Contains(q, "/file/") {
 				elems := strings.Split(q, "/")
 				for i, elem := range elems {
-					if elem == "message" && i+2 < len(elems) && len(elems[i+1]) >= 18 {
+					if (elem == "message" || elem == "file") && i+2 < len(elems) && len(elems[i+1]) >= 12 &&
+						elems[i+2] != "status" {
 						// show partial key, hide pin
 						prefix := strings.Join(elems[:i+1], "/")
-						q = fmt.Sprintf("%s/%s/*****", prefix, elems[i+1][:17])
+						q = fmt.Sprintf("%s/%s/*****", prefix, elems[i+1][:min(len(elems[i+1]), 17)])
 						break
 					}
 				}
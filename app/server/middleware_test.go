@@ -312,6 +312,9 @@ func TestLoggerMaskingEdgeCases(t *testing.T) {
 		{"no pin segment", "/message/5e4e1633-24b01ef6-49d6-4c8a-acf9", false, "/message/5e4e1633-24b01ef6-49d6-4c8a-acf9"},
 		{"message at end", "/api/message", false, "/api/message"},
 		{"nested message path", "/v1/api/message/5e4e1633-24b01ef6-49d6-4c8a-acf9-9dac0aa0eff9/pin123", true, "/v1/api/message/5e4e1633-24b01ef6/*****"},
+		{"generated key", "/api/v1/message/ZkAnwcKYrX48/12345", true, "/api/v1/message/ZkAnwcKYrX48/*****"},
+		{"file path", "/api/v1/file/ZkAnwcKYrX48/pin123", true, "/api/v1/file/ZkAnwcKYrX48/*****"},
+		{"status path", "/api/v1/message/ZkAnwcKYrX48/status", false, "/api/v1/message/ZkAnwcKYrX48/status"},
 	}
 
 	for _, tt := range tests {
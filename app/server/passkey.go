@@ -0,0 +1,233 @@
+package server
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/go-pkgz/lgr"
+
+	"github.com/umputun/secrets/v2/app/passkey"
+)
+
+const (
+	passkeyCookieName = "secrets_passkey"
+	passkeyFlowTTL    = 5 * time.Minute
+	passkeyFlowLogin  = "login"
+	passkeyFlowReg    = "register"
+	setupInvalidMsg   = "setup link invalid or expired, ask for a new one"
+)
+
+// passkeyForm is data of passkey registration page
+type passkeyForm struct {
+	User  string // user registering the passkey, empty if registration is not allowed
+	Setup string // token of the setup link
+	Name  string
+	Done  bool
+	Error string
+}
+
+// passkeyLoginBeginCtrl starts passkey login, returns options for navigator.credentials.get.
+// The challenge is kept in a short-lived signed cookie until the browser responds.
+// POST /passkey/login/begin
+func (s Server) passkeyLoginBeginCtrl(w http.ResponseWriter, r *http.Request) {
+	options, state, err := s.passkeys.BeginLogin(r.Context())
+	if err != nil {
+		SendErrorJSON(w, r, log.Default(), http.StatusInternalServerError, err, "can't start passkey login")
+		return
+	}
+	s.setPasskeyFlow(w, passkeyFlowLogin, state)
+	writePasskeyOptions(w, options)
+}
+
+// passkeyLoginCtrl completes passkey login with the assertion of the browser and closes login popup.
+// Passkey requires user verification, so it is not followed by the second factor, and it is not a subject
+// of lockout as it can't be guessed.
+// POST /passkey/login
+func (s Server) passkeyLoginCtrl(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		s.renderLoginPopup(w, r, "invalid form data")
+		return
+	}
+	state, ok := s.passkeyFlow(w, r, passkeyFlowLogin)
+	if !ok {
+		s.renderLoginPopup(w, r, "passkey login expired, try again")
+		return
+	}
+	user, err := s.passkeys.FinishLogin(r.Context(), state, strings.NewReader(r.PostForm.Get("credential")))
+	if err != nil {
+		log.Printf("[WARN] passkey login failed, %v, ip=%s", err, GetHashedIP(r))
+		s.renderLoginPopup(w, r, "passkey not accepted")
+		return
+	}
+	s.completeLogin(w, r, user)
+}
+
+// passkeyPageCtrl renders page registering a passkey, for the user of setup link or the user logged in
+// GET /passkey
+func (s Server) passkeyPageCtrl(w http.ResponseWriter, r *http.Request) {
+	form := passkeyForm{Setup: r.URL.Query().Get("setup")}
+	status := http.StatusOK
+	user, errMsg := s.passkeyUser(w, r, form.Setup)
+	if errMsg != "" {
+		form.Error, status = errMsg, http.StatusForbidden
+	}
+	form.User = user
+	s.render(w, status, "passkey.tmpl.html", baseTmpl, s.newTemplateData(r, form))
+}
+
+// passkeyRegisterBeginCtrl starts passkey registration, returns options for navigator.credentials.create
+// POST /passkey/register/begin
+func (s Server) passkeyRegisterBeginCtrl(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		SendErrorJSON(w, r, log.Default(), http.StatusBadRequest, err, "invalid form data")
+		return
+	}
+	user, errMsg := s.passkeyUser(w, r, r.PostForm.Get("setup"))
+	if errMsg != "" {
+		SendErrorJSON(w, r, log.Default(), http.StatusForbidden, errors.New("passkey registration not allowed"), errMsg)
+		return
+	}
+	options, state, err := s.passkeys.BeginRegistration(r.Context(), user)
+	if err != nil {
+		SendErrorJSON(w, r, log.Default(), http.StatusInternalServerError, err, "can't start passkey registration")
+		return
+	}
+	s.setPasskeyFlow(w, passkeyFlowReg, state)
+	writePasskeyOptions(w, options)
+}
+
+// passkeyRegisterCtrl completes passkey registration with the attestation of the browser
+// POST /passkey/register
+func (s Server) passkeyRegisterCtrl(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		s.render(w, http.StatusOK, "passkey.tmpl.html", "passkey-card", passkeyForm{Error: "invalid form data"})
+		return
+	}
+	form := passkeyForm{Setup: r.PostForm.Get("setup"), Name: r.PostForm.Get("name")}
+	user, errMsg := s.passkeyUser(w, r, form.Setup)
+	if errMsg != "" {
+		form.Error = errMsg
+		s.render(w, http.StatusOK, "passkey.tmpl.html", "passkey-card", form)
+		return
+	}
+	form.User = user
+
+	state, ok := s.passkeyFlow(w, r, passkeyFlowReg)
+	if !ok {
+		form.Error = "passkey registration expired, try again"
+		s.render(w, http.StatusOK, "passkey.tmpl.html", "passkey-card", form)
+		return
+	}
+	_, err := s.passkeys.FinishRegistration(r.Context(), passkey.Registration{User: user, Name: form.Name, Setup: form.Setup,
+		State: state}, strings.NewReader(r.PostForm.Get("credential")))
+	switch {
+	case errors.Is(err, passkey.ErrSetupInvalid):
+		log.Printf("[WARN] passkey registration failed, %v, user=%s, ip=%s", err, user, GetHashedIP(r))
+		form.User, form.Error = "", setupInvalidMsg
+	case errors.Is(err, passkey.ErrInvalid):
+		log.Printf("[WARN] passkey registration failed, %v, user=%s, ip=%s", err, user, GetHashedIP(r))
+		form.Error = "passkey not accepted, try again"
+	case err != nil:
+		log.Printf("[ERROR] can't register passkey, %v", err)
+		form.Error = "can't register passkey, try again later"
+	default:
+		form.Done = true
+	}
+	s.render(w, http.StatusOK, "passkey.tmpl.html", "passkey-card", form)
+}
+
+// passkeyUser returns the user registering a passkey, the user of setup link if passed, the user logged in otherwise.
+// SSO users log in with SSO only. Returns message for the user if registration is not allowed.
+func (s Server) passkeyUser(w http.ResponseWriter, r *http.Request, setup string) (user, errMsg string) {
+	if setup != "" {
+		user, err := s.passkeys.SetupUser(r.Context(), setup)
+		if err != nil {
+			return "", setupInvalidMsg
+		}
+		return user, ""
+	}
+	user, ok := s.sessionUser(w, r)
+	if !ok {
+		return "", "log in to add a passkey, or open the setup link"
+	}
+	if strings.HasPrefix(user, ssoUserPrefix) {
+		return "", "passkeys are not available for SSO users"
+	}
+	return user, ""
+}
+
+// passkeyRegistered checks if the user has a passkey, so the user can log in without password.
+// Store error counts as no passkey, so sessions fail closed.
+func (s Server) passkeyRegistered(ctx context.Context, user string) bool {
+	if s.passkeys == nil {
+		return false
+	}
+	ok, err := s.passkeys.Registered(ctx, user)
+	if err != nil {
+		log.Printf("[WARN] can't check passkeys of %s, %v", user, err)
+		return false
+	}
+	return ok
+}
+
+// setPasskeyFlow keeps state of passkey login or registration in signed cookie until the browser responds,
+// format: kind.timestamp.state.signature, state is base64url encoded
+func (s Server) setPasskeyFlow(w http.ResponseWriter, kind string, state []byte) {
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	stateB64 := base64.RawURLEncoding.EncodeToString(state)
+	http.SetCookie(w, &http.Cookie{
+		Name:     passkeyCookieName,
+		Value:    strings.Join([]string{kind, timestamp, stateB64, s.signSession("passkey", kind, timestamp, stateB64)}, "."),
+		Path:     "/passkey",
+		HttpOnly: true,
+		Secure:   s.cfg.Protocol == "https",
+		SameSite: http.SameSiteStrictMode,
+		MaxAge:   int(passkeyFlowTTL.Seconds()),
+	})
+}
+
+// passkeyFlow returns state of passkey login or registration kept by setPasskeyFlow, the cookie is single use
+func (s Server) passkeyFlow(w http.ResponseWriter, r *http.Request, kind string) ([]byte, bool) {
+	cookie, err := r.Cookie(passkeyCookieName)
+	if err != nil {
+		return nil, false
+	}
+	http.SetCookie(w, &http.Cookie{Name: passkeyCookieName, Value: "", Path: "/passkey", HttpOnly: true,
+		Secure: s.cfg.Protocol == "https", SameSite: http.SameSiteStrictMode, MaxAge: -1})
+
+	parts := strings.Split(cookie.Value, ".")
+	if len(parts) != 4 || parts[0] != kind {
+		return nil, false
+	}
+	signature, err := base64.StdEncoding.DecodeString(parts[3])
+	if err != nil {
+		return nil, false
+	}
+	expected, _ := base64.StdEncoding.DecodeString(s.signSession("passkey", parts[0], parts[1], parts[2]))
+	if subtle.ConstantTimeCompare(signature, expected) != 1 {
+		return nil, false
+	}
+	timestamp, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || time.Since(time.Unix(timestamp, 0)) > passkeyFlowTTL {
+		return nil, false
+	}
+	state, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, false
+	}
+	return state, true
+}
+
+// writePasskeyOptions sends options of passkey ceremony to the browser, they are JSON already
+func writePasskeyOptions(w http.ResponseWriter, options []byte) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(options)
+}
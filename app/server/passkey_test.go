@@ -0,0 +1,184 @@
+package server
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/umputun/secrets/v2/app/passkey"
+	"github.com/umputun/secrets/v2/app/store"
+)
+
+// fakePasskeys accepts response "ok" to registration and user name with a passkey to login,
+// with the state of the last begin only
+type fakePasskeys struct {
+	state string
+	users map[string]bool   // users with passkey
+	setup map[string]string // setup token to user
+}
+
+func (f *fakePasskeys) BeginLogin(context.Context) (options, state []byte, err error) {
+	f.state = "login:" + randomString()
+	return []byte(`{"publicKey":{"challenge":"Y2hhbGxlbmdl"}}`), []byte(f.state), nil
+}
+
+func (f *fakePasskeys) FinishLogin(_ context.Context, state []byte, response io.Reader) (string, error) {
+	user, err := io.ReadAll(response)
+	if err != nil || string(state) != f.state || !f.users[string(user)] {
+		return "", passkey.ErrInvalid
+	}
+	return string(user), nil
+}
+
+func (f *fakePasskeys) BeginRegistration(_ context.Context, user string) (options, state []byte, err error) {
+	f.state = "register:" + user + ":" + randomString()
+	return []byte(`{"publicKey":{"challenge":"Y2hhbGxlbmdl"}}`), []byte(f.state), nil
+}
+
+func (f *fakePasskeys) FinishRegistration(_ context.Context, reg passkey.Registration, response io.Reader) (*store.Passkey, error) {
+	resp, err := io.ReadAll(response)
+	if err != nil || string(reg.State) != f.state || string(resp) != "ok" {
+		return nil, passkey.ErrInvalid
+	}
+	if reg.Setup != "" {
+		if f.setup[reg.Setup] != reg.User {
+			return nil, passkey.ErrSetupInvalid
+		}
+		delete(f.setup, reg.Setup)
+	}
+	f.users[reg.User] = true
+	return &store.Passkey{ID: "id-" + reg.User, User: reg.User, Name: reg.Name}, nil
+}
+
+func (f *fakePasskeys) SetupUser(_ context.Context, token string) (string, error) {
+	if user, ok := f.setup[token]; ok {
+		return user, nil
+	}
+	return "", passkey.ErrSetupInvalid
+}
+
+func (f *fakePasskeys) Registered(_ context.Context, user string) (bool, error) {
+	return f.users[user], nil
+}
+
+func TestServer_Passkey(t *testing.T) {
+	pk := &fakePasskeys{users: map[string]bool{}, setup: map[string]string{"setup-token": "alice"}}
+	ts, _ := prepServer(t, Config{SessionTTL: time.Hour, SignKey: "sign-key-1234567890"},
+		func(srv Server, _ *store.SQLite) Server { return srv.WithPasskeys(pk) })
+
+	newClient := func(t *testing.T) *http.Client {
+		t.Helper()
+		jar, err := cookiejar.New(nil)
+		require.NoError(t, err)
+		return &http.Client{Jar: jar, Timeout: 5 * time.Second}
+	}
+	get := func(t *testing.T, client *http.Client, u string) (status int, body string) {
+		t.Helper()
+		resp, err := client.Get(ts.URL + u)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		data, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp.StatusCode, string(data)
+	}
+
+	t.Run("login popup without password", func(t *testing.T) {
+		_, body := get(t, newClient(t), "/login-popup")
+		assert.Contains(t, body, `data-action="passkey-login"`)
+		assert.Contains(t, body, `hx-post="/passkey/login"`)
+		assert.NotContains(t, body, `name="password"`)
+		assert.NotContains(t, body, "login-divider")
+	})
+
+	client := newClient(t)
+	t.Run("register with setup link", func(t *testing.T) {
+		status, body := get(t, client, "/passkey?setup=bad")
+		assert.Equal(t, http.StatusForbidden, status)
+		assert.Contains(t, body, "setup link invalid or expired")
+		assert.NotContains(t, body, `data-action="passkey-register"`)
+
+		status, body = get(t, client, "/passkey?setup=setup-token")
+		assert.Equal(t, http.StatusOK, status)
+		assert.Contains(t, body, "<strong>alice</strong>")
+		assert.Contains(t, body, `name="setup" value="setup-token"`)
+		assert.Contains(t, body, `data-action="passkey-register"`)
+
+		form := url.Values{"setup": {"setup-token"}, "name": {"laptop"}, "credential": {"ok"}}
+		_, body = postForm(t, client, ts.URL+"/passkey/register", form)
+		assert.Contains(t, body, "passkey registration expired, try again", "no begin before")
+
+		resp, body := postForm(t, client, ts.URL+"/passkey/register/begin", url.Values{"setup": {"bad"}})
+		assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+		assert.JSONEq(t, `{"error":"setup link invalid or expired, ask for a new one"}`, body)
+
+		resp, body = postForm(t, client, ts.URL+"/passkey/register/begin", url.Values{"setup": {"setup-token"}})
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+		assert.JSONEq(t, `{"publicKey":{"challenge":"Y2hhbGxlbmdl"}}`, body)
+		_, body = postForm(t, client, ts.URL+"/passkey/register", form)
+		assert.Contains(t, body, "Passkey Registered")
+		assert.True(t, pk.users["alice"])
+
+		_, body = postForm(t, client, ts.URL+"/passkey/register", form)
+		assert.Contains(t, body, "setup link invalid or expired", "setup link used up")
+	})
+
+	t.Run("login", func(t *testing.T) {
+		resp, body := postForm(t, client, ts.URL+"/passkey/login", url.Values{"credential": {"alice"}})
+		assert.Contains(t, body, "passkey login expired, try again", "no begin before")
+		assert.Empty(t, resp.Header.Get("HX-Trigger"))
+
+		resp, body = postForm(t, client, ts.URL+"/passkey/login/begin", nil)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.JSONEq(t, `{"publicKey":{"challenge":"Y2hhbGxlbmdl"}}`, body)
+		resp, body = postForm(t, client, ts.URL+"/passkey/login", url.Values{"credential": {"bob"}})
+		assert.Contains(t, body, "passkey not accepted")
+		assert.Empty(t, resp.Header.Get("HX-Trigger"))
+
+		status, body := get(t, client, "/passkey")
+		assert.Equal(t, http.StatusForbidden, status, "not logged in yet")
+		assert.Contains(t, body, "log in to add a passkey")
+
+		_, _ = postForm(t, client, ts.URL+"/passkey/login/begin", nil)
+		resp, _ = postForm(t, client, ts.URL+"/passkey/login", url.Values{"credential": {"alice"}})
+		assert.Equal(t, "submitSecretForm", resp.Header.Get("HX-Trigger"))
+
+		// replayed response is rejected, the flow cookie is single use
+		resp, body = postForm(t, client, ts.URL+"/passkey/login", url.Values{"credential": {"alice"}})
+		assert.Contains(t, body, "passkey login expired, try again")
+		assert.Empty(t, resp.Header.Get("HX-Trigger"))
+	})
+
+	t.Run("logged in user adds passkey", func(t *testing.T) {
+		status, body := get(t, client, "/passkey")
+		assert.Equal(t, http.StatusOK, status)
+		assert.Contains(t, body, "<strong>alice</strong>")
+
+		_, _ = postForm(t, client, ts.URL+"/passkey/login/begin", nil)
+		_, body = postForm(t, client, ts.URL+"/passkey/register", url.Values{"credential": {"ok"}})
+		assert.Contains(t, body, "passkey registration expired, try again", "login flow doesn't pass as registration")
+
+		_, _ = postForm(t, client, ts.URL+"/passkey/register/begin", nil)
+		_, body = postForm(t, client, ts.URL+"/passkey/register", url.Values{"credential": {"bad"}})
+		assert.Contains(t, body, "passkey not accepted, try again")
+		assert.Contains(t, body, `data-action="passkey-register"`, "form to retry")
+
+		_, _ = postForm(t, client, ts.URL+"/passkey/register/begin", nil)
+		_, body = postForm(t, client, ts.URL+"/passkey/register", url.Values{"credential": {"ok"}})
+		assert.Contains(t, body, "Passkey Registered")
+	})
+
+	t.Run("session ends with removed passkeys", func(t *testing.T) {
+		delete(pk.users, "alice")
+		status, body := get(t, client, "/passkey")
+		assert.Equal(t, http.StatusForbidden, status)
+		assert.Contains(t, body, "log in to add a passkey")
+	})
+}
@@ -4,13 +4,17 @@ package server
 import (
 	"context"
 	"crypto/sha256"
+	"encoding/base64"
 	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"html/template"
+	"io"
 	"io/fs"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 
@@ -21,8 +25,12 @@ import (
 
 	"github.com/umputun/secrets/v2/app/email"
 	"github.com/umputun/secrets/v2/app/messager"
+	"github.com/umputun/secrets/v2/app/passkey"
 	"github.com/umputun/secrets/v2/app/server/assets"
+	"github.com/umputun/secrets/v2/app/server/validator"
 	"github.com/umputun/secrets/v2/app/store"
+	"github.com/umputun/secrets/v2/app/tokens"
+	"github.com/umputun/secrets/v2/app/webhook"
 )
 
 // Config is a configuration for the server
@@ -33,11 +41,15 @@ type Config struct {
 	Branding string
 	Listen   string // server listen address (ip:port or :port), defaults to :8080
 	SignKey  string // sign key (will be hashed before use for IP anonymization)
+	LogKey   string // key for IP anonymization, SignKey used if empty. Keeps hashed IPs stable across sign key rotation
 
 	// validation parameters
 	PinSize        int
 	MaxPinAttempts int
 	MaxExpire      time.Duration
+	MaxViews       int  // max allowed views of a single message, 0 means single read only
+	Passphrase     bool // passphrases of any characters instead of numeric pins of PinSize
+	MinEntropy     int  // min estimated entropy of new passphrases in bits, 0 disables the check
 
 	// file upload settings
 	EnableFiles bool
@@ -45,10 +57,12 @@ type Config struct {
 
 	// authentication (optional)
 	AuthHash   string        // bcrypt hash of password, empty disables auth
-	SessionTTL time.Duration // session lifetime, defaults to 168h (7 days)
+	SessionTTL time.Duration // session lifetime, defaults to 168h (7 days), inactivity timeout with the session store
+	SessionKey string        // key signing session cookies, derived from AuthHash and SignKey if empty
 
 	EmailEnabled           bool // email sharing (optional)
 	AllowNoPin             bool // allow creating secrets without PIN protection
+	AllowCallback          bool // allow per-message webhook url set by API clients
 	DisableSecurityHeaders bool // skip security headers when proxy handles them
 }
 
@@ -64,10 +78,18 @@ type EmailSender interface {
 type Server struct {
 	messager      Messager
 	emailSender   EmailSender
+	tokens        Tokens
+	users         Users
+	sso           SSO
+	sessions      Sessions
+	lockout       Lockout
+	totp          TOTP
+	totpFailures  *totpFailures // wrong codes of pending logins, shared by copies of the server
+	passkeys      Passkeys
 	cfg           Config
 	version       string
 	templateCache map[string]*template.Template
-	logSecret     string // derived from SignKey for IP anonymization in logs
+	logSecret     string // derived from LogKey or SignKey for IP anonymization in logs
 }
 
 // New creates a new server with template cache
@@ -81,8 +103,12 @@ func New(m Messager, version string, cfg Config) (Server, error) {
 		return Server{}, fmt.Errorf("can't create template cache: %w", err)
 	}
 
-	// derive log secret from sign key for IP anonymization (never use raw SignKey for logging)
-	h := sha256.Sum256([]byte(cfg.SignKey + ":log"))
+	// derive log secret from log key or sign key for IP anonymization (never use raw key for logging)
+	logKey := cfg.SignKey
+	if cfg.LogKey != "" {
+		logKey = cfg.LogKey
+	}
+	h := sha256.Sum256([]byte(logKey + ":log"))
 	logSecret := hex.EncodeToString(h[:])
 
 	return Server{
@@ -100,6 +126,102 @@ func (s Server) WithEmail(sender EmailSender) Server {
 	return s
 }
 
+// WithTokens sets the manager of named API tokens, accepted as Bearer auth by API creating messages
+func (s Server) WithTokens(t Tokens) Server {
+	s.tokens = t
+	return s
+}
+
+// WithUsers sets named users allowed to create messages, in addition to "secrets" user with AuthHash password
+func (s Server) WithUsers(u Users) Server {
+	s.users = u
+	return s
+}
+
+// WithSSO sets OpenID Connect provider for login of message creators, an alternative to the password
+func (s Server) WithSSO(p SSO) Server {
+	s.sso = p
+	return s
+}
+
+// WithSessions sets the store of login sessions, so logout and revocation end sessions on the server side
+func (s Server) WithSessions(m Sessions) Server {
+	s.sessions = m
+	return s
+}
+
+// WithLockout sets the limiter of failed login attempts, for web login and basic auth
+func (s Server) WithLockout(l Lockout) Server {
+	s.lockout = l
+	return s
+}
+
+// WithTOTP sets the second login factor checked after the password, for users who enrolled it
+func (s Server) WithTOTP(t TOTP) Server {
+	s.totp = t
+	s.totpFailures = newTOTPFailures()
+	return s
+}
+
+// WithPasskeys sets passkeys of users, a password-less login and the only one for users without password
+func (s Server) WithPasskeys(p Passkeys) Server {
+	s.passkeys = p
+	return s
+}
+
+// Users interface to check credentials of named users
+type Users interface {
+	Check(ctx context.Context, name, password string) bool
+	Exists(ctx context.Context, name string) bool
+}
+
+// SSO interface of OpenID Connect provider, Exchange returns identity of verified and allowed user
+type SSO interface {
+	AuthURL(state, nonce, verifier string) string
+	Exchange(ctx context.Context, code, nonce, verifier string) (user string, err error)
+}
+
+// Tokens interface to check and manage named API tokens
+type Tokens interface {
+	Create(ctx context.Context, req tokens.Request) (token string, result *store.Token, err error)
+	List(ctx context.Context) ([]store.Token, error)
+	Revoke(ctx context.Context, ref string) (*store.Token, error)
+	Check(ctx context.Context, token string) (*store.Token, error)
+}
+
+// Sessions interface to keep and manage login sessions
+type Sessions interface {
+	Create(ctx context.Context, user, ip, userAgent string) (token string, result *store.Session, err error)
+	Check(ctx context.Context, token string) (*store.Session, error)
+	Remove(ctx context.Context, token string) error
+	List(ctx context.Context) ([]store.Session, error)
+	Revoke(ctx context.Context, id string) error
+	RevokeAll(ctx context.Context) (int, error)
+}
+
+// Lockout interface to count failed login attempts of clients by hashed IP and to lock them out
+type Lockout interface {
+	Check(ctx context.Context, ip string) time.Duration
+	Fail(ctx context.Context, ip string) time.Duration
+	Reset(ctx context.Context, ip string)
+}
+
+// TOTP interface to check the second login factor of users
+type TOTP interface {
+	Enabled(ctx context.Context, user string) (bool, error)
+	Verify(ctx context.Context, user, code string) error
+}
+
+// Passkeys interface to register passkeys of users and to log in with them
+type Passkeys interface {
+	BeginLogin(ctx context.Context) (options, state []byte, err error)
+	FinishLogin(ctx context.Context, state []byte, response io.Reader) (user string, err error)
+	BeginRegistration(ctx context.Context, user string) (options, state []byte, err error)
+	FinishRegistration(ctx context.Context, reg passkey.Registration, response io.Reader) (*store.Passkey, error)
+	SetupUser(ctx context.Context, token string) (string, error)
+	Registered(ctx context.Context, user string) (bool, error)
+}
+
 // Messager interface making and loading messages
 type Messager interface {
 	MakeMessage(ctx context.Context, req messager.MsgReq) (result *store.Message, err error)
@@ -107,6 +229,8 @@ type Messager interface {
 	LoadMessage(ctx context.Context, key, pin string) (msg *store.Message, err error)
 	IsFile(ctx context.Context, key string) bool          // checks if message is a file without decrypting
 	HasPin(ctx context.Context, key string) (bool, error) // checks if message requires PIN
+	Revoke(ctx context.Context, key, token string) error  // removes message, authorized by management token
+	Status(ctx context.Context, key, token string) (*messager.MsgStatus, error)
 }
 
 // newTemplateData creates a templateData with common fields populated
@@ -122,6 +246,8 @@ func (s Server) newTemplateData(r *http.Request, form any) templateData {
 	return templateData{
 		Form:         form,
 		PinSize:      s.cfg.PinSize,
+		Passphrase:   s.cfg.Passphrase,
+		MinEntropy:   s.cfg.MinEntropy,
 		CurrentYear:  time.Now().Year(),
 		Theme:        getTheme(r),
 		Branding:     s.cfg.Branding,
@@ -130,6 +256,7 @@ func (s Server) newTemplateData(r *http.Request, form any) templateData {
 		FilesEnabled: s.cfg.EnableFiles,
 		MaxFileSize:  s.cfg.MaxFileSize,
 		AllowNoPin:   s.cfg.AllowNoPin,
+		MaxViews:     max(s.cfg.MaxViews, 1),
 		Version:      s.version,
 	}
 }
@@ -176,6 +303,11 @@ func (s Server) Run(ctx context.Context) error {
 	return nil
 }
 
+// Handler returns http handler of all routes, for use with own http server or in tests
+func (s Server) Handler() http.Handler {
+	return s.routes()
+}
+
 func (s Server) routes() http.Handler {
 	router := routegroup.New(http.NewServeMux())
 
@@ -205,18 +337,34 @@ func (s Server) routes() http.Handler {
 	}
 
 	// API routes
-	router.Mount("/api/v1").Route(func(apiGroup *routegroup.Bundle) {
-		apiGroup.Use(Logger(log.Default()))
-		apiGroup.HandleFunc("POST /message", s.saveMessageCtrl)
-		apiGroup.HandleFunc("GET /message/{key}/{pin}", s.getMessageCtrl)
-		apiGroup.HandleFunc("GET /params", s.getParamsCtrl)
-	})
+	for _, api := range s.apiRoutes() {
+		router.Mount(api.basePath).Route(func(apiGroup *routegroup.Bundle) {
+			apiGroup.Use(Logger(log.Default()))
+			for _, rt := range api.routes {
+				apiGroup.HandleFunc(rt.pattern, rt.handler)
+			}
+		})
+	}
 
 	// auth routes (only if auth enabled)
-	if s.cfg.AuthHash != "" {
+	if s.authEnabled() {
 		router.HandleFunc("POST /login", s.loginCtrl)
 		router.HandleFunc("GET /logout", s.logoutCtrl)
 		router.HandleFunc("GET /login-popup", s.loginPopupCtrl)
+		if s.totp != nil && s.passwordEnabled() {
+			router.HandleFunc("POST /login/totp", s.loginTOTPCtrl)
+		}
+		if s.sso != nil {
+			router.HandleFunc("GET /auth/sso/login", s.ssoLoginCtrl)
+			router.HandleFunc("GET /auth/sso/callback", s.ssoCallbackCtrl)
+		}
+		if s.passkeys != nil {
+			router.HandleFunc("POST /passkey/login/begin", s.passkeyLoginBeginCtrl)
+			router.HandleFunc("POST /passkey/login", s.passkeyLoginCtrl)
+			router.HandleFunc("GET /passkey", s.passkeyPageCtrl)
+			router.HandleFunc("POST /passkey/register/begin", s.passkeyRegisterBeginCtrl)
+			router.HandleFunc("POST /passkey/register", s.passkeyRegisterCtrl)
+		}
 	}
 
 	// web routes
@@ -226,6 +374,7 @@ func (s Server) routes() http.Handler {
 		webGroup.With(RequireHTMX).HandleFunc("POST /generate-link", s.generateLinkCtrl)
 		webGroup.HandleFunc("GET /message/{key}", s.showMessageViewCtrl)
 		webGroup.HandleFunc("POST /load-message", s.loadMessageCtrl)
+		webGroup.With(RequireHTMX).HandleFunc("POST /revoke-message", s.revokeMessageCtrl)
 		webGroup.HandleFunc("POST /theme", s.themeToggleCtrl)
 		webGroup.HandleFunc("POST /copy-feedback", s.copyFeedbackCtrl)
 		webGroup.HandleFunc("GET /close-popup", s.closePopupCtrl)
@@ -275,51 +424,159 @@ func (s Server) routes() http.Handler {
 	return router
 }
 
+// apiGroup is a version of API, all its routes are described in openapi.json
+type apiGroup struct {
+	basePath string
+	routes   []apiRoute
+}
+
+// apiRoute is API route with pattern relative to base path of its group
+type apiRoute struct {
+	pattern string
+	handler http.HandlerFunc
+}
+
+// apiRoutes returns API routes of all versions
+func (s Server) apiRoutes() []apiGroup {
+	return []apiGroup{
+		{basePath: "/api/v1", routes: []apiRoute{
+			{"POST /message", s.saveMessageCtrl},
+			{"GET /message/{key}/{pin}", s.getMessageCtrl},
+			{"GET /message/{key}", s.getMessageCtrl},
+			{"DELETE /message/{key}", s.deleteMessageCtrl},
+			{"GET /message/{key}/status", s.messageStatusCtrl},
+			{"POST /file", s.saveFileCtrl},
+			{"GET /file/{key}/{pin}", s.getFileCtrl},
+			{"GET /params", s.getParamsCtrl},
+			{"GET /openapi.json", s.openAPICtrl},
+			{"POST /tokens", s.createTokenCtrl},
+			{"GET /tokens", s.listTokensCtrl},
+			{"DELETE /tokens/{ref}", s.revokeTokenCtrl},
+			{"GET /sessions", s.listSessionsCtrl},
+			{"DELETE /sessions", s.revokeSessionsCtrl},
+			{"DELETE /sessions/{id}", s.revokeSessionCtrl},
+		}},
+		// v2 keeps pin out of the url and responds with error codes
+		{basePath: "/api/v2", routes: []apiRoute{
+			{"POST /message", s.saveMessageV2Ctrl},
+			{"POST /message/{key}", s.getMessageV2Ctrl},
+			{"POST /file", s.saveFileV2Ctrl},
+			{"POST /file/{key}", s.getFileV2Ctrl},
+			{"GET /params", s.getParamsCtrl},
+		}},
+	}
+}
+
+// POST /v1/message
 func (s Server) saveMessageCtrl(w http.ResponseWriter, r *http.Request) {
-	// check basic auth if auth is enabled
-	if s.cfg.AuthHash != "" && !s.checkBasicAuth(r) {
-		w.Header().Set("WWW-Authenticate", `Basic realm="secrets"`)
-		SendErrorJSON(w, r, log.Default(), http.StatusUnauthorized, errors.New("unauthorized"), "authentication required")
+	caller, apiErr := s.checkAPIAuth(w, r, tokens.ScopeCreateText)
+	if apiErr != nil {
+		SendErrorJSON(w, r, log.Default(), apiErr.status, apiErr.err, apiErr.msg)
 		return
 	}
 
-	request := struct {
-		Message string
-		Exp     int
-		Pin     string
-	}{}
-
+	request := apiMsgRequest{}
 	if err := rest.DecodeJSON(r, &request); err != nil {
 		log.Printf("[WARN] can't bind request %v", request)
 		SendErrorJSON(w, r, log.Default(), http.StatusBadRequest, err, "can't decode request")
 		return
 	}
 
-	if len(request.Pin) != s.cfg.PinSize {
-		log.Printf("[WARN] incorrect pin size %d", len(request.Pin))
-		SendErrorJSON(w, r, log.Default(), http.StatusBadRequest, errors.New("incorrect pin size"), "incorrect pin size")
+	msg, apiErr := s.makeAPIMessage(r, request, caller)
+	if apiErr != nil {
+		SendErrorJSON(w, r, log.Default(), apiErr.status, apiErr.err, apiErr.msg)
 		return
 	}
+	_ = rest.EncodeJSON(w, http.StatusCreated, rest.JSON{"key": msg.Key, "exp": msg.Exp, "max_views": msg.MaxViews,
+		"token": msg.MgmtToken})
+}
+
+// apiMsgRequest is API request to create message
+type apiMsgRequest struct {
+	Message   string
+	Exp       int // seconds
+	Pin       string
+	MaxViews  int    `json:"max_views"`
+	Callback  string `json:"callback_url"`
+	ClientEnc bool   `json:"client_enc"`
+}
+
+// apiError is rejected API request. v1 responds with the message only, v2 with the code as well.
+type apiError struct {
+	status int
+	code   string // machine-readable code for v2
+	msg    string
+	err    error
+	// attempts left after wrong pin, for v2
+	attemptsLeft int
+}
+
+// makeAPIMessage validates API request and creates the message, caller's token limits expiration if set
+func (s Server) makeAPIMessage(r *http.Request, request apiMsgRequest, caller apiCaller) (*store.Message, *apiError) {
+	if apiErr := caller.checkTokenExp(time.Second * time.Duration(request.Exp)); apiErr != nil {
+		return nil, apiErr
+	}
+	if apiErr := s.checkCallback(r, request.Callback); apiErr != nil {
+		return nil, apiErr
+	}
+
+	// client-encrypted message is an opaque blob in crypto.js format, server can only check its shape
+	if request.ClientEnc && !validator.IsBase64URL(request.Message) {
+		return nil, &apiError{status: http.StatusBadRequest, code: codeBadRequest, msg: "invalid encrypted format",
+			err: errors.New("invalid encrypted format")}
+	}
+
+	// empty pin allowed for client-encrypted messages only, server-side encryption needs the pin
+	noPin := request.ClientEnc && s.cfg.AllowNoPin && request.Pin == ""
+	if !noPin {
+		if err := s.checkAPIPin(request.Pin, true); err != nil {
+			log.Printf("[WARN] rejected pin, %v", err)
+			return nil, &apiError{status: http.StatusBadRequest, code: codeInvalidPin, msg: err.Error(), err: err}
+		}
+	}
 
 	msg, err := s.messager.MakeMessage(r.Context(), messager.MsgReq{
-		Duration:  time.Second * time.Duration(request.Exp),
-		Message:   request.Message,
-		Pin:       request.Pin,
-		ClientEnc: false, // API uses server-side encryption
+		Duration:      time.Second * time.Duration(request.Exp),
+		Message:       request.Message,
+		Pin:           request.Pin,
+		ClientEnc:     request.ClientEnc, // server-side encryption unless client sends encrypted blob
+		AllowEmptyPin: noPin,
+		MaxViews:      request.MaxViews,
+		Callback:      request.Callback,
 	})
 	if err != nil {
-		SendErrorJSON(w, r, log.Default(), http.StatusBadRequest, err, "can't create message")
-		return
+		return nil, &apiError{status: http.StatusBadRequest, code: codeBadRequest, msg: "can't create message", err: err}
 	}
-	_ = rest.EncodeJSON(w, http.StatusCreated, rest.JSON{"key": msg.Key, "exp": msg.Exp})
-	log.Printf("[INFO] created message %s, type=text, size=%d, exp=%s, ip=%s",
-		msg.Key, len(request.Message), msg.Exp.Format(time.RFC3339), GetHashedIP(r))
+
+	msgType := "text"
+	if request.ClientEnc {
+		msgType = "client-enc"
+	}
+	log.Printf("[INFO] created message %s, type=%s, size=%d, exp=%s, user=%s, ip=%s",
+		msg.Key, msgType, len(request.Message), msg.Exp.Format(time.RFC3339), caller, GetHashedIP(r))
+	return msg, nil
 }
 
-// GET /v1/message/{key}/{pin}
+// checkCallback rejects per-message callback url if callbacks are not allowed or the url is invalid, empty url is fine
+func (s Server) checkCallback(r *http.Request, callback string) *apiError {
+	if callback == "" {
+		return nil
+	}
+	if !s.cfg.AllowCallback {
+		return &apiError{status: http.StatusBadRequest, code: codeBadRequest, msg: "callback url not allowed",
+			err: errors.New("callback url not allowed")}
+	}
+	if err := webhook.ValidateCallback(r.Context(), callback); err != nil {
+		return &apiError{status: http.StatusBadRequest, code: codeBadRequest, msg: "invalid callback url", err: err}
+	}
+	return nil
+}
+
+// GET /v1/message/{key}/{pin}, or GET /v1/message/{key} for PIN-less messages
 func (s Server) getMessageCtrl(w http.ResponseWriter, r *http.Request) {
 	key, pin := r.PathValue("key"), r.PathValue("pin")
-	if key == "" || pin == "" || len(pin) != s.cfg.PinSize {
+	pinValid := pin != "" && s.checkAPIPin(pin, false) == nil || pin == "" && s.cfg.AllowNoPin
+	if key == "" || !pinValid {
 		log.Print("[WARN] no valid key or pin in get request")
 		SendErrorJSON(w, r, log.Default(), http.StatusBadRequest, errors.New("no key or pin passed"), "invalid request")
 		return
@@ -335,18 +592,11 @@ func (s Server) getMessageCtrl(w http.ResponseWriter, r *http.Request) {
 			}
 			return http.StatusBadRequest, rest.JSON{"error": err.Error()}
 		}
-		// determine message type for logging
-		if messager.IsFileMessage(msg.Data) {
-			msgType = "file"
-			// reject file messages when files are disabled
-			if !s.cfg.EnableFiles {
-				log.Printf("[WARN] file download rejected for %s, files disabled", key)
-				return http.StatusForbidden, rest.JSON{"error": "file downloads disabled"}
-			}
-		} else {
-			msgType = "text"
+		var apiErr *apiError
+		if res, msgType, apiErr = s.messageResponse(msg); apiErr != nil {
+			return apiErr.status, rest.JSON{"error": apiErr.msg}
 		}
-		return http.StatusOK, rest.JSON{"key": msg.Key, "message": string(msg.Data)}
+		return http.StatusOK, res
 	}
 
 	// make sure serveRequest takes constant time on any branch to prevent timing attacks
@@ -370,6 +620,272 @@ func (s Server) getMessageCtrl(w http.ResponseWriter, r *http.Request) {
 		key, msgType, status, statusText, GetHashedIP(r))
 }
 
+// messageResponse makes API response of loaded message and its type for logging.
+// Client-encrypted blob returned as-is, file content may be binary and sent base64-encoded with its metadata.
+func (s Server) messageResponse(msg *store.Message) (res rest.JSON, msgType string, apiErr *apiError) {
+	if msg.ClientEnc {
+		return rest.JSON{"key": msg.Key, "message": string(msg.Data), "client_enc": true, "views_left": msg.ViewsLeft()},
+			"client-enc", nil
+	}
+	if !messager.IsFileMessage(msg.Data) {
+		return rest.JSON{"key": msg.Key, "message": string(msg.Data), "views_left": msg.ViewsLeft()}, "text", nil
+	}
+
+	// reject file messages when files are disabled
+	if !s.cfg.EnableFiles {
+		log.Printf("[WARN] file download rejected for %s, files disabled", msg.Key)
+		return nil, "file", &apiError{status: http.StatusForbidden, code: codeFilesDisabled, msg: "file downloads disabled",
+			err: errors.New("file downloads disabled")}
+	}
+	fileName, contentType, dataStart := messager.ParseFileHeader(msg.Data)
+	if dataStart < 0 {
+		log.Printf("[ERROR] failed to parse file header for %s", msg.Key)
+		return nil, "file", &apiError{status: http.StatusInternalServerError, code: codeInternal, msg: "invalid file format",
+			err: errors.New("invalid file format")}
+	}
+	return rest.JSON{"key": msg.Key, "message": base64.StdEncoding.EncodeToString(msg.Data[dataStart:]),
+		"file_name": fileName, "content_type": contentType, "views_left": msg.ViewsLeft()}, "file", nil
+}
+
+// POST /v1/file, multipart form with "file", "exp" (seconds) and "pin" fields, optional "max_views" and "callback_url".
+// Parts are read in memory, so the file never touches the disk unencrypted.
+func (s Server) saveFileCtrl(w http.ResponseWriter, r *http.Request) {
+	caller, apiErr := s.checkAPIAuth(w, r, tokens.ScopeCreateFile)
+	if apiErr != nil {
+		SendErrorJSON(w, r, log.Default(), apiErr.status, apiErr.err, apiErr.msg)
+		return
+	}
+	msg, apiErr := s.makeAPIFileMessage(w, r, caller)
+	if apiErr != nil {
+		SendErrorJSON(w, r, log.Default(), apiErr.status, apiErr.err, apiErr.msg)
+		return
+	}
+	_ = rest.EncodeJSON(w, http.StatusCreated, rest.JSON{"key": msg.Key, "exp": msg.Exp, "max_views": msg.MaxViews,
+		"token": msg.MgmtToken})
+}
+
+// makeAPIFileMessage reads multipart upload and creates file message. The upload is streamed
+// and never written to disk, the whole request is limited by max file size. Caller's token limits expiration if set.
+func (s Server) makeAPIFileMessage(w http.ResponseWriter, r *http.Request, caller apiCaller) (*store.Message, *apiError) {
+	badRequest := func(err error, msg string) *apiError {
+		return &apiError{status: http.StatusBadRequest, code: codeBadRequest, msg: msg, err: err}
+	}
+	if !s.cfg.EnableFiles {
+		return nil, &apiError{status: http.StatusForbidden, code: codeFilesDisabled, msg: "file uploads disabled",
+			err: errors.New("file uploads disabled")}
+	}
+
+	maxSize := s.cfg.MaxFileSize
+	if maxSize == 0 {
+		maxSize = 1024 * 1024
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxSize+64*1024) // file and small form fields
+	mr, err := r.MultipartReader()
+	if err != nil {
+		return nil, badRequest(err, "multipart form expected")
+	}
+
+	req := messager.FileRequest{}
+	var exp, maxViews string
+	for {
+		part, err := mr.NextPart()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, badRequest(err, "can't read multipart form")
+		}
+		switch part.FormName() {
+		case "file":
+			req.FileName, req.ContentType = part.FileName(), part.Header.Get("Content-Type")
+			req.Data, err = io.ReadAll(io.LimitReader(part, maxSize+1)) // one more byte to detect too large file
+		case "exp":
+			exp, err = readFormValue(part)
+		case "pin":
+			req.Pin, err = readFormValue(part)
+		case "max_views":
+			maxViews, err = readFormValue(part)
+		case "callback_url":
+			req.Callback, err = readFormValue(part)
+		}
+		_ = part.Close()
+		if err != nil {
+			return nil, badRequest(err, "can't read multipart form")
+		}
+	}
+
+	if req.FileName == "" {
+		return nil, badRequest(errors.New("no file passed"), "file is required")
+	}
+	if req.ContentType == "" {
+		req.ContentType = "application/octet-stream"
+	}
+	expSecs, err := strconv.Atoi(exp)
+	if err != nil {
+		return nil, badRequest(err, "invalid exp")
+	}
+	req.Duration = time.Second * time.Duration(expSecs)
+	if apiErr := caller.checkTokenExp(req.Duration); apiErr != nil {
+		return nil, apiErr
+	}
+	if maxViews != "" {
+		if req.MaxViews, err = strconv.Atoi(maxViews); err != nil {
+			return nil, badRequest(err, "invalid max_views")
+		}
+	}
+	if apiErr := s.checkCallback(r, req.Callback); apiErr != nil {
+		return nil, apiErr
+	}
+	if err = s.checkAPIPin(req.Pin, true); err != nil {
+		log.Printf("[WARN] rejected pin, %v", err)
+		return nil, &apiError{status: http.StatusBadRequest, code: codeInvalidPin, msg: err.Error(), err: err}
+	}
+
+	msg, err := s.messager.MakeFileMessage(r.Context(), req)
+	if err != nil {
+		if errors.Is(err, messager.ErrFileTooLarge) {
+			return nil, &apiError{status: http.StatusRequestEntityTooLarge, code: codeTooLarge,
+				msg: "can't create file message", err: err}
+		}
+		return nil, badRequest(err, "can't create file message")
+	}
+	log.Printf("[INFO] created message %s, type=file, size=%d, exp=%s, user=%s, ip=%s",
+		msg.Key, len(req.Data), msg.Exp.Format(time.RFC3339), caller, GetHashedIP(r))
+	return msg, nil
+}
+
+// GET /v1/file/{key}/{pin}, responds with the file content as binary download
+func (s Server) getFileCtrl(w http.ResponseWriter, r *http.Request) {
+	key, pin := r.PathValue("key"), r.PathValue("pin")
+	if key == "" || pin == "" || s.checkAPIPin(pin, false) != nil {
+		log.Print("[WARN] no valid key or pin in get file request")
+		SendErrorJSON(w, r, log.Default(), http.StatusBadRequest, errors.New("no key or pin passed"), "invalid request")
+		return
+	}
+	if !s.cfg.EnableFiles {
+		SendErrorJSON(w, r, log.Default(), http.StatusForbidden, errors.New("file downloads disabled"), "file downloads disabled")
+		return
+	}
+
+	msg, err := s.loadFileMessage(r.Context(), key, pin)
+	if err != nil {
+		status := http.StatusBadRequest
+		if errors.Is(err, messager.ErrBadPinAttempt) {
+			status = http.StatusExpectationFailed
+		}
+		log.Printf("[INFO] accessed message %s, type=file, status=%d, ip=%s", key, status, GetHashedIP(r))
+		_ = rest.EncodeJSON(w, status, rest.JSON{"error": err.Error()})
+		return
+	}
+	if apiErr := writeFile(w, msg); apiErr != nil {
+		SendErrorJSON(w, r, log.Default(), apiErr.status, apiErr.err, apiErr.msg)
+		return
+	}
+	log.Printf("[INFO] accessed message %s, type=file, status=200 (success), ip=%s", key, GetHashedIP(r))
+}
+
+// loadFileMessage loads file message, text messages are not consumed.
+// Loading takes constant time on any branch to prevent timing attacks.
+func (s Server) loadFileMessage(ctx context.Context, key, pin string) (*store.Message, error) {
+	st := time.Now()
+	defer func() {
+		if elapsed := time.Since(st); elapsed < 100*time.Millisecond {
+			time.Sleep(100*time.Millisecond - elapsed)
+		}
+	}()
+	if !s.messager.IsFile(ctx, key) { // checked before loading, so text messages are not consumed here
+		return nil, errors.New("not a file message")
+	}
+	return s.messager.LoadMessage(ctx, key, pin)
+}
+
+// writeFile writes content of loaded file message as binary attachment
+func writeFile(w http.ResponseWriter, msg *store.Message) *apiError {
+	fileName, _, dataStart := messager.ParseFileHeader(msg.Data)
+	if dataStart < 0 {
+		log.Printf("[ERROR] failed to parse file header for %s", msg.Key)
+		return &apiError{status: http.StatusInternalServerError, code: codeInternal, msg: "invalid file format",
+			err: errors.New("invalid file format")}
+	}
+	setAttachmentHeaders(w, fileName, len(msg.Data)-dataStart)
+	w.Header().Set("X-Views-Left", strconv.Itoa(msg.ViewsLeft()))
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(msg.Data[dataStart:])
+	return nil
+}
+
+// readFormValue reads small multipart form field
+func readFormValue(part io.Reader) (string, error) {
+	b, err := io.ReadAll(io.LimitReader(part, 1024))
+	if err != nil {
+		return "", fmt.Errorf("read form value: %w", err)
+	}
+	return string(b), nil
+}
+
+// DELETE /v1/message/{key}, management token returned on creation passed in X-Management-Token header
+func (s Server) deleteMessageCtrl(w http.ResponseWriter, r *http.Request) {
+	key, token := r.PathValue("key"), r.Header.Get("X-Management-Token")
+	if key == "" || token == "" {
+		log.Print("[WARN] no key or token in delete request")
+		SendErrorJSON(w, r, log.Default(), http.StatusBadRequest, errors.New("no key or token passed"), "invalid request")
+		return
+	}
+
+	err := s.messager.Revoke(r.Context(), key, token)
+	switch {
+	case errors.Is(err, messager.ErrBadToken):
+		SendErrorJSON(w, r, log.Default(), http.StatusForbidden, err, "can't revoke message")
+		return
+	case errors.Is(err, store.ErrLoadRejected):
+		SendErrorJSON(w, r, log.Default(), http.StatusNotFound, err, "can't revoke message")
+		return
+	case err != nil:
+		SendErrorJSON(w, r, log.Default(), http.StatusInternalServerError, err, "can't revoke message")
+		return
+	}
+	rest.RenderJSON(w, rest.JSON{"key": key, "deleted": true})
+	log.Printf("[INFO] revoked message %s, ip=%s", key, GetHashedIP(r))
+}
+
+// GET /v1/message/{key}/status, management token passed in X-Management-Token header
+func (s Server) messageStatusCtrl(w http.ResponseWriter, r *http.Request) {
+	key, token := r.PathValue("key"), r.Header.Get("X-Management-Token")
+	if key == "" || token == "" {
+		log.Print("[WARN] no key or token in status request")
+		SendErrorJSON(w, r, log.Default(), http.StatusBadRequest, errors.New("no key or token passed"), "invalid request")
+		return
+	}
+
+	st, err := s.messager.Status(r.Context(), key, token)
+	switch {
+	case errors.Is(err, messager.ErrBadToken):
+		SendErrorJSON(w, r, log.Default(), http.StatusForbidden, err, "can't get message status")
+		return
+	case errors.Is(err, store.ErrLoadRejected):
+		SendErrorJSON(w, r, log.Default(), http.StatusNotFound, err, "can't get message status")
+		return
+	case err != nil:
+		SendErrorJSON(w, r, log.Default(), http.StatusInternalServerError, err, "can't get message status")
+		return
+	}
+
+	res := rest.JSON{
+		"key":             st.Key,
+		"state":           st.State,
+		"opened":          st.Views > 0,
+		"created":         st.Created,
+		"expires":         st.Exp,
+		"failed_attempts": st.Errors,
+		"views":           st.Views,
+		"max_views":       st.MaxViews,
+	}
+	if !st.Closed.IsZero() {
+		res["closed"] = st.Closed
+	}
+	rest.RenderJSON(w, res)
+}
+
 // GET /params
 func (s Server) getParamsCtrl(w http.ResponseWriter, _ *http.Request) {
 	params := struct {
@@ -379,6 +895,9 @@ func (s Server) getParamsCtrl(w http.ResponseWriter, _ *http.Request) {
 		FilesEnabled   bool  `json:"files_enabled"`
 		MaxFileSize    int64 `json:"max_file_size"`
 		AllowNoPin     bool  `json:"allow_no_pin"`
+		MaxViews       int   `json:"max_views"`
+		Passphrase     bool  `json:"passphrase"`
+		MinEntropy     int   `json:"min_entropy"`
 	}{
 		PinSize:        s.cfg.PinSize,
 		MaxPinAttempts: s.cfg.MaxPinAttempts,
@@ -386,10 +905,40 @@ func (s Server) getParamsCtrl(w http.ResponseWriter, _ *http.Request) {
 		FilesEnabled:   s.cfg.EnableFiles,
 		MaxFileSize:    s.cfg.MaxFileSize,
 		AllowNoPin:     s.cfg.AllowNoPin,
+		MaxViews:       max(s.cfg.MaxViews, 1),
+		Passphrase:     s.cfg.Passphrase,
+		MinEntropy:     s.cfg.MinEntropy,
 	}
 	rest.RenderJSON(w, params)
 }
 
+// GET /v1/openapi.json, embedded openapi spec with this server as the only server
+func (s Server) openAPICtrl(w http.ResponseWriter, r *http.Request) {
+	data, err := assets.Files.ReadFile("openapi.json")
+	if err != nil {
+		SendErrorJSON(w, r, log.Default(), http.StatusInternalServerError, err, "can't read openapi spec")
+		return
+	}
+	spec := map[string]any{}
+	if err = json.Unmarshal(data, &spec); err != nil {
+		SendErrorJSON(w, r, log.Default(), http.StatusInternalServerError, err, "can't parse openapi spec")
+		return
+	}
+	spec["servers"] = []rest.JSON{{"url": fmt.Sprintf("%s://%s", s.cfg.Protocol, s.cfg.Domain[0])}}
+	rest.RenderJSON(w, spec)
+}
+
+// checkAPIPin checks pin size, or passphrase in passphrase mode. Passphrase strength is checked for new messages only.
+func (s Server) checkAPIPin(pin string, isNew bool) error {
+	if s.cfg.Passphrase {
+		return validatePassphrase(pin, isNew, s.cfg.MinEntropy)
+	}
+	if len(pin) != s.cfg.PinSize {
+		return errors.New("incorrect pin size")
+	}
+	return nil
+}
+
 // sitemapCtrl generates an XML sitemap for SEO
 // GET /sitemap.xml
 func (s Server) sitemapCtrl(w http.ResponseWriter, _ *http.Request) {
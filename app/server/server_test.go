@@ -1,22 +1,34 @@
 package server
 
 import (
+	"bytes"
 	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"io"
+	"mime/multipart"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/go-pkgz/routegroup"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
 	"github.com/umputun/secrets/v2/app/messager"
+	"github.com/umputun/secrets/v2/app/server/assets"
 	"github.com/umputun/secrets/v2/app/store"
+	"github.com/umputun/secrets/v2/app/webhook"
 )
 
 func TestServer_saveAndLoadMemory(t *testing.T) {
@@ -249,7 +261,7 @@ func TestServer_getParams(t *testing.T) {
 	assert.Equal(t, 200, resp.StatusCode)
 	body, err := io.ReadAll(resp.Body)
 	require.NoError(t, err)
-	assert.Equal(t, `{"pin_size":5,"max_pin_attempts":3,"max_exp_sec":36000,"files_enabled":false,"max_file_size":1048576,"allow_no_pin":false}`+"\n", string(body))
+	assert.Equal(t, `{"pin_size":5,"max_pin_attempts":3,"max_exp_sec":36000,"files_enabled":false,"max_file_size":1048576,"allow_no_pin":false,"max_views":1,"passphrase":false,"min_entropy":0}`+"\n", string(body))
 }
 
 func TestServer_getParams_AllowNoPin(t *testing.T) {
@@ -282,7 +294,7 @@ func TestServer_getParams_AllowNoPin(t *testing.T) {
 	assert.Equal(t, 200, resp.StatusCode)
 	body, err := io.ReadAll(resp.Body)
 	require.NoError(t, err)
-	assert.Equal(t, `{"pin_size":5,"max_pin_attempts":3,"max_exp_sec":36000,"files_enabled":false,"max_file_size":0,"allow_no_pin":true}`+"\n", string(body))
+	assert.Equal(t, `{"pin_size":5,"max_pin_attempts":3,"max_exp_sec":36000,"files_enabled":false,"max_file_size":0,"allow_no_pin":true,"max_views":1,"passphrase":false,"min_entropy":0}`+"\n", string(body))
 }
 
 // TestServer_saveMessageCtrl_APIRejectsEmptyPinEvenWithAllowNoPin verifies that API endpoint
@@ -429,6 +441,52 @@ func TestServer_getMessageCtrl(t *testing.T) {
 	}
 }
 
+func TestServer_getMessageCtrl_Concurrent(t *testing.T) {
+	eng := store.NewInMemory(time.Second)
+	srv, err := New(
+		messager.New(eng, messager.Crypt{Key: "123456789012345678901234567"}, messager.Params{
+			MaxDuration:    10 * time.Hour,
+			MaxPinAttempts: 3,
+		}),
+		"1",
+		Config{
+			Domain:         []string{"example.com"},
+			PinSize:        5,
+			MaxPinAttempts: 3,
+			MaxExpire:      10 * time.Hour,
+			Branding:       "Safe Secrets",
+		})
+	require.NoError(t, err)
+
+	msg, err := srv.messager.MakeMessage(t.Context(), messager.MsgReq{Duration: time.Hour, Message: "test secret", Pin: "12345"})
+	require.NoError(t, err)
+
+	// call handler directly to bypass rate limiter, all requests come in parallel with the correct pin
+	const numRequests = 20
+	var wg sync.WaitGroup
+	statuses := make(chan int, numRequests)
+	wg.Add(numRequests)
+	for range numRequests {
+		go func() {
+			defer wg.Done()
+			req := httptest.NewRequest(http.MethodGet, "/api/v1/message/"+msg.Key+"/12345", http.NoBody)
+			req.SetPathValue("key", msg.Key)
+			req.SetPathValue("pin", "12345")
+			rr := httptest.NewRecorder()
+			srv.getMessageCtrl(rr, req)
+			statuses <- rr.Code
+		}()
+	}
+	wg.Wait()
+	close(statuses)
+
+	counts := map[int]int{}
+	for st := range statuses {
+		counts[st]++
+	}
+	assert.Equal(t, map[int]int{http.StatusOK: 1, http.StatusBadRequest: numRequests - 1}, counts)
+}
+
 func TestServer_Run(t *testing.T) {
 	eng := store.NewInMemory(time.Second)
 	srv, err := New(
@@ -724,6 +782,40 @@ func prepTestServer(t *testing.T) (ts *httptest.Server, teardown func()) {
 	return ts, ts.Close
 }
 
+// testServerOpt adds optional part, like tokens or lockout, to the test server made on top of the given store
+type testServerOpt func(srv Server, eng *store.SQLite) Server
+
+// prepServer starts server with in-memory store for the given config, with options applied before routes made.
+// Empty domain, pin size, pin attempts and max expiration set to example.com, 5, 3 and 10h.
+func prepServer(t *testing.T, cfg Config, opts ...testServerOpt) (*httptest.Server, *store.SQLite) {
+	t.Helper()
+	eng := store.NewInMemory(time.Second * 30)
+	t.Cleanup(func() { _ = eng.Close() })
+	if len(cfg.Domain) == 0 {
+		cfg.Domain = []string{"example.com"}
+	}
+	if cfg.PinSize == 0 {
+		cfg.PinSize = 5
+	}
+	if cfg.MaxPinAttempts == 0 {
+		cfg.MaxPinAttempts = 3
+	}
+	if cfg.MaxExpire == 0 {
+		cfg.MaxExpire = 10 * time.Hour
+	}
+	msgr := messager.New(eng, messager.Crypt{Key: "123456789012345678901234567"}, messager.Params{
+		MaxDuration: cfg.MaxExpire, MaxPinAttempts: cfg.MaxPinAttempts, MaxFileSize: cfg.MaxFileSize,
+	})
+	srv, err := New(msgr, "1", cfg)
+	require.NoError(t, err)
+	for _, opt := range opts {
+		srv = opt(srv, eng)
+	}
+	ts := httptest.NewServer(srv.routes())
+	t.Cleanup(ts.Close)
+	return ts, eng
+}
+
 func TestServer_ping(t *testing.T) {
 	ts, teardown := prepTestServer(t)
 	defer teardown()
@@ -864,6 +956,22 @@ func TestServer_NewWithMultipleDomains(t *testing.T) {
 	assert.Equal(t, "backup.example.com", srv.cfg.Domain[2])
 }
 
+func TestServer_NewLogKey(t *testing.T) {
+	eng := store.NewInMemory(time.Second)
+	m := messager.New(eng, messager.Crypt{Key: "123456789012345678901234567"}, messager.Params{})
+
+	oldSrv, err := New(m, "1", Config{Domain: []string{"example.com"}, SignKey: "old-sign-key-1234567890"})
+	require.NoError(t, err)
+	rotatedSrv, err := New(m, "1", Config{Domain: []string{"example.com"}, SignKey: "new-sign-key-1234567890",
+		LogKey: "old-sign-key-1234567890"})
+	require.NoError(t, err)
+	assert.Equal(t, oldSrv.logSecret, rotatedSrv.logSecret, "log key keeps ip hashes after sign key rotation")
+
+	newSrv, err := New(m, "1", Config{Domain: []string{"example.com"}, SignKey: "new-sign-key-1234567890"})
+	require.NoError(t, err)
+	assert.NotEqual(t, oldSrv.logSecret, newSrv.logSecret)
+}
+
 func TestServer_MultipleDomainsLinkGeneration(t *testing.T) {
 	eng := store.NewInMemory(time.Second)
 	srv, err := New(
@@ -973,6 +1081,345 @@ func TestServer_getMessageCtrl_FileMessageWhenFilesDisabled(t *testing.T) {
 	assert.Equal(t, "file downloads disabled", result["error"])
 }
 
+func TestServer_API_ClientEnc(t *testing.T) {
+	eng := store.NewInMemory(time.Second * 30)
+	msgr := messager.New(eng, messager.Crypt{Key: "123456789012345678901234567"}, messager.Params{
+		MaxDuration: 10 * time.Hour, MaxPinAttempts: 3,
+	})
+	srv, err := New(msgr, "1", Config{Domain: []string{"example.com"}, PinSize: 5, MaxPinAttempts: 3,
+		MaxExpire: 10 * time.Hour, AllowNoPin: true})
+	require.NoError(t, err)
+	ts := httptest.NewServer(srv.routes())
+	defer ts.Close()
+	client := http.Client{Timeout: 5 * time.Second}
+
+	// encrypt the same way crypto.js encrypt does: base64url(IV || AES-128-GCM(0x00 || text))
+	aesKey := bytes.Repeat([]byte{7}, 16)
+	encrypt := func(t *testing.T, payload []byte) string {
+		t.Helper()
+		block, err := aes.NewCipher(aesKey)
+		require.NoError(t, err)
+		gcm, err := cipher.NewGCM(block)
+		require.NoError(t, err)
+		iv := make([]byte, gcm.NonceSize())
+		_, err = rand.Read(iv)
+		require.NoError(t, err)
+		return base64.RawURLEncoding.EncodeToString(gcm.Seal(iv, iv, payload, nil))
+	}
+	decrypt := func(t *testing.T, blob string) []byte {
+		t.Helper()
+		data, err := base64.RawURLEncoding.DecodeString(blob)
+		require.NoError(t, err)
+		block, err := aes.NewCipher(aesKey)
+		require.NoError(t, err)
+		gcm, err := cipher.NewGCM(block)
+		require.NoError(t, err)
+		res, err := gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], nil)
+		require.NoError(t, err)
+		return res
+	}
+	save := func(t *testing.T, body string) (status int, key string) {
+		t.Helper()
+		resp, err := client.Post(ts.URL+"/api/v1/message", "application/json", strings.NewReader(body))
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		respSave := struct{ Key string }{}
+		_ = json.NewDecoder(resp.Body).Decode(&respSave)
+		return resp.StatusCode, respSave.Key
+	}
+	load := func(t *testing.T, path string) (status int, msg string, clientEnc bool) {
+		t.Helper()
+		resp, err := client.Get(ts.URL + path)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		respLoad := struct {
+			Message   string
+			ClientEnc bool `json:"client_enc"`
+		}{}
+		_ = json.NewDecoder(resp.Body).Decode(&respLoad)
+		return resp.StatusCode, respLoad.Message, respLoad.ClientEnc
+	}
+
+	t.Run("blob with pin returned as-is", func(t *testing.T) {
+		blob := encrypt(t, append([]byte{0x00}, "my secret"...))
+		status, key := save(t, `{"message":"`+blob+`","exp":600,"pin":"12345","client_enc":true}`)
+		require.Equal(t, http.StatusCreated, status)
+
+		stored, err := eng.Load(t.Context(), key)
+		require.NoError(t, err)
+		assert.True(t, stored.ClientEnc)
+		assert.Equal(t, blob, string(stored.Data), "server stores the blob untouched")
+
+		status, msg, clientEnc := load(t, "/api/v1/message/"+key+"/12345")
+		require.Equal(t, http.StatusOK, status)
+		assert.True(t, clientEnc)
+		assert.Equal(t, blob, msg)
+		assert.Equal(t, append([]byte{0x00}, "my secret"...), decrypt(t, msg))
+	})
+
+	t.Run("pin-less blob", func(t *testing.T) {
+		blob := encrypt(t, append([]byte{0x00}, "no pin"...))
+		status, key := save(t, `{"message":"`+blob+`","exp":600,"client_enc":true}`)
+		require.Equal(t, http.StatusCreated, status)
+
+		status, msg, _ := load(t, "/api/v1/message/"+key)
+		require.Equal(t, http.StatusOK, status)
+		assert.Equal(t, blob, msg)
+
+		status, _, _ = load(t, "/api/v1/message/"+key)
+		assert.Equal(t, http.StatusBadRequest, status, "message consumed")
+	})
+
+	t.Run("file blob", func(t *testing.T) {
+		// 0x01 || len_be16(filename) || filename || len_be16(contentType) || contentType || data
+		payload := []byte{0x01, 0x00, 0x05}
+		payload = append(payload, "a.bin"...)
+		payload = append(payload, 0x00, 0x18)
+		payload = append(payload, "application/octet-stream"...)
+		payload = append(payload, 0x00, 0xff, 0x10)
+		blob := encrypt(t, payload)
+		status, key := save(t, `{"message":"`+blob+`","exp":600,"pin":"12345","client_enc":true}`)
+		require.Equal(t, http.StatusCreated, status)
+		status, msg, clientEnc := load(t, "/api/v1/message/"+key+"/12345")
+		require.Equal(t, http.StatusOK, status)
+		assert.True(t, clientEnc)
+		assert.Equal(t, payload, decrypt(t, msg))
+	})
+
+	tests := []struct {
+		name string
+		body string
+	}{
+		{name: "not base64url", body: `{"message":"not a blob!","exp":600,"pin":"12345","client_enc":true}`},
+		{name: "too short", body: `{"message":"YWJj","exp":600,"pin":"12345","client_enc":true}`},
+		{name: "bad pin", body: `{"message":"` + encrypt(t, []byte{0x00, 'a'}) + `","exp":600,"pin":"123","client_enc":true}`},
+		{name: "server-side without pin", body: `{"message":"plain text","exp":600}`},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			status, _ := save(t, tc.body)
+			assert.Equal(t, http.StatusBadRequest, status)
+		})
+	}
+
+	t.Run("pin-less rejected when not allowed", func(t *testing.T) {
+		srvPin, err := New(msgr, "1", Config{Domain: []string{"example.com"}, PinSize: 5, MaxPinAttempts: 3,
+			MaxExpire: 10 * time.Hour})
+		require.NoError(t, err)
+		tsPin := httptest.NewServer(srvPin.routes())
+		defer tsPin.Close()
+
+		blob := encrypt(t, append([]byte{0x00}, "no pin"...))
+		resp, err := client.Post(tsPin.URL+"/api/v1/message", "application/json",
+			strings.NewReader(`{"message":"`+blob+`","exp":600,"client_enc":true}`))
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+		resp2, err := client.Get(tsPin.URL + "/api/v1/message/somekey")
+		require.NoError(t, err)
+		defer resp2.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, resp2.StatusCode)
+	})
+}
+
+func TestServer_API_File(t *testing.T) {
+	eng := store.NewInMemory(time.Second * 30)
+	msgr := messager.New(eng, messager.Crypt{Key: "123456789012345678901234567"}, messager.Params{
+		MaxDuration: 10 * time.Hour, MaxPinAttempts: 3, MaxFileSize: 1024, MaxViews: 3,
+	})
+	srv, err := New(msgr, "1", Config{Domain: []string{"example.com"}, PinSize: 5, MaxPinAttempts: 3,
+		MaxExpire: 10 * time.Hour, EnableFiles: true, MaxFileSize: 1024, MaxViews: 3})
+	require.NoError(t, err)
+
+	ts := httptest.NewServer(srv.routes())
+	defer ts.Close()
+	client := http.Client{Timeout: 5 * time.Second}
+
+	upload := func(t *testing.T, fields map[string]string, fileName string, data []byte) *http.Response {
+		t.Helper()
+		body := &bytes.Buffer{}
+		mw := multipart.NewWriter(body)
+		for k, v := range fields {
+			require.NoError(t, mw.WriteField(k, v))
+		}
+		if fileName != "" {
+			fw, err := mw.CreateFormFile("file", fileName)
+			require.NoError(t, err)
+			_, err = fw.Write(data)
+			require.NoError(t, err)
+		}
+		require.NoError(t, mw.Close())
+		resp, err := client.Post(ts.URL+"/api/v1/file", mw.FormDataContentType(), body)
+		require.NoError(t, err)
+		return resp
+	}
+	binData := []byte{0x00, 0xff, 0xfe, 0x80, 'k', 'e', 'y', 0xc3, 0x28, 0x0a}
+
+	t.Run("upload and download binary file", func(t *testing.T) {
+		resp := upload(t, map[string]string{"exp": "600", "pin": "12345"}, "keystore.jks", binData)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusCreated, resp.StatusCode)
+		respSave := struct {
+			Key   string
+			Token string
+		}{}
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&respSave))
+		assert.NotEmpty(t, respSave.Token)
+
+		resp2, err := client.Get(ts.URL + "/api/v1/file/" + respSave.Key + "/12345")
+		require.NoError(t, err)
+		defer resp2.Body.Close()
+		require.Equal(t, http.StatusOK, resp2.StatusCode)
+		assert.Equal(t, `attachment; filename="keystore.jks"`, resp2.Header.Get("Content-Disposition"))
+		assert.Equal(t, "application/octet-stream", resp2.Header.Get("Content-Type"))
+		assert.Equal(t, "nosniff", resp2.Header.Get("X-Content-Type-Options"))
+		assert.Equal(t, "0", resp2.Header.Get("X-Views-Left"))
+		body, err := io.ReadAll(resp2.Body)
+		require.NoError(t, err)
+		assert.Equal(t, binData, body)
+
+		resp3, err := client.Get(ts.URL + "/api/v1/file/" + respSave.Key + "/12345")
+		require.NoError(t, err)
+		defer resp3.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, resp3.StatusCode, "file consumed")
+	})
+
+	t.Run("file with max views", func(t *testing.T) {
+		resp := upload(t, map[string]string{"exp": "600", "pin": "12345", "max_views": "2"}, "keystore.jks", binData)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusCreated, resp.StatusCode)
+		respSave := struct {
+			Key      string
+			MaxViews int `json:"max_views"`
+		}{}
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&respSave))
+		assert.Equal(t, 2, respSave.MaxViews)
+
+		for _, left := range []string{"1", "0"} {
+			resp2, err := client.Get(ts.URL + "/api/v1/file/" + respSave.Key + "/12345")
+			require.NoError(t, err)
+			body, err := io.ReadAll(resp2.Body)
+			require.NoError(t, err)
+			resp2.Body.Close()
+			require.Equal(t, http.StatusOK, resp2.StatusCode)
+			assert.Equal(t, left, resp2.Header.Get("X-Views-Left"))
+			assert.Equal(t, binData, body)
+		}
+
+		resp3, err := client.Get(ts.URL + "/api/v1/file/" + respSave.Key + "/12345")
+		require.NoError(t, err)
+		defer resp3.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, resp3.StatusCode, "all views used")
+	})
+
+	t.Run("file via message endpoint is base64-encoded", func(t *testing.T) {
+		resp := upload(t, map[string]string{"exp": "600", "pin": "12345"}, "config.bin", binData)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusCreated, resp.StatusCode)
+		respSave := struct{ Key string }{}
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&respSave))
+
+		resp2, err := client.Get(ts.URL + "/api/v1/message/" + respSave.Key + "/12345")
+		require.NoError(t, err)
+		defer resp2.Body.Close()
+		require.Equal(t, http.StatusOK, resp2.StatusCode)
+		respLoad := struct {
+			Message     string
+			FileName    string `json:"file_name"`
+			ContentType string `json:"content_type"`
+		}{}
+		require.NoError(t, json.NewDecoder(resp2.Body).Decode(&respLoad))
+		assert.Equal(t, "config.bin", respLoad.FileName)
+		assert.Equal(t, "application/octet-stream", respLoad.ContentType)
+		data, err := base64.StdEncoding.DecodeString(respLoad.Message)
+		require.NoError(t, err)
+		assert.Equal(t, binData, data)
+	})
+
+	t.Run("text message not consumed by file endpoint", func(t *testing.T) {
+		msg, err := msgr.MakeMessage(t.Context(), messager.MsgReq{Duration: time.Hour, Message: "text", Pin: "12345"})
+		require.NoError(t, err)
+		resp, err := client.Get(ts.URL + "/api/v1/file/" + msg.Key + "/12345")
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+		_, err = msgr.LoadMessage(t.Context(), msg.Key, "12345")
+		require.NoError(t, err)
+	})
+
+	t.Run("wrong pin", func(t *testing.T) {
+		resp := upload(t, map[string]string{"exp": "600", "pin": "12345"}, "a.txt", []byte("data"))
+		defer resp.Body.Close()
+		respSave := struct{ Key string }{}
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&respSave))
+		resp2, err := client.Get(ts.URL + "/api/v1/file/" + respSave.Key + "/11111")
+		require.NoError(t, err)
+		defer resp2.Body.Close()
+		assert.Equal(t, http.StatusExpectationFailed, resp2.StatusCode)
+	})
+
+	tests := []struct {
+		name     string
+		fields   map[string]string
+		fileName string
+		data     []byte
+		status   int
+	}{
+		{name: "too large", fields: map[string]string{"exp": "600", "pin": "12345"}, fileName: "big.bin",
+			data: bytes.Repeat([]byte("x"), 1025), status: http.StatusRequestEntityTooLarge},
+		{name: "no file", fields: map[string]string{"exp": "600", "pin": "12345"}, status: http.StatusBadRequest},
+		{name: "bad pin", fields: map[string]string{"exp": "600", "pin": "123"}, fileName: "a.txt", data: []byte("data"),
+			status: http.StatusBadRequest},
+		{name: "bad exp", fields: map[string]string{"exp": "soon", "pin": "12345"}, fileName: "a.txt", data: []byte("data"),
+			status: http.StatusBadRequest},
+		{name: "exp too long", fields: map[string]string{"exp": "360000", "pin": "12345"}, fileName: "a.txt",
+			data: []byte("data"), status: http.StatusBadRequest},
+		{name: "bad max views", fields: map[string]string{"exp": "600", "pin": "12345", "max_views": "many"}, fileName: "a.txt",
+			data: []byte("data"), status: http.StatusBadRequest},
+		{name: "max views above limit", fields: map[string]string{"exp": "600", "pin": "12345", "max_views": "4"},
+			fileName: "a.txt", data: []byte("data"), status: http.StatusBadRequest},
+		{name: "callback not allowed", fields: map[string]string{"exp": "600", "pin": "12345",
+			"callback_url": "https://example.com/hook"}, fileName: "a.txt", data: []byte("data"), status: http.StatusBadRequest},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			resp := upload(t, tc.fields, tc.fileName, tc.data)
+			defer resp.Body.Close()
+			assert.Equal(t, tc.status, resp.StatusCode)
+		})
+	}
+
+	t.Run("not multipart", func(t *testing.T) {
+		resp, err := client.Post(ts.URL+"/api/v1/file", "application/json", strings.NewReader(`{}`))
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	})
+
+	t.Run("files disabled", func(t *testing.T) {
+		srvNoFiles, err := New(msgr, "1", Config{Domain: []string{"example.com"}, PinSize: 5, MaxPinAttempts: 3,
+			MaxExpire: 10 * time.Hour})
+		require.NoError(t, err)
+		tsNoFiles := httptest.NewServer(srvNoFiles.routes())
+		defer tsNoFiles.Close()
+
+		body := &bytes.Buffer{}
+		mw := multipart.NewWriter(body)
+		require.NoError(t, mw.WriteField("pin", "12345"))
+		require.NoError(t, mw.Close())
+		resp, err := client.Post(tsNoFiles.URL+"/api/v1/file", mw.FormDataContentType(), body)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+		resp2, err := client.Get(tsNoFiles.URL + "/api/v1/file/somekey/12345")
+		require.NoError(t, err)
+		defer resp2.Body.Close()
+		assert.Equal(t, http.StatusForbidden, resp2.StatusCode)
+	})
+}
+
 func TestServer_SizeLimit_TextOnly(t *testing.T) {
 	// test that text-only mode uses ~90KB limit (64KB * 1.4 for base64 overhead)
 	eng := store.NewInMemory(time.Second)
@@ -1069,6 +1516,280 @@ func TestServer_API_ServerSideEncryption(t *testing.T) {
 	assert.Equal(t, messageData, respLoad.Message, "decrypted data should match original")
 }
 
+func TestServer_API_MaxViews(t *testing.T) {
+	eng := store.NewInMemory(time.Second * 30)
+	srv, err := New(
+		messager.New(eng, messager.Crypt{Key: "123456789012345678901234567"}, messager.Params{
+			MaxDuration:    10 * time.Hour,
+			MaxPinAttempts: 3,
+			MaxViews:       5,
+		}),
+		"1",
+		Config{
+			Domain:         []string{"example.com"},
+			PinSize:        5,
+			MaxPinAttempts: 3,
+			MaxExpire:      10 * time.Hour,
+			MaxViews:       5,
+		})
+	require.NoError(t, err)
+
+	ts := httptest.NewServer(srv.routes())
+	defer ts.Close()
+	client := http.Client{Timeout: time.Second}
+
+	t.Run("params", func(t *testing.T) {
+		resp, err := client.Get(ts.URL + "/api/v1/params")
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		params := struct {
+			MaxViews int `json:"max_views"`
+		}{}
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&params))
+		assert.Equal(t, 5, params.MaxViews)
+	})
+
+	t.Run("too many views rejected", func(t *testing.T) {
+		resp, err := client.Post(ts.URL+"/api/v1/message", "application/json",
+			strings.NewReader(`{"message": "secret","exp": 600,"pin": "12345","max_views": 6}`))
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	})
+
+	t.Run("read until exhausted", func(t *testing.T) {
+		resp, err := client.Post(ts.URL+"/api/v1/message", "application/json",
+			strings.NewReader(`{"message": "secret","exp": 600,"pin": "12345","max_views": 3}`))
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusCreated, resp.StatusCode)
+		respSave := struct {
+			Key      string
+			MaxViews int `json:"max_views"`
+		}{}
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&respSave))
+		assert.Equal(t, 3, respSave.MaxViews)
+
+		url := fmt.Sprintf("%s/api/v1/message/%s/12345", ts.URL, respSave.Key)
+		for _, left := range []int{2, 1, 0} {
+			resp, err := client.Get(url)
+			require.NoError(t, err)
+			respLoad := struct {
+				Message   string
+				ViewsLeft int `json:"views_left"`
+			}{}
+			require.NoError(t, json.NewDecoder(resp.Body).Decode(&respLoad))
+			resp.Body.Close()
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+			assert.Equal(t, "secret", respLoad.Message)
+			assert.Equal(t, left, respLoad.ViewsLeft)
+		}
+
+		resp, err = client.Get(url)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	})
+}
+
+func TestServer_API_Callback(t *testing.T) {
+	var lock sync.Mutex
+	var payloads []webhook.Payload
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+		assert.Equal(t, "sha256="+webhook.Sign("hook-secret", body), r.Header.Get("X-Secrets-Signature"))
+		var p webhook.Payload
+		require.NoError(t, json.Unmarshal(body, &p))
+		lock.Lock()
+		payloads = append(payloads, p)
+		lock.Unlock()
+	}))
+	defer hook.Close()
+
+	// callbacks to public address are routed to the local hook, the hook itself is on internal address
+	const callbackURL = "http://203.0.113.10/hook"
+	hookClient := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, network, hook.Listener.Addr().String())
+		}}}
+	dispatcher, err := webhook.New(webhook.Config{Secret: "hook-secret", IP: HashedIPFromContext, CallbackClient: hookClient})
+	require.NoError(t, err)
+
+	makeServer := func(allowCallback bool) *httptest.Server {
+		eng := store.NewInMemory(time.Second * 30)
+		msgProc := messager.New(eng, messager.Crypt{Key: "123456789012345678901234567"}, messager.Params{
+			MaxDuration: 10 * time.Hour, MaxPinAttempts: 3}).WithNotifier(dispatcher)
+		srv, err := New(msgProc, "1", Config{Domain: []string{"example.com"}, PinSize: 5, MaxPinAttempts: 3,
+			MaxExpire: 10 * time.Hour, AllowCallback: allowCallback})
+		require.NoError(t, err)
+		return httptest.NewServer(srv.routes())
+	}
+	client := http.Client{Timeout: time.Second}
+
+	t.Run("callback not allowed", func(t *testing.T) {
+		ts := makeServer(false)
+		defer ts.Close()
+		resp, err := client.Post(ts.URL+"/api/v1/message", "application/json",
+			strings.NewReader(`{"message": "secret","exp": 600,"pin": "12345","callback_url": "`+callbackURL+`"}`))
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	})
+
+	ts := makeServer(true)
+	defer ts.Close()
+
+	t.Run("invalid callback", func(t *testing.T) {
+		resp, err := client.Post(ts.URL+"/api/v1/message", "application/json",
+			strings.NewReader(`{"message": "secret","exp": 600,"pin": "12345","callback_url": "ftp://example.com"}`))
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	})
+
+	t.Run("internal callback", func(t *testing.T) {
+		for _, u := range []string{hook.URL, "http://10.0.0.1/hook", "http://169.254.169.254/latest", "http://[::1]:8080/"} {
+			resp, err := client.Post(ts.URL+"/api/v1/message", "application/json",
+				strings.NewReader(`{"message": "secret","exp": 600,"pin": "12345","callback_url": "`+u+`"}`))
+			require.NoError(t, err)
+			resp.Body.Close()
+			assert.Equal(t, http.StatusBadRequest, resp.StatusCode, u)
+		}
+	})
+
+	t.Run("events sent to callback", func(t *testing.T) {
+		resp, err := client.Post(ts.URL+"/api/v1/message", "application/json",
+			strings.NewReader(`{"message": "secret","exp": 600,"pin": "12345","callback_url": "`+callbackURL+`"}`))
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusCreated, resp.StatusCode)
+		respSave := struct{ Key string }{}
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&respSave))
+
+		resp2, err := client.Get(ts.URL + "/api/v1/message/" + respSave.Key + "/12345")
+		require.NoError(t, err)
+		defer resp2.Body.Close()
+		require.Equal(t, http.StatusOK, resp2.StatusCode)
+
+		dispatcher.Close()
+		require.Len(t, payloads, 2)
+		events := []string{payloads[0].Event, payloads[1].Event}
+		assert.ElementsMatch(t, []string{webhook.EventCreated, webhook.EventAccessed}, events)
+		for _, p := range payloads {
+			assert.Equal(t, respSave.Key[:4], p.KeyPrefix)
+			assert.Len(t, p.IP, 8, "hashed ip from request")
+		}
+	})
+}
+
+func TestServer_deleteMessageCtrl(t *testing.T) {
+	ts, teardown := prepTestServer(t)
+	defer teardown()
+	client := http.Client{Timeout: time.Second}
+
+	resp, err := client.Post(ts.URL+"/api/v1/message", "application/json",
+		strings.NewReader(`{"message": "sent to the wrong chat","exp": 600,"pin": "12345"}`))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	respSave := struct{ Key, Token string }{}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&respSave))
+	require.NotEmpty(t, respSave.Token)
+
+	deleteMsg := func(key, token string) int {
+		req, err := http.NewRequest(http.MethodDelete, ts.URL+"/api/v1/message/"+key, http.NoBody)
+		require.NoError(t, err)
+		if token != "" {
+			req.Header.Set("X-Management-Token", token)
+		}
+		resp, err := client.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	assert.Equal(t, http.StatusBadRequest, deleteMsg(respSave.Key, ""), "no token")
+	assert.Equal(t, http.StatusForbidden, deleteMsg(respSave.Key, "wrong-token"), "wrong token")
+	assert.Equal(t, http.StatusOK, deleteMsg(respSave.Key, respSave.Token), "revoked")
+	assert.Equal(t, http.StatusNotFound, deleteMsg(respSave.Key, respSave.Token), "already revoked")
+
+	// revoked message can't be read
+	resp, err = client.Get(fmt.Sprintf("%s/api/v1/message/%s/12345", ts.URL, respSave.Key))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
+
+func TestServer_messageStatusCtrl(t *testing.T) {
+	ts, teardown := prepTestServer(t)
+	defer teardown()
+	client := http.Client{Timeout: time.Second}
+
+	resp, err := client.Post(ts.URL+"/api/v1/message", "application/json",
+		strings.NewReader(`{"message": "reset password","exp": 600,"pin": "12345"}`))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	respSave := struct{ Key, Token string }{}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&respSave))
+
+	type status struct {
+		State          string
+		Opened         bool
+		Created        time.Time
+		Expires        time.Time
+		Closed         *time.Time
+		FailedAttempts int `json:"failed_attempts"`
+		Views          int
+	}
+	getStatus := func(key, token string) (int, status) {
+		req, err := http.NewRequest(http.MethodGet, ts.URL+"/api/v1/message/"+key+"/status", http.NoBody)
+		require.NoError(t, err)
+		if token != "" {
+			req.Header.Set("X-Management-Token", token)
+		}
+		resp, err := client.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		var st status
+		if resp.StatusCode == http.StatusOK {
+			require.NoError(t, json.NewDecoder(resp.Body).Decode(&st))
+		}
+		return resp.StatusCode, st
+	}
+
+	code, st := getStatus(respSave.Key, respSave.Token)
+	require.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "active", st.State)
+	assert.False(t, st.Opened)
+	assert.Nil(t, st.Closed)
+	assert.WithinDuration(t, time.Now(), st.Created, 5*time.Second)
+	assert.WithinDuration(t, time.Now().Add(600*time.Second), st.Expires, 5*time.Second)
+
+	// wrong pin, then read
+	for _, pin := range []string{"00000", "12345"} {
+		resp, err := client.Get(fmt.Sprintf("%s/api/v1/message/%s/%s", ts.URL, respSave.Key, pin))
+		require.NoError(t, err)
+		resp.Body.Close()
+	}
+
+	code, st = getStatus(respSave.Key, respSave.Token)
+	require.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "opened", st.State)
+	assert.True(t, st.Opened)
+	assert.Equal(t, 1, st.FailedAttempts)
+	assert.Equal(t, 1, st.Views)
+	require.NotNil(t, st.Closed)
+
+	code, _ = getStatus(respSave.Key, "")
+	assert.Equal(t, http.StatusBadRequest, code, "no token")
+	code, _ = getStatus(respSave.Key, "wrong-token")
+	assert.Equal(t, http.StatusForbidden, code, "wrong token")
+	code, _ = getStatus("nonexistent", respSave.Token)
+	assert.Equal(t, http.StatusNotFound, code, "unknown message")
+}
+
 func TestServer_getMessageCtrl_TimingPad(t *testing.T) {
 	eng := store.NewInMemory(time.Second)
 	srv, err := New(
@@ -1128,3 +1849,143 @@ func TestServer_getMessageCtrl_TimingPad(t *testing.T) {
 		})
 	}
 }
+
+func TestServer_API_Passphrase(t *testing.T) {
+	eng := store.NewInMemory(time.Second * 30)
+	srv, err := New(
+		messager.New(eng, messager.Crypt{Key: "123456789012345678901234567"}, messager.Params{
+			MaxDuration: 10 * time.Hour, MaxPinAttempts: 3,
+		}),
+		"1",
+		Config{Domain: []string{"example.com"}, PinSize: 5, MaxPinAttempts: 3, MaxExpire: 10 * time.Hour,
+			Passphrase: true, MinEntropy: 40})
+	require.NoError(t, err)
+
+	ts := httptest.NewServer(srv.routes())
+	defer ts.Close()
+	client := http.Client{Timeout: 5 * time.Second}
+
+	t.Run("params", func(t *testing.T) {
+		resp, err := client.Get(ts.URL + "/api/v1/params")
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		params := struct {
+			Passphrase bool `json:"passphrase"`
+			MinEntropy int  `json:"min_entropy"`
+		}{}
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&params))
+		assert.True(t, params.Passphrase)
+		assert.Equal(t, 40, params.MinEntropy)
+	})
+
+	t.Run("weak passphrase rejected", func(t *testing.T) {
+		resp, err := client.Post(ts.URL+"/api/v1/message", "application/json",
+			strings.NewReader(`{"message": "secret","exp": 600,"pin": "12345"}`))
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		assert.Contains(t, string(body), "passphrase is too weak")
+	})
+
+	t.Run("save and load with passphrase", func(t *testing.T) {
+		pass := "my c@t/likes #tuna?"
+		reqBody, err := json.Marshal(map[string]any{"message": "secret", "exp": 600, "pin": pass})
+		require.NoError(t, err)
+		resp, err := client.Post(ts.URL+"/api/v1/message", "application/json", bytes.NewReader(reqBody))
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusCreated, resp.StatusCode)
+		respSave := struct{ Key string }{}
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&respSave))
+
+		resp2, err := client.Get(ts.URL + "/api/v1/message/" + respSave.Key + "/" + url.PathEscape("my c@t/likes"))
+		require.NoError(t, err)
+		defer resp2.Body.Close()
+		assert.Equal(t, http.StatusExpectationFailed, resp2.StatusCode, "wrong passphrase")
+
+		resp3, err := client.Get(ts.URL + "/api/v1/message/" + respSave.Key + "/" + url.PathEscape(pass))
+		require.NoError(t, err)
+		defer resp3.Body.Close()
+		require.Equal(t, http.StatusOK, resp3.StatusCode)
+		respLoad := struct{ Message string }{}
+		require.NoError(t, json.NewDecoder(resp3.Body).Decode(&respLoad))
+		assert.Equal(t, "secret", respLoad.Message)
+	})
+}
+
+func TestServer_OpenAPI(t *testing.T) {
+	eng := store.NewInMemory(time.Second * 30)
+	msgr := messager.New(eng, messager.Crypt{Key: "123456789012345678901234567"}, messager.Params{MaxDuration: time.Hour})
+	srv, err := New(msgr, "1", Config{Domain: []string{"example.com"}, Protocol: "https", PinSize: 5, MaxExpire: time.Hour})
+	require.NoError(t, err)
+	router := srv.routes()
+
+	data, err := assets.Files.ReadFile("openapi.json")
+	require.NoError(t, err)
+	spec := struct {
+		Paths map[string]map[string]struct {
+			Responses map[string]any `json:"responses"`
+		} `json:"paths"`
+	}{}
+	require.NoError(t, json.Unmarshal(data, &spec))
+
+	t.Run("spec describes all api routes", func(t *testing.T) {
+		var specRoutes, apiRoutes []string
+		for path, ops := range spec.Paths {
+			for method := range ops {
+				specRoutes = append(specRoutes, strings.ToUpper(method)+" "+path)
+			}
+		}
+		for _, api := range srv.apiRoutes() {
+			for _, rt := range api.routes {
+				method, path, _ := strings.Cut(rt.pattern, " ")
+				apiRoutes = append(apiRoutes, method+" "+api.basePath+path)
+			}
+		}
+		apiRoutes = append(apiRoutes, "GET /ping") // served by rest.Ping middleware
+		assert.ElementsMatch(t, apiRoutes, specRoutes)
+	})
+
+	t.Run("spec routes registered", func(t *testing.T) {
+		mux, ok := router.(*routegroup.Bundle)
+		require.True(t, ok)
+		for path, ops := range spec.Paths {
+			if path == "/ping" {
+				continue
+			}
+			reqPath := strings.NewReplacer("{key}", "ZkAnwcKYrX48", "{pin}", "12345").Replace(path)
+			for method := range ops {
+				req := httptest.NewRequest(strings.ToUpper(method), reqPath, http.NoBody)
+				_, pattern := mux.Handler(req)
+				assert.Equal(t, strings.ToUpper(method)+" "+path, pattern)
+			}
+		}
+	})
+
+	t.Run("wrong pin status documented", func(t *testing.T) {
+		assert.Contains(t, spec.Paths["/api/v1/message/{key}/{pin}"]["get"].Responses, "417")
+		assert.Contains(t, spec.Paths["/api/v2/message/{key}"]["post"].Responses, "417")
+	})
+
+	t.Run("served with own server url", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/openapi.json", http.NoBody)
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		require.Equal(t, http.StatusOK, rr.Code)
+		assert.Equal(t, "application/json; charset=utf-8", rr.Header().Get("Content-Type"))
+		res := struct {
+			OpenAPI string `json:"openapi"`
+			Servers []struct {
+				URL string `json:"url"`
+			} `json:"servers"`
+			Paths map[string]any `json:"paths"`
+		}{}
+		require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &res))
+		assert.Equal(t, "3.0.3", res.OpenAPI)
+		require.Len(t, res.Servers, 1)
+		assert.Equal(t, "https://example.com", res.Servers[0].URL)
+		assert.Len(t, res.Paths, len(spec.Paths))
+	})
+}
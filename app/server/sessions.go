@@ -0,0 +1,66 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+
+	log "github.com/go-pkgz/lgr"
+	"github.com/go-pkgz/rest"
+
+	"github.com/umputun/secrets/v2/app/sessions"
+	"github.com/umputun/secrets/v2/app/store"
+)
+
+// GET /v1/sessions, lists active login sessions
+func (s Server) listSessionsCtrl(w http.ResponseWriter, r *http.Request) {
+	if !s.checkAdminAuth(w, r, "session", s.sessions != nil) {
+		return
+	}
+	list, err := s.sessions.List(r.Context())
+	if err != nil {
+		SendErrorJSON(w, r, log.Default(), http.StatusInternalServerError, err, "can't list sessions")
+		return
+	}
+	res := make([]rest.JSON, 0, len(list))
+	for i := range list {
+		res = append(res, sessionJSON(&list[i]))
+	}
+	rest.RenderJSON(w, res)
+}
+
+// DELETE /v1/sessions, revokes all sessions, everybody has to log in again
+func (s Server) revokeSessionsCtrl(w http.ResponseWriter, r *http.Request) {
+	if !s.checkAdminAuth(w, r, "session", s.sessions != nil) {
+		return
+	}
+	count, err := s.sessions.RevokeAll(r.Context())
+	if err != nil {
+		SendErrorJSON(w, r, log.Default(), http.StatusInternalServerError, err, "can't revoke sessions")
+		return
+	}
+	rest.RenderJSON(w, rest.JSON{"deleted": count})
+}
+
+// DELETE /v1/sessions/{id}, revokes session by id
+func (s Server) revokeSessionCtrl(w http.ResponseWriter, r *http.Request) {
+	if !s.checkAdminAuth(w, r, "session", s.sessions != nil) {
+		return
+	}
+	id := r.PathValue("id")
+	err := s.sessions.Revoke(r.Context(), id)
+	switch {
+	case errors.Is(err, sessions.ErrNotFound):
+		SendErrorJSON(w, r, log.Default(), http.StatusNotFound, err, "session not found")
+		return
+	case err != nil:
+		SendErrorJSON(w, r, log.Default(), http.StatusInternalServerError, err, "can't revoke session")
+		return
+	}
+	rest.RenderJSON(w, rest.JSON{"id": id, "deleted": true})
+}
+
+// sessionJSON makes API response of the session record, without its hash
+func sessionJSON(sess *store.Session) rest.JSON {
+	return rest.JSON{"id": sess.ID, "user": sess.User, "ip": sess.IP, "user_agent": sess.UserAgent,
+		"created": sess.Created, "last_seen": sess.LastSeen, "expires": sess.Expires}
+}
@@ -0,0 +1,170 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/umputun/secrets/v2/app/sessions"
+	"github.com/umputun/secrets/v2/app/store"
+)
+
+func TestServer_StoredSessions(t *testing.T) {
+	withSessions := func(srv Server, eng *store.SQLite) Server { return srv.WithSessions(sessions.New(eng, time.Hour)) }
+	ts, eng := prepServer(t, Config{AuthHash: testBcryptHash(t, "passwd"), SessionTTL: time.Hour, SessionKey: "session-key"},
+		withSessions)
+	client := http.Client{Timeout: 5 * time.Second}
+
+	login := func(t *testing.T) *http.Cookie {
+		t.Helper()
+		req, err := http.NewRequest(http.MethodPost, ts.URL+"/login", strings.NewReader(url.Values{"password": {"passwd"}}.Encode()))
+		require.NoError(t, err)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("User-Agent", "test-agent/1.0")
+		resp, err := client.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		require.Equal(t, "submitSecretForm", resp.Header.Get("HX-Trigger"))
+		for _, c := range resp.Cookies() {
+			if c.Name == authCookieName {
+				return c
+			}
+		}
+		require.FailNow(t, "no session cookie")
+		return nil
+	}
+	generateLink := func(t *testing.T, cookie *http.Cookie) *http.Response {
+		t.Helper()
+		form := url.Values{"message": {"ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnop"}, "pin": {"12345"}, "exp": {"10"}, "expUnit": {"m"}}
+		req, err := http.NewRequest(http.MethodPost, ts.URL+"/generate-link", strings.NewReader(form.Encode()))
+		require.NoError(t, err)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("HX-Request", "true")
+		req.AddCookie(cookie)
+		resp, err := client.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp
+	}
+	admin := func(t *testing.T, method, path string) (status int, res json.RawMessage) {
+		t.Helper()
+		req, err := http.NewRequest(method, ts.URL+path, http.NoBody)
+		require.NoError(t, err)
+		req.SetBasicAuth(authUser, "passwd")
+		resp, err := client.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&res))
+		return resp.StatusCode, res
+	}
+
+	t.Run("session stored with request details", func(t *testing.T) {
+		cookie := login(t)
+		assert.Equal(t, int(time.Hour.Seconds()), cookie.MaxAge)
+		list, err := eng.ListSessions(t.Context())
+		require.NoError(t, err)
+		require.NotEmpty(t, list)
+		sess := list[len(list)-1]
+		assert.Equal(t, authUser, sess.User)
+		assert.Equal(t, "test-agent/1.0", sess.UserAgent)
+		assert.NotEmpty(t, sess.IP)
+		assert.NotContains(t, sess.IP, "127.0.0.1", "ip is hashed")
+		assert.NotContains(t, cookie.Value, sess.Hash)
+
+		resp := generateLink(t, cookie)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		refreshed := resp.Cookies()
+		require.Len(t, refreshed, 1, "cookie extended with the session")
+		assert.Equal(t, cookie.Value, refreshed[0].Value)
+		assert.Positive(t, refreshed[0].MaxAge)
+	})
+
+	t.Run("logout ends the session", func(t *testing.T) {
+		cookie := login(t)
+		req, err := http.NewRequest(http.MethodGet, ts.URL+"/logout", http.NoBody)
+		require.NoError(t, err)
+		req.AddCookie(cookie)
+		noRedirect := http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+		resp, err := noRedirect.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusSeeOther, resp.StatusCode)
+
+		// the old cookie is rejected even if the browser kept it
+		assert.Equal(t, http.StatusUnauthorized, generateLink(t, cookie).StatusCode)
+	})
+
+	t.Run("stateless cookie rejected", func(t *testing.T) {
+		srv := Server{cfg: Config{AuthHash: "x", SessionTTL: time.Hour}}
+		cookie := &http.Cookie{Name: authCookieName, Value: srv.generateSessionToken(authUser)}
+		assert.Equal(t, http.StatusUnauthorized, generateLink(t, cookie).StatusCode)
+	})
+
+	t.Run("admin revokes sessions", func(t *testing.T) {
+		cookie1, cookie2 := login(t), login(t)
+
+		status, res := admin(t, http.MethodGet, "/api/v1/sessions")
+		require.Equal(t, http.StatusOK, status)
+		type sessionItem struct {
+			ID        string
+			User      string
+			UserAgent string `json:"user_agent"`
+			Hash      string
+		}
+		list := []sessionItem{}
+		require.NoError(t, json.Unmarshal(res, &list))
+		require.GreaterOrEqual(t, len(list), 2)
+		assert.Equal(t, authUser, list[0].User)
+		assert.Equal(t, "test-agent/1.0", list[0].UserAgent)
+		assert.Empty(t, list[0].Hash, "hash not exposed")
+
+		// session id is the beginning of the cookie
+		id2 := cookie2.Value[:12]
+		require.True(t, slices.ContainsFunc(list, func(s sessionItem) bool { return s.ID == id2 }))
+		status, _ = admin(t, http.MethodDelete, "/api/v1/sessions/"+id2)
+		require.Equal(t, http.StatusOK, status)
+		assert.Equal(t, http.StatusUnauthorized, generateLink(t, cookie2).StatusCode)
+		assert.Equal(t, http.StatusOK, generateLink(t, cookie1).StatusCode)
+		status, _ = admin(t, http.MethodDelete, "/api/v1/sessions/"+id2)
+		assert.Equal(t, http.StatusNotFound, status)
+
+		// kill all
+		status, res = admin(t, http.MethodDelete, "/api/v1/sessions")
+		require.Equal(t, http.StatusOK, status)
+		deleted := struct{ Deleted int }{}
+		require.NoError(t, json.Unmarshal(res, &deleted))
+		assert.Equal(t, len(list)-1, deleted.Deleted)
+		assert.Equal(t, http.StatusUnauthorized, generateLink(t, cookie1).StatusCode)
+		status, res = admin(t, http.MethodGet, "/api/v1/sessions")
+		require.Equal(t, http.StatusOK, status)
+		assert.JSONEq(t, `[]`, string(res))
+	})
+
+	t.Run("admin api requires admin password", func(t *testing.T) {
+		req, err := http.NewRequest(http.MethodDelete, ts.URL+"/api/v1/sessions", http.NoBody)
+		require.NoError(t, err)
+		req.SetBasicAuth(authUser, "wrong")
+		resp, err := client.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	})
+}
+
+func TestServer_SessionsAdminDisabled(t *testing.T) {
+	ts, _ := prepServer(t, Config{AuthHash: testBcryptHash(t, "passwd")}, withTestTokens) // no session store
+	req, err := http.NewRequest(http.MethodGet, ts.URL+"/api/v1/sessions", http.NoBody)
+	require.NoError(t, err)
+	req.SetBasicAuth(authUser, "passwd")
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+}
@@ -0,0 +1,112 @@
+package server
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/go-pkgz/lgr"
+)
+
+const (
+	ssoCookieName = "secrets_sso"
+	ssoUserPrefix = "sso:" // session user of SSO login, can't clash with named users as they have no colon
+	ssoFlowTTL    = 10 * time.Minute
+)
+
+// ssoLoginCtrl starts SSO login, redirects to provider's login page. State, nonce and PKCE verifier
+// are kept in a short-lived signed cookie until the callback.
+// GET /auth/sso/login
+func (s Server) ssoLoginCtrl(w http.ResponseWriter, r *http.Request) {
+	state, nonce, verifier := randomString(), randomString(), randomString()
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	http.SetCookie(w, &http.Cookie{
+		Name:     ssoCookieName,
+		Value:    strings.Join([]string{state, nonce, verifier, timestamp, s.signSession("sso", state, nonce, verifier, timestamp)}, "."),
+		Path:     "/auth/sso",
+		HttpOnly: true,
+		Secure:   s.cfg.Protocol == "https",
+		SameSite: http.SameSiteLaxMode, // callback is a cross-site redirect from the provider
+		MaxAge:   int(ssoFlowTTL.Seconds()),
+	})
+	http.Redirect(w, r, s.sso.AuthURL(state, nonce, verifier), http.StatusFound)
+}
+
+// ssoCallbackCtrl completes SSO login, exchanges the code for verified identity and sets session cookie
+// GET /auth/sso/callback
+func (s Server) ssoCallbackCtrl(w http.ResponseWriter, r *http.Request) {
+	// flow cookie is single use
+	http.SetCookie(w, &http.Cookie{Name: ssoCookieName, Value: "", Path: "/auth/sso", HttpOnly: true,
+		Secure: s.cfg.Protocol == "https", SameSite: http.SameSiteLaxMode, MaxAge: -1})
+
+	fail := func(status int, msg, logMsg string) {
+		log.Printf("[WARN] sso login failed, %s, ip=%s", logMsg, GetHashedIP(r))
+		s.render(w, status, "login-error.tmpl.html", baseTmpl, s.newTemplateData(r, msg))
+	}
+
+	query := r.URL.Query()
+	if errCode := query.Get("error"); errCode != "" {
+		fail(http.StatusUnauthorized, "login rejected by identity provider", "provider error "+strconv.Quote(errCode))
+		return
+	}
+
+	state, nonce, verifier, ok := s.ssoFlow(r)
+	if !ok {
+		fail(http.StatusBadRequest, "login session expired, try again", "no valid flow cookie")
+		return
+	}
+	if subtle.ConstantTimeCompare([]byte(query.Get("state")), []byte(state)) != 1 {
+		fail(http.StatusBadRequest, "login session expired, try again", "state mismatch")
+		return
+	}
+
+	user, err := s.sso.Exchange(r.Context(), query.Get("code"), nonce, verifier)
+	if err != nil {
+		fail(http.StatusForbidden, "you are not allowed to create secrets", err.Error())
+		return
+	}
+
+	user = ssoUserPrefix + user
+	if err = s.setSessionCookie(w, r, user); err != nil {
+		fail(http.StatusInternalServerError, "can't create session, try again later", err.Error())
+		return
+	}
+	log.Printf("[INFO] login success, user=%s, ip=%s", user, GetHashedIP(r))
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// ssoFlow returns state, nonce and PKCE verifier from the flow cookie set by ssoLoginCtrl
+func (s Server) ssoFlow(r *http.Request) (state, nonce, verifier string, ok bool) {
+	cookie, err := r.Cookie(ssoCookieName)
+	if err != nil {
+		return "", "", "", false
+	}
+	parts := strings.Split(cookie.Value, ".")
+	if len(parts) != 5 {
+		return "", "", "", false
+	}
+	signature, err := base64.StdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return "", "", "", false
+	}
+	expected, _ := base64.StdEncoding.DecodeString(s.signSession("sso", parts[0], parts[1], parts[2], parts[3]))
+	if subtle.ConstantTimeCompare(signature, expected) != 1 {
+		return "", "", "", false
+	}
+	timestamp, err := strconv.ParseInt(parts[3], 10, 64)
+	if err != nil || time.Since(time.Unix(timestamp, 0)) > ssoFlowTTL {
+		return "", "", "", false
+	}
+	return parts[0], parts[1], parts[2], true
+}
+
+// randomString returns 256 random bits, base64url encoded. Long enough for PKCE verifier (43-128 characters).
+func randomString() string {
+	b := make([]byte, 32)
+	_, _ = rand.Read(b) // never fails, crashes the program on broken system source
+	return base64.RawURLEncoding.EncodeToString(b)
+}
@@ -0,0 +1,185 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/umputun/secrets/v2/app/store"
+)
+
+// fakeSSO accepts code "good" with nonce and verifier of the last auth url
+type fakeSSO struct {
+	nonce, verifier string
+}
+
+func (f *fakeSSO) AuthURL(state, nonce, verifier string) string {
+	f.nonce, f.verifier = nonce, verifier
+	return "https://idp.example.com/authorize?" + url.Values{"state": {state}}.Encode()
+}
+
+func (f *fakeSSO) Exchange(_ context.Context, code, nonce, verifier string) (string, error) {
+	if code != "good" || nonce != f.nonce || verifier != f.verifier {
+		return "", errors.New("not allowed")
+	}
+	return "bob@example.com", nil
+}
+
+func TestServer_SSO(t *testing.T) {
+	newServer := func(t *testing.T, authHash string, provider SSO) *httptest.Server {
+		t.Helper()
+		var opts []testServerOpt
+		if provider != nil {
+			opts = append(opts, func(srv Server, _ *store.SQLite) Server { return srv.WithSSO(provider) })
+		}
+		ts, _ := prepServer(t, Config{AuthHash: authHash, SessionTTL: time.Hour, SignKey: "sign-key-1234567890"}, opts...)
+		return ts
+	}
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	cookieOf := func(resp *http.Response, name string) *http.Cookie {
+		for _, c := range resp.Cookies() {
+			if c.Name == name {
+				return c
+			}
+		}
+		return nil
+	}
+	// startLogin returns flow cookie and state of auth url
+	startLogin := func(t *testing.T, ts *httptest.Server) (*http.Cookie, string) {
+		t.Helper()
+		resp, err := client.Get(ts.URL + "/auth/sso/login")
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusFound, resp.StatusCode)
+		loc, err := url.Parse(resp.Header.Get("Location"))
+		require.NoError(t, err)
+		assert.Equal(t, "idp.example.com", loc.Host)
+		flow := cookieOf(resp, ssoCookieName)
+		require.NotNil(t, flow)
+		assert.Equal(t, "/auth/sso", flow.Path)
+		assert.Equal(t, http.SameSiteLaxMode, flow.SameSite)
+		assert.True(t, flow.HttpOnly)
+		return flow, loc.Query().Get("state")
+	}
+	callback := func(t *testing.T, ts *httptest.Server, flow *http.Cookie, query url.Values) *http.Response {
+		t.Helper()
+		req, err := http.NewRequest(http.MethodGet, ts.URL+"/auth/sso/callback?"+query.Encode(), http.NoBody)
+		require.NoError(t, err)
+		if flow != nil {
+			req.AddCookie(flow)
+		}
+		resp, err := client.Do(req)
+		require.NoError(t, err)
+		_ = resp.Body.Close()
+		return resp
+	}
+	generateLink := func(t *testing.T, ts *httptest.Server, cookie *http.Cookie) int {
+		t.Helper()
+		form := url.Values{"message": {"ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnop"}, "pin": {"12345"}, "exp": {"10"},
+			"expUnit": {"m"}}
+		req, err := http.NewRequest(http.MethodPost, ts.URL+"/generate-link", strings.NewReader(form.Encode()))
+		require.NoError(t, err)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("HX-Request", "true")
+		if cookie != nil {
+			req.AddCookie(cookie)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		return resp.StatusCode
+	}
+	loginPopup := func(t *testing.T, ts *httptest.Server) string {
+		t.Helper()
+		resp, err := http.Get(ts.URL + "/login-popup")
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return string(body)
+	}
+
+	t.Run("login", func(t *testing.T) {
+		ts := newServer(t, "", &fakeSSO{})
+		assert.Equal(t, http.StatusUnauthorized, generateLink(t, ts, nil), "auth enabled by sso")
+
+		flow, state := startLogin(t, ts)
+		resp := callback(t, ts, flow, url.Values{"code": {"good"}, "state": {state}})
+		require.Equal(t, http.StatusSeeOther, resp.StatusCode)
+		assert.Equal(t, "/", resp.Header.Get("Location"))
+		flowCleared := cookieOf(resp, ssoCookieName)
+		require.NotNil(t, flowCleared)
+		assert.Negative(t, flowCleared.MaxAge)
+		session := cookieOf(resp, authCookieName)
+		require.NotNil(t, session)
+		assert.Equal(t, http.StatusOK, generateLink(t, ts, session))
+
+		srv := Server{cfg: Config{SignKey: "sign-key-1234567890", SessionTTL: time.Hour}}
+		user, ok := srv.validateSessionToken(session.Value)
+		require.True(t, ok)
+		assert.Equal(t, "sso:bob@example.com", user)
+	})
+
+	t.Run("rejected callbacks", func(t *testing.T) {
+		ts := newServer(t, "", &fakeSSO{})
+		flow, state := startLogin(t, ts)
+
+		tbl := []struct {
+			name   string
+			flow   *http.Cookie
+			query  url.Values
+			status int
+		}{
+			{"no flow cookie", nil, url.Values{"code": {"good"}, "state": {state}}, http.StatusBadRequest},
+			{"state mismatch", flow, url.Values{"code": {"good"}, "state": {"other"}}, http.StatusBadRequest},
+			{"tampered flow cookie", &http.Cookie{Name: ssoCookieName, Value: strings.Replace(flow.Value, state, "x", 1)},
+				url.Values{"code": {"good"}, "state": {"x"}}, http.StatusBadRequest},
+			{"provider error", flow, url.Values{"error": {"access_denied"}, "state": {state}}, http.StatusUnauthorized},
+			{"exchange failed", flow, url.Values{"code": {"bad"}, "state": {state}}, http.StatusForbidden},
+		}
+		for _, tt := range tbl {
+			t.Run(tt.name, func(t *testing.T) {
+				resp := callback(t, ts, tt.flow, tt.query)
+				assert.Equal(t, tt.status, resp.StatusCode)
+				assert.Nil(t, cookieOf(resp, authCookieName))
+			})
+		}
+	})
+
+	t.Run("login popup", func(t *testing.T) {
+		body := loginPopup(t, newServer(t, "", &fakeSSO{}))
+		assert.Contains(t, body, `href="/auth/sso/login"`)
+		assert.NotContains(t, body, `name="password"`, "no password login")
+
+		body = loginPopup(t, newServer(t, testBcryptHash(t, "admin-pass"), &fakeSSO{}))
+		assert.Contains(t, body, `href="/auth/sso/login"`)
+		assert.Contains(t, body, `name="password"`)
+
+		body = loginPopup(t, newServer(t, testBcryptHash(t, "admin-pass"), nil))
+		assert.NotContains(t, body, "/auth/sso/login")
+	})
+
+	t.Run("sso session rejected without sso", func(t *testing.T) {
+		hash := testBcryptHash(t, "admin-pass")
+		ts := newServer(t, hash, nil)
+		srv := Server{cfg: Config{AuthHash: hash, SignKey: "sign-key-1234567890", SessionTTL: time.Hour}}
+		assert.Equal(t, http.StatusOK, generateLink(t, ts, &http.Cookie{Name: authCookieName,
+			Value: srv.generateSessionToken(authUser)}))
+		assert.Equal(t, http.StatusUnauthorized, generateLink(t, ts, &http.Cookie{Name: authCookieName,
+			Value: srv.generateSessionToken("sso:bob@example.com")}))
+
+		resp, err := client.Get(ts.URL + "/auth/sso/login")
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	})
+}
@@ -0,0 +1,124 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	log "github.com/go-pkgz/lgr"
+	"github.com/go-pkgz/rest"
+
+	"github.com/umputun/secrets/v2/app/store"
+	"github.com/umputun/secrets/v2/app/tokens"
+)
+
+// POST /v1/tokens, creates named API token, the token is returned only once
+func (s Server) createTokenCtrl(w http.ResponseWriter, r *http.Request) {
+	if !s.checkAdminAuth(w, r, "token", s.tokens != nil) {
+		return
+	}
+	request := struct {
+		Name   string   `json:"name"`
+		Scopes []string `json:"scopes"`
+		MaxExp int      `json:"max_exp"` // seconds
+	}{}
+	if err := rest.DecodeJSON(r, &request); err != nil {
+		SendErrorJSON(w, r, log.Default(), http.StatusBadRequest, err, "can't decode request")
+		return
+	}
+
+	token, t, err := s.tokens.Create(r.Context(), tokens.Request{Name: request.Name, Scopes: request.Scopes,
+		MaxExp: time.Duration(request.MaxExp) * time.Second})
+	if err != nil {
+		status := http.StatusBadRequest
+		if errors.Is(err, tokens.ErrNameTaken) {
+			status = http.StatusConflict
+		}
+		SendErrorJSON(w, r, log.Default(), status, err, err.Error())
+		return
+	}
+	res := tokenJSON(t)
+	res["token"] = token
+	_ = rest.EncodeJSON(w, http.StatusCreated, res)
+}
+
+// GET /v1/tokens, lists tokens without their secrets
+func (s Server) listTokensCtrl(w http.ResponseWriter, r *http.Request) {
+	if !s.checkAdminAuth(w, r, "token", s.tokens != nil) {
+		return
+	}
+	list, err := s.tokens.List(r.Context())
+	if err != nil {
+		SendErrorJSON(w, r, log.Default(), http.StatusInternalServerError, err, "can't list tokens")
+		return
+	}
+	res := make([]rest.JSON, 0, len(list))
+	for i := range list {
+		res = append(res, tokenJSON(&list[i]))
+	}
+	rest.RenderJSON(w, res)
+}
+
+// DELETE /v1/tokens/{ref}, revokes token by id or name
+func (s Server) revokeTokenCtrl(w http.ResponseWriter, r *http.Request) {
+	if !s.checkAdminAuth(w, r, "token", s.tokens != nil) {
+		return
+	}
+	t, err := s.tokens.Revoke(r.Context(), r.PathValue("ref"))
+	switch {
+	case errors.Is(err, tokens.ErrNotFound):
+		SendErrorJSON(w, r, log.Default(), http.StatusNotFound, err, "token not found")
+		return
+	case err != nil:
+		SendErrorJSON(w, r, log.Default(), http.StatusInternalServerError, err, "can't revoke token")
+		return
+	}
+	rest.RenderJSON(w, rest.JSON{"id": t.ID, "name": t.Name, "deleted": true})
+}
+
+// checkAdminAuth allows management of tokens and sessions with the admin password of "secrets" user only,
+// named users and tokens can't manage them. With second factor of "secrets" user the password alone is not enough,
+// management is possible with CLI only.
+// Responds with error if management of the subject is disabled or not authorized.
+func (s Server) checkAdminAuth(w http.ResponseWriter, r *http.Request, subject string, enabled bool) bool {
+	if !enabled || s.cfg.AuthHash == "" {
+		SendErrorJSON(w, r, log.Default(), http.StatusForbidden, errors.New(subject+" management disabled"),
+			subject+" management requires auth enabled")
+		return false
+	}
+	// second factor is checked after the password, the password alone is not a complete login with it
+	hasTOTP := s.totpBlocksBasicAuth(r.Context(), authUser)
+	username, password, ok := r.BasicAuth()
+	var retryAfter time.Duration
+	if ok {
+		ok, retryAfter = s.guardLogin(r, func() bool { return s.checkAdminPassword(username, password) }, !hasTOTP)
+	}
+	if retryAfter > 0 {
+		log.Printf("[WARN] admin auth rejected, locked out, ip=%s", GetHashedIP(r))
+		setRetryAfter(w, retryAfter)
+		SendErrorJSON(w, r, log.Default(), http.StatusTooManyRequests, errors.New("locked out"), lockedOutMsg(retryAfter))
+		return false
+	}
+	if !ok {
+		log.Printf("[WARN] admin auth failed, ip=%s", GetHashedIP(r))
+		w.Header().Set("WWW-Authenticate", `Basic realm="secrets"`)
+		SendErrorJSON(w, r, log.Default(), http.StatusUnauthorized, errors.New("unauthorized"), "authentication required")
+		return false
+	}
+	if hasTOTP {
+		SendErrorJSON(w, r, log.Default(), http.StatusForbidden, errors.New("basic auth with second factor"),
+			subject+" management over API not allowed with second factor, use CLI")
+		return false
+	}
+	return true
+}
+
+// tokenJSON makes API response of the token record, without its hash
+func tokenJSON(t *store.Token) rest.JSON {
+	res := rest.JSON{"id": t.ID, "name": t.Name, "scopes": t.Scopes, "max_exp": int(t.MaxExp.Seconds()),
+		"created": t.Created}
+	if !t.LastUsed.IsZero() {
+		res["last_used"] = t.LastUsed
+	}
+	return res
+}
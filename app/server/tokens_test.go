@@ -0,0 +1,197 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/umputun/secrets/v2/app/store"
+	"github.com/umputun/secrets/v2/app/tokens"
+)
+
+func TestServer_TokensAdmin(t *testing.T) {
+	ts, _ := prepServer(t, Config{EnableFiles: true, MaxFileSize: 1024, AuthHash: testBcryptHash(t, "passwd")}, withTestTokens)
+	client := http.Client{Timeout: 5 * time.Second}
+
+	call := func(t *testing.T, method, path, body, password string) (status int, res json.RawMessage) {
+		t.Helper()
+		req, err := http.NewRequest(method, ts.URL+path, strings.NewReader(body))
+		require.NoError(t, err)
+		if password != "" {
+			req.SetBasicAuth(authUser, password)
+		}
+		resp, err := client.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&res))
+		return resp.StatusCode, res
+	}
+
+	status, _ := call(t, http.MethodGet, "/api/v1/tokens", "", "")
+	require.Equal(t, http.StatusUnauthorized, status)
+	status, _ = call(t, http.MethodGet, "/api/v1/tokens", "", "wrong")
+	require.Equal(t, http.StatusUnauthorized, status)
+
+	status, res := call(t, http.MethodPost, "/api/v1/tokens",
+		`{"name": "ci", "scopes": ["create-text", "create-file"], "max_exp": 3600}`, "passwd")
+	require.Equal(t, http.StatusCreated, status)
+	created := struct {
+		ID       string
+		Name     string
+		Token    string
+		Scopes   []string
+		MaxExp   int        `json:"max_exp"`
+		LastUsed *time.Time `json:"last_used"`
+	}{}
+	require.NoError(t, json.Unmarshal(res, &created))
+	assert.Equal(t, "ci", created.Name)
+	assert.True(t, strings.HasPrefix(created.Token, "sct_"+created.ID))
+	assert.Equal(t, []string{"create-text", "create-file"}, created.Scopes)
+	assert.Equal(t, 3600, created.MaxExp)
+	assert.Nil(t, created.LastUsed)
+
+	status, _ = call(t, http.MethodPost, "/api/v1/tokens", `{"name": "ci"}`, "passwd")
+	assert.Equal(t, http.StatusConflict, status)
+	status, _ = call(t, http.MethodPost, "/api/v1/tokens", `{"name": "bad", "scopes": ["admin"]}`, "passwd")
+	assert.Equal(t, http.StatusBadRequest, status)
+
+	// tokens can't manage tokens
+	req, err := http.NewRequest(http.MethodGet, ts.URL+"/api/v1/tokens", http.NoBody)
+	require.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer "+created.Token)
+	resp, err := client.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	status, res = call(t, http.MethodGet, "/api/v1/tokens", "", "passwd")
+	require.Equal(t, http.StatusOK, status)
+	assert.NotContains(t, string(res), created.Token)
+	assert.NotContains(t, string(res), "hash")
+	list := []struct{ ID, Name string }{}
+	require.NoError(t, json.Unmarshal(res, &list))
+	require.Len(t, list, 1)
+	assert.Equal(t, created.ID, list[0].ID)
+
+	status, res = call(t, http.MethodDelete, "/api/v1/tokens/ci", "", "passwd")
+	require.Equal(t, http.StatusOK, status)
+	assert.JSONEq(t, `{"id": "`+created.ID+`", "name": "ci", "deleted": true}`, string(res))
+	status, _ = call(t, http.MethodDelete, "/api/v1/tokens/"+created.ID, "", "passwd")
+	assert.Equal(t, http.StatusNotFound, status)
+
+	t.Run("disabled without auth", func(t *testing.T) {
+		tsNoAuth, _ := prepServer(t, Config{EnableFiles: true, MaxFileSize: 1024}, withTestTokens)
+		resp, err := client.Get(tsNoAuth.URL + "/api/v1/tokens")
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	})
+}
+
+func TestServer_TokenAuth(t *testing.T) {
+	ts, eng := prepServer(t, Config{EnableFiles: true, MaxFileSize: 1024, AuthHash: testBcryptHash(t, "passwd")}, withTestTokens)
+	tm := tokens.New(eng)
+	client := http.Client{Timeout: 5 * time.Second}
+
+	textToken, _, err := tm.Create(t.Context(), tokens.Request{Name: "text", Scopes: []string{tokens.ScopeCreateText},
+		MaxExp: time.Hour})
+	require.NoError(t, err)
+	fileToken, _, err := tm.Create(t.Context(), tokens.Request{Name: "file", Scopes: []string{tokens.ScopeCreateFile}})
+	require.NoError(t, err)
+	revokedToken, _, err := tm.Create(t.Context(), tokens.Request{Name: "revoked", Scopes: tokens.Scopes})
+	require.NoError(t, err)
+	_, err = tm.Revoke(t.Context(), "revoked")
+	require.NoError(t, err)
+
+	saveMsg := func(t *testing.T, path, token string, exp int) (status int, res map[string]any) {
+		t.Helper()
+		body := `{"message": "my secret", "exp": ` + strconv.Itoa(exp) + `, "pin": "12345"}`
+		req, err := http.NewRequest(http.MethodPost, ts.URL+path, strings.NewReader(body))
+		require.NoError(t, err)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := client.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		res = map[string]any{}
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&res))
+		return resp.StatusCode, res
+	}
+	saveFile := func(t *testing.T, path, token string) int {
+		t.Helper()
+		body := &bytes.Buffer{}
+		mw := multipart.NewWriter(body)
+		require.NoError(t, mw.WriteField("exp", "600"))
+		require.NoError(t, mw.WriteField("pin", "12345"))
+		fw, err := mw.CreateFormFile("file", "a.txt")
+		require.NoError(t, err)
+		_, err = fw.Write([]byte("data"))
+		require.NoError(t, err)
+		require.NoError(t, mw.Close())
+		req, err := http.NewRequest(http.MethodPost, ts.URL+path, body)
+		require.NoError(t, err)
+		req.Header.Set("Content-Type", mw.FormDataContentType())
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := client.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	for _, path := range []string{"/api/v1/message", "/api/v2/message"} {
+		t.Run(path, func(t *testing.T) {
+			status, _ := saveMsg(t, path, textToken, 600)
+			assert.Equal(t, http.StatusCreated, status)
+
+			status, res := saveMsg(t, path, textToken, 7200)
+			assert.Equal(t, http.StatusForbidden, status, "exp above token limit")
+			assert.Equal(t, "expiration exceeds token limit", res["error"])
+
+			status, _ = saveMsg(t, path, fileToken, 600)
+			assert.Equal(t, http.StatusForbidden, status, "no create-text scope")
+
+			status, _ = saveMsg(t, path, revokedToken, 600)
+			assert.Equal(t, http.StatusUnauthorized, status)
+
+			status, _ = saveMsg(t, path, "sct_garbage", 600)
+			assert.Equal(t, http.StatusUnauthorized, status)
+
+			status, _ = saveMsg(t, path, "", 600)
+			assert.Equal(t, http.StatusUnauthorized, status, "auth still required")
+		})
+	}
+
+	t.Run("v2 error codes", func(t *testing.T) {
+		_, res := saveMsg(t, "/api/v2/message", fileToken, 600)
+		assert.Equal(t, "forbidden", res["code"])
+		_, res = saveMsg(t, "/api/v2/message", revokedToken, 600)
+		assert.Equal(t, "unauthorized", res["code"])
+	})
+
+	for _, path := range []string{"/api/v1/file", "/api/v2/file"} {
+		t.Run(path, func(t *testing.T) {
+			assert.Equal(t, http.StatusCreated, saveFile(t, path, fileToken))
+			assert.Equal(t, http.StatusForbidden, saveFile(t, path, textToken), "no create-file scope")
+		})
+	}
+
+	t.Run("last used updated", func(t *testing.T) {
+		list, err := tm.List(t.Context())
+		require.NoError(t, err)
+		for _, tk := range list {
+			assert.False(t, tk.LastUsed.IsZero(), tk.Name)
+		}
+	})
+}
+
+// withTestTokens adds tokens manager over the test server store
+func withTestTokens(srv Server, eng *store.SQLite) Server { return srv.WithTokens(tokens.New(eng)) }
@@ -0,0 +1,175 @@
+package server
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/go-pkgz/lgr"
+)
+
+const (
+	totpPendingTTL      = 5 * time.Minute // limits time between the password and the second factor of login
+	totpPendingAttempts = 5               // wrong codes of pending login before the password is asked again
+	totpExhaustedMsg    = "too many invalid codes, enter the password again"
+)
+
+// totpFailures counts wrong codes of pending logins, in memory for the life of pending login. Lockout is optional,
+// this limit is not: a pending login has a few attempts only, then the password is needed again.
+type totpFailures struct {
+	mu     sync.Mutex
+	counts map[string]totpFailure // by pending login token
+}
+
+type totpFailure struct {
+	count   int
+	expires time.Time
+}
+
+func newTOTPFailures() *totpFailures {
+	return &totpFailures{counts: map[string]totpFailure{}}
+}
+
+// exhausted checks if the pending login has no attempts left
+func (f *totpFailures) exhausted(pending string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.counts[pending].count >= totpPendingAttempts
+}
+
+// fail counts wrong code of the pending login and returns attempts left, forgets expired pending logins
+func (f *totpFailures) fail(pending string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	now := time.Now()
+	for k, v := range f.counts {
+		if now.After(v.expires) {
+			delete(f.counts, k)
+		}
+	}
+	c := f.counts[pending]
+	c.count++
+	c.expires = now.Add(totpPendingTTL)
+	f.counts[pending] = c
+	return totpPendingAttempts - c.count
+}
+
+// forget removes the pending login after successful login
+func (f *totpFailures) forget(pending string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.counts, pending)
+}
+
+// loginTOTPCtrl handles the second step of login, code of authenticator app or recovery code
+// for the login pending after the password
+// POST /login/totp
+func (s Server) loginTOTPCtrl(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		s.renderLoginPopup(w, r, "invalid form data")
+		return
+	}
+	pending := r.PostForm.Get("pending")
+	username, ok := s.parseTOTPPending(pending)
+	if !ok {
+		s.renderLoginPopup(w, r, "login expired, enter the password again")
+		return
+	}
+	if s.totpFailures.exhausted(pending) {
+		s.renderLoginPopup(w, r, totpExhaustedMsg)
+		return
+	}
+	code := r.PostForm.Get("code")
+
+	ok, retryAfter := s.guardLogin(r, func() bool { return s.totp.Verify(r.Context(), username, code) == nil }, true)
+	if retryAfter > 0 {
+		log.Printf("[WARN] login rejected, locked out, user=%q, ip=%s", username, GetHashedIP(r))
+		setRetryAfter(w, retryAfter)
+		s.renderLoginPopupWithStatus(w, r, lockedOutMsg(retryAfter), http.StatusTooManyRequests)
+		return
+	}
+	if !ok {
+		log.Printf("[WARN] login failed, wrong second factor, user=%q, ip=%s", username, GetHashedIP(r))
+		if s.totpFailures.fail(pending) <= 0 {
+			log.Printf("[WARN] pending login dropped after %d invalid codes, user=%q, ip=%s", totpPendingAttempts,
+				username, GetHashedIP(r))
+			s.renderLoginPopup(w, r, totpExhaustedMsg)
+			return
+		}
+		s.renderLoginStep(w, r, pending, "invalid code", http.StatusOK)
+		return
+	}
+	s.totpFailures.forget(pending)
+	s.completeLogin(w, r, username)
+}
+
+// totpRequired checks if login of the user needs the second factor. Store error is returned, so login fails closed.
+func (s Server) totpRequired(ctx context.Context, user string) (bool, error) {
+	if s.totp == nil {
+		return false, nil
+	}
+	enabled, err := s.totp.Enabled(ctx, user)
+	if err != nil {
+		return false, fmt.Errorf("check second factor of %s: %w", user, err)
+	}
+	return enabled, nil
+}
+
+// totpBlocksBasicAuth checks if basic auth of the user is not allowed, as the password alone skips the second factor.
+// Such user can access API with tokens only.
+func (s Server) totpBlocksBasicAuth(ctx context.Context, user string) bool {
+	required, err := s.totpRequired(ctx, user)
+	if err != nil {
+		log.Printf("[WARN] basic auth rejected, %v", err)
+		return true
+	}
+	return required
+}
+
+// signTOTPPending makes signed token of login waiting for the second factor after the password,
+// format: timestamp.nonce.user.signature, user is base64url encoded. Nonce makes each pending login distinct,
+// so its wrong codes are counted apart from other logins.
+func (s Server) signTOTPPending(user string) string {
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	nonce := randomString()
+	userB64 := base64.RawURLEncoding.EncodeToString([]byte(user))
+	return strings.Join([]string{timestamp, nonce, userB64, s.signTOTP(timestamp, nonce, userB64)}, ".")
+}
+
+// parseTOTPPending checks signature and age of pending login token and returns its user
+func (s Server) parseTOTPPending(token string) (string, bool) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 4 {
+		return "", false
+	}
+	timestamp, nonce, userB64, signature := parts[0], parts[1], parts[2], parts[3]
+	if subtle.ConstantTimeCompare([]byte(signature), []byte(s.signTOTP(timestamp, nonce, userB64))) != 1 {
+		return "", false
+	}
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil || time.Since(time.Unix(ts, 0)) > totpPendingTTL {
+		return "", false
+	}
+	user, err := base64.RawURLEncoding.DecodeString(userB64)
+	if err != nil || len(user) == 0 {
+		return "", false
+	}
+	return string(user), true
+}
+
+// signTOTP returns signature of pending login parts. The key is derived from session secret for this use only,
+// so a pending login can't pass as session cookie.
+func (s Server) signTOTP(parts ...string) string {
+	key := sha256.Sum256(append([]byte("totp-pending:"), s.sessionSecret()...))
+	h := hmac.New(sha256.New, key[:])
+	h.Write([]byte(strings.Join(parts, ".")))
+	return base64.RawURLEncoding.EncodeToString(h.Sum(nil))
+}
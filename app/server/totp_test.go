@@ -0,0 +1,219 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/umputun/secrets/v2/app/store"
+	"github.com/umputun/secrets/v2/app/tokens"
+	"github.com/umputun/secrets/v2/app/totp"
+)
+
+func TestServer_LoginTOTP(t *testing.T) {
+	var recovery []string
+	ts, eng := prepServer(t, Config{AuthHash: testBcryptHash(t, "passwd"), SessionTTL: time.Hour},
+		withTestTokens, withTestTOTP(t, &recovery), withTestLockout(10))
+	tm := tokens.New(eng)
+	client := http.Client{Timeout: 5 * time.Second}
+
+	t.Run("password asks for code", func(t *testing.T) {
+		resp, body := postForm(t, &client, ts.URL+"/login", url.Values{"password": {"passwd"}})
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Empty(t, resp.Cookies(), "no session before the second factor")
+		assert.Empty(t, resp.Header.Get("HX-Trigger"))
+		assert.Contains(t, body, `hx-post="/login/totp"`)
+		assert.NotContains(t, body, `name="password"`)
+		assert.NotEmpty(t, pendingOf(t, body))
+
+		resp, body = postForm(t, &client, ts.URL+"/login", url.Values{"password": {"wrong"}})
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Contains(t, body, "invalid password")
+		assert.NotContains(t, body, `name="pending"`)
+	})
+
+	t.Run("login with recovery code", func(t *testing.T) {
+		_, body := postForm(t, &client, ts.URL+"/login", url.Values{"password": {"passwd"}})
+		pending := pendingOf(t, body)
+
+		resp, body := postForm(t, &client, ts.URL+"/login/totp", url.Values{"pending": {pending}, "code": {"123456"}})
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Contains(t, body, "invalid code")
+		assert.Equal(t, pending, pendingOf(t, body), "same pending login to retry")
+		assert.Empty(t, resp.Cookies())
+
+		resp, _ = postForm(t, &client, ts.URL+"/login/totp", url.Values{"pending": {pending}, "code": {recovery[0]}})
+		assert.Equal(t, "submitSecretForm", resp.Header.Get("HX-Trigger"))
+		require.Len(t, resp.Cookies(), 1)
+		assert.Equal(t, authCookieName, resp.Cookies()[0].Name)
+
+		resp, body = postForm(t, &client, ts.URL+"/login/totp", url.Values{"pending": {pending}, "code": {recovery[0]}})
+		assert.Contains(t, body, "invalid code", "recovery code used up")
+		assert.Empty(t, resp.Cookies())
+	})
+
+	t.Run("pending login checked", func(t *testing.T) {
+		_, body := postForm(t, &client, ts.URL+"/login", url.Values{"password": {"passwd"}})
+		pending := pendingOf(t, body)
+		parts := strings.Split(pending, ".")
+		forged := strings.Join([]string{parts[0], parts[1], "Ym9i", parts[3]}, ".")
+		for _, bad := range []string{"", "junk", forged} {
+			resp, body := postForm(t, &client, ts.URL+"/login/totp", url.Values{"pending": {bad}, "code": {recovery[1]}})
+			assert.Empty(t, resp.Cookies())
+			assert.Contains(t, body, "login expired, enter the password again")
+		}
+
+		// pending login doesn't pass as session cookie
+		form := url.Values{"message": {"ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnop"}, "pin": {"12345"}, "exp": {"10"}, "expUnit": {"m"}}
+		req, err := http.NewRequest(http.MethodPost, ts.URL+"/generate-link", strings.NewReader(form.Encode()))
+		require.NoError(t, err)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("HX-Request", "true")
+		req.AddCookie(&http.Cookie{Name: authCookieName, Value: pending})
+		resp, err := client.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	})
+
+	t.Run("basic auth replaced by tokens", func(t *testing.T) {
+		msg := `{"message": "secret", "exp": 600, "pin": "12345"}`
+		req, err := http.NewRequest(http.MethodPost, ts.URL+"/api/v1/message", strings.NewReader(msg))
+		require.NoError(t, err)
+		req.SetBasicAuth(authUser, "passwd")
+		resp, err := client.Do(req)
+		require.NoError(t, err)
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+		assert.Contains(t, string(body), "use API token")
+
+		// wrong password of user with second factor gets the same response as of any user, no probing
+		for _, user := range []string{authUser, "nobody"} {
+			req, err = http.NewRequest(http.MethodPost, ts.URL+"/api/v1/message", strings.NewReader(msg))
+			require.NoError(t, err)
+			req.SetBasicAuth(user, "wrong")
+			resp, err = client.Do(req)
+			require.NoError(t, err)
+			body, err = io.ReadAll(resp.Body)
+			require.NoError(t, err)
+			resp.Body.Close()
+			assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+			assert.Equal(t, `Basic realm="secrets"`, resp.Header.Get("WWW-Authenticate"))
+			assert.NotContains(t, string(body), "second factor")
+		}
+
+		token, _, err := tm.Create(t.Context(), tokens.Request{Name: "ci", Scopes: []string{tokens.ScopeCreateText}})
+		require.NoError(t, err)
+		req, err = http.NewRequest(http.MethodPost, ts.URL+"/api/v1/message", strings.NewReader(msg))
+		require.NoError(t, err)
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err = client.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusCreated, resp.StatusCode)
+
+		req, err = http.NewRequest(http.MethodGet, ts.URL+"/api/v1/tokens", http.NoBody)
+		require.NoError(t, err)
+		req.SetBasicAuth(authUser, "passwd")
+		resp, err = client.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusForbidden, resp.StatusCode, "management with cli only")
+	})
+}
+
+func TestServer_LoginTOTPAttempts(t *testing.T) {
+	var recovery []string // lockout disabled, pending login limits codes anyway
+	ts, _ := prepServer(t, Config{AuthHash: testBcryptHash(t, "passwd"), SessionTTL: time.Hour},
+		withTestTokens, withTestTOTP(t, &recovery), withTestLockout(0))
+	client := http.Client{Timeout: 5 * time.Second}
+
+	_, body := postForm(t, &client, ts.URL+"/login", url.Values{"password": {"passwd"}})
+	pending := pendingOf(t, body)
+	for range totpPendingAttempts - 1 {
+		_, body = postForm(t, &client, ts.URL+"/login/totp", url.Values{"pending": {pending}, "code": {"123456"}})
+		assert.Contains(t, body, "invalid code")
+		assert.Equal(t, pending, pendingOf(t, body))
+	}
+	_, body = postForm(t, &client, ts.URL+"/login/totp", url.Values{"pending": {pending}, "code": {"123456"}})
+	assert.Contains(t, body, "too many invalid codes, enter the password again")
+	assert.NotContains(t, body, `name="pending"`)
+	assert.Contains(t, body, `name="password"`)
+
+	resp, body := postForm(t, &client, ts.URL+"/login/totp", url.Values{"pending": {pending}, "code": {recovery[0]}})
+	assert.Contains(t, body, "too many invalid codes", "right code not checked after the limit")
+	assert.Empty(t, resp.Cookies())
+
+	// the password starts a new pending login with its own attempts
+	_, body = postForm(t, &client, ts.URL+"/login", url.Values{"password": {"passwd"}})
+	next := pendingOf(t, body)
+	assert.NotEqual(t, pending, next)
+	resp, _ = postForm(t, &client, ts.URL+"/login/totp", url.Values{"pending": {next}, "code": {recovery[0]}})
+	assert.Equal(t, "submitSecretForm", resp.Header.Get("HX-Trigger"))
+	require.Len(t, resp.Cookies(), 1)
+}
+
+func TestServer_LoginTOTPLockout(t *testing.T) {
+	var recovery []string
+	ts, _ := prepServer(t, Config{AuthHash: testBcryptHash(t, "passwd"), SessionTTL: time.Hour},
+		withTestTokens, withTestTOTP(t, &recovery), withTestLockout(2))
+	client := http.Client{Timeout: 5 * time.Second}
+
+	_, body := postForm(t, &client, ts.URL+"/login", url.Values{"password": {"passwd"}})
+	resp, _ := postForm(t, &client, ts.URL+"/login/totp", url.Values{"pending": {pendingOf(t, body)}, "code": {"123456"}})
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// the right password again doesn't forget the failed code
+	_, body = postForm(t, &client, ts.URL+"/login", url.Values{"password": {"passwd"}})
+	pending := pendingOf(t, body)
+	resp, body = postForm(t, &client, ts.URL+"/login/totp", url.Values{"pending": {pending}, "code": {"654321"}})
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	assert.NotEmpty(t, resp.Header.Get("Retry-After"))
+	assert.Contains(t, body, "too many failed attempts")
+
+	resp, _ = postForm(t, &client, ts.URL+"/login/totp", url.Values{"pending": {pending}, "code": {recovery[0]}})
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode, "code not checked while locked out")
+	assert.Empty(t, resp.Cookies())
+}
+
+// withTestTOTP adds second factor over the test server store with "secrets" user enrolled, its recovery codes set to recovery
+func withTestTOTP(t *testing.T, recovery *[]string) testServerOpt {
+	return func(srv Server, eng *store.SQLite) Server {
+		m := totp.New(eng, "example.com")
+		enr, err := m.Enroll(t.Context(), authUser)
+		require.NoError(t, err)
+		*recovery = enr.Recovery
+		return srv.WithTOTP(m)
+	}
+}
+
+// postForm posts the form and returns the response with its body
+func postForm(t *testing.T, client *http.Client, u string, form url.Values) (resp *http.Response, body string) {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodPost, u, strings.NewReader(form.Encode()))
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err = client.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return resp, string(data)
+}
+
+// pendingOf extracts pending login token from the second step of login popup
+func pendingOf(t *testing.T, body string) string {
+	t.Helper()
+	m := regexp.MustCompile(`name="pending" value="([^"]+)"`).FindStringSubmatch(body)
+	require.Len(t, m, 2, "no pending login in %s", body)
+	return m[1]
+}
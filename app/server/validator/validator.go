@@ -2,6 +2,7 @@
 package validator
 
 import (
+	"math"
 	"strconv"
 	"strings"
 	"time"
@@ -91,3 +92,49 @@ func IsBase64URL(value string) bool {
 func isBase64URLChar(c rune) bool {
 	return (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') || c == '-' || c == '_'
 }
+
+// Entropy estimates strength of a passphrase in bits, as log2 of the character pool size times length.
+// The pool is made of character classes present in the value. Characters repeating the previous one
+// or continuing a sequence, like "aaa" or "123", add nothing, so such patterns don't inflate the estimate.
+func Entropy(value string) float64 {
+	var lower, upper, digit, symbol, other bool
+	count := 0
+	var prev rune
+	for i, c := range []rune(value) {
+		switch {
+		case c >= 'a' && c <= 'z':
+			lower = true
+		case c >= 'A' && c <= 'Z':
+			upper = true
+		case c >= '0' && c <= '9':
+			digit = true
+		case c < utf8.RuneSelf:
+			symbol = true
+		default:
+			other = true
+		}
+		if i == 0 || (c != prev && c != prev+1 && c != prev-1) {
+			count++
+		}
+		prev = c
+	}
+
+	pool := 0
+	for _, class := range []struct {
+		present bool
+		size    int
+	}{{lower, 26}, {upper, 26}, {digit, 10}, {symbol, 33}, {other, 100}} {
+		if class.present {
+			pool += class.size
+		}
+	}
+	if pool == 0 {
+		return 0
+	}
+	return float64(count) * math.Log2(float64(pool))
+}
+
+// MinEntropy returns true if estimated entropy of a value is at least bits.
+func MinEntropy(value string, bits int) bool {
+	return Entropy(value) >= float64(bits)
+}
@@ -1,6 +1,7 @@
 package validator
 
 import (
+	"math"
 	"testing"
 	"time"
 
@@ -430,3 +431,34 @@ func TestValidator_IsBase64URL(t *testing.T) {
 		})
 	}
 }
+
+func TestValidator_Entropy(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+		want  float64
+	}{
+		{name: "empty", value: "", want: 0},
+		{name: "5-digit pin", value: "13579", want: 5 * math.Log2(10)},
+		{name: "lowercase", value: "qwzx", want: 4 * math.Log2(26)},
+		{name: "mixed case, digits and symbols", value: "aZ3!", want: 4 * math.Log2(95)},
+		{name: "repeated chars add nothing", value: "aaaaaaaa", want: math.Log2(26)},
+		{name: "sequences add nothing", value: "12345678", want: math.Log2(10)},
+		{name: "descending sequence", value: "zyxw", want: math.Log2(26)},
+		{name: "non-ascii", value: "пароль", want: 6 * math.Log2(100)},
+		{name: "words with spaces", value: "cat dog", want: 7 * math.Log2(59)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.InDelta(t, tt.want, Entropy(tt.value), 0.001)
+		})
+	}
+}
+
+func TestValidator_MinEntropy(t *testing.T) {
+	assert.False(t, MinEntropy("12345", 40))
+	assert.False(t, MinEntropy("password", 40))
+	assert.True(t, MinEntropy("correct horse battery", 40))
+	assert.True(t, MinEntropy("Tr0ub4dor&3", 40))
+	assert.True(t, MinEntropy("", 0))
+}
@@ -35,7 +35,10 @@ const (
 	pinKey       = "pin"
 	expKey       = "exp"
 	expUnitKey   = "expUnit"
+	maxViewsKey  = "maxViews"
 	pathKeyParam = "key" // URL path parameter for message key
+
+	maxPassphraseLen = 72 // bcrypt ignores input beyond 72 bytes
 )
 
 type createMsgForm struct {
@@ -43,6 +46,7 @@ type createMsgForm struct {
 	Exp      int
 	MaxExp   string
 	ExpUnit  string
+	MaxViews int    // successful reads before removal
 	IsFile   bool   // true if this is a file upload
 	FileName string // original filename for display
 	FileSize int64  // file size in bytes for display
@@ -67,6 +71,8 @@ type emailPopupData struct {
 type templateData struct {
 	Form           any
 	PinSize        int
+	Passphrase     bool // true if passphrases used instead of numeric pins
+	MinEntropy     int  // min entropy of new passphrases in bits
 	CurrentYear    int
 	Theme          string
 	Branding       string
@@ -81,6 +87,7 @@ type templateData struct {
 	IsFile         bool   // true if the message is a file (for show-message template)
 	AllowNoPin     bool   // true if PIN-less secrets are allowed
 	HasPin         bool   // true if the message requires PIN (for show-message template)
+	MaxViews       int    // max allowed views of a single message
 	Version        string // app version for cache busting
 }
 
@@ -120,8 +127,9 @@ func (s Server) render(w http.ResponseWriter, status int, page, tmplName string,
 // GET /
 func (s Server) indexCtrl(w http.ResponseWriter, r *http.Request) {
 	data := s.newTemplateData(r, createMsgForm{
-		Exp:    15,
-		MaxExp: humanDuration(s.cfg.MaxExpire),
+		Exp:      15,
+		MaxExp:   humanDuration(s.cfg.MaxExpire),
+		MaxViews: 1,
 	})
 	data.PageTitle = "Secret Sharing - Self-Destructing Encrypted Messages"
 	data.PageDesc = "Share sensitive information securely with self-destructing messages protected by PIN codes. Free, open-source, and privacy-focused."
@@ -140,9 +148,13 @@ func (s Server) indexCtrl(w http.ResponseWriter, r *http.Request) {
 //   - "file" (file): The file to upload
 func (s Server) generateLinkCtrl(w http.ResponseWriter, r *http.Request) {
 	// check auth if enabled
-	if s.cfg.AuthHash != "" && !s.isAuthenticated(r) {
-		s.renderLoginPopupWithStatus(w, r, "", http.StatusUnauthorized)
-		return
+	user := "-"
+	if s.authEnabled() {
+		var ok bool
+		if user, ok = s.sessionUser(w, r); !ok {
+			s.renderLoginPopupWithStatus(w, r, "", http.StatusUnauthorized)
+			return
+		}
 	}
 
 	// reject multipart requests - all file uploads must use client-side JS encryption
@@ -171,14 +183,18 @@ func (s Server) generateLinkCtrl(w http.ResponseWriter, r *http.Request) {
 	pin := strings.Join(pinValues, "")
 	pinIsEmpty := pin == ""
 
-	// validate PIN: skip validation if AllowNoPin and PIN is empty, otherwise require valid digits
+	// validate PIN: skip validation if AllowNoPin and PIN is empty, otherwise require valid digits or strong passphrase
 	if !pinIsEmpty {
-		if pinErr := validatePIN(pin, pinValues, s.cfg.PinSize); pinErr != nil {
+		if pinErr := s.checkPin(pin, pinValues, true); pinErr != nil {
 			form.AddFieldError(pinKey, pinErr.Error())
 		}
 	}
 	if pinIsEmpty && !s.cfg.AllowNoPin {
-		form.AddFieldError(pinKey, fmt.Sprintf("Pin must be %d digits long", s.cfg.PinSize))
+		msg := fmt.Sprintf("Pin must be %d digits long", s.cfg.PinSize)
+		if s.cfg.Passphrase {
+			msg = "Passphrase can't be empty"
+		}
+		form.AddFieldError(pinKey, msg)
 	}
 
 	form.CheckField(validator.NotBlank(form.Message), msgKey, "Message can't be empty")
@@ -198,6 +214,18 @@ func (s Server) generateLinkCtrl(w http.ResponseWriter, r *http.Request) {
 
 	form.CheckField(validator.MaxDuration(expDuration, s.cfg.MaxExpire), expKey, "Expire must be less than "+humanDuration(s.cfg.MaxExpire))
 
+	// max views is optional, single read if not set
+	form.MaxViews = 1
+	if views := r.PostFormValue(maxViewsKey); views != "" {
+		maxViews, convErr := strconv.Atoi(views)
+		maxAllowed := max(s.cfg.MaxViews, 1)
+		form.CheckField(convErr == nil && maxViews >= 1 && maxViews <= maxAllowed, maxViewsKey,
+			fmt.Sprintf("Views must be between 1 and %d", maxAllowed))
+		if convErr == nil {
+			form.MaxViews = maxViews
+		}
+	}
+
 	if !form.Valid() {
 		data := s.newTemplateData(r, form)
 
@@ -216,19 +244,20 @@ func (s Server) generateLinkCtrl(w http.ResponseWriter, r *http.Request) {
 		Pin:           pin,
 		ClientEnc:     true, // UI always uses client-side encryption
 		AllowEmptyPin: s.cfg.AllowNoPin && pinIsEmpty,
+		MaxViews:      form.MaxViews,
 	})
 	if err != nil {
 		s.render(w, http.StatusOK, "secure-link.tmpl.html", errorTmpl, err.Error())
 		return
 	}
 
-	log.Printf("[INFO] created message %s, type=text, size=%d, exp=%s, ip=%s",
-		msg.Key, len(form.Message), msg.Exp.Format(time.RFC3339), GetHashedIP(r))
-	s.renderSecureLink(w, r, msg.Key, form)
+	log.Printf("[INFO] created message %s, type=text, size=%d, exp=%s, user=%s, ip=%s",
+		msg.Key, len(form.Message), msg.Exp.Format(time.RFC3339), user, GetHashedIP(r))
+	s.renderSecureLink(w, r, msg, form)
 }
 
 // renderSecureLink renders the secure link page with the generated URL
-func (s Server) renderSecureLink(w http.ResponseWriter, r *http.Request, key string, form createMsgForm) {
+func (s Server) renderSecureLink(w http.ResponseWriter, r *http.Request, msg *store.Message, form createMsgForm) {
 	validatedHost := s.getValidatedHost(r)
 
 	// ensure IPv6 addresses are properly bracketed for URL construction
@@ -246,21 +275,27 @@ func (s Server) renderSecureLink(w http.ResponseWriter, r *http.Request, key str
 	msgURL := (&url.URL{
 		Scheme: s.cfg.Protocol,
 		Host:   validatedHost,
-		Path:   path.Join("/message", key),
+		Path:   path.Join("/message", msg.Key),
 	}).String()
 
 	// pass form data for file info display in template
 	data := struct {
 		URL          string
+		Key          string
+		Token        string // management token for revoke button
 		IsFile       bool
 		FileName     string
 		FileSize     int64
+		MaxViews     int
 		EmailEnabled bool
 	}{
 		URL:          msgURL,
+		Key:          msg.Key,
+		Token:        msg.MgmtToken,
 		IsFile:       form.IsFile,
 		FileName:     form.FileName,
 		FileSize:     form.FileSize,
+		MaxViews:     form.MaxViews,
 		EmailEnabled: s.cfg.EmailEnabled && s.emailSender != nil,
 	}
 
@@ -336,7 +371,7 @@ func (s Server) loadMessageCtrl(w http.ResponseWriter, r *http.Request) {
 
 	// validate PIN only if message requires it (or if we couldn't check)
 	if hasPin {
-		if pinErr := validatePIN(pin, pinValues, s.cfg.PinSize); pinErr != nil {
+		if pinErr := s.checkPin(pin, pinValues, false); pinErr != nil {
 			form.AddFieldError(pinKey, pinErr.Error())
 		}
 	}
@@ -370,6 +405,7 @@ func (s Server) loadMessageCtrl(w http.ResponseWriter, r *http.Request) {
 		}
 		// non-HTMX request (from client-side JS with fetch) - return blob for decryption
 		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("X-Views-Left", strconv.Itoa(msg.ViewsLeft()))
 		w.WriteHeader(http.StatusOK)
 		_, _ = w.Write(msg.Data)
 		log.Printf("[INFO] accessed message %s, type=client-enc, status=200 (success), ip=%s", form.Key, GetHashedIP(r))
@@ -393,18 +429,7 @@ func (s Server) loadMessageCtrl(w http.ResponseWriter, r *http.Request) {
 		}
 
 		// serve file directly as download
-		// sanitize filename for Content-Disposition to prevent header injection
-		safeName := strings.Map(func(r rune) rune {
-			if r < 32 || r == '"' || r == '\\' || r > 127 {
-				return '_'
-			}
-			return r
-		}, filename)
-		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", safeName))
-		// force binary download to prevent browser content interpretation (XSS mitigation)
-		w.Header().Set("Content-Type", "application/octet-stream")
-		w.Header().Set("Content-Length", strconv.Itoa(len(msg.Data)-dataStart))
-		w.Header().Set("X-Content-Type-Options", "nosniff")
+		setAttachmentHeaders(w, filename, len(msg.Data)-dataStart)
 		w.WriteHeader(http.StatusOK)
 		_, _ = w.Write(msg.Data[dataStart:])
 		log.Printf("[INFO] accessed message %s, type=file, status=200 (success), ip=%s", form.Key, GetHashedIP(r))
@@ -412,10 +437,30 @@ func (s Server) loadMessageCtrl(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// text message - render decoded message template
-	s.render(w, http.StatusOK, "decoded-message.tmpl.html", "decoded-message", string(msg.Data))
+	s.render(w, http.StatusOK, "decoded-message.tmpl.html", "decoded-message",
+		struct {
+			Message   string
+			ViewsLeft int
+		}{Message: string(msg.Data), ViewsLeft: msg.ViewsLeft()})
 	log.Printf("[INFO] accessed message %s, type=text, status=200 (success), ip=%s", form.Key, GetHashedIP(r))
 }
 
+// setAttachmentHeaders sets headers of binary file download.
+// Filename is sanitized for Content-Disposition to prevent header injection.
+func setAttachmentHeaders(w http.ResponseWriter, filename string, size int) {
+	safeName := strings.Map(func(r rune) rune {
+		if r < 32 || r == '"' || r == '\\' || r > 127 {
+			return '_'
+		}
+		return r
+	}, filename)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", safeName))
+	// force binary download to prevent browser content interpretation (XSS mitigation)
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.Itoa(size))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+}
+
 // handleLoadMessageError handles errors from LoadMessage, rendering appropriate responses.
 // isFile indicates whether the message was a file (checked before LoadMessage which may delete it).
 func (s Server) handleLoadMessageError(w http.ResponseWriter, r *http.Request, form *showMsgForm, err error, isFile bool) {
@@ -448,6 +493,25 @@ func (s Server) handleLoadMessageError(w http.ResponseWriter, r *http.Request, f
 	log.Printf("[INFO] accessed message %s, type=%s, status=403 (wrong pin), ip=%s", form.Key, msgType, GetHashedIP(r))
 }
 
+// revokes the message before expiration and renders the result in place of the secure link
+// POST /revoke-message
+// Request Body: This function expects a POST request body containing the following fields:
+//   - "key" (string): The unique key of the message to revoke.
+//   - "token" (string): The management token returned on message creation.
+func (s Server) revokeMessageCtrl(w http.ResponseWriter, r *http.Request) {
+	key, token := r.PostFormValue("key"), r.PostFormValue("token")
+	if err := s.messager.Revoke(r.Context(), key, token); err != nil {
+		msg := "can't revoke the link"
+		if errors.Is(err, store.ErrLoadRejected) {
+			msg = "the link is already used, expired or revoked"
+		}
+		s.render(w, http.StatusOK, "error.tmpl.html", errorTmpl, msg)
+		return
+	}
+	s.render(w, http.StatusOK, "revoked.tmpl.html", "revoked", nil)
+	log.Printf("[INFO] revoked message %s, ip=%s", key, GetHashedIP(r))
+}
+
 // duration converts a number and unit into a time.Duration
 func duration(n int, unit string) time.Duration {
 	switch unit {
@@ -462,6 +526,30 @@ func duration(n int, unit string) time.Duration {
 	}
 }
 
+// checkPin validates pin entered in web form, or passphrase in passphrase mode.
+// Passphrase strength is checked for new messages only, so messages made with a pin
+// before passphrase mode was enabled can still be opened.
+func (s Server) checkPin(pin string, pinValues []string, isNew bool) error {
+	if s.cfg.Passphrase {
+		return validatePassphrase(pin, isNew, s.cfg.MinEntropy)
+	}
+	return validatePIN(pin, pinValues, s.cfg.PinSize)
+}
+
+// validatePassphrase checks passphrase fits bcrypt limit and, for new messages, has at least minEntropy bits.
+func validatePassphrase(pass string, isNew bool, minEntropy int) error {
+	if pass == "" {
+		return errors.New("passphrase can't be empty")
+	}
+	if len(pass) > maxPassphraseLen {
+		return fmt.Errorf("passphrase must be at most %d bytes", maxPassphraseLen)
+	}
+	if isNew && !validator.MinEntropy(pass, minEntropy) {
+		return errors.New("passphrase is too weak, use a longer one with mixed characters or several words")
+	}
+	return nil
+}
+
 // validatePIN checks if PIN has correct length and contains only digits.
 func validatePIN(pin string, pinValues []string, pinSize int) error {
 	if len(pin) != pinSize {
@@ -577,7 +665,7 @@ func (s Server) closePopupCtrl(w http.ResponseWriter, _ *http.Request) {
 // GET /email-popup?link=...
 func (s Server) emailPopupCtrl(w http.ResponseWriter, r *http.Request) {
 	// check auth if enabled - email sharing requires same auth as secret creation
-	if s.cfg.AuthHash != "" && !s.isAuthenticated(r) {
+	if s.authEnabled() && !s.isAuthenticated(w, r) {
 		s.renderLoginPopupWithStatus(w, r, "", http.StatusUnauthorized)
 		return
 	}
@@ -613,7 +701,7 @@ func (s Server) emailPopupCtrl(w http.ResponseWriter, r *http.Request) {
 // POST /send-email
 func (s Server) sendEmailCtrl(w http.ResponseWriter, r *http.Request) { //nolint:gocyclo // linear validation logic
 	// check auth if enabled - email sharing requires same auth as secret creation
-	if s.cfg.AuthHash != "" && !s.isAuthenticated(r) {
+	if s.authEnabled() && !s.isAuthenticated(w, r) {
 		s.renderLoginPopupWithStatus(w, r, "", http.StatusUnauthorized)
 		return
 	}
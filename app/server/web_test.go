@@ -77,7 +77,7 @@ func TestTemplates_NewTemplateCache(t *testing.T) {
 
 	require.NoError(t, err)
 
-	assert.Len(t, cache, 14)
+	assert.Len(t, cache, 17)
 	assert.NotNil(t, cache["404.tmpl.html"])
 	assert.NotNil(t, cache["about.tmpl.html"])
 	assert.NotNil(t, cache["home.tmpl.html"])
@@ -92,6 +92,9 @@ func TestTemplates_NewTemplateCache(t *testing.T) {
 	assert.NotNil(t, cache["email-popup.tmpl.html"])
 	assert.NotNil(t, cache["email-sent.tmpl.html"])
 	assert.NotNil(t, cache["no-pin-modal.tmpl.html"])
+	assert.NotNil(t, cache["revoked.tmpl.html"])
+	assert.NotNil(t, cache["passkey.tmpl.html"])
+	assert.NotNil(t, cache["login-error.tmpl.html"])
 }
 
 func TestServer_indexCtrl(t *testing.T) {
@@ -399,6 +402,221 @@ func TestServer_generateLinkCtrl_EmptyPinRejected(t *testing.T) {
 	assert.Contains(t, rr.Body.String(), "Pin must be 5 digits long") // error shown
 }
 
+func TestServer_generateLinkCtrl_MaxViews(t *testing.T) {
+	eng := store.NewInMemory(time.Second)
+	srv, err := New(
+		messager.New(eng, messager.Crypt{Key: "123456789012345678901234567"}, messager.Params{
+			MaxDuration: 10 * time.Hour, MaxPinAttempts: 3, MaxViews: 3,
+		}),
+		"1",
+		Config{
+			PinSize: 5, MaxPinAttempts: 3, MaxExpire: 10 * time.Hour, MaxViews: 3,
+			Protocol: "https", Domain: []string{"example.com"},
+		})
+	require.NoError(t, err)
+
+	tests := []struct {
+		name     string
+		maxViews string
+		wantErr  string
+		wantBody string
+	}{
+		{name: "not set", maxViews: "", wantBody: "https://example.com/message/"},
+		{name: "single view", maxViews: "1", wantBody: "https://example.com/message/"},
+		{name: "allowed", maxViews: "3", wantBody: "The link can be opened 3 times."},
+		{name: "too many", maxViews: "4", wantErr: "Views must be between 1 and 3"},
+		{name: "zero", maxViews: "0", wantErr: "Views must be between 1 and 3"},
+		{name: "not a number", maxViews: "abc", wantErr: "Views must be between 1 and 3"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			formData := url.Values{
+				"message":  {"ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnop"},
+				"exp":      {"15"},
+				"expUnit":  {"m"},
+				"pin":      {"1", "2", "3", "4", "5"},
+				"maxViews": {tc.maxViews},
+			}
+			req := httptest.NewRequest(http.MethodPost, "/generate-link", strings.NewReader(formData.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			rr := httptest.NewRecorder()
+
+			srv.generateLinkCtrl(rr, req)
+
+			assert.Equal(t, http.StatusOK, rr.Code)
+			if tc.wantErr != "" {
+				assert.Contains(t, rr.Body.String(), tc.wantErr)
+				assert.NotContains(t, rr.Body.String(), "https://example.com/message/")
+				return
+			}
+			assert.Contains(t, rr.Body.String(), tc.wantBody)
+		})
+	}
+}
+
+func TestServer_generateLinkCtrl_Passphrase(t *testing.T) {
+	eng := store.NewInMemory(time.Second)
+	msgr := messager.New(eng, messager.Crypt{Key: "123456789012345678901234567"}, messager.Params{
+		MaxDuration: 10 * time.Hour, MaxPinAttempts: 3,
+	})
+	srv, err := New(msgr, "1", Config{
+		PinSize: 5, MaxPinAttempts: 3, MaxExpire: 10 * time.Hour, Passphrase: true, MinEntropy: 40,
+		Protocol: "https", Domain: []string{"example.com"},
+	})
+	require.NoError(t, err)
+
+	tests := []struct {
+		name     string
+		pin      string
+		wantErr  string
+		wantBody string
+	}{
+		{name: "strong passphrase", pin: "correct horse battery", wantBody: "https://example.com/message/"},
+		{name: "mixed characters", pin: "Tr0ub4dor&3", wantBody: "https://example.com/message/"},
+		{name: "numeric pin too weak", pin: "12345", wantErr: "passphrase is too weak"},
+		{name: "common word too weak", pin: "password", wantErr: "passphrase is too weak"},
+		{name: "too long", pin: strings.Repeat("ab cd ", 13), wantErr: "passphrase must be at most 72 bytes"},
+		{name: "empty", pin: "", wantErr: "Passphrase can&#39;t be empty"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			formData := url.Values{
+				"message": {"ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnop"},
+				"exp":     {"15"},
+				"expUnit": {"m"},
+				"pin":     {tc.pin},
+			}
+			req := httptest.NewRequest(http.MethodPost, "/generate-link", strings.NewReader(formData.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			rr := httptest.NewRecorder()
+
+			srv.generateLinkCtrl(rr, req)
+
+			assert.Equal(t, http.StatusOK, rr.Code)
+			if tc.wantErr != "" {
+				assert.Contains(t, rr.Body.String(), tc.wantErr)
+				assert.Contains(t, rr.Body.String(), "at least 40 bits of entropy")
+				assert.NotContains(t, rr.Body.String(), "https://example.com/message/")
+				return
+			}
+			assert.Contains(t, rr.Body.String(), tc.wantBody)
+		})
+	}
+
+	t.Run("home page with passphrase input", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/", http.NoBody)
+		rr := httptest.NewRecorder()
+		srv.indexCtrl(rr, req)
+		assert.Equal(t, http.StatusOK, rr.Code)
+		body := rr.Body.String()
+		assert.Contains(t, body, "Create passphrase")
+		assert.Contains(t, body, "passphrase-input")
+		assert.Contains(t, body, "at least 40 bits of entropy")
+		assert.NotContains(t, body, "data-numeric-only")
+	})
+}
+
+func TestServer_loadMessageCtrl_Passphrase(t *testing.T) {
+	eng := store.NewInMemory(time.Second)
+	msgr := messager.New(eng, messager.Crypt{Key: "123456789012345678901234567"}, messager.Params{
+		MaxDuration: 10 * time.Hour, MaxPinAttempts: 3,
+	})
+	srv, err := New(msgr, "1", Config{
+		PinSize: 5, MaxPinAttempts: 3, MaxExpire: 10 * time.Hour, Passphrase: true, MinEntropy: 40,
+		Protocol: "https", Domain: []string{"example.com"},
+	})
+	require.NoError(t, err)
+
+	load := func(key, pin string) *httptest.ResponseRecorder {
+		formData := url.Values{"key": {key}, "pin": {pin}}
+		req := httptest.NewRequest(http.MethodPost, "/load-message", strings.NewReader(formData.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rr := httptest.NewRecorder()
+		srv.loadMessageCtrl(rr, req)
+		return rr
+	}
+
+	t.Run("passphrase message", func(t *testing.T) {
+		msg, err := msgr.MakeMessage(t.Context(), messager.MsgReq{Duration: time.Hour, Message: "test secret",
+			Pin: "correct horse battery"})
+		require.NoError(t, err)
+
+		req := httptest.NewRequest(http.MethodGet, "/message/"+msg.Key, http.NoBody)
+		req.SetPathValue("key", msg.Key)
+		rr := httptest.NewRecorder()
+		srv.showMessageViewCtrl(rr, req)
+		assert.Contains(t, rr.Body.String(), "Enter your passphrase")
+
+		rr = load(msg.Key, "correct horse")
+		assert.Equal(t, http.StatusForbidden, rr.Code)
+		rr = load(msg.Key, "correct horse battery")
+		assert.Equal(t, http.StatusOK, rr.Code)
+		assert.Contains(t, rr.Body.String(), "test secret")
+	})
+
+	t.Run("pin message made before passphrase mode", func(t *testing.T) {
+		msg, err := msgr.MakeMessage(t.Context(), messager.MsgReq{Duration: time.Hour, Message: "old secret", Pin: "12345"})
+		require.NoError(t, err)
+		rr := load(msg.Key, "12345")
+		assert.Equal(t, http.StatusOK, rr.Code)
+		assert.Contains(t, rr.Body.String(), "old secret")
+	})
+}
+
+func TestServer_revokeMessageCtrl(t *testing.T) {
+	eng := store.NewInMemory(time.Second)
+	srv, err := New(
+		messager.New(eng, messager.Crypt{Key: "123456789012345678901234567"}, messager.Params{
+			MaxDuration: 10 * time.Hour, MaxPinAttempts: 3,
+		}),
+		"1",
+		Config{
+			PinSize: 5, MaxPinAttempts: 3, MaxExpire: 10 * time.Hour,
+			Protocol: "https", Domain: []string{"example.com"},
+		})
+	require.NoError(t, err)
+
+	revoke := func(key, token string) string {
+		formData := url.Values{"key": {key}, "token": {token}}
+		req := httptest.NewRequest(http.MethodPost, "/revoke-message", strings.NewReader(formData.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("HX-Request", "true")
+		rr := httptest.NewRecorder()
+		srv.revokeMessageCtrl(rr, req)
+		assert.Equal(t, http.StatusOK, rr.Code)
+		return rr.Body.String()
+	}
+
+	t.Run("secure link page has revoke button", func(t *testing.T) {
+		formData := url.Values{
+			"message": {"ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnop"},
+			"exp":     {"15"},
+			"expUnit": {"m"},
+			"pin":     {"12345"},
+		}
+		req := httptest.NewRequest(http.MethodPost, "/generate-link", strings.NewReader(formData.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rr := httptest.NewRecorder()
+		srv.generateLinkCtrl(rr, req)
+		assert.Contains(t, rr.Body.String(), `hx-post="/revoke-message"`)
+		assert.Contains(t, rr.Body.String(), `name="token"`)
+	})
+
+	t.Run("revoke with valid token", func(t *testing.T) {
+		msg, err := srv.messager.MakeMessage(t.Context(), messager.MsgReq{Duration: time.Hour, Message: "secret",
+			Pin: "12345", ClientEnc: true})
+		require.NoError(t, err)
+
+		assert.Contains(t, revoke(msg.Key, "bad-token"), "can&#39;t revoke the link")
+		assert.Contains(t, revoke(msg.Key, msg.MgmtToken), "Link Revoked")
+		assert.Contains(t, revoke(msg.Key, msg.MgmtToken), "already used, expired or revoked")
+		_, err = srv.messager.HasPin(t.Context(), msg.Key)
+		require.Error(t, err, "message removed")
+	})
+}
+
 func TestServer_generateLinkCtrl_HTMX(t *testing.T) {
 	eng := store.NewInMemory(time.Second)
 	srv, err := New(
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"text/tabwriter"
+	"time"
+
+	"github.com/umputun/secrets/v2/app/sessions"
+)
+
+// sessionCmd is "secrets session", it manages login sessions of the web UI stored by the engine
+type sessionCmd struct {
+	List      struct{}         `command:"list" description:"list active login sessions"`
+	Revoke    sessionRevokeCmd `command:"revoke" description:"revoke login session by id"`
+	RevokeAll struct{}         `command:"revoke-all" description:"revoke all login sessions, everybody has to log in again"`
+}
+
+type sessionRevokeCmd struct {
+	Args struct {
+		ID string `positional-arg-name:"id" required:"yes"`
+	} `positional-args:"yes"`
+}
+
+// runSessionList prints sessions table to out
+func runSessionList(ctx context.Context, m *sessions.Manager, out io.Writer) error {
+	list, err := m.List(ctx)
+	if err != nil {
+		return err //nolint:wrapcheck // already wrapped by manager
+	}
+	if len(list) == 0 {
+		_, _ = fmt.Fprintln(out, "no sessions")
+		return nil
+	}
+	tw := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	_, _ = fmt.Fprintln(tw, "ID\tUSER\tIP\tCREATED\tLAST SEEN\tEXPIRES\tUSER AGENT")
+	for _, s := range list {
+		_, _ = fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", s.ID, s.User, s.IP, s.Created.Format(time.DateTime),
+			s.LastSeen.Format(time.DateTime), s.Expires.Format(time.DateTime), s.UserAgent)
+	}
+	if err = tw.Flush(); err != nil {
+		return fmt.Errorf("write sessions: %w", err)
+	}
+	return nil
+}
+
+// runSessionRevoke revokes session by id
+func runSessionRevoke(ctx context.Context, m *sessions.Manager, id string, out io.Writer) error {
+	err := m.Revoke(ctx, id)
+	if errors.Is(err, sessions.ErrNotFound) {
+		return fmt.Errorf("no session with id %q", id)
+	}
+	if err != nil {
+		return err //nolint:wrapcheck // already wrapped by manager
+	}
+	_, _ = fmt.Fprintf(out, "session %s revoked\n", id)
+	return nil
+}
+
+// runSessionRevokeAll revokes all sessions
+func runSessionRevokeAll(ctx context.Context, m *sessions.Manager, out io.Writer) error {
+	count, err := m.RevokeAll(ctx)
+	if err != nil {
+		return err //nolint:wrapcheck // already wrapped by manager
+	}
+	_, _ = fmt.Fprintf(out, "%d sessions revoked\n", count)
+	return nil
+}
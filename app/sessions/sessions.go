@@ -0,0 +1,161 @@
+// Package sessions keeps login sessions of message creators in the store, so logout and revocation take effect
+// on the server side. A session expires after ttl of inactivity, each use moves the expiration forward.
+// The session token is in the cookie only, the store keeps its sha256 hash.
+package sessions
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	log "github.com/go-pkgz/lgr"
+
+	"github.com/umputun/secrets/v2/app/store"
+)
+
+// touchInterval limits updates of last seen time, so an active session doesn't write on each request
+const touchInterval = time.Minute
+
+// maxUserAgent limits stored user agent, it's informational only
+const maxUserAgent = 256
+
+// Errors
+var (
+	ErrInvalid  = errors.New("invalid session")
+	ErrNotFound = errors.New("session not found")
+)
+
+// Store is a persistent storage of sessions, implemented by all store engines
+type Store interface {
+	SaveSession(ctx context.Context, sess *store.Session) error
+	LoadSession(ctx context.Context, id string) (*store.Session, error)
+	ListSessions(ctx context.Context) ([]store.Session, error)
+	TouchSession(ctx context.Context, id string, lastSeen, expires time.Time) error
+	RemoveSession(ctx context.Context, id string) error
+	RemoveSessions(ctx context.Context) (int, error)
+}
+
+// Manager creates, checks and revokes sessions
+type Manager struct {
+	store Store
+	ttl   time.Duration
+	now   func() time.Time
+}
+
+// New makes Manager with the store, sessions expire after ttl of inactivity
+func New(s Store, ttl time.Duration) *Manager {
+	return &Manager{store: s, ttl: ttl, now: time.Now}
+}
+
+// Create makes a new session of the user and returns its token along with the stored record.
+// ip is expected to be hashed already, it's never stored as is.
+func (m *Manager) Create(ctx context.Context, user, ip, userAgent string) (token string, result *store.Session, err error) {
+	if user == "" {
+		return "", nil, errors.New("session user required")
+	}
+	secret := make([]byte, 32)
+	if _, err = rand.Read(secret); err != nil {
+		return "", nil, fmt.Errorf("generate session: %w", err)
+	}
+	if len(userAgent) > maxUserAgent {
+		userAgent = userAgent[:maxUserAgent]
+	}
+	now := m.now()
+	result = &store.Session{ID: store.GenerateID(), User: user, IP: ip, UserAgent: userAgent,
+		Created: now, LastSeen: now, Expires: now.Add(m.ttl)}
+	token = result.ID + base64.RawURLEncoding.EncodeToString(secret)
+	result.Hash = hash(token)
+	if err = m.store.SaveSession(ctx, result); err != nil {
+		return "", nil, fmt.Errorf("save session: %w", err)
+	}
+	return token, result, nil
+}
+
+// Check verifies the token and returns its session, ErrInvalid for unknown, expired or revoked session.
+// Expiration moves forward by ttl from now, updated in the store at most once per touchInterval.
+func (m *Manager) Check(ctx context.Context, token string) (*store.Session, error) {
+	sess, err := m.load(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+	if now := m.now(); now.Sub(sess.LastSeen) >= touchInterval {
+		if err = m.store.TouchSession(ctx, sess.ID, now, now.Add(m.ttl)); err != nil {
+			log.Printf("[WARN] can't update last seen time of session %s, %v", sess.ID, err)
+		}
+		sess.LastSeen, sess.Expires = now, now.Add(m.ttl)
+	}
+	return sess, nil
+}
+
+// Remove ends the session of the token, used by logout
+func (m *Manager) Remove(ctx context.Context, token string) error {
+	sess, err := m.load(ctx, token)
+	if err != nil {
+		return err
+	}
+	if err = m.store.RemoveSession(ctx, sess.ID); err != nil && !errors.Is(err, store.ErrLoadRejected) {
+		return fmt.Errorf("remove session: %w", err)
+	}
+	return nil
+}
+
+// List returns all active sessions, oldest first
+func (m *Manager) List(ctx context.Context) ([]store.Session, error) {
+	res, err := m.store.ListSessions(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("list sessions: %w", err)
+	}
+	return res, nil
+}
+
+// Revoke removes session by its id
+func (m *Manager) Revoke(ctx context.Context, id string) error {
+	if err := m.store.RemoveSession(ctx, id); err != nil {
+		if errors.Is(err, store.ErrLoadRejected) {
+			return fmt.Errorf("%w: %s", ErrNotFound, id)
+		}
+		return fmt.Errorf("remove session: %w", err)
+	}
+	log.Printf("[INFO] revoked session %s", id)
+	return nil
+}
+
+// RevokeAll removes all sessions, everybody has to log in again. Returns the number of removed sessions.
+func (m *Manager) RevokeAll(ctx context.Context) (int, error) {
+	count, err := m.store.RemoveSessions(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("remove sessions: %w", err)
+	}
+	log.Printf("[INFO] revoked all sessions, %d removed", count)
+	return count, nil
+}
+
+// load returns stored session of the token if the token matches its hash and the session is not expired
+func (m *Manager) load(ctx context.Context, token string) (*store.Session, error) {
+	if len(token) <= 12 {
+		return nil, ErrInvalid
+	}
+	sess, err := m.store.LoadSession(ctx, token[:12])
+	if err != nil {
+		return nil, ErrInvalid
+	}
+	if subtle.ConstantTimeCompare([]byte(sess.Hash), []byte(hash(token))) != 1 {
+		return nil, ErrInvalid
+	}
+	if !m.now().Before(sess.Expires) {
+		return nil, ErrInvalid
+	}
+	return sess, nil
+}
+
+// hash returns hex-encoded sha256 of the token, random enough to skip bcrypt
+func hash(token string) string {
+	h := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(h[:])
+}
@@ -0,0 +1,119 @@
+package sessions
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/umputun/secrets/v2/app/store"
+)
+
+func TestManager_CreateCheck(t *testing.T) {
+	eng := store.NewInMemory(time.Minute)
+	defer eng.Close()
+	m := New(eng, time.Hour)
+
+	token, sess, err := m.Create(t.Context(), "bob", "iphash", strings.Repeat("a", 300))
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(token, sess.ID))
+	assert.Equal(t, "bob", sess.User)
+	assert.Equal(t, "iphash", sess.IP)
+	assert.Len(t, sess.UserAgent, maxUserAgent)
+	assert.NotContains(t, sess.Hash, token)
+	assert.WithinDuration(t, time.Now().Add(time.Hour), sess.Expires, 2*time.Second)
+
+	checked, err := m.Check(t.Context(), token)
+	require.NoError(t, err)
+	assert.Equal(t, sess.ID, checked.ID)
+	assert.Equal(t, "bob", checked.User)
+
+	tampered := token[:len(token)-1] + "A"
+	if tampered == token {
+		tampered = token[:len(token)-1] + "B"
+	}
+	for _, bad := range []string{"", sess.ID, token + "x", "x" + token[1:], tampered} {
+		_, err = m.Check(t.Context(), bad)
+		require.ErrorIs(t, err, ErrInvalid, bad)
+	}
+
+	_, _, err = m.Create(t.Context(), "", "iphash", "ua")
+	require.Error(t, err)
+}
+
+func TestManager_SlidingExpiry(t *testing.T) {
+	eng := store.NewInMemory(time.Minute)
+	defer eng.Close()
+	now := time.Now().Truncate(time.Second)
+	m := New(eng, time.Hour)
+	m.now = func() time.Time { return now }
+
+	token, sess, err := m.Create(t.Context(), "bob", "iphash", "ua")
+	require.NoError(t, err)
+
+	// used within touch interval, nothing written
+	now = now.Add(30 * time.Second)
+	checked, err := m.Check(t.Context(), token)
+	require.NoError(t, err)
+	assert.True(t, sess.Expires.Equal(checked.Expires))
+
+	// used later, expiration moved forward
+	now = now.Add(50 * time.Minute)
+	checked, err = m.Check(t.Context(), token)
+	require.NoError(t, err)
+	assert.True(t, now.Add(time.Hour).Equal(checked.Expires))
+	stored, err := eng.LoadSession(t.Context(), sess.ID)
+	require.NoError(t, err)
+	assert.True(t, now.Equal(stored.LastSeen))
+	assert.True(t, now.Add(time.Hour).Equal(stored.Expires))
+
+	// still valid past the original expiration
+	now = now.Add(40 * time.Minute)
+	_, err = m.Check(t.Context(), token)
+	require.NoError(t, err)
+
+	// inactive for ttl
+	now = now.Add(time.Hour)
+	_, err = m.Check(t.Context(), token)
+	require.ErrorIs(t, err, ErrInvalid)
+}
+
+func TestManager_RemoveRevoke(t *testing.T) {
+	eng := store.NewInMemory(time.Minute)
+	defer eng.Close()
+	m := New(eng, time.Hour)
+
+	token1, s1, err := m.Create(t.Context(), "bob", "ip1", "ua1")
+	require.NoError(t, err)
+	token2, s2, err := m.Create(t.Context(), "alice", "ip2", "ua2")
+	require.NoError(t, err)
+	token3, _, err := m.Create(t.Context(), "secrets", "ip3", "ua3")
+	require.NoError(t, err)
+
+	list, err := m.List(t.Context())
+	require.NoError(t, err)
+	assert.Len(t, list, 3)
+
+	// logout
+	require.NoError(t, m.Remove(t.Context(), token1))
+	_, err = m.Check(t.Context(), token1)
+	require.ErrorIs(t, err, ErrInvalid)
+	require.ErrorIs(t, m.Remove(t.Context(), token1), ErrInvalid)
+	require.ErrorIs(t, m.Remove(t.Context(), s2.ID+"wrong-secret"), ErrInvalid, "id alone can't end session")
+
+	require.ErrorIs(t, m.Revoke(t.Context(), s1.ID), ErrNotFound)
+	require.NoError(t, m.Revoke(t.Context(), s2.ID))
+	_, err = m.Check(t.Context(), token2)
+	require.ErrorIs(t, err, ErrInvalid)
+
+	count, err := m.RevokeAll(t.Context())
+	require.NoError(t, err)
+	assert.Equal(t, 1, count)
+	_, err = m.Check(t.Context(), token3)
+	require.ErrorIs(t, err, ErrInvalid)
+	list, err = m.List(t.Context())
+	require.NoError(t, err)
+	assert.Empty(t, list)
+}
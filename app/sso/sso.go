@@ -0,0 +1,159 @@
+// Package sso implements OpenID Connect login of message creators, authorization code flow with PKCE.
+// Provider is discovered from the issuer, ID token is verified against issuer's keys and the identity
+// has to pass allowlist of email domains and groups.
+package sso
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+)
+
+// ErrNotAllowed returned for authenticated identity not passing allowlist
+var ErrNotAllowed = errors.New("identity not allowed")
+
+// Config of OIDC provider
+type Config struct {
+	Issuer         string       // issuer url, discovery document is at issuer/.well-known/openid-configuration
+	ClientID       string       // client id registered with the provider
+	ClientSecret   string       // client secret, empty for public client
+	RedirectURL    string       // callback url of the server, like https://example.com/auth/sso/callback
+	AllowedDomains []string     // email domains allowed to log in, verified email required if set
+	AllowedGroups  []string     // groups allowed to log in, any of them
+	GroupsClaim    string       // claim with groups, "groups" if empty
+	HTTPClient     *http.Client // client for discovery, keys and token exchange, http.DefaultClient if nil
+}
+
+// Provider is discovered OIDC provider
+type Provider struct {
+	cfg      Config
+	oauth    oauth2.Config
+	verifier *oidc.IDTokenVerifier
+}
+
+// New discovers the provider from issuer
+func New(ctx context.Context, cfg Config) (*Provider, error) {
+	if cfg.Issuer == "" || cfg.ClientID == "" || cfg.RedirectURL == "" {
+		return nil, errors.New("issuer, client id and redirect url required")
+	}
+	if cfg.GroupsClaim == "" {
+		cfg.GroupsClaim = "groups"
+	}
+	if cfg.HTTPClient == nil {
+		cfg.HTTPClient = http.DefaultClient
+	}
+	domains := make([]string, 0, len(cfg.AllowedDomains))
+	for _, d := range cfg.AllowedDomains {
+		domains = append(domains, strings.ToLower(strings.TrimPrefix(strings.TrimSpace(d), "@")))
+	}
+	cfg.AllowedDomains = domains
+
+	p := &Provider{cfg: cfg}
+	provider, err := oidc.NewProvider(p.clientContext(ctx), cfg.Issuer)
+	if err != nil {
+		return nil, fmt.Errorf("discover oidc provider %s: %w", cfg.Issuer, err)
+	}
+	p.oauth = oauth2.Config{
+		ClientID:     cfg.ClientID,
+		ClientSecret: cfg.ClientSecret,
+		RedirectURL:  cfg.RedirectURL,
+		Endpoint:     provider.Endpoint(),
+		Scopes:       []string{oidc.ScopeOpenID, "email", "profile"},
+	}
+	// the verifier fetches keys lazily with the client of discovery context, keep it for the whole provider life
+	p.verifier = provider.VerifierContext(p.clientContext(context.WithoutCancel(ctx)), &oidc.Config{ClientID: cfg.ClientID})
+	return p, nil
+}
+
+// AuthURL returns url of provider's login page, verifier is PKCE code verifier sent with S256 challenge
+func (p *Provider) AuthURL(state, nonce, verifier string) string {
+	return p.oauth.AuthCodeURL(state, oidc.Nonce(nonce), oauth2.S256ChallengeOption(verifier))
+}
+
+// Exchange trades authorization code for ID token, verifies it and returns identity of the user.
+// Identity is verified email, or preferred user name, or subject if neither present.
+func (p *Provider) Exchange(ctx context.Context, code, nonce, verifier string) (string, error) {
+	ctx = p.clientContext(ctx)
+	token, err := p.oauth.Exchange(ctx, code, oauth2.VerifierOption(verifier))
+	if err != nil {
+		return "", fmt.Errorf("exchange code: %w", err)
+	}
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok || rawIDToken == "" {
+		return "", errors.New("no id_token in token response")
+	}
+	idToken, err := p.verifier.Verify(ctx, rawIDToken)
+	if err != nil {
+		return "", fmt.Errorf("verify id token: %w", err)
+	}
+	if idToken.Nonce != nonce {
+		return "", errors.New("id token nonce mismatch")
+	}
+
+	var claims map[string]any
+	if err = idToken.Claims(&claims); err != nil {
+		return "", fmt.Errorf("parse id token claims: %w", err)
+	}
+	email, _ := claims["email"].(string)
+	emailVerified, _ := claims["email_verified"].(bool)
+	if !emailVerified {
+		email = ""
+	}
+
+	if err = p.checkAllowed(strings.ToLower(email), groups(claims[p.cfg.GroupsClaim])); err != nil {
+		return "", err
+	}
+
+	switch name, _ := claims["preferred_username"].(string); {
+	case email != "":
+		return email, nil
+	case name != "":
+		return name, nil
+	default:
+		return idToken.Subject, nil
+	}
+}
+
+// checkAllowed checks identity against allowlists, both of them if both set
+func (p *Provider) checkAllowed(email string, userGroups []string) error {
+	if len(p.cfg.AllowedDomains) > 0 {
+		_, domain, ok := strings.Cut(email, "@")
+		if !ok || !slices.Contains(p.cfg.AllowedDomains, domain) {
+			return fmt.Errorf("%w: email %q not in allowed domains", ErrNotAllowed, email)
+		}
+	}
+	if len(p.cfg.AllowedGroups) > 0 {
+		if !slices.ContainsFunc(userGroups, func(g string) bool { return slices.Contains(p.cfg.AllowedGroups, g) }) {
+			return fmt.Errorf("%w: groups %v not allowed", ErrNotAllowed, userGroups)
+		}
+	}
+	return nil
+}
+
+func (p *Provider) clientContext(ctx context.Context) context.Context {
+	return context.WithValue(oidc.ClientContext(ctx, p.cfg.HTTPClient), oauth2.HTTPClient, p.cfg.HTTPClient)
+}
+
+// groups converts groups claim to list, providers send either a list or a single string
+func groups(claim any) []string {
+	switch v := claim.(type) {
+	case string:
+		return []string{v}
+	case []any:
+		res := make([]string, 0, len(v))
+		for _, g := range v {
+			if s, ok := g.(string); ok {
+				res = append(res, s)
+			}
+		}
+		return res
+	default:
+		return nil
+	}
+}
@@ -0,0 +1,279 @@
+package sso
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProvider(t *testing.T) {
+	issuer := newMockIssuer(t)
+	p, err := New(t.Context(), Config{Issuer: issuer.URL, ClientID: "secrets", ClientSecret: "client-secret",
+		RedirectURL: "https://example.com/auth/sso/callback"})
+	require.NoError(t, err)
+
+	t.Run("auth url", func(t *testing.T) {
+		u, err := url.Parse(p.AuthURL("state1", "nonce1", "verifier1"))
+		require.NoError(t, err)
+		assert.Equal(t, issuer.URL+"/authorize", u.Scheme+"://"+u.Host+u.Path)
+		q := u.Query()
+		assert.Equal(t, "code", q.Get("response_type"))
+		assert.Equal(t, "secrets", q.Get("client_id"))
+		assert.Equal(t, "state1", q.Get("state"))
+		assert.Equal(t, "nonce1", q.Get("nonce"))
+		assert.Equal(t, "S256", q.Get("code_challenge_method"))
+		assert.Equal(t, challenge("verifier1"), q.Get("code_challenge"))
+		assert.Equal(t, "openid email profile", q.Get("scope"))
+	})
+
+	t.Run("verified email", func(t *testing.T) {
+		code := issuer.authorize(t, p.AuthURL("st", "n1", "v1"), map[string]any{"email": "bob@example.com",
+			"email_verified": true, "preferred_username": "bob"})
+		user, err := p.Exchange(t.Context(), code, "n1", "v1")
+		require.NoError(t, err)
+		assert.Equal(t, "bob@example.com", user)
+
+		_, err = p.Exchange(t.Context(), code, "n1", "v1")
+		require.Error(t, err, "code is single use")
+	})
+
+	t.Run("user name or subject without verified email", func(t *testing.T) {
+		code := issuer.authorize(t, p.AuthURL("st", "n1", "v1"), map[string]any{"email": "bob@example.com",
+			"preferred_username": "bob"})
+		user, err := p.Exchange(t.Context(), code, "n1", "v1")
+		require.NoError(t, err)
+		assert.Equal(t, "bob", user)
+
+		code = issuer.authorize(t, p.AuthURL("st", "n1", "v1"), nil)
+		user, err = p.Exchange(t.Context(), code, "n1", "v1")
+		require.NoError(t, err)
+		assert.Equal(t, "subject-1", user)
+	})
+
+	t.Run("wrong pkce verifier", func(t *testing.T) {
+		code := issuer.authorize(t, p.AuthURL("st", "n1", "v1"), nil)
+		_, err := p.Exchange(t.Context(), code, "n1", "v2")
+		require.ErrorContains(t, err, "exchange code")
+	})
+
+	t.Run("wrong nonce", func(t *testing.T) {
+		code := issuer.authorize(t, p.AuthURL("st", "n1", "v1"), nil)
+		_, err := p.Exchange(t.Context(), code, "n2", "v1")
+		require.ErrorContains(t, err, "nonce mismatch")
+	})
+
+	t.Run("bad id token", func(t *testing.T) {
+		for name, claims := range map[string]map[string]any{
+			"expired":        {"exp": time.Now().Add(-time.Minute).Unix()},
+			"other audience": {"aud": "other-client"},
+			"other issuer":   {"iss": "https://evil.example.com"},
+		} {
+			code := issuer.authorize(t, p.AuthURL("st", "n1", "v1"), claims)
+			_, err := p.Exchange(t.Context(), code, "n1", "v1")
+			require.ErrorContains(t, err, "verify id token", name)
+		}
+
+		issuer.signWith(t, "unknown-key")
+		defer issuer.signWith(t, "")
+		code := issuer.authorize(t, p.AuthURL("st", "n1", "v1"), nil)
+		_, err := p.Exchange(t.Context(), code, "n1", "v1")
+		require.ErrorContains(t, err, "verify id token")
+	})
+
+	t.Run("provider not found", func(t *testing.T) {
+		_, err := New(t.Context(), Config{Issuer: issuer.URL + "/unknown", ClientID: "secrets", RedirectURL: "https://example.com/cb"})
+		require.Error(t, err)
+		_, err = New(t.Context(), Config{Issuer: issuer.URL})
+		require.Error(t, err)
+	})
+}
+
+func TestProvider_Allowlist(t *testing.T) {
+	issuer := newMockIssuer(t)
+	newProvider := func(t *testing.T, domains, groups []string, groupsClaim string) *Provider {
+		t.Helper()
+		p, err := New(t.Context(), Config{Issuer: issuer.URL, ClientID: "secrets", RedirectURL: "https://example.com/cb",
+			AllowedDomains: domains, AllowedGroups: groups, GroupsClaim: groupsClaim})
+		require.NoError(t, err)
+		return p
+	}
+	exchange := func(t *testing.T, p *Provider, claims map[string]any) (string, error) {
+		t.Helper()
+		code := issuer.authorize(t, p.AuthURL("st", "n1", "v1"), claims)
+		return p.Exchange(t.Context(), code, "n1", "v1")
+	}
+
+	t.Run("domains", func(t *testing.T) {
+		p := newProvider(t, []string{"Example.com", "@corp.example.com"}, nil, "")
+		user, err := exchange(t, p, map[string]any{"email": "bob@example.com", "email_verified": true})
+		require.NoError(t, err)
+		assert.Equal(t, "bob@example.com", user)
+		_, err = exchange(t, p, map[string]any{"email": "Alice@Corp.Example.com", "email_verified": true})
+		require.NoError(t, err, "domain case ignored")
+
+		_, err = exchange(t, p, map[string]any{"email": "bob@other.com", "email_verified": true})
+		require.ErrorIs(t, err, ErrNotAllowed)
+		_, err = exchange(t, p, map[string]any{"email": "bob@example.com", "email_verified": false})
+		require.ErrorIs(t, err, ErrNotAllowed, "unverified email")
+		_, err = exchange(t, p, map[string]any{"email": "bob@sub.example.com", "email_verified": true})
+		require.ErrorIs(t, err, ErrNotAllowed, "subdomain not allowed")
+		_, err = exchange(t, p, map[string]any{"preferred_username": "bob"})
+		require.ErrorIs(t, err, ErrNotAllowed, "no email")
+	})
+
+	t.Run("groups", func(t *testing.T) {
+		p := newProvider(t, nil, []string{"admins", "devs"}, "")
+		_, err := exchange(t, p, map[string]any{"groups": []string{"users", "devs"}})
+		require.NoError(t, err)
+		_, err = exchange(t, p, map[string]any{"groups": "admins"})
+		require.NoError(t, err, "single group as string")
+		_, err = exchange(t, p, map[string]any{"groups": []string{"users"}})
+		require.ErrorIs(t, err, ErrNotAllowed)
+		_, err = exchange(t, p, nil)
+		require.ErrorIs(t, err, ErrNotAllowed, "no groups claim")
+
+		p = newProvider(t, nil, []string{"admins"}, "roles")
+		_, err = exchange(t, p, map[string]any{"roles": []string{"admins"}})
+		require.NoError(t, err)
+		_, err = exchange(t, p, map[string]any{"groups": []string{"admins"}})
+		require.ErrorIs(t, err, ErrNotAllowed, "custom claim")
+	})
+
+	t.Run("domains and groups", func(t *testing.T) {
+		p := newProvider(t, []string{"example.com"}, []string{"devs"}, "")
+		_, err := exchange(t, p, map[string]any{"email": "bob@example.com", "email_verified": true, "groups": []string{"devs"}})
+		require.NoError(t, err)
+		_, err = exchange(t, p, map[string]any{"email": "bob@example.com", "email_verified": true})
+		require.ErrorIs(t, err, ErrNotAllowed)
+		_, err = exchange(t, p, map[string]any{"email": "bob@other.com", "email_verified": true, "groups": []string{"devs"}})
+		require.ErrorIs(t, err, ErrNotAllowed)
+	})
+}
+
+// mockIssuer is OIDC provider with discovery, keys and token endpoint. Login is done by authorize,
+// it registers a code for the challenge and nonce of auth url.
+type mockIssuer struct {
+	*httptest.Server
+	key *rsa.PrivateKey
+
+	mu      sync.Mutex
+	codes   map[string]mockAuth
+	signKey *rsa.PrivateKey // key signing ID tokens, published key if nil
+	keyID   string
+}
+
+type mockAuth struct {
+	challenge string
+	nonce     string
+	claims    map[string]any
+}
+
+func newMockIssuer(t *testing.T) *mockIssuer {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	m := &mockIssuer{key: key, codes: map[string]mockAuth{}, keyID: "key-1"}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /.well-known/openid-configuration", func(w http.ResponseWriter, _ *http.Request) {
+		writeJSON(w, map[string]any{"issuer": m.URL, "authorization_endpoint": m.URL + "/authorize",
+			"token_endpoint": m.URL + "/token", "jwks_uri": m.URL + "/keys",
+			"id_token_signing_alg_values_supported": []string{"RS256"}})
+	})
+	mux.HandleFunc("GET /keys", func(w http.ResponseWriter, _ *http.Request) {
+		writeJSON(w, jose.JSONWebKeySet{Keys: []jose.JSONWebKey{{Key: &key.PublicKey, KeyID: "key-1", Algorithm: "RS256", Use: "sig"}}})
+	})
+	mux.HandleFunc("POST /token", func(w http.ResponseWriter, r *http.Request) {
+		m.mu.Lock()
+		auth, ok := m.codes[r.FormValue("code")]
+		delete(m.codes, r.FormValue("code"))
+		m.mu.Unlock()
+		if clientID, _, _ := r.BasicAuth(); clientID != "secrets" && r.FormValue("client_id") != "secrets" {
+			ok = false
+		}
+		if !ok || r.FormValue("grant_type") != "authorization_code" || challenge(r.FormValue("code_verifier")) != auth.challenge {
+			w.WriteHeader(http.StatusBadRequest)
+			writeJSON(w, map[string]string{"error": "invalid_grant"})
+			return
+		}
+		writeJSON(w, map[string]any{"access_token": "access", "token_type": "Bearer", "expires_in": 300,
+			"id_token": m.idToken(t, auth)})
+	})
+	m.Server = httptest.NewServer(mux)
+	t.Cleanup(m.Close)
+	return m
+}
+
+// authorize logs in with auth url and returns the code
+func (m *mockIssuer) authorize(t *testing.T, authURL string, claims map[string]any) string {
+	t.Helper()
+	u, err := url.Parse(authURL)
+	require.NoError(t, err)
+	code := rand.Text()
+	m.mu.Lock()
+	m.codes[code] = mockAuth{challenge: u.Query().Get("code_challenge"), nonce: u.Query().Get("nonce"), claims: claims}
+	m.mu.Unlock()
+	return code
+}
+
+// signWith switches signing of ID tokens to a new key with the id, published key used if empty
+func (m *mockIssuer) signWith(t *testing.T, keyID string) {
+	t.Helper()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.signKey, m.keyID = nil, "key-1"
+	if keyID != "" {
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		require.NoError(t, err)
+		m.signKey, m.keyID = key, keyID
+	}
+}
+
+func (m *mockIssuer) idToken(t *testing.T, auth mockAuth) string {
+	t.Helper()
+	claims := map[string]any{"iss": m.URL, "sub": "subject-1", "aud": "secrets", "nonce": auth.nonce,
+		"iat": time.Now().Unix(), "exp": time.Now().Add(time.Minute).Unix()}
+	for k, v := range auth.claims {
+		claims[k] = v
+	}
+
+	m.mu.Lock()
+	key, keyID := m.key, m.keyID
+	if m.signKey != nil {
+		key = m.signKey
+	}
+	m.mu.Unlock()
+
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.RS256, Key: jose.JSONWebKey{Key: key, KeyID: keyID}},
+		(&jose.SignerOptions{}).WithType("JWT"))
+	require.NoError(t, err)
+	payload, err := json.Marshal(claims)
+	require.NoError(t, err)
+	obj, err := signer.Sign(payload)
+	require.NoError(t, err)
+	res, err := obj.CompactSerialize()
+	require.NoError(t, err)
+	return res
+}
+
+func challenge(verifier string) string {
+	h := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(h[:])
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,569 @@
+package store
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func prepRedis(t *testing.T) (*Redis, *miniredis.Miniredis) {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	s, err := NewRedis("redis://" + mr.Addr())
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = s.Close() })
+	return s, mr
+}
+
+func TestRedis_New(t *testing.T) {
+	_, err := NewRedis("bad-url")
+	require.Error(t, err)
+
+	_, err = NewRedis("redis://127.0.0.1:1")
+	require.Error(t, err, "should fail on unreachable server")
+}
+
+func TestRedis_SaveLoad(t *testing.T) {
+	s, mr := prepRedis(t)
+
+	msg := Message{Key: "testkey123", Exp: time.Now().Add(time.Hour), Data: []byte("test\x00binary\xffdata"),
+		PinHash: "hash123", Errors: 2, ClientEnc: true, MgmtHash: "mgmthash",
+		Callback: "https://example.com/hook"}
+	require.NoError(t, s.Save(t.Context(), &msg))
+
+	loaded, err := s.Load(t.Context(), "testkey123")
+	require.NoError(t, err)
+	assert.Equal(t, msg.Key, loaded.Key)
+	assert.Equal(t, msg.Data, loaded.Data)
+	assert.Equal(t, msg.PinHash, loaded.PinHash)
+	assert.Equal(t, msg.Errors, loaded.Errors)
+	assert.Equal(t, msg.Exp.UnixMilli(), loaded.Exp.UnixMilli())
+	assert.True(t, loaded.ClientEnc)
+	assert.Equal(t, "mgmthash", loaded.MgmtHash)
+	assert.Equal(t, "https://example.com/hook", loaded.Callback)
+
+	// ttl set from message expiration
+	ttl := mr.TTL(redisKeyPrefix + "testkey123")
+	assert.InDelta(t, time.Hour.Seconds(), ttl.Seconds(), 5)
+
+	// duplicate key rejected
+	require.ErrorIs(t, s.Save(t.Context(), &msg), ErrSaveRejected)
+
+	_, err = s.Load(t.Context(), "nonexistent")
+	require.ErrorIs(t, err, ErrLoadRejected)
+}
+
+func TestRedis_Expiration(t *testing.T) {
+	s, mr := prepRedis(t)
+
+	msg := Message{Key: "expiring", Exp: time.Now().Add(time.Minute), Data: []byte("data"), PinHash: "hash"}
+	require.NoError(t, s.Save(t.Context(), &msg))
+
+	_, err := s.Load(t.Context(), "expiring")
+	require.NoError(t, err)
+
+	mr.FastForward(2 * time.Minute)
+	_, err = s.Load(t.Context(), "expiring")
+	require.ErrorIs(t, err, ErrLoadRejected, "message should be expired by redis")
+}
+
+func TestRedis_IncErr(t *testing.T) {
+	s, mr := prepRedis(t)
+
+	ctx := t.Context()
+	msg := Message{Key: "errkey", Exp: time.Now().Add(time.Hour), Data: []byte("data"), PinHash: "hash"}
+	require.NoError(t, s.Save(ctx, &msg))
+
+	const numGoroutines = 10
+	var wg sync.WaitGroup
+	wg.Add(numGoroutines)
+	for range numGoroutines {
+		go func() {
+			defer wg.Done()
+			_, _ = s.IncErr(ctx, "errkey")
+		}()
+	}
+	wg.Wait()
+
+	count, err := s.IncErr(ctx, "errkey")
+	require.NoError(t, err)
+	assert.Equal(t, numGoroutines+1, count)
+	assert.Positive(t, mr.TTL(redisKeyPrefix+"errkey"), "ttl should be kept after increment")
+
+	_, err = s.IncErr(ctx, "nonexistent")
+	require.ErrorIs(t, err, ErrLoadRejected)
+	assert.False(t, mr.Exists(redisKeyPrefix+"nonexistent"), "increment should not create missing message")
+}
+
+func TestRedis_Consume(t *testing.T) {
+	s, mr := prepRedis(t)
+
+	ctx := t.Context()
+	msg := Message{Key: "consumekey", Exp: time.Now().Add(time.Hour), Data: []byte("data"), PinHash: "hash"}
+	require.NoError(t, s.Save(ctx, &msg))
+
+	errVerify := errors.New("verify failed")
+	res, err := s.Consume(ctx, "consumekey", func(*Message) error { return errVerify })
+	require.ErrorIs(t, err, errVerify)
+	assert.Equal(t, "consumekey", res.Key)
+	assert.True(t, mr.Exists(redisKeyPrefix+"consumekey"), "message should stay after failed verification")
+
+	res, err = s.Consume(ctx, "consumekey", func(*Message) error { return nil })
+	require.NoError(t, err)
+	assert.Equal(t, []byte("data"), res.Data)
+	assert.Equal(t, "hash", res.PinHash)
+	assert.False(t, mr.Exists(redisKeyPrefix+"consumekey"))
+
+	_, err = s.Consume(ctx, "consumekey", func(*Message) error { return nil })
+	require.ErrorIs(t, err, ErrLoadRejected)
+}
+
+func TestRedis_Consume_Concurrent(t *testing.T) {
+	s, _ := prepRedis(t)
+
+	ctx := t.Context()
+	msg := Message{Key: "conckey", Exp: time.Now().Add(time.Hour), Data: []byte("data"), PinHash: "hash"}
+	require.NoError(t, s.Save(ctx, &msg))
+
+	const numGoroutines = 50
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	success, rejected := 0, 0
+	wg.Add(numGoroutines)
+	for range numGoroutines {
+		go func() {
+			defer wg.Done()
+			_, err := s.Consume(ctx, "conckey", func(*Message) error { return nil })
+			mu.Lock()
+			defer mu.Unlock()
+			if err == nil {
+				success++
+				return
+			}
+			if errors.Is(err, ErrLoadRejected) {
+				rejected++
+			}
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, 1, success, "exactly one consumer should get the message")
+	assert.Equal(t, numGoroutines-1, rejected)
+}
+
+func TestRedis_Consume_MaxViews(t *testing.T) {
+	s, mr := prepRedis(t)
+
+	ctx := t.Context()
+	msg := Message{Key: "viewskey", Exp: time.Now().Add(time.Hour), Data: []byte("data"), PinHash: "hash", MaxViews: 3}
+	require.NoError(t, s.Save(ctx, &msg))
+
+	for i := 1; i <= 3; i++ {
+		res, err := s.Consume(ctx, "viewskey", func(*Message) error { return nil })
+		require.NoError(t, err)
+		assert.Equal(t, i, res.Views)
+		assert.Equal(t, 3, res.MaxViews)
+	}
+	assert.False(t, mr.Exists(redisKeyPrefix+"viewskey"), "message removed after the last view")
+
+	// concurrent readers get exactly the allowed number of views
+	require.NoError(t, s.Save(ctx, &Message{Key: "conckey", Exp: time.Now().Add(time.Hour), Data: []byte("data"),
+		PinHash: "hash", MaxViews: 3}))
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	success := 0
+	for range 20 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := s.Consume(ctx, "conckey", func(*Message) error { return nil }); err == nil {
+				mu.Lock()
+				success++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, 3, success)
+
+	// message saved before views were introduced is single read
+	mr.HSet(redisKeyPrefix+"oldkey", "data", "data", "pin_hash", "hash", "errors", "0", "client_enc", "0",
+		"exp", strconv.FormatInt(time.Now().Add(time.Hour).UnixMilli(), 10))
+	res, err := s.Consume(ctx, "oldkey", func(*Message) error { return nil })
+	require.NoError(t, err)
+	assert.Equal(t, 1, res.MaxViews)
+	assert.False(t, mr.Exists(redisKeyPrefix+"oldkey"))
+}
+
+func TestRedis_Remove(t *testing.T) {
+	s, _ := prepRedis(t)
+
+	msg := Message{Key: "toremove", Exp: time.Now().Add(time.Hour), Data: []byte("data"), PinHash: "hash"}
+	require.NoError(t, s.Save(t.Context(), &msg))
+	require.NoError(t, s.Remove(t.Context(), "toremove"))
+
+	_, err := s.Load(t.Context(), "toremove")
+	require.ErrorIs(t, err, ErrLoadRejected)
+}
+
+func TestRedis_Tombstone(t *testing.T) {
+	s, mr := prepRedis(t)
+
+	ctx := t.Context()
+	_, err := s.LoadTombstone(ctx, "key1")
+	require.ErrorIs(t, err, ErrLoadRejected)
+
+	now := time.Now().Truncate(time.Second)
+	ts := Tombstone{Key: "key1", MgmtHash: "hash", State: StateExpired, Created: now, Exp: now.Add(time.Hour),
+		Purge: now.Add(2 * time.Hour), MaxViews: 2}
+	require.NoError(t, s.SaveTombstone(ctx, &ts))
+	loaded, err := s.LoadTombstone(ctx, "key1")
+	require.NoError(t, err)
+	assert.True(t, ts.Created.Equal(loaded.Created))
+	assert.True(t, ts.Purge.Equal(loaded.Purge))
+	assert.Equal(t, StateExpired, loaded.State)
+	assert.Equal(t, 2, loaded.MaxViews)
+	assert.InDelta(t, (2 * time.Hour).Seconds(), mr.TTL(redisTombstonePrefix+"key1").Seconds(), 5)
+
+	// replaced on the next save
+	ts.State, ts.Closed, ts.Errors, ts.Views = StateOpened, now.Add(time.Minute), 1, 2
+	require.NoError(t, s.SaveTombstone(ctx, &ts))
+	loaded, err = s.LoadTombstone(ctx, "key1")
+	require.NoError(t, err)
+	assert.Equal(t, StateOpened, loaded.State)
+	assert.True(t, ts.Closed.Equal(loaded.Closed))
+	assert.Equal(t, 1, loaded.Errors)
+
+	// tombstones are not messages
+	keys, err := s.Keys(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, keys)
+
+	// expires natively at purge time
+	mr.FastForward(3 * time.Hour)
+	_, err = s.LoadTombstone(ctx, "key1")
+	require.ErrorIs(t, err, ErrLoadRejected)
+
+	// tombstone past purge time is not kept
+	require.NoError(t, s.SaveTombstone(ctx, &Tombstone{Key: "key2", State: StateBurned, Purge: now.Add(-time.Minute)}))
+	_, err = s.LoadTombstone(ctx, "key2")
+	require.ErrorIs(t, err, ErrLoadRejected)
+}
+
+func TestRedis_UpdateTombstone(t *testing.T) {
+	s, mr := prepRedis(t)
+	checkUpdateTombstone(t, s)
+	assert.InDelta(t, (3 * time.Hour).Seconds(), mr.TTL(redisTombstonePrefix+"upd1").Seconds(), 65, "ttl of final state")
+
+	require.NoError(t, s.UpdateTombstone(t.Context(), "upd1", TombstoneUpdate{Views: 5}))
+	assert.InDelta(t, (3 * time.Hour).Seconds(), mr.TTL(redisTombstonePrefix+"upd1").Seconds(), 65, "ttl kept")
+}
+
+func TestRedis_Token(t *testing.T) {
+	s, mr := prepRedis(t)
+
+	ctx := t.Context()
+	_, err := s.LoadToken(ctx, "id1")
+	require.ErrorIs(t, err, ErrLoadRejected)
+
+	now := time.Now().Truncate(time.Second)
+	tk1 := Token{ID: "id1", Name: "ci", Hash: "hash1", Scopes: []string{"create-text", "create-file"}, MaxExp: time.Hour,
+		Created: now}
+	tk2 := Token{ID: "id2", Name: "deploy", Hash: "hash2", Scopes: []string{}, Created: now.Add(time.Second)}
+	require.NoError(t, s.SaveToken(ctx, &tk2))
+	require.NoError(t, s.SaveToken(ctx, &tk1))
+	require.ErrorIs(t, s.SaveToken(ctx, &tk1), ErrSaveRejected, "id taken")
+	assert.Equal(t, time.Duration(0), mr.TTL(redisTokenPrefix+"id1"), "tokens don't expire")
+
+	loaded, err := s.LoadToken(ctx, "id1")
+	require.NoError(t, err)
+	assert.Equal(t, "ci", loaded.Name)
+	assert.Equal(t, tk1.Scopes, loaded.Scopes)
+	assert.Equal(t, time.Hour, loaded.MaxExp)
+	assert.True(t, now.Equal(loaded.Created))
+
+	require.NoError(t, s.TouchToken(ctx, "id2", now.Add(time.Minute)))
+	list, err := s.ListTokens(ctx)
+	require.NoError(t, err)
+	require.Len(t, list, 2)
+	assert.Equal(t, "id1", list[0].ID, "oldest first")
+	assert.True(t, now.Add(time.Minute).Equal(list[1].LastUsed))
+
+	// tokens are not messages
+	keys, err := s.Keys(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, keys)
+
+	require.NoError(t, s.RemoveToken(ctx, "id1"))
+	require.ErrorIs(t, s.RemoveToken(ctx, "id1"), ErrLoadRejected)
+	require.Error(t, s.TouchToken(ctx, "id1", now), "removed token not stored back")
+	_, err = s.LoadToken(ctx, "id1")
+	require.ErrorIs(t, err, ErrLoadRejected)
+}
+
+func TestRedis_Session(t *testing.T) {
+	s, mr := prepRedis(t)
+
+	ctx := t.Context()
+	_, err := s.LoadSession(ctx, "id1")
+	require.ErrorIs(t, err, ErrLoadRejected)
+
+	now := time.Now().Truncate(time.Second)
+	s1 := Session{ID: "id1", Hash: "hash1", User: "secrets", IP: "iphash1", UserAgent: "curl/8.0", Created: now,
+		LastSeen: now, Expires: now.Add(time.Hour)}
+	s2 := Session{ID: "id2", Hash: "hash2", User: "bob", Created: now.Add(time.Second), LastSeen: now.Add(time.Second),
+		Expires: now.Add(time.Hour)}
+	require.NoError(t, s.SaveSession(ctx, &s2))
+	require.NoError(t, s.SaveSession(ctx, &s1))
+	require.ErrorIs(t, s.SaveSession(ctx, &s1), ErrSaveRejected, "id taken")
+	require.ErrorIs(t, s.SaveSession(ctx, &Session{ID: "id3", Expires: now.Add(-time.Minute)}), ErrSaveRejected,
+		"already expired")
+	assert.InDelta(t, time.Hour.Seconds(), mr.TTL(redisSessionPrefix+"id1").Seconds(), 5, "ttl set from expiration")
+
+	loaded, err := s.LoadSession(ctx, "id1")
+	require.NoError(t, err)
+	assert.Equal(t, "secrets", loaded.User)
+	assert.Equal(t, "iphash1", loaded.IP)
+	assert.Equal(t, "curl/8.0", loaded.UserAgent)
+	assert.True(t, now.Equal(loaded.Created))
+
+	require.NoError(t, s.TouchSession(ctx, "id2", now.Add(time.Minute), now.Add(2*time.Hour)))
+	assert.InDelta(t, (2 * time.Hour).Seconds(), mr.TTL(redisSessionPrefix+"id2").Seconds(), 5, "ttl moved")
+	list, err := s.ListSessions(ctx)
+	require.NoError(t, err)
+	require.Len(t, list, 2)
+	assert.Equal(t, "id1", list[0].ID, "oldest first")
+	assert.True(t, now.Add(time.Minute).Equal(list[1].LastSeen))
+	assert.True(t, now.Add(2*time.Hour).Equal(list[1].Expires))
+
+	mr.FastForward(90 * time.Minute)
+	_, err = s.LoadSession(ctx, "id1")
+	require.ErrorIs(t, err, ErrLoadRejected, "expired natively")
+
+	require.NoError(t, s.RemoveSession(ctx, "id2"))
+	require.ErrorIs(t, s.RemoveSession(ctx, "id2"), ErrLoadRejected)
+	require.Error(t, s.TouchSession(ctx, "id2", now, now.Add(time.Hour)), "removed session not stored back")
+
+	require.NoError(t, s.SaveSession(ctx, &Session{ID: "id4", Expires: time.Now().Add(time.Hour)}))
+	require.NoError(t, s.SaveSession(ctx, &Session{ID: "id5", Expires: time.Now().Add(time.Hour)}))
+	removed, err := s.RemoveSessions(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 2, removed)
+	list, err = s.ListSessions(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, list)
+}
+
+func TestRedis_Failures(t *testing.T) {
+	s, mr := prepRedis(t)
+
+	ctx := t.Context()
+	_, err := s.LoadFailures(ctx, "ip:hash1")
+	require.ErrorIs(t, err, ErrLoadRejected)
+
+	now := time.Now().Truncate(time.Second)
+	for i := 1; i <= 3; i++ {
+		f, err := s.IncFailures(ctx, "ip:hash1", now.Add(time.Duration(i)*time.Second), now.Add(time.Hour))
+		require.NoError(t, err)
+		assert.Equal(t, i, f.Count)
+	}
+	assert.InDelta(t, time.Hour.Seconds(), mr.TTL(redisFailuresPrefix+"ip:hash1").Seconds(), 5, "ttl set from expiration")
+	f, err := s.LoadFailures(ctx, "ip:hash1")
+	require.NoError(t, err)
+	assert.Equal(t, 3, f.Count)
+	assert.True(t, now.Add(3*time.Second).Equal(f.Last))
+	assert.True(t, now.Add(time.Hour).Equal(f.Expires))
+
+	// counter past expiration starts over
+	mr.FastForward(2 * time.Hour)
+	_, err = s.LoadFailures(ctx, "ip:hash1")
+	require.ErrorIs(t, err, ErrLoadRejected, "expired counter")
+	f, err = s.IncFailures(ctx, "ip:hash1", now, now.Add(time.Hour))
+	require.NoError(t, err)
+	assert.Equal(t, 1, f.Count)
+
+	require.NoError(t, s.RemoveFailures(ctx, "ip:hash1"))
+	require.ErrorIs(t, s.RemoveFailures(ctx, "ip:hash1"), ErrLoadRejected)
+}
+
+func TestRedis_TOTP(t *testing.T) {
+	s, _ := prepRedis(t)
+
+	ctx := t.Context()
+	_, err := s.LoadTOTP(ctx, "secrets")
+	require.ErrorIs(t, err, ErrLoadRejected)
+
+	now := time.Now().Truncate(time.Second)
+	require.NoError(t, s.SaveTOTP(ctx, &TOTP{User: "secrets", Secret: "OLDSECRET", Recovery: []string{"old1"}, LastStep: 5,
+		Created: now.Add(-time.Hour)}))
+	totp := TOTP{User: "secrets", Secret: "JBSWY3DPEHPK3PXP", Recovery: []string{"h1", "h2", "h3"}, Created: now}
+	require.NoError(t, s.SaveTOTP(ctx, &totp), "replaces existing")
+	require.NoError(t, s.SaveTOTP(ctx, &TOTP{User: "bob", Secret: "BOBSECRET", Recovery: []string{"h1"}, Created: now}))
+
+	loaded, err := s.LoadTOTP(ctx, "secrets")
+	require.NoError(t, err)
+	assert.Equal(t, "JBSWY3DPEHPK3PXP", loaded.Secret)
+	assert.Equal(t, []string{"h1", "h2", "h3"}, loaded.Recovery)
+	assert.Zero(t, loaded.LastStep)
+	assert.True(t, now.Equal(loaded.Created))
+
+	// steps only move forward
+	require.NoError(t, s.UseTOTPStep(ctx, "secrets", 100))
+	require.ErrorIs(t, s.UseTOTPStep(ctx, "secrets", 100), ErrSaveRejected, "same step again")
+	require.ErrorIs(t, s.UseTOTPStep(ctx, "secrets", 99), ErrSaveRejected, "earlier step")
+	require.ErrorIs(t, s.UseTOTPStep(ctx, "alice", 100), ErrSaveRejected, "not enrolled")
+	require.NoError(t, s.UseTOTPStep(ctx, "secrets", 101))
+
+	// recovery codes are single use
+	require.NoError(t, s.UseRecoveryCode(ctx, "secrets", "h2"))
+	require.ErrorIs(t, s.UseRecoveryCode(ctx, "secrets", "h2"), ErrLoadRejected)
+	require.ErrorIs(t, s.UseRecoveryCode(ctx, "secrets", "bad"), ErrLoadRejected)
+	loaded, err = s.LoadTOTP(ctx, "secrets")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"h1", "h3"}, loaded.Recovery)
+	assert.Equal(t, int64(101), loaded.LastStep)
+	loaded, err = s.LoadTOTP(ctx, "bob")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"h1"}, loaded.Recovery, "codes of other user not affected")
+
+	require.NoError(t, s.RemoveTOTP(ctx, "secrets"))
+	require.ErrorIs(t, s.RemoveTOTP(ctx, "secrets"), ErrLoadRejected)
+	_, err = s.LoadTOTP(ctx, "secrets")
+	require.ErrorIs(t, err, ErrLoadRejected)
+	require.ErrorIs(t, s.UseRecoveryCode(ctx, "secrets", "h1"), ErrLoadRejected, "codes removed along")
+}
+
+func TestRedis_User(t *testing.T) {
+	s, mr := prepRedis(t)
+
+	ctx := t.Context()
+	_, err := s.LoadUser(ctx, "bob")
+	require.ErrorIs(t, err, ErrLoadRejected)
+
+	now := time.Now().Truncate(time.Second)
+	require.NoError(t, s.SaveUser(ctx, &User{Name: "bob", Hash: "hash1", Created: now}))
+	require.NoError(t, s.SaveUser(ctx, &User{Name: "alice", Hash: "hash2", Created: now}))
+	require.NoError(t, s.SaveUser(ctx, &User{Name: "bob", Hash: "hash3", Created: now}), "replaces existing")
+	assert.Equal(t, time.Duration(0), mr.TTL(redisUserPrefix+"bob"), "users don't expire")
+
+	u, err := s.LoadUser(ctx, "bob")
+	require.NoError(t, err)
+	assert.Equal(t, "hash3", u.Hash)
+	assert.True(t, now.Equal(u.Created))
+
+	list, err := s.ListUsers(ctx)
+	require.NoError(t, err)
+	require.Len(t, list, 2)
+	assert.Equal(t, "alice", list[0].Name, "ordered by name")
+
+	require.NoError(t, s.RemoveUser(ctx, "bob"))
+	require.ErrorIs(t, s.RemoveUser(ctx, "bob"), ErrLoadRejected)
+}
+
+func TestRedis_KeysUpdateData(t *testing.T) {
+	s, mr := prepRedis(t)
+
+	ctx := t.Context()
+	require.NoError(t, mr.Set("other:key", "not a message"))
+	for _, key := range []string{"key2", "key1"} {
+		require.NoError(t, s.Save(ctx, &Message{Key: key, Exp: time.Now().Add(time.Hour), Data: []byte("data"), PinHash: "hash"}))
+	}
+	keys, err := s.Keys(ctx)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"key1", "key2"}, keys)
+
+	require.NoError(t, s.UpdateData(ctx, "key1", []byte("data"), []byte("new data")))
+	loaded, err := s.Load(ctx, "key1")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("new data"), loaded.Data)
+	assert.Positive(t, mr.TTL(redisKeyPrefix+"key1"), "ttl should be kept after update")
+
+	require.ErrorIs(t, s.UpdateData(ctx, "key1", []byte("data"), []byte("other")), ErrLoadRejected, "data changed")
+	require.ErrorIs(t, s.UpdateData(ctx, "nonexistent", []byte("data"), []byte("other")), ErrLoadRejected)
+	assert.False(t, mr.Exists(redisKeyPrefix+"nonexistent"), "update should not create missing message")
+}
+
+func TestRedis_Passkeys(t *testing.T) {
+	s, _ := prepRedis(t)
+
+	ctx := t.Context()
+	_, err := s.LoadPasskey(ctx, "cred1")
+	require.ErrorIs(t, err, ErrLoadRejected)
+
+	now := time.Now().Truncate(time.Second)
+	require.NoError(t, s.SavePasskey(ctx, &Passkey{ID: "cred1", User: "secrets", Name: "laptop", Credential: []byte(`{"id":"1"}`),
+		Created: now.Add(-time.Hour)}))
+	require.NoError(t, s.SavePasskey(ctx, &Passkey{ID: "cred2", User: "bob", Name: "phone", Credential: []byte(`{"id":"2"}`),
+		Created: now}))
+	require.NoError(t, s.SavePasskey(ctx, &Passkey{ID: "cred3", User: "secrets", Name: "key", Credential: []byte(`{"id":"3"}`),
+		Created: now}))
+
+	pk, err := s.LoadPasskey(ctx, "cred1")
+	require.NoError(t, err)
+	assert.Equal(t, "secrets", pk.User)
+	assert.Equal(t, "laptop", pk.Name)
+	assert.JSONEq(t, `{"id":"1"}`, string(pk.Credential))
+	assert.True(t, now.Add(-time.Hour).Equal(pk.Created))
+	assert.True(t, pk.LastUsed.IsZero())
+
+	// save replaces, e.g. sign counter updated on login
+	pk.Credential, pk.LastUsed = []byte(`{"id":"1","count":5}`), now
+	require.NoError(t, s.SavePasskey(ctx, pk))
+	pk, err = s.LoadPasskey(ctx, "cred1")
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"id":"1","count":5}`, string(pk.Credential))
+	assert.True(t, now.Equal(pk.LastUsed))
+
+	list, err := s.ListPasskeys(ctx, "secrets")
+	require.NoError(t, err)
+	require.Len(t, list, 2)
+	assert.Equal(t, "cred1", list[0].ID, "oldest first")
+	assert.Equal(t, "cred3", list[1].ID)
+	list, err = s.ListPasskeys(ctx, "")
+	require.NoError(t, err)
+	assert.Len(t, list, 3, "all users")
+	list, err = s.ListPasskeys(ctx, "alice")
+	require.NoError(t, err)
+	assert.Empty(t, list)
+
+	require.NoError(t, s.RemovePasskey(ctx, "cred1"))
+	require.ErrorIs(t, s.RemovePasskey(ctx, "cred1"), ErrLoadRejected)
+	_, err = s.LoadPasskey(ctx, "cred1")
+	require.ErrorIs(t, err, ErrLoadRejected)
+}
+
+func TestRedis_PasskeySetup(t *testing.T) {
+	s, mr := prepRedis(t)
+
+	ctx := t.Context()
+	_, err := s.LoadPasskeySetup(ctx, "h1")
+	require.ErrorIs(t, err, ErrLoadRejected)
+
+	exp := time.Now().Add(time.Hour).Truncate(time.Second)
+	require.NoError(t, s.SavePasskeySetup(ctx, &PasskeySetup{Hash: "h1", User: "secrets", Expires: exp}))
+	require.ErrorIs(t, s.SavePasskeySetup(ctx, &PasskeySetup{Hash: "h1", User: "bob", Expires: exp}), ErrSaveRejected)
+	require.ErrorIs(t, s.SavePasskeySetup(ctx, &PasskeySetup{Hash: "h2", User: "bob", Expires: time.Now().Add(-time.Second)}),
+		ErrSaveRejected, "expired already")
+
+	ps, err := s.LoadPasskeySetup(ctx, "h1")
+	require.NoError(t, err)
+	assert.Equal(t, "secrets", ps.User)
+	assert.True(t, exp.Equal(ps.Expires))
+	require.NoError(t, s.SavePasskeySetup(ctx, &PasskeySetup{Hash: "h3", User: "bob", Expires: time.Now().Add(time.Minute)}))
+	mr.FastForward(2 * time.Minute)
+	_, err = s.LoadPasskeySetup(ctx, "h3")
+	require.ErrorIs(t, err, ErrLoadRejected, "expired")
+	require.ErrorIs(t, s.RemovePasskeySetup(ctx, "h3"), ErrLoadRejected, "expired")
+
+	// single use
+	require.NoError(t, s.RemovePasskeySetup(ctx, "h1"))
+	require.ErrorIs(t, s.RemovePasskeySetup(ctx, "h1"), ErrLoadRejected)
+	_, err = s.LoadPasskeySetup(ctx, "h1")
+	require.ErrorIs(t, err, ErrLoadRejected)
+}
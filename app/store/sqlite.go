@@ -7,6 +7,7 @@ import (
 	"encoding/hex"
 	"errors"
 	"fmt"
+	"strings"
 	"sync"
 	"time"
 
@@ -16,10 +17,11 @@ import (
 
 // SQLite implements store.Engine with SQLite database
 type SQLite struct {
-	db      *sql.DB
-	lock    sync.RWMutex
-	done    chan struct{}
-	cleanWg sync.WaitGroup
+	db        *sql.DB
+	lock      sync.RWMutex
+	done      chan struct{}
+	cleanWg   sync.WaitGroup
+	onExpired ExpiredFunc
 }
 
 // NewInMemory creates an ephemeral in-memory SQLite store.
@@ -38,10 +40,28 @@ func NewInMemory(cleanupDuration time.Duration) *SQLite {
 	return s
 }
 
-// NewSQLite creates a persistent SQLite-based store
+// NewSQLite creates a persistent SQLite-based store, schema migrated to the latest version
 func NewSQLite(dbFile string, cleanupDuration time.Duration) (*SQLite, error) {
 	log.Printf("[INFO] sqlite (%s) store", dbFile)
 
+	ctx := context.Background()
+	db, err := openSQLite(ctx, dbFile)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err = migrateSQLite(ctx, db); err != nil {
+		_ = db.Close()
+		return nil, fmt.Errorf("migrate schema: %w", err)
+	}
+
+	result := &SQLite{db: db, done: make(chan struct{})}
+	result.activateCleaner(cleanupDuration)
+	return result, nil
+}
+
+// openSQLite opens database and configures connection pool and pragmas
+func openSQLite(ctx context.Context, dbFile string) (*sql.DB, error) {
 	db, err := sql.Open("sqlite", dbFile)
 	if err != nil {
 		return nil, fmt.Errorf("open sqlite: %w", err)
@@ -51,8 +71,6 @@ func NewSQLite(dbFile string, cleanupDuration time.Duration) (*SQLite, error) {
 	db.SetMaxOpenConns(1)
 	db.SetMaxIdleConns(1)
 
-	ctx := context.Background()
-
 	// configure sqlite for better performance
 	if _, err = db.ExecContext(ctx, "PRAGMA journal_mode=WAL"); err != nil {
 		_ = db.Close()
@@ -66,33 +84,7 @@ func NewSQLite(dbFile string, cleanupDuration time.Duration) (*SQLite, error) {
 		_ = db.Close()
 		return nil, fmt.Errorf("set busy timeout: %w", err)
 	}
-
-	// create table and index
-	schema := `
-		CREATE TABLE IF NOT EXISTS messages (
-			id TEXT PRIMARY KEY,
-			exp INTEGER NOT NULL,
-			data BLOB NOT NULL,
-			pin_hash TEXT NOT NULL,
-			errors INTEGER DEFAULT 0,
-			client_enc INTEGER NOT NULL DEFAULT 0
-		);
-		CREATE INDEX IF NOT EXISTS idx_messages_exp ON messages(exp);
-	`
-	if _, err = db.ExecContext(ctx, schema); err != nil {
-		_ = db.Close()
-		return nil, fmt.Errorf("create schema: %w", err)
-	}
-
-	// migrate existing databases: add client_enc column if missing
-	if err = migrateClientEnc(ctx, db); err != nil {
-		_ = db.Close()
-		return nil, fmt.Errorf("migrate client_enc: %w", err)
-	}
-
-	result := &SQLite{db: db, done: make(chan struct{})}
-	result.activateCleaner(cleanupDuration)
-	return result, nil
+	return db, nil
 }
 
 // Save stores message in the database
@@ -106,8 +98,9 @@ func (s *SQLite) Save(ctx context.Context, msg *Message) error {
 	}
 
 	_, err := s.db.ExecContext(ctx,
-		"INSERT INTO messages (id, exp, data, pin_hash, errors, client_enc) VALUES (?, ?, ?, ?, ?, ?)",
-		msg.Key, msg.Exp.Unix(), msg.Data, msg.PinHash, msg.Errors, clientEnc,
+		"INSERT INTO messages (id, exp, data, pin_hash, errors, client_enc, max_views, views, mgmt_hash, callback) "+
+			"VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		msg.Key, msg.Exp.Unix(), msg.Data, msg.PinHash, msg.Errors, clientEnc, msg.MaxViews, msg.Views, msg.MgmtHash, msg.Callback,
 	)
 	if err != nil {
 		log.Printf("[ERROR] failed to save message: %v", err)
@@ -121,15 +114,72 @@ func (s *SQLite) Save(ctx context.Context, msg *Message) error {
 func (s *SQLite) Load(ctx context.Context, key string) (*Message, error) {
 	s.lock.RLock()
 	defer s.lock.RUnlock()
+	return loadMessage(ctx, s.db, key)
+}
+
+// Consume loads message by key, checks it with verify func and removes it in a single transaction.
+// Message with views left is kept, and its views counter incremented instead.
+// If verify returns an error, the message is kept and returned along with that error.
+// Concurrent calls for the same key are serialized, so only one of them can consume the message,
+// others get ErrLoadRejected. Verify runs under the write lock and should be reasonably fast.
+func (s *SQLite) Consume(ctx context.Context, key string, verify func(msg *Message) error) (*Message, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		log.Printf("[ERROR] failed to begin transaction: %v", err)
+		return nil, ErrLoadRejected
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	msg, err := loadMessage(ctx, tx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = verify(msg); err != nil {
+		return msg, err
+	}
+
+	query := "DELETE FROM messages WHERE id = ?"
+	if !msg.lastView() {
+		query = "UPDATE messages SET views = views + 1 WHERE id = ?"
+	}
+	res, err := tx.ExecContext(ctx, query, key)
+	if err != nil {
+		log.Printf("[ERROR] failed to consume message: %v", err)
+		return nil, ErrLoadRejected
+	}
+	if count, _ := res.RowsAffected(); count != 1 {
+		log.Printf("[DEBUG] not found %s", key)
+		return nil, ErrLoadRejected
+	}
+	if err = tx.Commit(); err != nil {
+		log.Printf("[ERROR] failed to commit consume: %v", err)
+		return nil, ErrLoadRejected
+	}
+	logConsumed(msg)
+	msg.Views++
+	return msg, nil
+}
+
+// queryRower is implemented by both *sql.DB and *sql.Tx
+type queryRower interface {
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
 
+// loadMessage reads a single message by key with the given db or transaction
+func loadMessage(ctx context.Context, q queryRower, key string) (*Message, error) {
 	var msg Message
 	var expUnix int64
 	var clientEnc int
 
-	err := s.db.QueryRowContext(ctx,
-		"SELECT id, exp, data, pin_hash, errors, client_enc FROM messages WHERE id = ?",
+	err := q.QueryRowContext(ctx,
+		"SELECT id, exp, data, pin_hash, errors, client_enc, max_views, views, mgmt_hash, callback FROM messages WHERE id = ?",
 		key,
-	).Scan(&msg.Key, &expUnix, &msg.Data, &msg.PinHash, &msg.Errors, &clientEnc)
+	).Scan(&msg.Key, &expUnix, &msg.Data, &msg.PinHash, &msg.Errors, &clientEnc, &msg.MaxViews, &msg.Views, &msg.MgmtHash,
+		&msg.Callback)
 
 	if errors.Is(err, sql.ErrNoRows) {
 		log.Printf("[DEBUG] not found %s", key)
@@ -145,6 +195,28 @@ func (s *SQLite) Load(ctx context.Context, key string) (*Message, error) {
 	return &msg, nil
 }
 
+// queryKeys runs query returning a single id column
+func queryKeys(ctx context.Context, db *sql.DB, query string) ([]string, error) {
+	rows, err := db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("query keys: %w", err)
+	}
+	defer rows.Close()
+
+	keys := []string{}
+	for rows.Next() {
+		var key string
+		if err = rows.Scan(&key); err != nil {
+			return nil, fmt.Errorf("scan key: %w", err)
+		}
+		keys = append(keys, key)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("iterate keys: %w", err)
+	}
+	return keys, nil
+}
+
 // IncErr atomically increments the error count and returns new value
 func (s *SQLite) IncErr(ctx context.Context, key string) (int, error) {
 	s.lock.Lock()
@@ -182,6 +254,722 @@ func (s *SQLite) Remove(ctx context.Context, key string) error {
 	return nil
 }
 
+// Keys returns keys of all stored messages
+func (s *SQLite) Keys(ctx context.Context) ([]string, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return queryKeys(ctx, s.db, "SELECT id FROM messages ORDER BY id")
+}
+
+// UpdateData replaces message data, only if it is still equal to oldData.
+// Returns ErrLoadRejected if the message was consumed, removed or changed meanwhile.
+func (s *SQLite) UpdateData(ctx context.Context, key string, oldData, newData []byte) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	res, err := s.db.ExecContext(ctx, "UPDATE messages SET data = ? WHERE id = ? AND data = ?", newData, key, oldData)
+	if err != nil {
+		log.Printf("[ERROR] failed to update message: %v", err)
+		return fmt.Errorf("update message: %w", err)
+	}
+	if count, _ := res.RowsAffected(); count != 1 {
+		log.Printf("[DEBUG] not updated %s", key)
+		return ErrLoadRejected
+	}
+	return nil
+}
+
+// SaveTombstone inserts or replaces the message tombstone
+func (s *SQLite) SaveTombstone(ctx context.Context, t *Tombstone) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	var closed int64
+	if !t.Closed.IsZero() {
+		closed = t.Closed.Unix()
+	}
+	_, err := s.db.ExecContext(ctx, `INSERT OR REPLACE INTO tombstones
+		(id, mgmt_hash, state, created, exp, closed, purge, errors, views, max_views) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		t.Key, t.MgmtHash, t.State, t.Created.Unix(), t.Exp.Unix(), closed, t.Purge.Unix(), t.Errors, t.Views, t.MaxViews)
+	if err != nil {
+		log.Printf("[ERROR] failed to save tombstone: %v", err)
+		return fmt.Errorf("save tombstone: %w", err)
+	}
+	return nil
+}
+
+// UpdateTombstone applies the status change in one statement, ErrLoadRejected if the tombstone not found or purged
+func (s *SQLite) UpdateTombstone(ctx context.Context, key string, u TombstoneUpdate) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	res, err := s.db.ExecContext(ctx, `UPDATE tombstones SET views = MAX(views, ?), errors = MAX(errors, ?),
+		closed = CASE WHEN ? != '' AND state = ? THEN ? ELSE closed END,
+		purge = CASE WHEN ? != '' AND state = ? THEN ? ELSE purge END,
+		state = CASE WHEN ? != '' AND state = ? THEN ? ELSE state END
+		WHERE id = ? AND purge >= ?`, u.Views, u.Errors,
+		u.State, StateExpired, u.Closed.Unix(), u.State, StateExpired, u.Purge.Unix(), u.State, StateExpired, u.State,
+		key, time.Now().Unix())
+	if err != nil {
+		log.Printf("[ERROR] failed to update tombstone: %v", err)
+		return fmt.Errorf("update tombstone: %w", err)
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return ErrLoadRejected
+	}
+	return nil
+}
+
+// LoadTombstone retrieves tombstone by message key, ErrLoadRejected if not found or past purge time
+func (s *SQLite) LoadTombstone(ctx context.Context, key string) (*Tombstone, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	var t Tombstone
+	var created, exp, closed, purge int64
+	err := s.db.QueryRowContext(ctx, `SELECT id, mgmt_hash, state, created, exp, closed, purge, errors, views, max_views
+		FROM tombstones WHERE id = ? AND purge >= ?`, key, time.Now().Unix()).
+		Scan(&t.Key, &t.MgmtHash, &t.State, &created, &exp, &closed, &purge, &t.Errors, &t.Views, &t.MaxViews)
+	if errors.Is(err, sql.ErrNoRows) {
+		log.Printf("[DEBUG] tombstone not found %s", key)
+		return nil, ErrLoadRejected
+	}
+	if err != nil {
+		log.Printf("[ERROR] failed to load tombstone: %v", err)
+		return nil, ErrLoadRejected
+	}
+
+	t.Created, t.Exp, t.Purge = time.Unix(created, 0), time.Unix(exp, 0), time.Unix(purge, 0)
+	if closed != 0 {
+		t.Closed = time.Unix(closed, 0)
+	}
+	return &t, nil
+}
+
+// SaveToken inserts a new token, ErrSaveRejected if the id is taken
+func (s *SQLite) SaveToken(ctx context.Context, t *Token) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	_, err := s.db.ExecContext(ctx, `INSERT INTO tokens (id, name, hash, scopes, max_exp, created, last_used)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`, t.ID, t.Name, t.Hash, strings.Join(t.Scopes, ","), int64(t.MaxExp.Seconds()),
+		t.Created.Unix(), unixOrZero(t.LastUsed))
+	if err != nil {
+		log.Printf("[ERROR] failed to save token: %v", err)
+		return ErrSaveRejected
+	}
+	return nil
+}
+
+// LoadToken retrieves token by id, ErrLoadRejected if not found
+func (s *SQLite) LoadToken(ctx context.Context, id string) (*Token, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	t, err := scanToken(s.db.QueryRowContext(ctx, `SELECT id, name, hash, scopes, max_exp, created, last_used
+		FROM tokens WHERE id = ?`, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		log.Printf("[DEBUG] token not found %s", id)
+		return nil, ErrLoadRejected
+	}
+	if err != nil {
+		log.Printf("[ERROR] failed to load token: %v", err)
+		return nil, ErrLoadRejected
+	}
+	return t, nil
+}
+
+// ListTokens returns all tokens, oldest first
+func (s *SQLite) ListTokens(ctx context.Context) ([]Token, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	rows, err := s.db.QueryContext(ctx, `SELECT id, name, hash, scopes, max_exp, created, last_used
+		FROM tokens ORDER BY created, id`)
+	if err != nil {
+		return nil, fmt.Errorf("query tokens: %w", err)
+	}
+	defer rows.Close()
+
+	res := []Token{}
+	for rows.Next() {
+		t, err := scanToken(rows)
+		if err != nil {
+			return nil, fmt.Errorf("scan token: %w", err)
+		}
+		res = append(res, *t)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("iterate tokens: %w", err)
+	}
+	return res, nil
+}
+
+// RemoveToken deletes token by id, ErrLoadRejected if not found
+func (s *SQLite) RemoveToken(ctx context.Context, id string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	res, err := s.db.ExecContext(ctx, "DELETE FROM tokens WHERE id = ?", id)
+	if err != nil {
+		log.Printf("[ERROR] failed to remove token: %v", err)
+		return fmt.Errorf("remove token: %w", err)
+	}
+	if count, _ := res.RowsAffected(); count != 1 {
+		return ErrLoadRejected
+	}
+	return nil
+}
+
+// TouchToken sets last used time of the token
+func (s *SQLite) TouchToken(ctx context.Context, id string, ts time.Time) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if _, err := s.db.ExecContext(ctx, "UPDATE tokens SET last_used = ? WHERE id = ?", ts.Unix(), id); err != nil {
+		log.Printf("[ERROR] failed to update token: %v", err)
+		return fmt.Errorf("update token: %w", err)
+	}
+	return nil
+}
+
+// scanToken makes Token from a row of tokens table, times stored as unix seconds
+func scanToken(row interface{ Scan(dest ...any) error }) (*Token, error) {
+	var t Token
+	var scopes string
+	var maxExp, created, lastUsed int64
+	if err := row.Scan(&t.ID, &t.Name, &t.Hash, &scopes, &maxExp, &created, &lastUsed); err != nil {
+		return nil, err //nolint:wrapcheck // callers check for sql.ErrNoRows
+	}
+	t.Scopes = splitScopes(scopes)
+	t.MaxExp, t.Created = time.Duration(maxExp)*time.Second, time.Unix(created, 0)
+	if lastUsed != 0 {
+		t.LastUsed = time.Unix(lastUsed, 0)
+	}
+	return &t, nil
+}
+
+// SaveUser inserts the user or replaces the existing one with the same name
+func (s *SQLite) SaveUser(ctx context.Context, u *User) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	_, err := s.db.ExecContext(ctx, "INSERT OR REPLACE INTO users (name, hash, created) VALUES (?, ?, ?)",
+		u.Name, u.Hash, u.Created.Unix())
+	if err != nil {
+		log.Printf("[ERROR] failed to save user: %v", err)
+		return ErrSaveRejected
+	}
+	return nil
+}
+
+// LoadUser retrieves user by name, ErrLoadRejected if not found
+func (s *SQLite) LoadUser(ctx context.Context, name string) (*User, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	var u User
+	var created int64
+	err := s.db.QueryRowContext(ctx, "SELECT name, hash, created FROM users WHERE name = ?", name).
+		Scan(&u.Name, &u.Hash, &created)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrLoadRejected
+	}
+	if err != nil {
+		log.Printf("[ERROR] failed to load user: %v", err)
+		return nil, ErrLoadRejected
+	}
+	u.Created = time.Unix(created, 0)
+	return &u, nil
+}
+
+// ListUsers returns all users ordered by name
+func (s *SQLite) ListUsers(ctx context.Context) ([]User, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	rows, err := s.db.QueryContext(ctx, "SELECT name, hash, created FROM users ORDER BY name")
+	if err != nil {
+		return nil, fmt.Errorf("query users: %w", err)
+	}
+	defer rows.Close()
+
+	res := []User{}
+	for rows.Next() {
+		var u User
+		var created int64
+		if err := rows.Scan(&u.Name, &u.Hash, &created); err != nil {
+			return nil, fmt.Errorf("scan user: %w", err)
+		}
+		u.Created = time.Unix(created, 0)
+		res = append(res, u)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("iterate users: %w", err)
+	}
+	return res, nil
+}
+
+// RemoveUser deletes user by name, ErrLoadRejected if not found
+func (s *SQLite) RemoveUser(ctx context.Context, name string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	res, err := s.db.ExecContext(ctx, "DELETE FROM users WHERE name = ?", name)
+	if err != nil {
+		log.Printf("[ERROR] failed to remove user: %v", err)
+		return fmt.Errorf("remove user: %w", err)
+	}
+	if count, _ := res.RowsAffected(); count != 1 {
+		return ErrLoadRejected
+	}
+	return nil
+}
+
+// SaveSession inserts a new session, ErrSaveRejected if the id is taken
+func (s *SQLite) SaveSession(ctx context.Context, sess *Session) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	_, err := s.db.ExecContext(ctx, `INSERT INTO sessions (id, hash, username, ip, user_agent, created, last_seen, expires)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`, sess.ID, sess.Hash, sess.User, sess.IP, sess.UserAgent, sess.Created.Unix(),
+		sess.LastSeen.Unix(), sess.Expires.Unix())
+	if err != nil {
+		log.Printf("[ERROR] failed to save session: %v", err)
+		return ErrSaveRejected
+	}
+	return nil
+}
+
+// LoadSession retrieves session by id, ErrLoadRejected if not found or expired
+func (s *SQLite) LoadSession(ctx context.Context, id string) (*Session, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	sess, err := scanSession(s.db.QueryRowContext(ctx, `SELECT id, hash, username, ip, user_agent, created, last_seen, expires
+		FROM sessions WHERE id = ? AND expires >= ?`, id, time.Now().Unix()))
+	if errors.Is(err, sql.ErrNoRows) {
+		log.Printf("[DEBUG] session not found %s", id)
+		return nil, ErrLoadRejected
+	}
+	if err != nil {
+		log.Printf("[ERROR] failed to load session: %v", err)
+		return nil, ErrLoadRejected
+	}
+	return sess, nil
+}
+
+// ListSessions returns all active sessions, oldest first
+func (s *SQLite) ListSessions(ctx context.Context) ([]Session, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	rows, err := s.db.QueryContext(ctx, `SELECT id, hash, username, ip, user_agent, created, last_seen, expires
+		FROM sessions WHERE expires >= ? ORDER BY created, id`, time.Now().Unix())
+	if err != nil {
+		return nil, fmt.Errorf("query sessions: %w", err)
+	}
+	defer rows.Close()
+
+	res := []Session{}
+	for rows.Next() {
+		sess, err := scanSession(rows)
+		if err != nil {
+			return nil, fmt.Errorf("scan session: %w", err)
+		}
+		res = append(res, *sess)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("iterate sessions: %w", err)
+	}
+	return res, nil
+}
+
+// TouchSession sets last seen and expiration time of the session
+func (s *SQLite) TouchSession(ctx context.Context, id string, lastSeen, expires time.Time) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if _, err := s.db.ExecContext(ctx, "UPDATE sessions SET last_seen = ?, expires = ? WHERE id = ?",
+		lastSeen.Unix(), expires.Unix(), id); err != nil {
+		log.Printf("[ERROR] failed to update session: %v", err)
+		return fmt.Errorf("update session: %w", err)
+	}
+	return nil
+}
+
+// RemoveSession deletes session by id, ErrLoadRejected if not found
+func (s *SQLite) RemoveSession(ctx context.Context, id string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	res, err := s.db.ExecContext(ctx, "DELETE FROM sessions WHERE id = ?", id)
+	if err != nil {
+		log.Printf("[ERROR] failed to remove session: %v", err)
+		return fmt.Errorf("remove session: %w", err)
+	}
+	if count, _ := res.RowsAffected(); count != 1 {
+		return ErrLoadRejected
+	}
+	return nil
+}
+
+// RemoveSessions deletes all sessions and returns the number of removed ones
+func (s *SQLite) RemoveSessions(ctx context.Context) (int, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	res, err := s.db.ExecContext(ctx, "DELETE FROM sessions")
+	if err != nil {
+		log.Printf("[ERROR] failed to remove sessions: %v", err)
+		return 0, fmt.Errorf("remove sessions: %w", err)
+	}
+	count, _ := res.RowsAffected()
+	return int(count), nil
+}
+
+// scanSession makes Session from a row of sessions table, times stored as unix seconds
+func scanSession(row interface{ Scan(dest ...any) error }) (*Session, error) {
+	var sess Session
+	var created, lastSeen, expires int64
+	if err := row.Scan(&sess.ID, &sess.Hash, &sess.User, &sess.IP, &sess.UserAgent, &created, &lastSeen, &expires); err != nil {
+		return nil, err //nolint:wrapcheck // callers check for sql.ErrNoRows
+	}
+	sess.Created, sess.LastSeen, sess.Expires = time.Unix(created, 0), time.Unix(lastSeen, 0), time.Unix(expires, 0)
+	return &sess, nil
+}
+
+// IncFailures counts a failed login attempt with the key and returns the updated counter.
+// Counter past its expiration starts over from 1.
+func (s *SQLite) IncFailures(ctx context.Context, key string, ts, expires time.Time) (*Failures, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	f := Failures{Key: key, Last: time.Unix(ts.Unix(), 0), Expires: time.Unix(expires.Unix(), 0)}
+	err := s.db.QueryRowContext(ctx, `INSERT INTO auth_failures (id, failures, last_failure, expires) VALUES (?, 1, ?, ?)
+		ON CONFLICT(id) DO UPDATE SET
+			failures = CASE WHEN auth_failures.expires < excluded.last_failure THEN 1 ELSE auth_failures.failures + 1 END,
+			last_failure = excluded.last_failure, expires = excluded.expires
+		RETURNING failures`, key, ts.Unix(), expires.Unix()).Scan(&f.Count)
+	if err != nil {
+		log.Printf("[ERROR] failed to count auth failure: %v", err)
+		return nil, fmt.Errorf("count auth failure: %w", err)
+	}
+	return &f, nil
+}
+
+// LoadFailures retrieves failed login attempts counter by key, ErrLoadRejected if not found or expired
+func (s *SQLite) LoadFailures(ctx context.Context, key string) (*Failures, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	f := Failures{Key: key}
+	var last, expires int64
+	err := s.db.QueryRowContext(ctx, "SELECT failures, last_failure, expires FROM auth_failures WHERE id = ? AND expires >= ?",
+		key, time.Now().Unix()).Scan(&f.Count, &last, &expires)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrLoadRejected
+	}
+	if err != nil {
+		log.Printf("[ERROR] failed to load auth failures: %v", err)
+		return nil, ErrLoadRejected
+	}
+	f.Last, f.Expires = time.Unix(last, 0), time.Unix(expires, 0)
+	return &f, nil
+}
+
+// RemoveFailures deletes failed login attempts counter by key, ErrLoadRejected if not found
+func (s *SQLite) RemoveFailures(ctx context.Context, key string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	res, err := s.db.ExecContext(ctx, "DELETE FROM auth_failures WHERE id = ?", key)
+	if err != nil {
+		log.Printf("[ERROR] failed to remove auth failures: %v", err)
+		return fmt.Errorf("remove auth failures: %w", err)
+	}
+	if count, _ := res.RowsAffected(); count != 1 {
+		return ErrLoadRejected
+	}
+	return nil
+}
+
+// SaveTOTP stores second factor of the user along with its recovery codes, replacing existing one
+func (s *SQLite) SaveTOTP(ctx context.Context, t *TOTP) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		log.Printf("[ERROR] failed to begin transaction: %v", err)
+		return ErrSaveRejected
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	if _, err = tx.ExecContext(ctx, "INSERT OR REPLACE INTO totp (username, secret, last_step, created) VALUES (?, ?, ?, ?)",
+		t.User, t.Secret, t.LastStep, t.Created.Unix()); err != nil {
+		log.Printf("[ERROR] failed to save totp: %v", err)
+		return ErrSaveRejected
+	}
+	if _, err = tx.ExecContext(ctx, "DELETE FROM totp_recovery WHERE username = ?", t.User); err != nil {
+		log.Printf("[ERROR] failed to replace recovery codes: %v", err)
+		return ErrSaveRejected
+	}
+	for _, h := range t.Recovery {
+		if _, err = tx.ExecContext(ctx, "INSERT INTO totp_recovery (username, hash) VALUES (?, ?)", t.User, h); err != nil {
+			log.Printf("[ERROR] failed to save recovery code: %v", err)
+			return ErrSaveRejected
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		log.Printf("[ERROR] failed to commit totp: %v", err)
+		return ErrSaveRejected
+	}
+	return nil
+}
+
+// LoadTOTP retrieves second factor of the user, ErrLoadRejected if not enrolled.
+// Unlike other loads it returns store errors as is, so the caller can tell them from missing second factor.
+func (s *SQLite) LoadTOTP(ctx context.Context, user string) (*TOTP, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	t := TOTP{User: user, Recovery: []string{}}
+	var created int64
+	err := s.db.QueryRowContext(ctx, "SELECT secret, last_step, created FROM totp WHERE username = ?", user).
+		Scan(&t.Secret, &t.LastStep, &created)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrLoadRejected
+	}
+	if err != nil {
+		return nil, fmt.Errorf("load totp: %w", err)
+	}
+	t.Created = time.Unix(created, 0)
+
+	rows, err := s.db.QueryContext(ctx, "SELECT hash FROM totp_recovery WHERE username = ? ORDER BY hash", user)
+	if err != nil {
+		return nil, fmt.Errorf("load recovery codes: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var h string
+		if err = rows.Scan(&h); err != nil {
+			return nil, fmt.Errorf("scan recovery code: %w", err)
+		}
+		t.Recovery = append(t.Recovery, h)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("load recovery codes: %w", err)
+	}
+	return &t, nil
+}
+
+// RemoveTOTP deletes second factor of the user with its recovery codes, ErrLoadRejected if not enrolled
+func (s *SQLite) RemoveTOTP(ctx context.Context, user string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if _, err := s.db.ExecContext(ctx, "DELETE FROM totp_recovery WHERE username = ?", user); err != nil {
+		log.Printf("[ERROR] failed to remove recovery codes: %v", err)
+		return fmt.Errorf("remove recovery codes: %w", err)
+	}
+	res, err := s.db.ExecContext(ctx, "DELETE FROM totp WHERE username = ?", user)
+	if err != nil {
+		log.Printf("[ERROR] failed to remove totp: %v", err)
+		return fmt.Errorf("remove totp: %w", err)
+	}
+	if count, _ := res.RowsAffected(); count != 1 {
+		return ErrLoadRejected
+	}
+	return nil
+}
+
+// UseTOTPStep marks time step of accepted code as used. ErrSaveRejected if this or a later step is used already,
+// so the same code can't be accepted twice.
+func (s *SQLite) UseTOTPStep(ctx context.Context, user string, step int64) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	res, err := s.db.ExecContext(ctx, "UPDATE totp SET last_step = ? WHERE username = ? AND last_step < ?", step, user, step)
+	if err != nil {
+		log.Printf("[ERROR] failed to update totp step: %v", err)
+		return ErrSaveRejected
+	}
+	if count, _ := res.RowsAffected(); count != 1 {
+		return ErrSaveRejected
+	}
+	return nil
+}
+
+// UseRecoveryCode removes recovery code by its hash, ErrLoadRejected if the code is unknown or used already
+func (s *SQLite) UseRecoveryCode(ctx context.Context, user, hash string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	res, err := s.db.ExecContext(ctx, "DELETE FROM totp_recovery WHERE username = ? AND hash = ?", user, hash)
+	if err != nil {
+		log.Printf("[ERROR] failed to use recovery code: %v", err)
+		return ErrLoadRejected
+	}
+	if count, _ := res.RowsAffected(); count != 1 {
+		return ErrLoadRejected
+	}
+	return nil
+}
+
+// SavePasskey inserts the passkey or replaces the existing one with the same id
+func (s *SQLite) SavePasskey(ctx context.Context, p *Passkey) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	_, err := s.db.ExecContext(ctx, `INSERT OR REPLACE INTO passkeys (id, username, name, credential, created, last_used)
+		VALUES (?, ?, ?, ?, ?, ?)`, p.ID, p.User, p.Name, p.Credential, p.Created.Unix(), unixOrZero(p.LastUsed))
+	if err != nil {
+		log.Printf("[ERROR] failed to save passkey: %v", err)
+		return ErrSaveRejected
+	}
+	return nil
+}
+
+// LoadPasskey retrieves passkey by credential id, ErrLoadRejected if not found
+func (s *SQLite) LoadPasskey(ctx context.Context, id string) (*Passkey, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	p, err := scanPasskey(s.db.QueryRowContext(ctx, `SELECT id, username, name, credential, created, last_used
+		FROM passkeys WHERE id = ?`, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		log.Printf("[DEBUG] passkey not found %s", id)
+		return nil, ErrLoadRejected
+	}
+	if err != nil {
+		log.Printf("[ERROR] failed to load passkey: %v", err)
+		return nil, ErrLoadRejected
+	}
+	return p, nil
+}
+
+// ListPasskeys returns passkeys of the user, or of all users if empty, oldest first
+func (s *SQLite) ListPasskeys(ctx context.Context, user string) ([]Passkey, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	rows, err := s.db.QueryContext(ctx, `SELECT id, username, name, credential, created, last_used
+		FROM passkeys WHERE ? = '' OR username = ? ORDER BY created, id`, user, user)
+	if err != nil {
+		return nil, fmt.Errorf("query passkeys: %w", err)
+	}
+	defer rows.Close()
+
+	res := []Passkey{}
+	for rows.Next() {
+		p, err := scanPasskey(rows)
+		if err != nil {
+			return nil, fmt.Errorf("scan passkey: %w", err)
+		}
+		res = append(res, *p)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("iterate passkeys: %w", err)
+	}
+	return res, nil
+}
+
+// RemovePasskey deletes passkey by credential id, ErrLoadRejected if not found
+func (s *SQLite) RemovePasskey(ctx context.Context, id string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	res, err := s.db.ExecContext(ctx, "DELETE FROM passkeys WHERE id = ?", id)
+	if err != nil {
+		log.Printf("[ERROR] failed to remove passkey: %v", err)
+		return fmt.Errorf("remove passkey: %w", err)
+	}
+	if count, _ := res.RowsAffected(); count != 1 {
+		return ErrLoadRejected
+	}
+	return nil
+}
+
+// scanPasskey makes Passkey from a row of passkeys table, times stored as unix seconds
+func scanPasskey(row interface{ Scan(dest ...any) error }) (*Passkey, error) {
+	var p Passkey
+	var created, lastUsed int64
+	if err := row.Scan(&p.ID, &p.User, &p.Name, &p.Credential, &created, &lastUsed); err != nil {
+		return nil, err //nolint:wrapcheck // callers check for sql.ErrNoRows
+	}
+	p.Created = time.Unix(created, 0)
+	if lastUsed != 0 {
+		p.LastUsed = time.Unix(lastUsed, 0)
+	}
+	return &p, nil
+}
+
+// SavePasskeySetup stores a new passkey setup link, ErrSaveRejected if the hash is taken
+func (s *SQLite) SavePasskeySetup(ctx context.Context, ps *PasskeySetup) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if _, err := s.db.ExecContext(ctx, "INSERT INTO passkey_setup (hash, username, expires) VALUES (?, ?, ?)",
+		ps.Hash, ps.User, ps.Expires.Unix()); err != nil {
+		log.Printf("[ERROR] failed to save passkey setup: %v", err)
+		return ErrSaveRejected
+	}
+	return nil
+}
+
+// LoadPasskeySetup retrieves passkey setup link by hash, ErrLoadRejected if not found or expired
+func (s *SQLite) LoadPasskeySetup(ctx context.Context, hash string) (*PasskeySetup, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	ps := PasskeySetup{Hash: hash}
+	var expires int64
+	err := s.db.QueryRowContext(ctx, "SELECT username, expires FROM passkey_setup WHERE hash = ? AND expires >= ?",
+		hash, time.Now().Unix()).Scan(&ps.User, &expires)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrLoadRejected
+	}
+	if err != nil {
+		log.Printf("[ERROR] failed to load passkey setup: %v", err)
+		return nil, ErrLoadRejected
+	}
+	ps.Expires = time.Unix(expires, 0)
+	return &ps, nil
+}
+
+// RemovePasskeySetup deletes passkey setup link by hash, ErrLoadRejected if not found or expired,
+// so only one of concurrent registrations with the same link succeeds
+func (s *SQLite) RemovePasskeySetup(ctx context.Context, hash string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	res, err := s.db.ExecContext(ctx, "DELETE FROM passkey_setup WHERE hash = ? AND expires >= ?", hash, time.Now().Unix())
+	if err != nil {
+		log.Printf("[ERROR] failed to remove passkey setup: %v", err)
+		return fmt.Errorf("remove passkey setup: %w", err)
+	}
+	if count, _ := res.RowsAffected(); count != 1 {
+		return ErrLoadRejected
+	}
+	return nil
+}
+
+// unixOrZero returns unix seconds of the time, 0 for zero time
+func unixOrZero(ts time.Time) int64 {
+	if ts.IsZero() {
+		return 0
+	}
+	return ts.Unix()
+}
+
+// OnExpired sets fn called for each message removed by cleaner on expiration
+func (s *SQLite) OnExpired(fn ExpiredFunc) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.onExpired = fn
+}
+
 // Close closes the database connection and stops the cleaner goroutine
 func (s *SQLite) Close() error {
 	close(s.done)
@@ -192,7 +980,49 @@ func (s *SQLite) Close() error {
 	return nil
 }
 
-// activateCleaner runs periodic cleanup of expired messages
+// cleanup removes expired messages, sessions, auth failures, passkey setup links and tombstones past purge time,
+// returns removed messages without data.
+// Caller should hold the write lock.
+func (s *SQLite) cleanup(ctx context.Context) ([]*Message, error) {
+	rows, err := s.db.QueryContext(ctx, "DELETE FROM messages WHERE exp < ? RETURNING id, exp, callback", time.Now().Unix())
+	if err != nil {
+		return nil, fmt.Errorf("delete expired: %w", err)
+	}
+	defer rows.Close()
+
+	expired := []*Message{}
+	for rows.Next() {
+		var msg Message
+		var expUnix int64
+		if err = rows.Scan(&msg.Key, &expUnix, &msg.Callback); err != nil {
+			return nil, fmt.Errorf("scan expired: %w", err)
+		}
+		msg.Exp = time.Unix(expUnix, 0)
+		expired = append(expired, &msg)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("iterate expired: %w", err)
+	}
+	if err = rows.Close(); err != nil {
+		return nil, fmt.Errorf("close expired rows: %w", err)
+	}
+
+	if _, err = s.db.ExecContext(ctx, "DELETE FROM tombstones WHERE purge < ?", time.Now().Unix()); err != nil {
+		return nil, fmt.Errorf("delete tombstones: %w", err)
+	}
+	if _, err = s.db.ExecContext(ctx, "DELETE FROM sessions WHERE expires < ?", time.Now().Unix()); err != nil {
+		return nil, fmt.Errorf("delete sessions: %w", err)
+	}
+	if _, err = s.db.ExecContext(ctx, "DELETE FROM auth_failures WHERE expires < ?", time.Now().Unix()); err != nil {
+		return nil, fmt.Errorf("delete auth failures: %w", err)
+	}
+	if _, err = s.db.ExecContext(ctx, "DELETE FROM passkey_setup WHERE expires < ?", time.Now().Unix()); err != nil {
+		return nil, fmt.Errorf("delete passkey setup: %w", err)
+	}
+	return expired, nil
+}
+
+// activateCleaner runs periodic cleanup of expired messages and tombstones past purge time
 func (s *SQLite) activateCleaner(every time.Duration) {
 	log.Printf("[INFO] cleaner activated, every %v", every)
 
@@ -207,53 +1037,22 @@ func (s *SQLite) activateCleaner(every time.Duration) {
 				return
 			case <-ticker.C:
 				s.lock.Lock()
-				result, err := s.db.ExecContext(context.Background(), "DELETE FROM messages WHERE exp < ?", time.Now().Unix())
+				expired, err := s.cleanup(context.Background())
+				onExpired := s.onExpired
 				s.lock.Unlock()
 				if err != nil {
 					log.Printf("[WARN] cleanup failed: %v", err)
 					continue
 				}
-				if count, _ := result.RowsAffected(); count > 0 {
-					log.Printf("[INFO] cleaned %d expired messages", count)
+				if len(expired) > 0 {
+					log.Printf("[INFO] cleaned %d expired messages", len(expired))
+				}
+				if onExpired != nil {
+					for _, msg := range expired {
+						onExpired(msg)
+					}
 				}
 			}
 		}
 	}()
 }
-
-// migrateClientEnc adds client_enc column to existing databases
-func migrateClientEnc(ctx context.Context, db *sql.DB) error {
-	// check if column exists using PRAGMA table_info
-	rows, err := db.QueryContext(ctx, "PRAGMA table_info(messages)")
-	if err != nil {
-		return fmt.Errorf("query table info: %w", err)
-	}
-	defer rows.Close()
-
-	hasClientEnc := false
-	for rows.Next() {
-		var cid int
-		var name, typ string
-		var notNull, pk int
-		var dfltValue sql.NullString
-		if err := rows.Scan(&cid, &name, &typ, &notNull, &dfltValue, &pk); err != nil {
-			return fmt.Errorf("scan table info: %w", err)
-		}
-		if name == "client_enc" {
-			hasClientEnc = true
-			break
-		}
-	}
-	if err := rows.Err(); err != nil {
-		return fmt.Errorf("iterate table info: %w", err)
-	}
-
-	if !hasClientEnc {
-		log.Printf("[INFO] migrating database: adding client_enc column")
-		_, err := db.ExecContext(ctx, "ALTER TABLE messages ADD COLUMN client_enc INTEGER NOT NULL DEFAULT 0")
-		if err != nil {
-			return fmt.Errorf("add client_enc column: %w", err)
-		}
-	}
-	return nil
-}
@@ -0,0 +1,344 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	log "github.com/go-pkgz/lgr"
+)
+
+// Migration is a versioned schema change of SQLite store, applied in its own transaction
+type Migration struct {
+	Version int
+	Name    string
+	apply   func(ctx context.Context, tx *sql.Tx) error
+}
+
+// sqliteMigrations lists all schema changes in order.
+// Never change or remove released entries, add a new one with the next version instead.
+var sqliteMigrations = []Migration{
+	{Version: 1, Name: "create messages table", apply: func(ctx context.Context, tx *sql.Tx) error {
+		_, err := tx.ExecContext(ctx, `
+			CREATE TABLE IF NOT EXISTS messages (
+				id TEXT PRIMARY KEY,
+				exp INTEGER NOT NULL,
+				data BLOB NOT NULL,
+				pin_hash TEXT NOT NULL,
+				errors INTEGER DEFAULT 0
+			);
+			CREATE INDEX IF NOT EXISTS idx_messages_exp ON messages(exp);
+		`)
+		if err != nil {
+			return fmt.Errorf("create messages table: %w", err)
+		}
+		return nil
+	}},
+	{Version: 2, Name: "add client_enc column", apply: func(ctx context.Context, tx *sql.Tx) error {
+		// databases created before schema versioning may have this column already
+		return addColumnIfMissing(ctx, tx, "messages", "client_enc", "INTEGER NOT NULL DEFAULT 0")
+	}},
+	{Version: 3, Name: "add max_views and views columns", apply: func(ctx context.Context, tx *sql.Tx) error {
+		if err := addColumnIfMissing(ctx, tx, "messages", "max_views", "INTEGER NOT NULL DEFAULT 1"); err != nil {
+			return err
+		}
+		return addColumnIfMissing(ctx, tx, "messages", "views", "INTEGER NOT NULL DEFAULT 0")
+	}},
+	{Version: 4, Name: "add mgmt_hash column", apply: func(ctx context.Context, tx *sql.Tx) error {
+		return addColumnIfMissing(ctx, tx, "messages", "mgmt_hash", "TEXT NOT NULL DEFAULT ''")
+	}},
+	{Version: 5, Name: "create tombstones table", apply: func(ctx context.Context, tx *sql.Tx) error {
+		_, err := tx.ExecContext(ctx, `
+			CREATE TABLE IF NOT EXISTS tombstones (
+				id TEXT PRIMARY KEY,
+				mgmt_hash TEXT NOT NULL,
+				state TEXT NOT NULL,
+				created INTEGER NOT NULL,
+				exp INTEGER NOT NULL,
+				closed INTEGER NOT NULL DEFAULT 0,
+				purge INTEGER NOT NULL,
+				errors INTEGER NOT NULL DEFAULT 0,
+				views INTEGER NOT NULL DEFAULT 0,
+				max_views INTEGER NOT NULL DEFAULT 1
+			);
+			CREATE INDEX IF NOT EXISTS idx_tombstones_purge ON tombstones(purge);
+		`)
+		if err != nil {
+			return fmt.Errorf("create tombstones table: %w", err)
+		}
+		return nil
+	}},
+	{Version: 6, Name: "add callback column", apply: func(ctx context.Context, tx *sql.Tx) error {
+		return addColumnIfMissing(ctx, tx, "messages", "callback", "TEXT NOT NULL DEFAULT ''")
+	}},
+	{Version: 7, Name: "create tokens table", apply: func(ctx context.Context, tx *sql.Tx) error {
+		_, err := tx.ExecContext(ctx, `
+			CREATE TABLE IF NOT EXISTS tokens (
+				id TEXT PRIMARY KEY,
+				name TEXT NOT NULL,
+				hash TEXT NOT NULL,
+				scopes TEXT NOT NULL,
+				max_exp INTEGER NOT NULL DEFAULT 0,
+				created INTEGER NOT NULL,
+				last_used INTEGER NOT NULL DEFAULT 0
+			);
+		`)
+		if err != nil {
+			return fmt.Errorf("create tokens table: %w", err)
+		}
+		return nil
+	}},
+	{Version: 8, Name: "create users table", apply: func(ctx context.Context, tx *sql.Tx) error {
+		_, err := tx.ExecContext(ctx, `
+			CREATE TABLE IF NOT EXISTS users (
+				name TEXT PRIMARY KEY,
+				hash TEXT NOT NULL,
+				created INTEGER NOT NULL
+			);
+		`)
+		if err != nil {
+			return fmt.Errorf("create users table: %w", err)
+		}
+		return nil
+	}},
+	{Version: 9, Name: "create sessions table", apply: func(ctx context.Context, tx *sql.Tx) error {
+		_, err := tx.ExecContext(ctx, `
+			CREATE TABLE IF NOT EXISTS sessions (
+				id TEXT PRIMARY KEY,
+				hash TEXT NOT NULL,
+				username TEXT NOT NULL,
+				ip TEXT NOT NULL,
+				user_agent TEXT NOT NULL,
+				created INTEGER NOT NULL,
+				last_seen INTEGER NOT NULL,
+				expires INTEGER NOT NULL
+			);
+			CREATE INDEX IF NOT EXISTS idx_sessions_expires ON sessions(expires);
+		`)
+		if err != nil {
+			return fmt.Errorf("create sessions table: %w", err)
+		}
+		return nil
+	}},
+	{Version: 10, Name: "create auth_failures table", apply: func(ctx context.Context, tx *sql.Tx) error {
+		_, err := tx.ExecContext(ctx, `
+			CREATE TABLE IF NOT EXISTS auth_failures (
+				id TEXT PRIMARY KEY,
+				failures INTEGER NOT NULL,
+				last_failure INTEGER NOT NULL,
+				expires INTEGER NOT NULL
+			);
+		`)
+		if err != nil {
+			return fmt.Errorf("create auth_failures table: %w", err)
+		}
+		return nil
+	}},
+	{Version: 11, Name: "create totp tables", apply: func(ctx context.Context, tx *sql.Tx) error {
+		_, err := tx.ExecContext(ctx, `
+			CREATE TABLE IF NOT EXISTS totp (
+				username TEXT PRIMARY KEY,
+				secret TEXT NOT NULL,
+				last_step INTEGER NOT NULL DEFAULT 0,
+				created INTEGER NOT NULL
+			);
+			CREATE TABLE IF NOT EXISTS totp_recovery (
+				username TEXT NOT NULL,
+				hash TEXT NOT NULL,
+				PRIMARY KEY (username, hash)
+			);
+		`)
+		if err != nil {
+			return fmt.Errorf("create totp tables: %w", err)
+		}
+		return nil
+	}},
+	{Version: 12, Name: "create passkey tables", apply: func(ctx context.Context, tx *sql.Tx) error {
+		_, err := tx.ExecContext(ctx, `
+			CREATE TABLE IF NOT EXISTS passkeys (
+				id TEXT PRIMARY KEY,
+				username TEXT NOT NULL,
+				name TEXT NOT NULL,
+				credential BLOB NOT NULL,
+				created INTEGER NOT NULL,
+				last_used INTEGER NOT NULL DEFAULT 0
+			);
+			CREATE INDEX IF NOT EXISTS idx_passkeys_username ON passkeys(username);
+			CREATE TABLE IF NOT EXISTS passkey_setup (
+				hash TEXT PRIMARY KEY,
+				username TEXT NOT NULL,
+				expires INTEGER NOT NULL
+			);
+		`)
+		if err != nil {
+			return fmt.Errorf("create passkey tables: %w", err)
+		}
+		return nil
+	}},
+}
+
+// MigrateSQLite applies pending migrations to sqlite database file and returns them.
+// With dryRun set, the database is opened read-only and pending migrations are returned without applying.
+func MigrateSQLite(ctx context.Context, dbFile string, dryRun bool) ([]Migration, error) {
+	if !dryRun {
+		db, err := openSQLite(ctx, dbFile)
+		if err != nil {
+			return nil, err
+		}
+		defer db.Close()
+		return migrateSQLite(ctx, db)
+	}
+
+	if _, err := os.Stat(dbFile); errors.Is(err, os.ErrNotExist) {
+		return sqliteMigrations, nil // new database, everything is pending
+	}
+	db, err := sql.Open("sqlite", "file:"+dbFile+"?mode=ro")
+	if err != nil {
+		return nil, fmt.Errorf("open sqlite: %w", err)
+	}
+	defer db.Close()
+
+	version, err := sqliteSchemaVersion(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+	return pendingMigrations(version), nil
+}
+
+// BackupSQLite writes a copy of sqlite database file to <dbFile>.bak-v<N>, with N of its current schema version,
+// and returns the copy path. Empty path returned for a missing file, as there is nothing to keep.
+// An existing copy is never overwritten, the call fails instead.
+func BackupSQLite(ctx context.Context, dbFile string) (string, error) {
+	if _, err := os.Stat(dbFile); errors.Is(err, os.ErrNotExist) {
+		return "", nil
+	}
+	db, err := openSQLite(ctx, dbFile)
+	if err != nil {
+		return "", err
+	}
+	defer db.Close()
+
+	version, err := sqliteSchemaVersion(ctx, db)
+	if err != nil {
+		return "", err
+	}
+	backup := fmt.Sprintf("%s.bak-v%d", dbFile, version)
+	if _, err = os.Stat(backup); err == nil {
+		return "", fmt.Errorf("backup %s already exists", backup)
+	}
+	if _, err = db.ExecContext(ctx, "VACUUM INTO ?", backup); err != nil {
+		return "", fmt.Errorf("write backup %s: %w", backup, err)
+	}
+	return backup, nil
+}
+
+// migrateSQLite brings db schema to the latest version, each migration runs in a separate transaction
+// and is recorded in schema_version table. A failed migration is rolled back and stops the process.
+func migrateSQLite(ctx context.Context, db *sql.DB) ([]Migration, error) {
+	if _, err := db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_version (
+			version INTEGER PRIMARY KEY,
+			name TEXT NOT NULL,
+			applied_at INTEGER NOT NULL
+		)`); err != nil {
+		return nil, fmt.Errorf("create schema_version table: %w", err)
+	}
+
+	version, err := sqliteSchemaVersion(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+
+	pending := pendingMigrations(version)
+	for i, m := range pending {
+		log.Printf("[INFO] applying sqlite migration %d: %s", m.Version, m.Name)
+		if err := applyMigration(ctx, db, m); err != nil {
+			return pending[:i], fmt.Errorf("migration %d (%s): %w", m.Version, m.Name, err)
+		}
+	}
+	return pending, nil
+}
+
+// applyMigration runs a single migration and records it in schema_version in the same transaction
+func applyMigration(ctx context.Context, db *sql.DB, m Migration) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("begin transaction: %w", err)
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	if err = m.apply(ctx, tx); err != nil {
+		return err
+	}
+	if _, err = tx.ExecContext(ctx, "INSERT INTO schema_version (version, name, applied_at) VALUES (?, ?, ?)",
+		m.Version, m.Name, time.Now().Unix()); err != nil {
+		return fmt.Errorf("record version: %w", err)
+	}
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("commit: %w", err)
+	}
+	return nil
+}
+
+// sqliteSchemaVersion returns the latest applied migration version, 0 for databases without schema_version table
+func sqliteSchemaVersion(ctx context.Context, db *sql.DB) (int, error) {
+	var exists int
+	if err := db.QueryRowContext(ctx,
+		"SELECT count(*) FROM sqlite_master WHERE type = 'table' AND name = 'schema_version'").Scan(&exists); err != nil {
+		return 0, fmt.Errorf("check schema_version table: %w", err)
+	}
+	if exists == 0 {
+		return 0, nil
+	}
+
+	var version int
+	if err := db.QueryRowContext(ctx, "SELECT COALESCE(MAX(version), 0) FROM schema_version").Scan(&version); err != nil {
+		return 0, fmt.Errorf("get schema version: %w", err)
+	}
+	return version, nil
+}
+
+// pendingMigrations returns migrations with version above the given one
+func pendingMigrations(version int) []Migration {
+	res := []Migration{}
+	for _, m := range sqliteMigrations {
+		if m.Version > version {
+			res = append(res, m)
+		}
+	}
+	return res
+}
+
+// addColumnIfMissing adds column to the table unless it is already there
+func addColumnIfMissing(ctx context.Context, tx *sql.Tx, table, column, definition string) error {
+	// check if column exists using PRAGMA table_info
+	rows, err := tx.QueryContext(ctx, "PRAGMA table_info("+table+")") //nolint:gosec // table name is a constant from migrations
+	if err != nil {
+		return fmt.Errorf("query table info: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var cid int
+		var name, typ string
+		var notNull, pk int
+		var dfltValue sql.NullString
+		if err := rows.Scan(&cid, &name, &typ, &notNull, &dfltValue, &pk); err != nil {
+			return fmt.Errorf("scan table info: %w", err)
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("iterate table info: %w", err)
+	}
+
+	//nolint:gosec // table, column and definition are constants from migrations
+	if _, err := tx.ExecContext(ctx, "ALTER TABLE "+table+" ADD COLUMN "+column+" "+definition); err != nil {
+		return fmt.Errorf("add %s column: %w", column, err)
+	}
+	return nil
+}
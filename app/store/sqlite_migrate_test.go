@@ -0,0 +1,182 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSQLite_Migrate_NewDB(t *testing.T) {
+	dbFile := "/tmp/test_sqlite_migrate_new.db"
+	_ = os.Remove(dbFile)
+	defer os.Remove(dbFile)
+
+	// dry run on missing file reports everything and doesn't create the file
+	pending, err := MigrateSQLite(t.Context(), dbFile, true)
+	require.NoError(t, err)
+	assert.Len(t, pending, len(sqliteMigrations))
+	_, err = os.Stat(dbFile)
+	require.ErrorIs(t, err, os.ErrNotExist)
+
+	s, err := NewSQLite(dbFile, time.Minute)
+	require.NoError(t, err)
+	version, err := sqliteSchemaVersion(t.Context(), s.db)
+	require.NoError(t, err)
+	assert.Equal(t, sqliteMigrations[len(sqliteMigrations)-1].Version, version)
+	require.NoError(t, s.Close())
+
+	// nothing pending after store created
+	pending, err = MigrateSQLite(t.Context(), dbFile, true)
+	require.NoError(t, err)
+	assert.Empty(t, pending)
+
+	applied, err := MigrateSQLite(t.Context(), dbFile, false)
+	require.NoError(t, err)
+	assert.Empty(t, applied)
+}
+
+func TestSQLite_Migrate_UnversionedDB(t *testing.T) {
+	dbFile := "/tmp/test_sqlite_migrate_unversioned.db"
+	_ = os.Remove(dbFile)
+	defer os.Remove(dbFile)
+
+	// database created before schema versioning, already with client_enc column
+	db, err := sql.Open("sqlite", dbFile)
+	require.NoError(t, err)
+	_, err = db.Exec(`
+		CREATE TABLE messages (
+			id TEXT PRIMARY KEY,
+			exp INTEGER NOT NULL,
+			data BLOB NOT NULL,
+			pin_hash TEXT NOT NULL,
+			errors INTEGER DEFAULT 0,
+			client_enc INTEGER NOT NULL DEFAULT 0
+		)
+	`)
+	require.NoError(t, err)
+	_, err = db.Exec("INSERT INTO messages (id, exp, data, pin_hash, errors, client_enc) VALUES (?, ?, ?, ?, ?, ?)",
+		"oldmsg", time.Now().Add(time.Hour).Unix(), []byte("old data"), "oldhash", 0, 1)
+	require.NoError(t, err)
+	require.NoError(t, db.Close())
+
+	// dry run lists all steps and changes nothing
+	pending, err := MigrateSQLite(t.Context(), dbFile, true)
+	require.NoError(t, err)
+	require.Len(t, pending, len(sqliteMigrations))
+	assert.Equal(t, 1, pending[0].Version)
+	assert.Equal(t, "add client_enc column", pending[1].Name)
+
+	db, err = sql.Open("sqlite", dbFile)
+	require.NoError(t, err)
+	version, err := sqliteSchemaVersion(t.Context(), db)
+	require.NoError(t, err)
+	assert.Zero(t, version, "dry run should not create schema_version")
+	require.NoError(t, db.Close())
+
+	// real run applies all, existing column is kept as is
+	applied, err := MigrateSQLite(t.Context(), dbFile, false)
+	require.NoError(t, err)
+	assert.Len(t, applied, len(sqliteMigrations))
+
+	s, err := NewSQLite(dbFile, time.Minute)
+	require.NoError(t, err)
+	defer s.Close()
+	loaded, err := s.Load(t.Context(), "oldmsg")
+	require.NoError(t, err)
+	assert.True(t, loaded.ClientEnc)
+	assert.Equal(t, 1, loaded.MaxViews, "old messages are single read")
+}
+
+func TestSQLite_Migrate_FailedRolledBack(t *testing.T) {
+	dbFile := "/tmp/test_sqlite_migrate_failed.db"
+	_ = os.Remove(dbFile)
+	defer os.Remove(dbFile)
+
+	s, err := NewSQLite(dbFile, time.Minute)
+	require.NoError(t, err)
+	require.NoError(t, s.Close())
+
+	orig := sqliteMigrations
+	defer func() { sqliteMigrations = orig }()
+	lastVersion := orig[len(orig)-1].Version
+	sqliteMigrations = append(append([]Migration{}, orig...),
+		Migration{Version: lastVersion + 1, Name: "good one", apply: func(ctx context.Context, tx *sql.Tx) error {
+			_, err := tx.ExecContext(ctx, "CREATE TABLE good_one (id TEXT)")
+			return err
+		}},
+		Migration{Version: lastVersion + 2, Name: "broken", apply: func(ctx context.Context, tx *sql.Tx) error {
+			if _, err := tx.ExecContext(ctx, "CREATE TABLE partial (id TEXT)"); err != nil {
+				return err
+			}
+			return errors.New("something went wrong")
+		}},
+	)
+
+	applied, err := MigrateSQLite(t.Context(), dbFile, false)
+	require.ErrorContains(t, err, "broken")
+	require.Len(t, applied, 1)
+	assert.Equal(t, "good one", applied[0].Name)
+
+	db, err := sql.Open("sqlite", dbFile)
+	require.NoError(t, err)
+	defer db.Close()
+	version, err := sqliteSchemaVersion(t.Context(), db)
+	require.NoError(t, err)
+	assert.Equal(t, lastVersion+1, version, "failed migration should not be recorded")
+
+	var count int
+	require.NoError(t, db.QueryRow("SELECT count(*) FROM sqlite_master WHERE type = 'table' AND name = 'partial'").Scan(&count))
+	assert.Zero(t, count, "changes of failed migration should be rolled back")
+
+	pending, err := MigrateSQLite(t.Context(), dbFile, true)
+	require.NoError(t, err)
+	require.Len(t, pending, 1)
+	assert.Equal(t, "broken", pending[0].Name)
+}
+
+func TestSQLite_Backup(t *testing.T) {
+	dbFile := "/tmp/test_sqlite_backup.db"
+	_ = os.Remove(dbFile)
+	defer os.Remove(dbFile)
+	version := sqliteMigrations[len(sqliteMigrations)-1].Version
+	backupFile := dbFile + ".bak-v" + strconv.Itoa(version)
+	_ = os.Remove(backupFile)
+	defer os.Remove(backupFile)
+
+	backup, err := BackupSQLite(t.Context(), dbFile)
+	require.NoError(t, err)
+	assert.Empty(t, backup, "nothing to back up for missing file")
+	_, err = os.Stat(dbFile)
+	require.ErrorIs(t, err, os.ErrNotExist)
+
+	s, err := NewSQLite(dbFile, time.Minute)
+	require.NoError(t, err)
+	_, err = s.db.Exec("INSERT INTO messages (id, exp, data, pin_hash) VALUES (?, ?, ?, ?)",
+		"msg", time.Now().Add(time.Hour).Unix(), []byte("data"), "hash")
+	require.NoError(t, err)
+	require.NoError(t, s.Close())
+
+	backup, err = BackupSQLite(t.Context(), dbFile)
+	require.NoError(t, err)
+	assert.Equal(t, backupFile, backup)
+
+	db, err := sql.Open("sqlite", "file:"+backup+"?mode=ro")
+	require.NoError(t, err)
+	defer db.Close()
+	backupVersion, err := sqliteSchemaVersion(t.Context(), db)
+	require.NoError(t, err)
+	assert.Equal(t, version, backupVersion)
+	var data []byte
+	require.NoError(t, db.QueryRow("SELECT data FROM messages WHERE id = ?", "msg").Scan(&data))
+	assert.Equal(t, []byte("data"), data)
+
+	_, err = BackupSQLite(t.Context(), dbFile)
+	require.ErrorContains(t, err, "already exists", "existing backup is not overwritten")
+}
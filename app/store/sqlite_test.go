@@ -125,6 +125,123 @@ func TestSQLite_IncErr_Concurrent(t *testing.T) {
 	assert.Equal(t, numGoroutines, loaded.Errors, "should have exactly %d errors after concurrent increments", numGoroutines)
 }
 
+func TestSQLite_Consume(t *testing.T) {
+	s := NewInMemory(time.Minute)
+	defer s.Close()
+
+	ctx := t.Context()
+	msg := Message{Key: "consumekey", Exp: time.Now().Add(time.Hour), Data: []byte("data"), PinHash: "hash"}
+	require.NoError(t, s.Save(ctx, &msg))
+
+	t.Run("verify rejects, message kept", func(t *testing.T) {
+		errVerify := errors.New("verify failed")
+		res, err := s.Consume(ctx, "consumekey", func(m *Message) error {
+			assert.Equal(t, []byte("data"), m.Data)
+			return errVerify
+		})
+		require.ErrorIs(t, err, errVerify)
+		require.NotNil(t, res)
+		assert.Equal(t, "consumekey", res.Key)
+
+		_, err = s.Load(ctx, "consumekey")
+		require.NoError(t, err, "message should stay after failed verification")
+	})
+
+	t.Run("verify passes, message removed", func(t *testing.T) {
+		res, err := s.Consume(ctx, "consumekey", func(*Message) error { return nil })
+		require.NoError(t, err)
+		assert.Equal(t, []byte("data"), res.Data)
+		assert.Equal(t, "hash", res.PinHash)
+
+		_, err = s.Load(ctx, "consumekey")
+		require.ErrorIs(t, err, ErrLoadRejected)
+	})
+
+	t.Run("not found", func(t *testing.T) {
+		called := false
+		_, err := s.Consume(ctx, "consumekey", func(*Message) error { called = true; return nil })
+		require.ErrorIs(t, err, ErrLoadRejected)
+		assert.False(t, called, "verify should not be called for missing message")
+	})
+}
+
+func TestSQLite_Consume_Concurrent(t *testing.T) {
+	dbFile := "/tmp/test_sqlite_consume_concurrent.db"
+	defer os.Remove(dbFile)
+
+	s, err := NewSQLite(dbFile, time.Minute)
+	require.NoError(t, err)
+	defer s.Close()
+
+	ctx := t.Context()
+	msg := Message{Key: "conckey", Exp: time.Now().Add(time.Hour), Data: []byte("data"), PinHash: "hash"}
+	require.NoError(t, s.Save(ctx, &msg))
+
+	const numGoroutines = 50
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	success, rejected := 0, 0
+	wg.Add(numGoroutines)
+
+	for range numGoroutines {
+		go func() {
+			defer wg.Done()
+			_, err := s.Consume(ctx, "conckey", func(*Message) error { return nil })
+			mu.Lock()
+			defer mu.Unlock()
+			if err == nil {
+				success++
+				return
+			}
+			if errors.Is(err, ErrLoadRejected) {
+				rejected++
+			}
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, 1, success, "exactly one consumer should get the message")
+	assert.Equal(t, numGoroutines-1, rejected, "all other consumers should be rejected")
+}
+
+func TestSQLite_Consume_MaxViews(t *testing.T) {
+	s := NewInMemory(time.Minute)
+	defer s.Close()
+
+	ctx := t.Context()
+	msg := Message{Key: "viewskey", Exp: time.Now().Add(time.Hour), Data: []byte("data"), PinHash: "hash", MaxViews: 3}
+	require.NoError(t, s.Save(ctx, &msg))
+
+	for i := 1; i <= 3; i++ {
+		res, err := s.Consume(ctx, "viewskey", func(*Message) error { return nil })
+		require.NoError(t, err)
+		assert.Equal(t, i, res.Views)
+		assert.Equal(t, 3, res.MaxViews)
+	}
+	_, err := s.Load(ctx, "viewskey")
+	require.ErrorIs(t, err, ErrLoadRejected, "message removed after the last view")
+
+	// concurrent readers get exactly the allowed number of views
+	require.NoError(t, s.Save(ctx, &Message{Key: "conckey", Exp: time.Now().Add(time.Hour), Data: []byte("data"),
+		PinHash: "hash", MaxViews: 3}))
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	success := 0
+	for range 20 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := s.Consume(ctx, "conckey", func(*Message) error { return nil }); err == nil {
+				mu.Lock()
+				success++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, 3, success)
+}
+
 func TestSQLite_Remove(t *testing.T) {
 	dbFile := "/tmp/test_sqlite_remove.db"
 	defer os.Remove(dbFile)
@@ -149,6 +266,359 @@ func TestSQLite_Remove(t *testing.T) {
 	assert.Equal(t, ErrLoadRejected, err)
 }
 
+func TestSQLite_KeysUpdateData(t *testing.T) {
+	dbFile := "/tmp/test_sqlite_keys.db"
+	defer os.Remove(dbFile)
+
+	s, err := NewSQLite(dbFile, time.Minute)
+	require.NoError(t, err)
+	defer s.Close()
+
+	ctx := t.Context()
+	keys, err := s.Keys(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, keys)
+
+	for _, key := range []string{"key2", "key1"} {
+		require.NoError(t, s.Save(ctx, &Message{Key: key, Exp: time.Now().Add(time.Hour), Data: []byte("data"), PinHash: "hash"}))
+	}
+	keys, err = s.Keys(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"key1", "key2"}, keys)
+
+	require.NoError(t, s.UpdateData(ctx, "key1", []byte("data"), []byte("new data")))
+	loaded, err := s.Load(ctx, "key1")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("new data"), loaded.Data)
+
+	require.ErrorIs(t, s.UpdateData(ctx, "key1", []byte("data"), []byte("other")), ErrLoadRejected, "data changed")
+	require.ErrorIs(t, s.UpdateData(ctx, "nonexistent", []byte("data"), []byte("other")), ErrLoadRejected)
+}
+
+func TestSQLite_Tombstone(t *testing.T) {
+	dbFile := "/tmp/test_sqlite_tombstone.db"
+	defer os.Remove(dbFile)
+
+	s, err := NewSQLite(dbFile, time.Millisecond*50)
+	require.NoError(t, err)
+	defer s.Close()
+
+	ctx := t.Context()
+	_, err = s.LoadTombstone(ctx, "key1")
+	require.ErrorIs(t, err, ErrLoadRejected)
+
+	now := time.Now().Truncate(time.Second)
+	ts := Tombstone{Key: "key1", MgmtHash: "hash", State: StateExpired, Created: now, Exp: now.Add(time.Hour),
+		Purge: now.Add(2 * time.Hour), MaxViews: 2}
+	require.NoError(t, s.SaveTombstone(ctx, &ts))
+	loaded, err := s.LoadTombstone(ctx, "key1")
+	require.NoError(t, err)
+	assert.Equal(t, ts, *loaded)
+
+	// replaced on the next save
+	ts.State, ts.Closed, ts.Errors, ts.Views = StateOpened, now.Add(time.Minute), 1, 2
+	require.NoError(t, s.SaveTombstone(ctx, &ts))
+	loaded, err = s.LoadTombstone(ctx, "key1")
+	require.NoError(t, err)
+	assert.Equal(t, ts, *loaded)
+
+	// tombstone past purge time not returned and cleaned
+	require.NoError(t, s.SaveTombstone(ctx, &Tombstone{Key: "key2", MgmtHash: "hash", State: StateBurned,
+		Created: now.Add(-time.Hour), Exp: now, Purge: now.Add(-time.Minute)}))
+	_, err = s.LoadTombstone(ctx, "key2")
+	require.ErrorIs(t, err, ErrLoadRejected)
+	require.Eventually(t, func() bool {
+		var count int
+		require.NoError(t, s.db.QueryRowContext(ctx, "SELECT count(*) FROM tombstones").Scan(&count))
+		return count == 1
+	}, time.Second, time.Millisecond*25, "purged tombstone should be cleaned up")
+}
+
+func TestSQLite_UpdateTombstone(t *testing.T) {
+	s := NewInMemory(time.Minute)
+	defer s.Close()
+	checkUpdateTombstone(t, s)
+}
+
+func TestSQLite_Token(t *testing.T) {
+	s := NewInMemory(time.Minute)
+	defer s.Close()
+
+	ctx := t.Context()
+	_, err := s.LoadToken(ctx, "id1")
+	require.ErrorIs(t, err, ErrLoadRejected)
+
+	now := time.Now().Truncate(time.Second)
+	tk1 := Token{ID: "id1", Name: "ci", Hash: "hash1", Scopes: []string{"create-text", "create-file"}, MaxExp: time.Hour,
+		Created: now}
+	tk2 := Token{ID: "id2", Name: "deploy", Hash: "hash2", Scopes: []string{}, Created: now.Add(time.Second)}
+	require.NoError(t, s.SaveToken(ctx, &tk2))
+	require.NoError(t, s.SaveToken(ctx, &tk1))
+	require.ErrorIs(t, s.SaveToken(ctx, &tk1), ErrSaveRejected, "id taken")
+
+	loaded, err := s.LoadToken(ctx, "id1")
+	require.NoError(t, err)
+	assert.Equal(t, tk1, *loaded)
+
+	require.NoError(t, s.TouchToken(ctx, "id2", now.Add(time.Minute)))
+	tk2.LastUsed = now.Add(time.Minute)
+	list, err := s.ListTokens(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []Token{tk1, tk2}, list)
+
+	require.NoError(t, s.RemoveToken(ctx, "id1"))
+	require.ErrorIs(t, s.RemoveToken(ctx, "id1"), ErrLoadRejected)
+	list, err = s.ListTokens(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []Token{tk2}, list)
+}
+
+func TestSQLite_User(t *testing.T) {
+	s := NewInMemory(time.Minute)
+	defer s.Close()
+
+	ctx := t.Context()
+	_, err := s.LoadUser(ctx, "bob")
+	require.ErrorIs(t, err, ErrLoadRejected)
+
+	now := time.Now().Truncate(time.Second)
+	require.NoError(t, s.SaveUser(ctx, &User{Name: "bob", Hash: "hash1", Created: now}))
+	require.NoError(t, s.SaveUser(ctx, &User{Name: "alice", Hash: "hash2", Created: now}))
+	require.NoError(t, s.SaveUser(ctx, &User{Name: "bob", Hash: "hash3", Created: now}), "replaces existing")
+
+	u, err := s.LoadUser(ctx, "bob")
+	require.NoError(t, err)
+	assert.Equal(t, "hash3", u.Hash)
+	assert.True(t, now.Equal(u.Created))
+
+	list, err := s.ListUsers(ctx)
+	require.NoError(t, err)
+	require.Len(t, list, 2)
+	assert.Equal(t, "alice", list[0].Name, "ordered by name")
+	assert.Equal(t, "bob", list[1].Name)
+
+	require.NoError(t, s.RemoveUser(ctx, "bob"))
+	require.ErrorIs(t, s.RemoveUser(ctx, "bob"), ErrLoadRejected)
+	_, err = s.LoadUser(ctx, "bob")
+	require.ErrorIs(t, err, ErrLoadRejected)
+}
+
+func TestSQLite_Session(t *testing.T) {
+	s := NewInMemory(time.Minute)
+	defer s.Close()
+
+	ctx := t.Context()
+	_, err := s.LoadSession(ctx, "id1")
+	require.ErrorIs(t, err, ErrLoadRejected)
+
+	now := time.Now().Truncate(time.Second)
+	s1 := Session{ID: "id1", Hash: "hash1", User: "secrets", IP: "iphash1", UserAgent: "curl/8.0", Created: now,
+		LastSeen: now, Expires: now.Add(time.Hour)}
+	s2 := Session{ID: "id2", Hash: "hash2", User: "bob", IP: "iphash2", UserAgent: "Mozilla/5.0", Created: now.Add(time.Second),
+		LastSeen: now.Add(time.Second), Expires: now.Add(time.Hour)}
+	expired := Session{ID: "id3", Hash: "hash3", User: "bob", Created: now.Add(-2 * time.Hour), LastSeen: now.Add(-2 * time.Hour),
+		Expires: now.Add(-time.Hour)}
+	for _, sess := range []Session{s2, s1, expired} {
+		require.NoError(t, s.SaveSession(ctx, &sess))
+	}
+	require.ErrorIs(t, s.SaveSession(ctx, &s1), ErrSaveRejected, "id taken")
+
+	loaded, err := s.LoadSession(ctx, "id1")
+	require.NoError(t, err)
+	assert.Equal(t, s1, *loaded)
+	_, err = s.LoadSession(ctx, "id3")
+	require.ErrorIs(t, err, ErrLoadRejected, "expired session")
+
+	require.NoError(t, s.TouchSession(ctx, "id2", now.Add(time.Minute), now.Add(2*time.Hour)))
+	s2.LastSeen, s2.Expires = now.Add(time.Minute), now.Add(2*time.Hour)
+	list, err := s.ListSessions(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []Session{s1, s2}, list, "oldest first, expired skipped")
+
+	_, err = s.cleanup(ctx)
+	require.NoError(t, err)
+	var count int
+	require.NoError(t, s.db.QueryRowContext(ctx, "SELECT count(*) FROM sessions").Scan(&count))
+	assert.Equal(t, 2, count, "expired session cleaned")
+
+	require.NoError(t, s.RemoveSession(ctx, "id1"))
+	require.ErrorIs(t, s.RemoveSession(ctx, "id1"), ErrLoadRejected)
+	require.NoError(t, s.SaveSession(ctx, &s1))
+	removed, err := s.RemoveSessions(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 2, removed)
+	list, err = s.ListSessions(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, list)
+}
+
+func TestSQLite_Failures(t *testing.T) {
+	s := NewInMemory(time.Minute)
+	defer s.Close()
+
+	ctx := t.Context()
+	_, err := s.LoadFailures(ctx, "ip:hash1")
+	require.ErrorIs(t, err, ErrLoadRejected)
+
+	now := time.Now().Truncate(time.Second)
+	for i := 1; i <= 3; i++ {
+		f, err := s.IncFailures(ctx, "ip:hash1", now.Add(time.Duration(i)*time.Second), now.Add(time.Hour))
+		require.NoError(t, err)
+		assert.Equal(t, i, f.Count)
+	}
+	f, err := s.LoadFailures(ctx, "ip:hash1")
+	require.NoError(t, err)
+	assert.Equal(t, Failures{Key: "ip:hash1", Count: 3, Last: now.Add(3 * time.Second), Expires: now.Add(time.Hour)}, *f)
+
+	// counter past expiration starts over
+	_, err = s.IncFailures(ctx, "global", now.Add(-2*time.Hour), now.Add(-time.Hour))
+	require.NoError(t, err)
+	_, err = s.LoadFailures(ctx, "global")
+	require.ErrorIs(t, err, ErrLoadRejected, "expired counter")
+	f, err = s.IncFailures(ctx, "global", now, now.Add(time.Hour))
+	require.NoError(t, err)
+	assert.Equal(t, 1, f.Count)
+
+	_, err = s.IncFailures(ctx, "ip:hash2", now.Add(-2*time.Hour), now.Add(-time.Hour))
+	require.NoError(t, err)
+	_, err = s.cleanup(ctx)
+	require.NoError(t, err)
+	var count int
+	require.NoError(t, s.db.QueryRowContext(ctx, "SELECT count(*) FROM auth_failures").Scan(&count))
+	assert.Equal(t, 2, count, "expired counter cleaned")
+
+	require.NoError(t, s.RemoveFailures(ctx, "ip:hash1"))
+	require.ErrorIs(t, s.RemoveFailures(ctx, "ip:hash1"), ErrLoadRejected)
+	_, err = s.LoadFailures(ctx, "ip:hash1")
+	require.ErrorIs(t, err, ErrLoadRejected)
+}
+
+func TestSQLite_TOTP(t *testing.T) {
+	s := NewInMemory(time.Minute)
+	defer s.Close()
+
+	ctx := t.Context()
+	_, err := s.LoadTOTP(ctx, "secrets")
+	require.ErrorIs(t, err, ErrLoadRejected)
+
+	now := time.Now().Truncate(time.Second)
+	require.NoError(t, s.SaveTOTP(ctx, &TOTP{User: "secrets", Secret: "OLDSECRET", Recovery: []string{"old1"}, LastStep: 5,
+		Created: now.Add(-time.Hour)}))
+	totp := TOTP{User: "secrets", Secret: "JBSWY3DPEHPK3PXP", Recovery: []string{"h1", "h2", "h3"}, Created: now}
+	require.NoError(t, s.SaveTOTP(ctx, &totp), "replaces existing")
+	require.NoError(t, s.SaveTOTP(ctx, &TOTP{User: "bob", Secret: "BOBSECRET", Recovery: []string{"h1"}, Created: now}))
+
+	loaded, err := s.LoadTOTP(ctx, "secrets")
+	require.NoError(t, err)
+	assert.Equal(t, "JBSWY3DPEHPK3PXP", loaded.Secret)
+	assert.Equal(t, []string{"h1", "h2", "h3"}, loaded.Recovery)
+	assert.Zero(t, loaded.LastStep)
+	assert.True(t, now.Equal(loaded.Created))
+
+	// steps only move forward
+	require.NoError(t, s.UseTOTPStep(ctx, "secrets", 100))
+	require.ErrorIs(t, s.UseTOTPStep(ctx, "secrets", 100), ErrSaveRejected, "same step again")
+	require.ErrorIs(t, s.UseTOTPStep(ctx, "secrets", 99), ErrSaveRejected, "earlier step")
+	require.ErrorIs(t, s.UseTOTPStep(ctx, "alice", 100), ErrSaveRejected, "not enrolled")
+	require.NoError(t, s.UseTOTPStep(ctx, "secrets", 101))
+
+	// recovery codes are single use
+	require.NoError(t, s.UseRecoveryCode(ctx, "secrets", "h2"))
+	require.ErrorIs(t, s.UseRecoveryCode(ctx, "secrets", "h2"), ErrLoadRejected)
+	require.ErrorIs(t, s.UseRecoveryCode(ctx, "secrets", "bad"), ErrLoadRejected)
+	loaded, err = s.LoadTOTP(ctx, "secrets")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"h1", "h3"}, loaded.Recovery)
+	assert.Equal(t, int64(101), loaded.LastStep)
+	loaded, err = s.LoadTOTP(ctx, "bob")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"h1"}, loaded.Recovery, "codes of other user not affected")
+
+	require.NoError(t, s.RemoveTOTP(ctx, "secrets"))
+	require.ErrorIs(t, s.RemoveTOTP(ctx, "secrets"), ErrLoadRejected)
+	_, err = s.LoadTOTP(ctx, "secrets")
+	require.ErrorIs(t, err, ErrLoadRejected)
+	require.ErrorIs(t, s.UseRecoveryCode(ctx, "secrets", "h1"), ErrLoadRejected, "codes removed along")
+}
+
+func TestSQLite_Passkeys(t *testing.T) {
+	s := NewInMemory(time.Minute)
+	defer s.Close()
+
+	ctx := t.Context()
+	_, err := s.LoadPasskey(ctx, "cred1")
+	require.ErrorIs(t, err, ErrLoadRejected)
+
+	now := time.Now().Truncate(time.Second)
+	require.NoError(t, s.SavePasskey(ctx, &Passkey{ID: "cred1", User: "secrets", Name: "laptop", Credential: []byte(`{"id":"1"}`),
+		Created: now.Add(-time.Hour)}))
+	require.NoError(t, s.SavePasskey(ctx, &Passkey{ID: "cred2", User: "bob", Name: "phone", Credential: []byte(`{"id":"2"}`),
+		Created: now}))
+	require.NoError(t, s.SavePasskey(ctx, &Passkey{ID: "cred3", User: "secrets", Name: "key", Credential: []byte(`{"id":"3"}`),
+		Created: now}))
+
+	pk, err := s.LoadPasskey(ctx, "cred1")
+	require.NoError(t, err)
+	assert.Equal(t, "secrets", pk.User)
+	assert.Equal(t, "laptop", pk.Name)
+	assert.JSONEq(t, `{"id":"1"}`, string(pk.Credential))
+	assert.True(t, now.Add(-time.Hour).Equal(pk.Created))
+	assert.True(t, pk.LastUsed.IsZero())
+
+	// save replaces, e.g. sign counter updated on login
+	pk.Credential, pk.LastUsed = []byte(`{"id":"1","count":5}`), now
+	require.NoError(t, s.SavePasskey(ctx, pk))
+	pk, err = s.LoadPasskey(ctx, "cred1")
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"id":"1","count":5}`, string(pk.Credential))
+	assert.True(t, now.Equal(pk.LastUsed))
+
+	list, err := s.ListPasskeys(ctx, "secrets")
+	require.NoError(t, err)
+	require.Len(t, list, 2)
+	assert.Equal(t, "cred1", list[0].ID, "oldest first")
+	assert.Equal(t, "cred3", list[1].ID)
+	list, err = s.ListPasskeys(ctx, "")
+	require.NoError(t, err)
+	assert.Len(t, list, 3, "all users")
+	list, err = s.ListPasskeys(ctx, "alice")
+	require.NoError(t, err)
+	assert.Empty(t, list)
+
+	require.NoError(t, s.RemovePasskey(ctx, "cred1"))
+	require.ErrorIs(t, s.RemovePasskey(ctx, "cred1"), ErrLoadRejected)
+	_, err = s.LoadPasskey(ctx, "cred1")
+	require.ErrorIs(t, err, ErrLoadRejected)
+}
+
+func TestSQLite_PasskeySetup(t *testing.T) {
+	s := NewInMemory(time.Minute)
+	defer s.Close()
+
+	ctx := t.Context()
+	_, err := s.LoadPasskeySetup(ctx, "h1")
+	require.ErrorIs(t, err, ErrLoadRejected)
+
+	exp := time.Now().Add(time.Hour).Truncate(time.Second)
+	require.NoError(t, s.SavePasskeySetup(ctx, &PasskeySetup{Hash: "h1", User: "secrets", Expires: exp}))
+	require.ErrorIs(t, s.SavePasskeySetup(ctx, &PasskeySetup{Hash: "h1", User: "bob", Expires: exp}), ErrSaveRejected)
+	require.NoError(t, s.SavePasskeySetup(ctx, &PasskeySetup{Hash: "h2", User: "bob", Expires: time.Now().Add(-time.Second)}))
+
+	ps, err := s.LoadPasskeySetup(ctx, "h1")
+	require.NoError(t, err)
+	assert.Equal(t, "secrets", ps.User)
+	assert.True(t, exp.Equal(ps.Expires))
+	_, err = s.LoadPasskeySetup(ctx, "h2")
+	require.ErrorIs(t, err, ErrLoadRejected, "expired")
+	require.ErrorIs(t, s.RemovePasskeySetup(ctx, "h2"), ErrLoadRejected, "expired")
+
+	// single use
+	require.NoError(t, s.RemovePasskeySetup(ctx, "h1"))
+	require.ErrorIs(t, s.RemovePasskeySetup(ctx, "h1"), ErrLoadRejected)
+	_, err = s.LoadPasskeySetup(ctx, "h1")
+	require.ErrorIs(t, err, ErrLoadRejected)
+}
+
 func TestSQLite_Cleanup(t *testing.T) {
 	dbFile := "/tmp/test_sqlite_cleanup.db"
 	defer os.Remove(dbFile)
@@ -173,6 +643,42 @@ func TestSQLite_Cleanup(t *testing.T) {
 	}, time.Second, time.Millisecond*25, "expired message should be cleaned up")
 }
 
+func TestSQLite_Cleanup_OnExpired(t *testing.T) {
+	dbFile := "/tmp/test_sqlite_cleanup_expired.db"
+	defer os.Remove(dbFile)
+
+	s, err := NewSQLite(dbFile, time.Millisecond*50)
+	require.NoError(t, err)
+	defer s.Close()
+
+	var lock sync.Mutex
+	var expired []*Message
+	s.OnExpired(func(msg *Message) {
+		lock.Lock()
+		defer lock.Unlock()
+		expired = append(expired, msg)
+	})
+
+	exp := time.Now().Add(-time.Hour)
+	require.NoError(t, s.Save(t.Context(), &Message{Key: "expired", Exp: exp, Data: []byte("old data"), PinHash: "hash",
+		Callback: "https://example.com/hook"}))
+	require.NoError(t, s.Save(t.Context(), &Message{Key: "valid", Exp: time.Now().Add(time.Hour), Data: []byte("data"),
+		PinHash: "hash"}))
+
+	require.Eventually(t, func() bool {
+		lock.Lock()
+		defer lock.Unlock()
+		return len(expired) == 1
+	}, time.Second, time.Millisecond*25, "expired message should be reported")
+
+	lock.Lock()
+	defer lock.Unlock()
+	assert.Equal(t, "expired", expired[0].Key)
+	assert.Equal(t, "https://example.com/hook", expired[0].Callback)
+	assert.Equal(t, exp.Unix(), expired[0].Exp.Unix())
+	assert.Empty(t, expired[0].Data, "data not returned")
+}
+
 func TestSQLite_Cleanup_KeepsValid(t *testing.T) {
 	dbFile := "/tmp/test_sqlite_cleanup_valid.db"
 	defer os.Remove(dbFile)
@@ -220,7 +726,8 @@ func TestSQLite_SaveLoadClientEnc(t *testing.T) {
 	defer s.Close()
 
 	// save message with ClientEnc=true
-	msg := Message{Key: "clientenc123", Exp: time.Now().Add(time.Hour), Data: []byte("encrypted blob"), PinHash: "hash", ClientEnc: true}
+	msg := Message{Key: "clientenc123", Exp: time.Now().Add(time.Hour), Data: []byte("encrypted blob"), PinHash: "hash", ClientEnc: true,
+		MgmtHash: "mgmthash", Callback: "https://example.com/hook"}
 	err = s.Save(t.Context(), &msg)
 	require.NoError(t, err)
 
@@ -228,6 +735,8 @@ func TestSQLite_SaveLoadClientEnc(t *testing.T) {
 	loaded, err := s.Load(t.Context(), "clientenc123")
 	require.NoError(t, err)
 	assert.True(t, loaded.ClientEnc, "ClientEnc should be true")
+	assert.Equal(t, "mgmthash", loaded.MgmtHash)
+	assert.Equal(t, "https://example.com/hook", loaded.Callback)
 
 	// save message with ClientEnc=false (default)
 	msg2 := Message{Key: "serverenc123", Exp: time.Now().Add(time.Hour), Data: []byte("server encrypted"), PinHash: "hash2", ClientEnc: false}
@@ -1,10 +1,14 @@
-// Package store defines and implements data store for sqlite and in-memory
+// Package store defines and implements data store for sqlite, in-memory, postgres and redis
 package store
 
 import (
 	"crypto/rand"
 	"errors"
+	"slices"
+	"strings"
 	"time"
+
+	log "github.com/go-pkgz/lgr"
 )
 
 // Error messages
@@ -20,7 +24,147 @@ type Message struct {
 	Data      []byte
 	PinHash   string
 	Errors    int
-	ClientEnc bool // true if client-side encrypted (UI), false if server-side (API)
+	ClientEnc bool   // true if client-side encrypted (UI), false if server-side (API)
+	MaxViews  int    // successful reads allowed before removal, 0 or 1 means single read
+	Views     int    // successful reads so far
+	MgmtHash  string // hash of management token allowing the sender to revoke the message, empty if not set
+	MgmtToken string // plain management token, set on creation only and never stored
+	Callback  string // per-message webhook url set by sender, optional
+}
+
+// ExpiredFunc is called by engine cleaner for each message it removed on expiration
+type ExpiredFunc func(msg *Message)
+
+// Tombstone states
+const (
+	StateExpired = "expired" // message expired or removed by cleaner, the initial state of a tombstone
+	StateOpened  = "opened"  // all views used
+	StateBurned  = "burned"  // removed after too many wrong pins
+	StateRevoked = "revoked" // removed by the sender
+)
+
+// Tombstone keeps non-sensitive lifecycle data of a message. It is saved along with the message
+// and outlives it until Purge, so the sender can check what happened to the message.
+type Tombstone struct {
+	Key      string
+	MgmtHash string
+	State    string
+	Created  time.Time
+	Exp      time.Time // message expiration
+	Closed   time.Time // when the message was opened, burned or revoked, zero if not closed yet
+	Purge    time.Time // when the tombstone itself removed
+	Errors   int
+	Views    int
+	MaxViews int
+}
+
+// TombstoneUpdate is a change of message status after a view, wrong pin or removal, applied by engine atomically.
+// Counters never go down and the final state, once set, is not replaced, so concurrent updates give the same
+// result in any order.
+type TombstoneUpdate struct {
+	Views  int       // views so far, ignored if less than stored
+	Errors int       // wrong pins so far, ignored if less than stored
+	State  string    // final state, empty to keep the state; set only if not closed yet
+	Closed time.Time // when the final state reached, set with State
+	Purge  time.Time // when the tombstone removed, set with State
+}
+
+// Token is a named API token. Only the hash of the token is stored, the token itself is shown once on creation.
+type Token struct {
+	ID       string
+	Name     string
+	Hash     string
+	Scopes   []string      // allowed operations, e.g. create-text
+	MaxExp   time.Duration // max expiration of messages created with the token, 0 means no own limit
+	Created  time.Time
+	LastUsed time.Time // zero if never used
+}
+
+// User is a named creator of messages with bcrypt hash of the password
+type User struct {
+	Name    string
+	Hash    string
+	Created time.Time
+}
+
+// Session is a login session of message creator. Only the hash of session secret is stored, the secret is in the cookie.
+type Session struct {
+	ID        string
+	Hash      string
+	User      string
+	IP        string // hashed IP of the client on login
+	UserAgent string
+	Created   time.Time
+	LastSeen  time.Time
+	Expires   time.Time // moved forward on activity
+}
+
+// Failures counts failed login attempts of a client, or of all clients together
+type Failures struct {
+	Key     string
+	Count   int
+	Last    time.Time // time of the last failure
+	Expires time.Time // the counter starts over after this time
+}
+
+// TOTP is the second login factor of a user, RFC 6238 secret along with hashes of one-time recovery codes
+type TOTP struct {
+	User     string
+	Secret   string   // base32 secret shared with authenticator app
+	Recovery []string // sha256 hashes of unused recovery codes
+	LastStep int64    // time step of the last accepted code, codes up to it are rejected as replayed
+	Created  time.Time
+}
+
+// Passkey is a WebAuthn credential of a user. Credential keeps the public key and sign counter
+// as json of the webauthn library, the store doesn't look inside.
+type Passkey struct {
+	ID         string // credential id, base64url encoded
+	User       string
+	Name       string // label given on registration, e.g. the device
+	Credential []byte
+	Created    time.Time
+	LastUsed   time.Time // zero if never used
+}
+
+// PasskeySetup is a one-time link to register a passkey, made with CLI for the user without one.
+// Only the hash of the link token is stored.
+type PasskeySetup struct {
+	Hash    string
+	User    string
+	Expires time.Time
+}
+
+// HasScope checks if the token allows the operation
+func (t *Token) HasScope(scope string) bool {
+	return slices.Contains(t.Scopes, scope)
+}
+
+// splitScopes parses comma-separated scopes as stored by sql engines
+func splitScopes(s string) []string {
+	if s == "" {
+		return []string{}
+	}
+	return strings.Split(s, ",")
+}
+
+// ViewsLeft returns the number of successful reads left before the message removal
+func (m *Message) ViewsLeft() int {
+	return max(m.MaxViews, 1) - m.Views
+}
+
+// lastView checks if the next successful read uses up the allowed views, so the message should be removed
+func (m *Message) lastView() bool {
+	return m.Views+1 >= m.MaxViews
+}
+
+// logConsumed logs successful read of the message, before its views counter updated
+func logConsumed(m *Message) {
+	if m.lastView() {
+		log.Printf("[INFO] consumed %s", m.Key)
+		return
+	}
+	log.Printf("[INFO] viewed %s, %d of %d", m.Key, m.Views+1, m.MaxViews)
 }
 
 // base62 alphabet for short ID generation
@@ -1,7 +1,9 @@
 package store
 
 import (
+	"context"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -30,3 +32,47 @@ func TestGenerateID_Uniqueness(t *testing.T) {
 		seen[id] = true
 	}
 }
+
+// checkUpdateTombstone runs the same tombstone updates against any engine
+func checkUpdateTombstone(t *testing.T, s interface {
+	SaveTombstone(ctx context.Context, t *Tombstone) error
+	LoadTombstone(ctx context.Context, key string) (*Tombstone, error)
+	UpdateTombstone(ctx context.Context, key string, u TombstoneUpdate) error
+}) {
+	t.Helper()
+	ctx := t.Context()
+	require.ErrorIs(t, s.UpdateTombstone(ctx, "upd1", TombstoneUpdate{Views: 1}), ErrLoadRejected)
+
+	now := time.Now().Truncate(time.Second)
+	ts := Tombstone{Key: "upd1", MgmtHash: "hash/+=", State: StateExpired, Created: now, Exp: now.Add(time.Hour),
+		Purge: now.Add(2 * time.Hour), MaxViews: 3}
+	require.NoError(t, s.SaveTombstone(ctx, &ts))
+
+	require.NoError(t, s.UpdateTombstone(ctx, "upd1", TombstoneUpdate{Views: 2}))
+	require.NoError(t, s.UpdateTombstone(ctx, "upd1", TombstoneUpdate{Errors: 1}))
+	loaded, err := s.LoadTombstone(ctx, "upd1")
+	require.NoError(t, err)
+	assert.Equal(t, StateExpired, loaded.State, "not closed yet")
+	assert.Equal(t, 2, loaded.Views)
+	assert.Equal(t, 1, loaded.Errors)
+	assert.True(t, loaded.Closed.IsZero())
+
+	closed := now.Add(time.Minute)
+	require.NoError(t, s.UpdateTombstone(ctx, "upd1", TombstoneUpdate{Views: 3, State: StateOpened, Closed: closed,
+		Purge: closed.Add(3 * time.Hour)}))
+
+	// late updates don't take counters back or replace the final state
+	require.NoError(t, s.UpdateTombstone(ctx, "upd1", TombstoneUpdate{Views: 1}))
+	require.NoError(t, s.UpdateTombstone(ctx, "upd1", TombstoneUpdate{State: StateRevoked, Closed: now.Add(time.Hour),
+		Purge: now.Add(time.Hour)}))
+	loaded, err = s.LoadTombstone(ctx, "upd1")
+	require.NoError(t, err)
+	assert.Equal(t, StateOpened, loaded.State)
+	assert.Equal(t, 3, loaded.Views)
+	assert.Equal(t, 1, loaded.Errors)
+	assert.True(t, closed.Equal(loaded.Closed))
+	assert.True(t, closed.Add(3*time.Hour).Equal(loaded.Purge))
+	assert.Equal(t, "hash/+=", loaded.MgmtHash)
+	assert.True(t, now.Equal(loaded.Created))
+	assert.Equal(t, 3, loaded.MaxViews)
+}
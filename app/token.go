@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/umputun/secrets/v2/app/tokens"
+)
+
+// tokenCmd is "secrets token", it manages named API tokens stored by the engine
+type tokenCmd struct {
+	Create tokenCreateCmd `command:"create" description:"create API token and print it"`
+	List   struct{}       `command:"list" description:"list API tokens"`
+	Revoke tokenRevokeCmd `command:"revoke" description:"revoke API token by id or name"`
+}
+
+type tokenCreateCmd struct {
+	Name   string        `long:"name" required:"true" description:"token name, unique"`
+	Scopes []string      `long:"scope" description:"allowed operation, repeatable (create-text, create-file)"`
+	MaxExp time.Duration `long:"max-exp" description:"max lifetime of secrets created with the token, server max if not set"`
+}
+
+type tokenRevokeCmd struct {
+	Args struct {
+		Ref string `positional-arg-name:"id-or-name" required:"yes"`
+	} `positional-args:"yes"`
+}
+
+// runTokenCreate creates token and prints it to out, the token can't be shown again
+func runTokenCreate(ctx context.Context, m *tokens.Manager, cmd tokenCreateCmd, out io.Writer) error {
+	token, t, err := m.Create(ctx, tokens.Request{Name: cmd.Name, Scopes: cmd.Scopes, MaxExp: cmd.MaxExp})
+	if err != nil {
+		return fmt.Errorf("create token: %w", err)
+	}
+	_, _ = fmt.Fprintf(out, "token %s (%s) created, it won't be shown again:\n%s\n", t.ID, t.Name, token)
+	return nil
+}
+
+// runTokenList prints tokens table to out
+func runTokenList(ctx context.Context, m *tokens.Manager, out io.Writer) error {
+	list, err := m.List(ctx)
+	if err != nil {
+		return err //nolint:wrapcheck // already wrapped by manager
+	}
+	if len(list) == 0 {
+		_, _ = fmt.Fprintln(out, "no tokens")
+		return nil
+	}
+	tw := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	_, _ = fmt.Fprintln(tw, "ID\tNAME\tSCOPES\tMAX EXP\tCREATED\tLAST USED")
+	for _, t := range list {
+		maxExp, lastUsed := "-", "never"
+		if t.MaxExp > 0 {
+			maxExp = t.MaxExp.String()
+		}
+		if !t.LastUsed.IsZero() {
+			lastUsed = t.LastUsed.Format(time.DateTime)
+		}
+		scopes := strings.Join(t.Scopes, ",")
+		if scopes == "" {
+			scopes = "-"
+		}
+		_, _ = fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", t.ID, t.Name, scopes, maxExp,
+			t.Created.Format(time.DateTime), lastUsed)
+	}
+	if err = tw.Flush(); err != nil {
+		return fmt.Errorf("write tokens: %w", err)
+	}
+	return nil
+}
+
+// runTokenRevoke revokes token by id or name
+func runTokenRevoke(ctx context.Context, m *tokens.Manager, ref string, out io.Writer) error {
+	t, err := m.Revoke(ctx, ref)
+	if errors.Is(err, tokens.ErrNotFound) {
+		return fmt.Errorf("no token with id or name %q", ref)
+	}
+	if err != nil {
+		return err //nolint:wrapcheck // already wrapped by manager
+	}
+	_, _ = fmt.Fprintf(out, "token %s (%s) revoked\n", t.ID, t.Name)
+	return nil
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/umputun/secrets/v2/app/server"
+	"github.com/umputun/secrets/v2/app/store"
+	"github.com/umputun/secrets/v2/app/tokens"
+)
+
+func TestRunToken(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("passwd"), bcrypt.MinCost)
+	require.NoError(t, err)
+	url, eng := prepClientServer(t, server.Config{PinSize: 5, AuthHash: string(hash)},
+		func(srv server.Server, eng *store.SQLite) server.Server { return srv.WithTokens(tokens.New(eng)) })
+	m := tokens.New(eng)
+
+	// send makes text secret with the token, the way a script would use it
+	send := func(t *testing.T, token string) error {
+		t.Helper()
+		cmd := sendCmd{Server: url, Token: token, Pin: "12345", Exp: time.Hour, Views: 1, Timeout: 5 * time.Second}
+		return runSend(t.Context(), cmd, strings.NewReader("my secret"), &bytes.Buffer{}, &bytes.Buffer{})
+	}
+
+	out := bytes.Buffer{}
+	require.NoError(t, runTokenList(t.Context(), m, &out))
+	assert.Equal(t, "no tokens\n", out.String())
+
+	tbl := []struct {
+		name    string
+		cmd     tokenCreateCmd
+		wantErr string // error of create command
+		sendErr bool   // token not allowed to send text secret of 1h
+	}{
+		{name: "all scopes", cmd: tokenCreateCmd{Name: "ci", Scopes: tokens.Scopes}},
+		{name: "text scope", cmd: tokenCreateCmd{Name: "text", Scopes: []string{tokens.ScopeCreateText}}},
+		{name: "file scope", cmd: tokenCreateCmd{Name: "files", Scopes: []string{tokens.ScopeCreateFile}}, sendErr: true},
+		{name: "no scopes", cmd: tokenCreateCmd{Name: "none"}, sendErr: true},
+		{name: "short lived secrets", cmd: tokenCreateCmd{Name: "short", Scopes: []string{tokens.ScopeCreateText},
+			MaxExp: 30 * time.Minute}, sendErr: true},
+		{name: "name taken", cmd: tokenCreateCmd{Name: "ci"}, wantErr: "token name already used"},
+		{name: "unknown scope", cmd: tokenCreateCmd{Name: "bad", Scopes: []string{"read"}}, wantErr: "unknown scope"},
+	}
+	for _, tc := range tbl {
+		t.Run(tc.name, func(t *testing.T) {
+			out := bytes.Buffer{}
+			err := runTokenCreate(t.Context(), m, tc.cmd, &out)
+			if tc.wantErr != "" {
+				require.ErrorContains(t, err, tc.wantErr)
+				assert.Empty(t, out.String())
+				return
+			}
+			require.NoError(t, err)
+			lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+			require.Len(t, lines, 2)
+			assert.Regexp(t, `^token \S+ \(`+tc.cmd.Name+`\) created, it won't be shown again:$`, lines[0])
+			if tc.sendErr {
+				require.ErrorContains(t, send(t, lines[1]), "send secret")
+				return
+			}
+			require.NoError(t, send(t, lines[1]))
+		})
+	}
+
+	out.Reset()
+	require.NoError(t, runTokenList(t.Context(), m, &out))
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	require.Len(t, lines, 6)
+	assert.Regexp(t, `^ID\s+NAME\s+SCOPES\s+MAX EXP\s+CREATED\s+LAST USED$`, lines[0])
+	assert.Regexp(t, `\sci\s+create-text,create-file\s+-\s+\S+ \S+\s+\S+ \S+\n`, out.String())
+	assert.Regexp(t, `\snone\s+-\s+-\s`, out.String())
+	assert.Regexp(t, `\sshort\s+create-text\s+30m0s\s`, out.String())
+
+	t.Run("revoke", func(t *testing.T) {
+		out := bytes.Buffer{}
+		token, tk, err := m.Create(t.Context(), tokens.Request{Name: "temp", Scopes: []string{tokens.ScopeCreateText}})
+		require.NoError(t, err)
+		require.NoError(t, runTokenList(t.Context(), m, &out))
+		assert.Regexp(t, `\stemp\s+create-text\s+-\s+\S+ \S+\s+never\n`, out.String(), "not used yet")
+		require.NoError(t, send(t, token))
+		out.Reset()
+		require.NoError(t, runTokenRevoke(t.Context(), m, tk.ID, &out))
+		assert.Equal(t, "token "+tk.ID+" (temp) revoked\n", out.String())
+		require.Error(t, send(t, token), "revoked token rejected by server")
+
+		out.Reset()
+		require.NoError(t, runTokenRevoke(t.Context(), m, "files", &out), "revoke by name")
+		assert.Contains(t, out.String(), "(files) revoked")
+
+		err = runTokenRevoke(t.Context(), m, "temp", &out)
+		require.EqualError(t, err, `no token with id or name "temp"`)
+	})
+}
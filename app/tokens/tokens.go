@@ -0,0 +1,182 @@
+// Package tokens manages named API tokens with scopes, used instead of the shared password by API clients.
+// A token is shown once on creation, the store keeps only its sha256 hash.
+package tokens
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	log "github.com/go-pkgz/lgr"
+
+	"github.com/umputun/secrets/v2/app/store"
+)
+
+// Scopes of operations allowed to a token
+const (
+	ScopeCreateText = "create-text" // create text messages, including client-encrypted ones
+	ScopeCreateFile = "create-file" // upload files
+)
+
+// Scopes lists all known scopes
+var Scopes = []string{ScopeCreateText, ScopeCreateFile}
+
+// prefix marks secrets tokens, so they are easy to recognize in configs and by secret scanners
+const prefix = "sct_"
+
+// touchInterval limits updates of last used time, so a busy token doesn't write on each request
+const touchInterval = time.Minute
+
+// Errors
+var (
+	ErrInvalid   = errors.New("invalid token")
+	ErrNotFound  = errors.New("token not found")
+	ErrBadScope  = errors.New("unknown scope")
+	ErrNameTaken = errors.New("token name already used")
+)
+
+// Store is a persistent storage of tokens, implemented by all store engines
+type Store interface {
+	SaveToken(ctx context.Context, t *store.Token) error
+	LoadToken(ctx context.Context, id string) (*store.Token, error)
+	ListTokens(ctx context.Context) ([]store.Token, error)
+	RemoveToken(ctx context.Context, id string) error
+	TouchToken(ctx context.Context, id string, ts time.Time) error
+}
+
+// Request to create a token
+type Request struct {
+	Name   string
+	Scopes []string
+	MaxExp time.Duration // 0 means server max
+}
+
+// Manager creates, checks and revokes tokens
+type Manager struct {
+	store Store
+}
+
+// New makes Manager with the store
+func New(s Store) *Manager {
+	return &Manager{store: s}
+}
+
+// Create makes a new token and returns it along with the stored record. The token can't be recovered later.
+func (m *Manager) Create(ctx context.Context, req Request) (token string, result *store.Token, err error) {
+	name := strings.TrimSpace(req.Name)
+	if name == "" || len(name) > 64 {
+		return "", nil, errors.New("token name must be 1-64 characters")
+	}
+	if req.MaxExp < 0 {
+		return "", nil, errors.New("max expiration can't be negative")
+	}
+	scopes := []string{}
+	for _, sc := range req.Scopes {
+		if !slices.Contains(Scopes, sc) {
+			return "", nil, fmt.Errorf("%w %q, allowed: %s", ErrBadScope, sc, strings.Join(Scopes, ", "))
+		}
+		if !slices.Contains(scopes, sc) {
+			scopes = append(scopes, sc)
+		}
+	}
+
+	existing, err := m.store.ListTokens(ctx)
+	if err != nil {
+		return "", nil, fmt.Errorf("list tokens: %w", err)
+	}
+	if slices.ContainsFunc(existing, func(t store.Token) bool { return t.Name == name }) {
+		return "", nil, fmt.Errorf("%w: %s", ErrNameTaken, name)
+	}
+
+	secret := make([]byte, 32)
+	if _, err = rand.Read(secret); err != nil {
+		return "", nil, fmt.Errorf("generate token: %w", err)
+	}
+	result = &store.Token{ID: store.GenerateID(), Name: name, Scopes: scopes, MaxExp: req.MaxExp,
+		Created: time.Now().Truncate(time.Second)}
+	token = prefix + result.ID + base64.RawURLEncoding.EncodeToString(secret)
+	result.Hash = hash(token)
+	if err = m.store.SaveToken(ctx, result); err != nil {
+		return "", nil, fmt.Errorf("save token: %w", err)
+	}
+	log.Printf("[INFO] created token %s (%s), scopes: %v", result.ID, name, scopes)
+	return token, result, nil
+}
+
+// List returns all tokens, oldest first
+func (m *Manager) List(ctx context.Context) ([]store.Token, error) {
+	res, err := m.store.ListTokens(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("list tokens: %w", err)
+	}
+	return res, nil
+}
+
+// Revoke removes token by its id or name and returns it
+func (m *Manager) Revoke(ctx context.Context, ref string) (*store.Token, error) {
+	list, err := m.store.ListTokens(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("list tokens: %w", err)
+	}
+	idx := slices.IndexFunc(list, func(t store.Token) bool { return t.ID == ref })
+	if idx < 0 {
+		idx = slices.IndexFunc(list, func(t store.Token) bool { return t.Name == ref })
+	}
+	if idx < 0 {
+		return nil, fmt.Errorf("%w: %s", ErrNotFound, ref)
+	}
+	if err = m.store.RemoveToken(ctx, list[idx].ID); err != nil {
+		if errors.Is(err, store.ErrLoadRejected) {
+			return nil, fmt.Errorf("%w: %s", ErrNotFound, ref)
+		}
+		return nil, fmt.Errorf("remove token: %w", err)
+	}
+	log.Printf("[INFO] revoked token %s (%s)", list[idx].ID, list[idx].Name)
+	return &list[idx], nil
+}
+
+// Check verifies the token and returns its record, ErrInvalid for unknown or revoked token.
+// Last used time is updated at most once per touchInterval.
+func (m *Manager) Check(ctx context.Context, token string) (*store.Token, error) {
+	id, ok := parseID(token)
+	if !ok {
+		return nil, ErrInvalid
+	}
+	t, err := m.store.LoadToken(ctx, id)
+	if err != nil {
+		return nil, ErrInvalid
+	}
+	if subtle.ConstantTimeCompare([]byte(t.Hash), []byte(hash(token))) != 1 {
+		return nil, ErrInvalid
+	}
+	if now := time.Now(); now.Sub(t.LastUsed) >= touchInterval {
+		if err = m.store.TouchToken(ctx, id, now); err != nil {
+			log.Printf("[WARN] can't update last used time of token %s, %v", id, err)
+		}
+		t.LastUsed = now
+	}
+	return t, nil
+}
+
+// parseID extracts token id, the 12 characters after the prefix
+func parseID(token string) (string, bool) {
+	rest, ok := strings.CutPrefix(token, prefix)
+	if !ok || len(rest) <= 12 {
+		return "", false
+	}
+	return rest[:12], true
+}
+
+// hash returns hex-encoded sha256 of the token, random enough to skip bcrypt
+func hash(token string) string {
+	h := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(h[:])
+}
@@ -0,0 +1,110 @@
+package tokens
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/umputun/secrets/v2/app/store"
+)
+
+func TestManager_CreateCheck(t *testing.T) {
+	eng := store.NewInMemory(time.Minute)
+	defer eng.Close()
+	m := New(eng)
+
+	token, tk, err := m.Create(t.Context(), Request{Name: " ci ", Scopes: []string{ScopeCreateText, ScopeCreateText},
+		MaxExp: time.Hour})
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(token, "sct_"+tk.ID))
+	assert.Equal(t, "ci", tk.Name)
+	assert.Equal(t, []string{ScopeCreateText}, tk.Scopes)
+	assert.Equal(t, time.Hour, tk.MaxExp)
+	assert.NotContains(t, tk.Hash, token)
+
+	stored, err := eng.LoadToken(t.Context(), tk.ID)
+	require.NoError(t, err)
+	assert.True(t, stored.LastUsed.IsZero())
+
+	checked, err := m.Check(t.Context(), token)
+	require.NoError(t, err)
+	assert.Equal(t, tk.ID, checked.ID)
+	assert.True(t, checked.HasScope(ScopeCreateText))
+	assert.False(t, checked.HasScope(ScopeCreateFile))
+	stored, err = eng.LoadToken(t.Context(), tk.ID)
+	require.NoError(t, err)
+	assert.WithinDuration(t, time.Now(), stored.LastUsed, 2*time.Second, "last used updated")
+
+	tampered := token[:len(token)-1] + "A"
+	if tampered == token {
+		tampered = token[:len(token)-1] + "B"
+	}
+	for _, bad := range []string{"", "sct_", "sct_" + tk.ID, token + "x", "xxx" + token[3:], tampered} {
+		_, err = m.Check(t.Context(), bad)
+		require.ErrorIs(t, err, ErrInvalid, bad)
+	}
+}
+
+func TestManager_CreateRejected(t *testing.T) {
+	eng := store.NewInMemory(time.Minute)
+	defer eng.Close()
+	m := New(eng)
+
+	_, _, err := m.Create(t.Context(), Request{Name: "ci"})
+	require.NoError(t, err)
+
+	tests := []struct {
+		name string
+		req  Request
+		err  error
+	}{
+		{name: "name taken", req: Request{Name: "ci"}, err: ErrNameTaken},
+		{name: "unknown scope", req: Request{Name: "other", Scopes: []string{"admin"}}, err: ErrBadScope},
+		{name: "empty name", req: Request{Name: "  "}},
+		{name: "long name", req: Request{Name: strings.Repeat("a", 65)}},
+		{name: "negative exp", req: Request{Name: "other", MaxExp: -time.Second}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			_, _, err := m.Create(t.Context(), tc.req)
+			require.Error(t, err)
+			if tc.err != nil {
+				require.ErrorIs(t, err, tc.err)
+			}
+		})
+	}
+}
+
+func TestManager_ListRevoke(t *testing.T) {
+	eng := store.NewInMemory(time.Minute)
+	defer eng.Close()
+	m := New(eng)
+
+	token1, tk1, err := m.Create(t.Context(), Request{Name: "ci", Scopes: []string{ScopeCreateText}})
+	require.NoError(t, err)
+	_, tk2, err := m.Create(t.Context(), Request{Name: "deploy", Scopes: Scopes})
+	require.NoError(t, err)
+
+	list, err := m.List(t.Context())
+	require.NoError(t, err)
+	require.Len(t, list, 2)
+
+	revoked, err := m.Revoke(t.Context(), tk1.ID)
+	require.NoError(t, err)
+	assert.Equal(t, "ci", revoked.Name)
+	_, err = m.Check(t.Context(), token1)
+	require.ErrorIs(t, err, ErrInvalid, "revoked token rejected")
+
+	revoked, err = m.Revoke(t.Context(), "deploy")
+	require.NoError(t, err, "revoke by name")
+	assert.Equal(t, tk2.ID, revoked.ID)
+
+	_, err = m.Revoke(t.Context(), "deploy")
+	require.ErrorIs(t, err, ErrNotFound)
+	list, err = m.List(t.Context())
+	require.NoError(t, err)
+	assert.Empty(t, list)
+}
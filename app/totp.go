@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/skip2/go-qrcode"
+
+	"github.com/umputun/secrets/v2/app/totp"
+)
+
+// totpCmd is "secrets totp", it manages the second login factor stored by the engine
+type totpCmd struct {
+	Enroll  totpEnrollCmd `command:"enroll" description:"enroll second login factor, print otpauth uri, QR code and recovery codes"`
+	Disable totpUserCmd   `command:"disable" description:"remove second login factor, the password alone is enough again"`
+}
+
+type totpEnrollCmd struct {
+	totpUserCmd
+	Force bool `long:"force" description:"replace enrolled second factor, old authenticator and recovery codes stop working"`
+}
+
+type totpUserCmd struct {
+	User string `long:"user" default:"secrets" description:"user name, secrets for the password of --auth.hash"`
+}
+
+// runTOTPEnroll enrolls second factor of the user and prints it, the secret and recovery codes can't be shown again
+func runTOTPEnroll(ctx context.Context, m *totp.Manager, cmd totpEnrollCmd, out io.Writer) error {
+	enabled, err := m.Enabled(ctx, cmd.User)
+	if err != nil {
+		return err //nolint:wrapcheck // already wrapped by manager
+	}
+	if enabled && !cmd.Force {
+		return fmt.Errorf("user %s has second factor already, use --force to replace it", cmd.User)
+	}
+	enr, err := m.Enroll(ctx, cmd.User)
+	if err != nil {
+		return fmt.Errorf("enroll: %w", err)
+	}
+	qr, err := qrcode.New(enr.URI, qrcode.Medium)
+	if err != nil {
+		return fmt.Errorf("make qr code: %w", err)
+	}
+
+	_, _ = fmt.Fprintf(out, "second factor of %s enrolled, it won't be shown again.\n\n", cmd.User)
+	_, _ = fmt.Fprintf(out, "scan with authenticator app:\n%s\n", qr.ToSmallString(false))
+	_, _ = fmt.Fprintf(out, "or add it manually:\n%s\nsecret: %s\n\n", enr.URI, enr.Secret)
+	_, _ = fmt.Fprintln(out, "recovery codes, each works once instead of the code if the authenticator is lost:")
+	for _, code := range enr.Recovery {
+		_, _ = fmt.Fprintln(out, code)
+	}
+	return nil
+}
+
+// runTOTPDisable removes second factor of the user
+func runTOTPDisable(ctx context.Context, m *totp.Manager, user string, out io.Writer) error {
+	err := m.Disable(ctx, user)
+	if errors.Is(err, totp.ErrNotEnrolled) {
+		return fmt.Errorf("user %s has no second factor", user)
+	}
+	if err != nil {
+		return err //nolint:wrapcheck // already wrapped by manager
+	}
+	_, _ = fmt.Fprintf(out, "second factor of %s removed\n", user)
+	return nil
+}
@@ -0,0 +1,189 @@
+// Package totp implements RFC 6238 time-based one-time passwords as the second login factor.
+// The secret is enrolled with CLI and kept by the store along with sha256 hashes of one-time recovery codes,
+// which replace the code if the authenticator app is lost. Each code is accepted only once.
+package totp
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1" //nolint:gosec // sha1 is the algorithm of RFC 6238 supported by all authenticator apps
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/go-pkgz/lgr"
+
+	"github.com/umputun/secrets/v2/app/store"
+)
+
+const (
+	period        = 30 // seconds of a time step
+	digits        = 6
+	skew          = 1  // steps accepted before and after the current one, for clock drift of the phone
+	secretSize    = 20 // bytes of the secret, 160 bits recommended by RFC 4226
+	recoveryCodes = 10
+	recoverySize  = 10 // bytes of a recovery code, 16 base32 chars
+)
+
+// Errors
+var (
+	ErrInvalid     = errors.New("invalid code")
+	ErrNotEnrolled = errors.New("second factor not enrolled")
+)
+
+// b32 encodes secrets and recovery codes without padding, as authenticator apps expect
+var b32 = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// Store is a persistent storage of second factors, implemented by all store engines
+type Store interface {
+	SaveTOTP(ctx context.Context, t *store.TOTP) error
+	LoadTOTP(ctx context.Context, user string) (*store.TOTP, error)
+	RemoveTOTP(ctx context.Context, user string) error
+	UseTOTPStep(ctx context.Context, user string, step int64) error
+	UseRecoveryCode(ctx context.Context, user, hash string) error
+}
+
+// Manager enrolls and verifies second factors
+type Manager struct {
+	store  Store
+	issuer string
+	now    func() time.Time
+}
+
+// Enrollment is a new second factor, shown once
+type Enrollment struct {
+	Secret   string   // base32 secret for manual entry into authenticator app
+	URI      string   // otpauth:// uri, usually scanned as QR code
+	Recovery []string // one-time recovery codes
+}
+
+// New makes Manager with the store, issuer is the name of the service shown by authenticator apps
+func New(s Store, issuer string) *Manager {
+	return &Manager{store: s, issuer: issuer, now: time.Now}
+}
+
+// Enroll makes a new second factor of the user, replacing existing one along with its recovery codes
+func (m *Manager) Enroll(ctx context.Context, user string) (*Enrollment, error) {
+	if user == "" {
+		return nil, errors.New("user required")
+	}
+	secret := make([]byte, secretSize)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, fmt.Errorf("generate secret: %w", err)
+	}
+	res := &Enrollment{Secret: b32.EncodeToString(secret)}
+	t := &store.TOTP{User: user, Secret: res.Secret, Created: m.now()}
+	for range recoveryCodes {
+		b := make([]byte, recoverySize)
+		if _, err := rand.Read(b); err != nil {
+			return nil, fmt.Errorf("generate recovery code: %w", err)
+		}
+		code := strings.ToLower(b32.EncodeToString(b))
+		res.Recovery = append(res.Recovery, code[:4]+"-"+code[4:8]+"-"+code[8:12]+"-"+code[12:])
+		t.Recovery = append(t.Recovery, hash(code))
+	}
+	if err := m.store.SaveTOTP(ctx, t); err != nil {
+		return nil, fmt.Errorf("save totp: %w", err)
+	}
+
+	label := m.issuer + ":" + user
+	query := url.Values{"secret": {res.Secret}, "issuer": {m.issuer}, "algorithm": {"SHA1"},
+		"digits": {strconv.Itoa(digits)}, "period": {strconv.Itoa(period)}}
+	res.URI = (&url.URL{Scheme: "otpauth", Host: "totp", Path: "/" + label, RawQuery: query.Encode()}).String()
+	log.Printf("[INFO] second factor enrolled, user=%s", user)
+	return res, nil
+}
+
+// Enabled checks if the user has second factor enrolled. Store error is returned, so login can fail closed.
+func (m *Manager) Enabled(ctx context.Context, user string) (bool, error) {
+	_, err := m.store.LoadTOTP(ctx, user)
+	switch {
+	case errors.Is(err, store.ErrLoadRejected):
+		return false, nil
+	case err != nil:
+		return false, fmt.Errorf("load totp: %w", err)
+	}
+	return true, nil
+}
+
+// Verify checks the code of authenticator app, or one of recovery codes. Both are accepted once,
+// ErrInvalid for wrong or reused code.
+func (m *Manager) Verify(ctx context.Context, user, code string) error {
+	t, err := m.store.LoadTOTP(ctx, user)
+	if errors.Is(err, store.ErrLoadRejected) {
+		return ErrNotEnrolled
+	}
+	if err != nil {
+		return fmt.Errorf("load totp: %w", err)
+	}
+	code = strings.ReplaceAll(strings.TrimSpace(code), " ", "")
+	if _, err = strconv.Atoi(code); err == nil && len(code) == digits {
+		return m.verifyCode(ctx, t, code)
+	}
+
+	// recovery code, case and dashes don't matter
+	code = strings.ToLower(strings.ReplaceAll(code, "-", ""))
+	if err = m.store.UseRecoveryCode(ctx, user, hash(code)); err != nil {
+		return ErrInvalid
+	}
+	log.Printf("[INFO] recovery code used, user=%s, %d left", user, len(t.Recovery)-1)
+	return nil
+}
+
+// Disable removes second factor of the user along with its recovery codes
+func (m *Manager) Disable(ctx context.Context, user string) error {
+	if err := m.store.RemoveTOTP(ctx, user); err != nil {
+		if errors.Is(err, store.ErrLoadRejected) {
+			return ErrNotEnrolled
+		}
+		return fmt.Errorf("remove totp: %w", err)
+	}
+	log.Printf("[INFO] second factor removed, user=%s", user)
+	return nil
+}
+
+// verifyCode checks the code against time steps around now, its step is marked as used so the code can't be replayed
+func (m *Manager) verifyCode(ctx context.Context, t *store.TOTP, code string) error {
+	secret, err := b32.DecodeString(t.Secret)
+	if err != nil {
+		return fmt.Errorf("decode secret: %w", err)
+	}
+	current := m.now().Unix() / period
+	for step := current - skew; step <= current+skew; step++ {
+		if subtle.ConstantTimeCompare([]byte(generate(secret, step)), []byte(code)) != 1 {
+			continue
+		}
+		if step <= t.LastStep || m.store.UseTOTPStep(ctx, t.User, step) != nil {
+			return fmt.Errorf("%w, used already", ErrInvalid)
+		}
+		return nil
+	}
+	return ErrInvalid
+}
+
+// generate returns the code of the time step, HOTP of RFC 4226 with the step as counter
+func generate(secret []byte, step int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step)) //nolint:gosec // steps since epoch are positive
+	h := hmac.New(sha1.New, secret)
+	h.Write(msg[:])
+	sum := h.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", digits, value%1_000_000)
+}
+
+// hash returns hex-encoded sha256 of the recovery code, random enough to skip bcrypt
+func hash(code string) string {
+	h := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(h[:])
+}
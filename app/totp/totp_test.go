@@ -0,0 +1,116 @@
+package totp
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/umputun/secrets/v2/app/store"
+)
+
+func TestGenerate(t *testing.T) {
+	// test vectors of RFC 6238 appendix B for sha1, last 6 of 8 digits
+	secret := []byte("12345678901234567890")
+	tbl := []struct {
+		ts   int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+	for _, tt := range tbl {
+		assert.Equal(t, tt.code, generate(secret, tt.ts/period), "time %d", tt.ts)
+	}
+}
+
+func TestManager_Enroll(t *testing.T) {
+	eng := store.NewInMemory(time.Minute)
+	defer eng.Close()
+	m := New(eng, "secrets.example.com")
+
+	enr, err := m.Enroll(t.Context(), "secrets")
+	require.NoError(t, err)
+	assert.Len(t, enr.Secret, 32)
+	require.Len(t, enr.Recovery, recoveryCodes)
+	assert.Regexp(t, `^[a-z2-7]{4}-[a-z2-7]{4}-[a-z2-7]{4}-[a-z2-7]{4}$`, enr.Recovery[0])
+
+	u, err := url.Parse(enr.URI)
+	require.NoError(t, err)
+	assert.Equal(t, "otpauth", u.Scheme)
+	assert.Equal(t, "totp", u.Host)
+	assert.Equal(t, "/secrets.example.com:secrets", u.Path)
+	assert.Equal(t, enr.Secret, u.Query().Get("secret"))
+	assert.Equal(t, "secrets.example.com", u.Query().Get("issuer"))
+	assert.Equal(t, "6", u.Query().Get("digits"))
+
+	stored, err := eng.LoadTOTP(t.Context(), "secrets")
+	require.NoError(t, err)
+	assert.Equal(t, enr.Secret, stored.Secret)
+	require.Len(t, stored.Recovery, recoveryCodes)
+	for _, code := range enr.Recovery {
+		assert.NotContains(t, stored.Recovery, code, "recovery codes stored hashed")
+	}
+
+	enabled, err := m.Enabled(t.Context(), "secrets")
+	require.NoError(t, err)
+	assert.True(t, enabled)
+	enabled, err = m.Enabled(t.Context(), "bob")
+	require.NoError(t, err)
+	assert.False(t, enabled)
+
+	require.NoError(t, m.Disable(t.Context(), "secrets"))
+	require.ErrorIs(t, m.Disable(t.Context(), "secrets"), ErrNotEnrolled)
+	require.ErrorIs(t, m.Verify(t.Context(), "secrets", "123456"), ErrNotEnrolled)
+}
+
+func TestManager_Verify(t *testing.T) {
+	eng := store.NewInMemory(time.Minute)
+	defer eng.Close()
+	now := time.Unix(1_700_000_000, 0)
+	m := New(eng, "secrets")
+	m.now = func() time.Time { return now }
+
+	enr, err := m.Enroll(t.Context(), "secrets")
+	require.NoError(t, err)
+	secret, err := b32.DecodeString(enr.Secret)
+	require.NoError(t, err)
+	codeAt := func(ts time.Time) string { return generate(secret, ts.Unix()/period) }
+
+	require.NoError(t, m.Verify(t.Context(), "secrets", codeAt(now)))
+	require.ErrorIs(t, m.Verify(t.Context(), "secrets", codeAt(now)), ErrInvalid, "code replayed")
+
+	// phone clock off by one step is fine, but not older than the last used code
+	now = now.Add(5 * period * time.Second)
+	require.NoError(t, m.Verify(t.Context(), "secrets", codeAt(now.Add(period*time.Second))))
+	require.ErrorIs(t, m.Verify(t.Context(), "secrets", codeAt(now)), ErrInvalid, "older than the used one")
+	now = now.Add(5 * period * time.Second)
+	code := codeAt(now.Add(-period * time.Second))
+	require.NoError(t, m.Verify(t.Context(), "secrets", code[:3]+" "+code[3:]), "spaces ignored")
+	require.ErrorIs(t, m.Verify(t.Context(), "secrets", codeAt(now.Add(-2*period*time.Second))), ErrInvalid,
+		"too old")
+	require.ErrorIs(t, m.Verify(t.Context(), "secrets", codeAt(now.Add(2*period*time.Second))), ErrInvalid,
+		"too far ahead")
+	require.ErrorIs(t, m.Verify(t.Context(), "secrets", ""), ErrInvalid)
+
+	// recovery codes are single use, case and dashes don't matter
+	require.NoError(t, m.Verify(t.Context(), "secrets", enr.Recovery[0]))
+	require.ErrorIs(t, m.Verify(t.Context(), "secrets", enr.Recovery[0]), ErrInvalid, "recovery code used")
+	require.NoError(t, m.Verify(t.Context(), "secrets", strings.ToUpper(strings.ReplaceAll(enr.Recovery[1], "-", ""))))
+	require.ErrorIs(t, m.Verify(t.Context(), "secrets", "aaaa-bbbb-cccc-dddd"), ErrInvalid)
+	stored, err := eng.LoadTOTP(t.Context(), "secrets")
+	require.NoError(t, err)
+	assert.Len(t, stored.Recovery, recoveryCodes-2)
+
+	// enrolled again, old recovery codes are gone
+	_, err = m.Enroll(t.Context(), "secrets")
+	require.NoError(t, err)
+	require.ErrorIs(t, m.Verify(t.Context(), "secrets", enr.Recovery[2]), ErrInvalid)
+}
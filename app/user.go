@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/umputun/secrets/v2/app/users"
+)
+
+// userCmd is "secrets user", it manages named users kept in users table of the engine
+type userCmd struct {
+	Set    userNameCmd `command:"set" description:"add user or change password, the password is read from stdin"`
+	List   struct{}    `command:"list" description:"list users"`
+	Remove userNameCmd `command:"remove" description:"remove user"`
+}
+
+type userNameCmd struct {
+	Args struct {
+		Name string `positional-arg-name:"name" required:"yes"`
+	} `positional-args:"yes"`
+}
+
+// runUserSet reads password from the first line of in and saves the user, so the password is not in shell history
+func runUserSet(ctx context.Context, tbl *users.Table, name string, in io.Reader, out io.Writer) error {
+	password, err := bufio.NewReader(in).ReadString('\n')
+	if err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("read password: %w", err)
+	}
+	password = strings.TrimRight(password, "\r\n")
+	if password == "" {
+		return errors.New("empty password, pass it to stdin")
+	}
+	if err = tbl.Set(ctx, name, password); err != nil {
+		return fmt.Errorf("set user: %w", err)
+	}
+	_, _ = fmt.Fprintf(out, "user %s saved\n", name)
+	return nil
+}
+
+// runUserList prints user names with creation time to out
+func runUserList(ctx context.Context, tbl *users.Table, out io.Writer) error {
+	list, err := tbl.List(ctx)
+	if err != nil {
+		return err //nolint:wrapcheck // already wrapped by table
+	}
+	if len(list) == 0 {
+		_, _ = fmt.Fprintln(out, "no users")
+		return nil
+	}
+	for _, u := range list {
+		_, _ = fmt.Fprintf(out, "%s\t%s\n", u.Name, u.Created.Format(time.DateTime))
+	}
+	return nil
+}
+
+// runUserRemove removes user, sessions of the user are rejected right away
+func runUserRemove(ctx context.Context, tbl *users.Table, name string, out io.Writer) error {
+	if err := tbl.Remove(ctx, name); err != nil {
+		return err //nolint:wrapcheck // already wrapped by table
+	}
+	_, _ = fmt.Fprintf(out, "user %s removed\n", name)
+	return nil
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/umputun/secrets/v2/app/server"
+	"github.com/umputun/secrets/v2/app/store"
+	"github.com/umputun/secrets/v2/app/users"
+)
+
+func TestRunUser(t *testing.T) {
+	url, eng := prepClientServer(t, server.Config{PinSize: 5},
+		func(srv server.Server, eng *store.SQLite) server.Server { return srv.WithUsers(users.NewTable(eng)) })
+	usersTbl := users.NewTable(eng)
+
+	// send makes text secret as the user, the way "secrets send" does it
+	send := func(t *testing.T, user, password string) error {
+		t.Helper()
+		cmd := sendCmd{Server: url, User: user, Password: password, Pin: "12345", Exp: time.Hour, Views: 1,
+			Timeout: 5 * time.Second}
+		return runSend(t.Context(), cmd, strings.NewReader("my secret"), &bytes.Buffer{}, &bytes.Buffer{})
+	}
+
+	out := bytes.Buffer{}
+	require.NoError(t, runUserList(t.Context(), usersTbl, &out))
+	assert.Equal(t, "no users\n", out.String())
+
+	tbl := []struct {
+		name, user, in string
+		wantPassword   string // password accepted by server after set
+		wantErr        string
+	}{
+		{name: "password line", user: "bob", in: "bob-pass\n", wantPassword: "bob-pass"},
+		{name: "without newline", user: "alice", in: "alice-pass", wantPassword: "alice-pass"},
+		{name: "first line only", user: "carol", in: "carol pass\r\nsecond line\n", wantPassword: "carol pass"},
+		{name: "password changed", user: "bob", in: "new-pass\n", wantPassword: "new-pass"},
+		{name: "empty input", user: "dave", in: "", wantErr: "empty password, pass it to stdin"},
+		{name: "empty line", user: "dave", in: "\nsecond line\n", wantErr: "empty password, pass it to stdin"},
+		{name: "bad name", user: "dave:admin", in: "pass\n", wantErr: "set user"},
+	}
+	for _, tc := range tbl {
+		t.Run(tc.name, func(t *testing.T) {
+			out := bytes.Buffer{}
+			err := runUserSet(t.Context(), usersTbl, tc.user, strings.NewReader(tc.in), &out)
+			if tc.wantErr != "" {
+				require.ErrorContains(t, err, tc.wantErr)
+				assert.Empty(t, out.String())
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, "user "+tc.user+" saved\n", out.String())
+			require.NoError(t, send(t, tc.user, tc.wantPassword))
+			require.Error(t, send(t, tc.user, tc.wantPassword+"x"), "wrong password rejected")
+		})
+	}
+	require.Error(t, send(t, "bob", "bob-pass"), "old password rejected after change")
+
+	out.Reset()
+	require.NoError(t, runUserList(t.Context(), usersTbl, &out))
+	assert.Regexp(t, `^alice\t\S+ \S+\nbob\t\S+ \S+\ncarol\t\S+ \S+\n$`, out.String())
+
+	out.Reset()
+	require.NoError(t, runUserRemove(t.Context(), usersTbl, "bob", &out))
+	assert.Equal(t, "user bob removed\n", out.String())
+	require.Error(t, send(t, "bob", "new-pass"), "removed user rejected by server")
+	require.NoError(t, send(t, "alice", "alice-pass"))
+	require.ErrorIs(t, runUserRemove(t.Context(), usersTbl, "bob", &out), users.ErrNotFound)
+}
@@ -0,0 +1,259 @@
+package users
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+	log "github.com/go-pkgz/lgr"
+)
+
+// LDAPConfig of LDAP or Active Directory server
+type LDAPConfig struct {
+	URL          string        // ldap://host:389 or ldaps://host:636
+	StartTLS     bool          // upgrade ldap:// connection with StartTLS
+	TLS          *tls.Config   // config of LDAPS and StartTLS, system roots if nil
+	BindDN       string        // service account searching users, anonymous search if empty
+	BindPassword string        // password of service account
+	BaseDN       string        // search base of users
+	UserFilter   string        // filter of user with %s for escaped user name, like (sAMAccountName=%s)
+	GroupFilter  string        // optional filter user has to match too, like (memberOf=cn=secrets,ou=groups,dc=example,dc=com)
+	PoolSize     int           // max open connections, 4 if not set
+	Timeout      time.Duration // dial and request timeout, 10s if not set
+}
+
+// LDAP checks users with bind to LDAP or Active Directory. The user is found by service account with
+// user and group filters, and the password is checked by bind with user's DN.
+type LDAP struct {
+	cfg  LDAPConfig
+	pool *ldapPool
+}
+
+// NewLDAP makes LDAP users checker. Connections are made on demand, the server is not contacted here.
+func NewLDAP(cfg LDAPConfig) (*LDAP, error) {
+	if cfg.URL == "" || cfg.BaseDN == "" {
+		return nil, errors.New("ldap url and base dn required")
+	}
+	if strings.Count(cfg.UserFilter, "%s") == 0 {
+		return nil, fmt.Errorf("ldap user filter %q has no %%s for user name", cfg.UserFilter)
+	}
+	if cfg.StartTLS && strings.HasPrefix(strings.ToLower(cfg.URL), "ldaps://") {
+		return nil, errors.New("ldap starttls can't be used with ldaps:// url")
+	}
+	if cfg.PoolSize <= 0 {
+		cfg.PoolSize = 4
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = 10 * time.Second
+	}
+	l := &LDAP{cfg: cfg}
+	l.pool = newLDAPPool(cfg.PoolSize, l.dial)
+	return l, nil
+}
+
+// Check verifies password of the user with bind
+func (l *LDAP) Check(ctx context.Context, name, password string) bool {
+	// empty password makes unauthenticated bind, which succeeds on most servers
+	if password == "" || ValidateName(name) != nil {
+		return false
+	}
+	conn, err := l.pool.get(ctx)
+	if err != nil {
+		log.Printf("[WARN] ldap connection failed, %v", err)
+		return false
+	}
+
+	dn, err := l.findUser(conn, name)
+	if err != nil {
+		l.pool.put(conn, !isLDAPConnError(err))
+		if !errors.Is(err, ErrNotFound) {
+			log.Printf("[WARN] ldap search of %q failed, %v", name, err)
+		}
+		return false
+	}
+
+	bindErr := conn.Bind(dn, password)
+	// switch the connection back to service account before reuse, drop it if that fails
+	l.pool.put(conn, l.bindService(conn) == nil)
+	if bindErr != nil {
+		if !ldap.IsErrorWithCode(bindErr, ldap.LDAPResultInvalidCredentials) {
+			log.Printf("[WARN] ldap bind of %q failed, %v", name, bindErr)
+		}
+		return false
+	}
+	return true
+}
+
+// Exists checks if the user is still in the directory and matches group filter
+func (l *LDAP) Exists(ctx context.Context, name string) bool {
+	if ValidateName(name) != nil {
+		return false
+	}
+	conn, err := l.pool.get(ctx)
+	if err != nil {
+		log.Printf("[WARN] ldap connection failed, %v", err)
+		return false
+	}
+	_, err = l.findUser(conn, name)
+	l.pool.put(conn, err == nil || !isLDAPConnError(err))
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		log.Printf("[WARN] ldap search of %q failed, %v", name, err)
+	}
+	return err == nil
+}
+
+// Close closes idle connections
+func (l *LDAP) Close() {
+	l.pool.close()
+}
+
+// findUser returns DN of the only entry matching user and group filters
+func (l *LDAP) findUser(conn *ldap.Conn, name string) (string, error) {
+	filter := strings.ReplaceAll(l.cfg.UserFilter, "%s", ldap.EscapeFilter(name))
+	if l.cfg.GroupFilter != "" {
+		filter = "(&" + filter + l.cfg.GroupFilter + ")"
+	}
+	req := ldap.NewSearchRequest(l.cfg.BaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 2,
+		int(l.cfg.Timeout.Seconds()), false, filter, []string{"dn"}, nil)
+	res, err := conn.Search(req)
+	if err != nil {
+		return "", fmt.Errorf("search: %w", err)
+	}
+	if len(res.Entries) != 1 {
+		return "", fmt.Errorf("%w: %d entries for %s", ErrNotFound, len(res.Entries), name)
+	}
+	return res.Entries[0].DN, nil
+}
+
+// dial connects to the server, upgrades with StartTLS if enabled, and binds as service account
+func (l *LDAP) dial() (*ldap.Conn, error) {
+	conn, err := ldap.DialURL(l.cfg.URL, ldap.DialWithDialer(&net.Dialer{Timeout: l.cfg.Timeout}),
+		ldap.DialWithTLSConfig(l.tlsConfig()))
+	if err != nil {
+		return nil, fmt.Errorf("dial %s: %w", l.cfg.URL, err)
+	}
+	conn.SetTimeout(l.cfg.Timeout)
+	if l.cfg.StartTLS {
+		if err = conn.StartTLS(l.tlsConfig()); err != nil {
+			_ = conn.Close()
+			return nil, fmt.Errorf("starttls: %w", err)
+		}
+	}
+	if err = l.bindService(conn); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// bindService binds as service account, or makes the connection anonymous if there is no service account
+func (l *LDAP) bindService(conn *ldap.Conn) error {
+	if l.cfg.BindDN == "" {
+		if err := conn.UnauthenticatedBind(""); err != nil {
+			return fmt.Errorf("anonymous bind: %w", err)
+		}
+		return nil
+	}
+	if err := conn.Bind(l.cfg.BindDN, l.cfg.BindPassword); err != nil {
+		return fmt.Errorf("bind as %s: %w", l.cfg.BindDN, err)
+	}
+	return nil
+}
+
+// tlsConfig returns TLS config with server name of the url, ldap package doesn't set it for StartTLS
+func (l *LDAP) tlsConfig() *tls.Config {
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+	if l.cfg.TLS != nil {
+		cfg = l.cfg.TLS.Clone()
+	}
+	if cfg.ServerName == "" {
+		if u, err := url.Parse(l.cfg.URL); err == nil {
+			cfg.ServerName = u.Hostname()
+		}
+	}
+	return cfg
+}
+
+// isLDAPConnError checks if the error is a broken connection rather than a result of the request
+func isLDAPConnError(err error) bool {
+	var ldapErr *ldap.Error
+	if !errors.As(err, &ldapErr) {
+		return !errors.Is(err, ErrNotFound)
+	}
+	return ldapErr.ResultCode == ldap.ErrorNetwork || ldapErr.ResultCode == ldap.ErrorUnexpectedResponse
+}
+
+// ldapPool keeps up to size open connections. Idle connections are reused for a minute, servers and
+// firewalls drop them silently after a while.
+type ldapPool struct {
+	sem  chan struct{} // taken by each connection in use
+	idle chan idleConn
+	dial func() (*ldap.Conn, error)
+}
+
+type idleConn struct {
+	conn  *ldap.Conn
+	since time.Time
+}
+
+const ldapIdleTimeout = time.Minute
+
+func newLDAPPool(size int, dial func() (*ldap.Conn, error)) *ldapPool {
+	return &ldapPool{sem: make(chan struct{}, size), idle: make(chan idleConn, size), dial: dial}
+}
+
+// get returns idle connection or dials a new one, waits while all connections are in use
+func (p *ldapPool) get(ctx context.Context) (*ldap.Conn, error) {
+	select {
+	case p.sem <- struct{}{}:
+	case <-ctx.Done():
+		return nil, fmt.Errorf("wait for ldap connection: %w", ctx.Err())
+	}
+	for {
+		select {
+		case ic := <-p.idle:
+			if time.Since(ic.since) > ldapIdleTimeout || ic.conn.IsClosing() {
+				_ = ic.conn.Close()
+				continue
+			}
+			return ic.conn, nil
+		default:
+			conn, err := p.dial()
+			if err != nil {
+				<-p.sem
+				return nil, err
+			}
+			return conn, nil
+		}
+	}
+}
+
+// put returns connection to the pool, or closes it if not reusable
+func (p *ldapPool) put(conn *ldap.Conn, reuse bool) {
+	defer func() { <-p.sem }()
+	if reuse {
+		select {
+		case p.idle <- idleConn{conn: conn, since: time.Now()}:
+			return
+		default:
+		}
+	}
+	_ = conn.Close()
+}
+
+func (p *ldapPool) close() {
+	for {
+		select {
+		case ic := <-p.idle:
+			_ = ic.conn.Close()
+		default:
+			return
+		}
+	}
+}
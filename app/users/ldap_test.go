@@ -0,0 +1,332 @@
+package users
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"math/big"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/jimlambrt/gldap"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	testBaseDN    = "ou=people,dc=example,dc=com"
+	testServiceDN = "cn=svc,dc=example,dc=com"
+	testGroupDN   = "cn=secrets,ou=groups,dc=example,dc=com"
+)
+
+func TestLDAP(t *testing.T) {
+	srv := startLDAPServer(t, ldapServerOpts{})
+	l, err := NewLDAP(LDAPConfig{URL: srv.url, BindDN: testServiceDN, BindPassword: "svc-pass", BaseDN: testBaseDN,
+		UserFilter: "(uid=%s)", GroupFilter: "(memberOf=" + testGroupDN + ")"})
+	require.NoError(t, err)
+	defer l.Close()
+
+	assert.True(t, l.Check(t.Context(), "bob", "bob-pass"))
+	assert.True(t, l.Check(t.Context(), "bob", "bob-pass"), "connection reused after user bind")
+	assert.False(t, l.Check(t.Context(), "bob", "alice-pass"))
+	assert.False(t, l.Check(t.Context(), "bob", ""), "empty password is unauthenticated bind")
+	assert.False(t, l.Check(t.Context(), "alice", "alice-pass"), "not in group")
+	assert.False(t, l.Check(t.Context(), "carol", "carol-pass"))
+	assert.False(t, l.Check(t.Context(), "*", "bob-pass"), "filter escaped")
+	assert.False(t, l.Check(t.Context(), "bob)(uid=*", "bob-pass"), "filter escaped")
+	assert.True(t, l.Exists(t.Context(), "bob"))
+	assert.False(t, l.Exists(t.Context(), "alice"))
+	assert.False(t, l.Exists(t.Context(), "carol"))
+	assert.Equal(t, 1, srv.dials(), "single connection reused")
+
+	t.Run("without group filter", func(t *testing.T) {
+		l, err := NewLDAP(LDAPConfig{URL: srv.url, BindDN: testServiceDN, BindPassword: "svc-pass", BaseDN: testBaseDN,
+			UserFilter: "(uid=%s)"})
+		require.NoError(t, err)
+		defer l.Close()
+		assert.True(t, l.Check(t.Context(), "alice", "alice-pass"))
+	})
+
+	t.Run("wrong service password", func(t *testing.T) {
+		l, err := NewLDAP(LDAPConfig{URL: srv.url, BindDN: testServiceDN, BindPassword: "bad", BaseDN: testBaseDN,
+			UserFilter: "(uid=%s)"})
+		require.NoError(t, err)
+		defer l.Close()
+		assert.False(t, l.Check(t.Context(), "bob", "bob-pass"))
+	})
+
+	t.Run("bad config", func(t *testing.T) {
+		_, err := NewLDAP(LDAPConfig{URL: srv.url, BaseDN: testBaseDN, UserFilter: "(uid=bob)"})
+		require.Error(t, err)
+		_, err = NewLDAP(LDAPConfig{URL: srv.url, UserFilter: "(uid=%s)"})
+		require.Error(t, err)
+		_, err = NewLDAP(LDAPConfig{URL: "ldaps://localhost", BaseDN: testBaseDN, UserFilter: "(uid=%s)", StartTLS: true})
+		require.Error(t, err)
+	})
+}
+
+func TestLDAP_Anonymous(t *testing.T) {
+	srv := startLDAPServer(t, ldapServerOpts{anonymous: true})
+	l, err := NewLDAP(LDAPConfig{URL: srv.url, BaseDN: testBaseDN, UserFilter: "(uid=%s)"})
+	require.NoError(t, err)
+	defer l.Close()
+	assert.True(t, l.Check(t.Context(), "alice", "alice-pass"))
+	assert.True(t, l.Check(t.Context(), "bob", "bob-pass"))
+	assert.False(t, l.Check(t.Context(), "bob", "alice-pass"))
+	assert.Equal(t, 1, srv.dials())
+}
+
+func TestLDAP_TLS(t *testing.T) {
+	cert, roots := testCert(t)
+
+	t.Run("ldaps", func(t *testing.T) {
+		srv := startLDAPServer(t, ldapServerOpts{tls: &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}})
+		url := strings.Replace(srv.url, "ldap://", "ldaps://", 1)
+		l, err := NewLDAP(LDAPConfig{URL: url, BindDN: testServiceDN, BindPassword: "svc-pass", BaseDN: testBaseDN,
+			UserFilter: "(uid=%s)", TLS: &tls.Config{RootCAs: roots, MinVersion: tls.VersionTLS12}})
+		require.NoError(t, err)
+		defer l.Close()
+		assert.True(t, l.Check(t.Context(), "bob", "bob-pass"))
+
+		untrusted, err := NewLDAP(LDAPConfig{URL: url, BindDN: testServiceDN, BindPassword: "svc-pass", BaseDN: testBaseDN,
+			UserFilter: "(uid=%s)"})
+		require.NoError(t, err)
+		assert.False(t, untrusted.Check(t.Context(), "bob", "bob-pass"), "self-signed cert not trusted")
+	})
+
+	t.Run("starttls", func(t *testing.T) {
+		srv := startLDAPServer(t, ldapServerOpts{startTLS: &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}})
+		l, err := NewLDAP(LDAPConfig{URL: srv.url, StartTLS: true, BindDN: testServiceDN, BindPassword: "svc-pass",
+			BaseDN: testBaseDN, UserFilter: "(uid=%s)", TLS: &tls.Config{RootCAs: roots, MinVersion: tls.VersionTLS12}})
+		require.NoError(t, err)
+		defer l.Close()
+		assert.True(t, l.Check(t.Context(), "bob", "bob-pass"))
+		assert.False(t, l.Check(t.Context(), "bob", "alice-pass"))
+	})
+}
+
+func TestLDAP_Pool(t *testing.T) {
+	srv := startLDAPServer(t, ldapServerOpts{})
+	l, err := NewLDAP(LDAPConfig{URL: srv.url, BindDN: testServiceDN, BindPassword: "svc-pass", BaseDN: testBaseDN,
+		UserFilter: "(uid=%s)", PoolSize: 2})
+	require.NoError(t, err)
+	defer l.Close()
+
+	var wg sync.WaitGroup
+	for range 20 {
+		wg.Go(func() { assert.True(t, l.Check(t.Context(), "bob", "bob-pass")) })
+	}
+	wg.Wait()
+	assert.LessOrEqual(t, srv.dials(), 2, "connections limited by pool size")
+
+	t.Run("canceled while all connections in use", func(t *testing.T) {
+		l, err := NewLDAP(LDAPConfig{URL: srv.url, BindDN: testServiceDN, BindPassword: "svc-pass", BaseDN: testBaseDN,
+			UserFilter: "(uid=%s)", PoolSize: 1})
+		require.NoError(t, err)
+		defer l.Close()
+		conn, err := l.pool.get(t.Context())
+		require.NoError(t, err)
+		ctx, cancel := context.WithTimeout(t.Context(), 50*time.Millisecond)
+		defer cancel()
+		assert.False(t, l.Check(ctx, "bob", "bob-pass"))
+		l.pool.put(conn, true)
+		assert.True(t, l.Check(t.Context(), "bob", "bob-pass"))
+	})
+}
+
+func TestLDAP_Timeout(t *testing.T) {
+	// server accepting connections and never answering
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			t.Cleanup(func() { _ = conn.Close() })
+		}
+	}()
+
+	l, err := NewLDAP(LDAPConfig{URL: "ldap://" + ln.Addr().String(), BindDN: testServiceDN, BindPassword: "svc-pass",
+		BaseDN: testBaseDN, UserFilter: "(uid=%s)", Timeout: 100 * time.Millisecond})
+	require.NoError(t, err)
+	defer l.Close()
+	st := time.Now()
+	assert.False(t, l.Check(t.Context(), "bob", "bob-pass"))
+	assert.Less(t, time.Since(st), 2*time.Second)
+}
+
+type ldapServerOpts struct {
+	anonymous bool        // allow anonymous search
+	tls       *tls.Config // ldaps listener
+	startTLS  *tls.Config // allow StartTLS with the config
+}
+
+// testLDAPServer is in-process LDAP server with users bob (in group) and alice. It supports binds and
+// searches with filters of equality terms joined with &.
+type testLDAPServer struct {
+	url string
+
+	mu    sync.Mutex
+	bound map[int]string // dn of the last bind by connection id
+}
+
+func (s *testLDAPServer) dials() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.bound)
+}
+
+func startLDAPServer(t *testing.T, opts ldapServerOpts) *testLDAPServer {
+	t.Helper()
+	entries := map[string]map[string][]string{
+		testServiceDN:                  {"cn": {"svc"}, "userPassword": {"svc-pass"}},
+		"uid=bob," + testBaseDN:        {"uid": {"bob"}, "userPassword": {"bob-pass"}, "memberOf": {testGroupDN}},
+		"uid=alice," + testBaseDN:      {"uid": {"alice"}, "userPassword": {"alice-pass"}},
+		"uid=carol,ou=other,dc=x,dc=y": {"uid": {"carol"}, "userPassword": {"carol-pass"}},
+	}
+	s := &testLDAPServer{bound: map[int]string{}}
+
+	server, err := gldap.NewServer(gldap.WithLogger(hclog.NewNullLogger()))
+	require.NoError(t, err)
+	mux, err := gldap.NewMux()
+	require.NoError(t, err)
+
+	require.NoError(t, mux.Bind(func(w *gldap.ResponseWriter, r *gldap.Request) {
+		resp := r.NewBindResponse(gldap.WithResponseCode(gldap.ResultInvalidCredentials))
+		defer func() { _ = w.Write(resp) }()
+		m, err := r.GetSimpleBindMessage()
+		if err != nil {
+			return
+		}
+		ok := m.UserName == "" && m.Password == "" && opts.anonymous
+		if e, found := entries[m.UserName]; found && m.Password != "" && string(m.Password) == e["userPassword"][0] {
+			ok = true
+		}
+		s.mu.Lock()
+		s.bound[r.ConnectionID()] = ""
+		if ok {
+			s.bound[r.ConnectionID()] = "dn:" + m.UserName
+			resp.SetResultCode(gldap.ResultSuccess)
+		}
+		s.mu.Unlock()
+	}))
+
+	require.NoError(t, mux.Search(func(w *gldap.ResponseWriter, r *gldap.Request) {
+		resp := r.NewSearchDoneResponse(gldap.WithResponseCode(gldap.ResultInsufficientAccessRights))
+		defer func() { _ = w.Write(resp) }()
+		m, err := r.GetSearchMessage()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		boundAs := s.bound[r.ConnectionID()]
+		s.mu.Unlock()
+		// only service account and anonymous allowed to search, users can't
+		if boundAs != "dn:"+testServiceDN && (boundAs != "dn:" || !opts.anonymous) {
+			return
+		}
+		for dn, attrs := range entries {
+			if strings.HasSuffix(dn, m.BaseDN) && matchTestFilter(t, m.Filter, attrs) {
+				_ = w.Write(r.NewSearchResponseEntry(dn))
+			}
+		}
+		resp.SetResultCode(gldap.ResultSuccess)
+	}))
+
+	if opts.startTLS != nil {
+		require.NoError(t, mux.ExtendedOperation(func(w *gldap.ResponseWriter, r *gldap.Request) {
+			resp := r.NewExtendedResponse(gldap.WithResponseCode(gldap.ResultSuccess))
+			resp.SetResponseName(gldap.ExtendedOperationStartTLS)
+			_ = w.Write(resp)
+			_ = r.StartTLS(opts.startTLS)
+		}, gldap.ExtendedOperationStartTLS))
+	}
+	require.NoError(t, server.Router(mux))
+
+	// pick free port, gldap doesn't expose the listener
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := ln.Addr().String()
+	require.NoError(t, ln.Close())
+
+	var runOpts []gldap.Option
+	if opts.tls != nil {
+		runOpts = append(runOpts, gldap.WithTLSConfig(opts.tls))
+	}
+	go func() { _ = server.Run(addr, runOpts...) }()
+	t.Cleanup(func() { _ = server.Stop() })
+	require.Eventually(t, server.Ready, time.Second, time.Millisecond)
+	s.url = "ldap://" + addr
+	return s
+}
+
+// matchTestFilter evaluates filter of equality terms like (uid=bob) or (&(uid=bob)(memberOf=cn=x)), case-insensitive
+func matchTestFilter(t *testing.T, filter string, attrs map[string][]string) bool {
+	if inner, ok := strings.CutPrefix(filter, "(&"); ok {
+		for term := range strings.SplitAfterSeq(strings.TrimSuffix(inner, ")"), ")") {
+			if term != "" && !matchTestFilter(t, term, attrs) {
+				return false
+			}
+		}
+		return true
+	}
+	name, value, ok := strings.Cut(strings.TrimSuffix(strings.TrimPrefix(filter, "("), ")"), "=")
+	require.True(t, ok, "unsupported filter %s", filter)
+	value = unescapeTestFilter(t, value)
+	for attr, values := range attrs {
+		if strings.EqualFold(attr, name) {
+			for _, v := range values {
+				if strings.EqualFold(v, value) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// unescapeTestFilter decodes \XX escapes of filter value
+func unescapeTestFilter(t *testing.T, value string) string {
+	var sb strings.Builder
+	for i := 0; i < len(value); i++ {
+		if value[i] == '\\' && i+2 < len(value) {
+			b, err := hex.DecodeString(value[i+1 : i+3])
+			require.NoError(t, err)
+			sb.Write(b)
+			i += 2
+			continue
+		}
+		sb.WriteByte(value[i])
+	}
+	return sb.String()
+}
+
+// testCert makes self-signed certificate of 127.0.0.1 and pool trusting it
+func testCert(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	tmpl := &x509.Certificate{SerialNumber: big.NewInt(1), Subject: pkix.Name{CommonName: "test ldap"},
+		IPAddresses: []net.IP{net.ParseIP("127.0.0.1")}, NotBefore: time.Now().Add(-time.Hour),
+		NotAfter: time.Now().Add(time.Hour), KeyUsage: x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}, BasicConstraintsValid: true, IsCA: true}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.NoError(t, err)
+	parsed, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	roots := x509.NewCertPool()
+	roots.AddCert(parsed)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: parsed}, roots
+}
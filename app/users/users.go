@@ -0,0 +1,196 @@
+// Package users checks credentials of named creators, kept in htpasswd file, in users table of the store,
+// or in LDAP / Active Directory. Only bcrypt password hashes are supported by file and table.
+package users
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/go-pkgz/lgr"
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/umputun/secrets/v2/app/store"
+)
+
+// Errors
+var (
+	ErrNotFound = errors.New("user not found")
+	ErrBadName  = errors.New("user name must be 1-64 characters without colon and spaces")
+)
+
+// dummyHash is compared for unknown users, so the response time doesn't tell which users exist
+var dummyHash = sync.OnceValue(func() []byte {
+	h, _ := bcrypt.GenerateFromPassword([]byte("dummy password"), bcrypt.DefaultCost)
+	return h
+})
+
+// File is a list of users from htpasswd-style file, lines of user:bcrypt-hash. Empty lines and # comments ignored.
+type File struct {
+	path string
+
+	mu     sync.RWMutex
+	hashes map[string][]byte
+}
+
+// NewFile loads users from htpasswd file
+func NewFile(path string) (*File, error) {
+	f := &File{path: path}
+	if err := f.Reload(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Reload reads the file again. On error the users loaded before are kept.
+func (f *File) Reload() error {
+	fh, err := os.Open(f.path)
+	if err != nil {
+		return fmt.Errorf("open users file: %w", err)
+	}
+	defer fh.Close()
+
+	hashes := map[string][]byte{}
+	scanner := bufio.NewScanner(fh)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		name, hash, ok := strings.Cut(text, ":")
+		if !ok || ValidateName(name) != nil {
+			return fmt.Errorf("users file %s, line %d: expected user:hash", f.path, line)
+		}
+		if _, err = bcrypt.Cost([]byte(hash)); err != nil {
+			return fmt.Errorf("users file %s, line %d: hash of %q is not bcrypt", f.path, line, name)
+		}
+		if _, dup := hashes[name]; dup {
+			return fmt.Errorf("users file %s, line %d: duplicate user %q", f.path, line, name)
+		}
+		hashes[name] = []byte(hash)
+	}
+	if err = scanner.Err(); err != nil {
+		return fmt.Errorf("read users file: %w", err)
+	}
+
+	f.mu.Lock()
+	f.hashes = hashes
+	f.mu.Unlock()
+	log.Printf("[INFO] loaded %d user(s) from %s", len(hashes), f.path)
+	return nil
+}
+
+// Check verifies password of the user
+func (f *File) Check(_ context.Context, name, password string) bool {
+	f.mu.RLock()
+	hash, ok := f.hashes[name]
+	f.mu.RUnlock()
+	return checkHash(hash, ok, password)
+}
+
+// Exists checks if the user is in the file, removed users lose their sessions after reload
+func (f *File) Exists(_ context.Context, name string) bool {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	_, ok := f.hashes[name]
+	return ok
+}
+
+// Store is a persistent storage of users, implemented by all store engines
+type Store interface {
+	SaveUser(ctx context.Context, u *store.User) error
+	LoadUser(ctx context.Context, name string) (*store.User, error)
+	ListUsers(ctx context.Context) ([]store.User, error)
+	RemoveUser(ctx context.Context, name string) error
+}
+
+// Table is a list of users kept in the store, changes apply without restart
+type Table struct {
+	store Store
+}
+
+// NewTable makes Table with the store
+func NewTable(s Store) *Table {
+	return &Table{store: s}
+}
+
+// Set adds the user or changes password of the existing one
+func (t *Table) Set(ctx context.Context, name, password string) error {
+	if err := ValidateName(name); err != nil {
+		return err
+	}
+	if password == "" || len(password) > 72 {
+		return errors.New("password must be 1-72 bytes")
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return fmt.Errorf("hash password: %w", err)
+	}
+	u := &store.User{Name: name, Hash: string(hash), Created: time.Now().Truncate(time.Second)}
+	if existing, loadErr := t.store.LoadUser(ctx, name); loadErr == nil {
+		u.Created = existing.Created
+	}
+	if err = t.store.SaveUser(ctx, u); err != nil {
+		return fmt.Errorf("save user: %w", err)
+	}
+	log.Printf("[INFO] saved user %s", name)
+	return nil
+}
+
+// List returns all users ordered by name
+func (t *Table) List(ctx context.Context) ([]store.User, error) {
+	res, err := t.store.ListUsers(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("list users: %w", err)
+	}
+	return res, nil
+}
+
+// Remove deletes the user, ErrNotFound if there is no such user
+func (t *Table) Remove(ctx context.Context, name string) error {
+	if err := t.store.RemoveUser(ctx, name); err != nil {
+		if errors.Is(err, store.ErrLoadRejected) {
+			return fmt.Errorf("%w: %s", ErrNotFound, name)
+		}
+		return fmt.Errorf("remove user: %w", err)
+	}
+	log.Printf("[INFO] removed user %s", name)
+	return nil
+}
+
+// Check verifies password of the user
+func (t *Table) Check(ctx context.Context, name, password string) bool {
+	u, err := t.store.LoadUser(ctx, name)
+	if err != nil {
+		return checkHash(nil, false, password)
+	}
+	return checkHash([]byte(u.Hash), true, password)
+}
+
+// Exists checks if the user is in the table, removed users lose their sessions
+func (t *Table) Exists(ctx context.Context, name string) bool {
+	_, err := t.store.LoadUser(ctx, name)
+	return err == nil
+}
+
+// ValidateName checks user name, it is used in logs and session cookie, and can't have colon for htpasswd format
+func ValidateName(name string) error {
+	if name == "" || len(name) > 64 || strings.ContainsAny(name, ": \t") {
+		return ErrBadName
+	}
+	return nil
+}
+
+// checkHash compares password with bcrypt hash, dummy hash used for unknown user to keep the timing
+func checkHash(hash []byte, found bool, password string) bool {
+	if !found {
+		_ = bcrypt.CompareHashAndPassword(dummyHash(), []byte(password))
+		return false
+	}
+	return bcrypt.CompareHashAndPassword(hash, []byte(password)) == nil
+}
@@ -0,0 +1,85 @@
+package users
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/umputun/secrets/v2/app/store"
+)
+
+func TestFile(t *testing.T) {
+	bob, err := bcrypt.GenerateFromPassword([]byte("bob-pass"), bcrypt.MinCost)
+	require.NoError(t, err)
+	alice, err := bcrypt.GenerateFromPassword([]byte("alice-pass"), bcrypt.MinCost)
+	require.NoError(t, err)
+
+	path := filepath.Join(t.TempDir(), "users.htpasswd")
+	require.NoError(t, os.WriteFile(path, []byte("# creators\nbob:"+string(bob)+"\n\n"), 0o600))
+
+	f, err := NewFile(path)
+	require.NoError(t, err)
+	assert.True(t, f.Check(t.Context(), "bob", "bob-pass"))
+	assert.False(t, f.Check(t.Context(), "bob", "alice-pass"))
+	assert.False(t, f.Check(t.Context(), "alice", "alice-pass"))
+	assert.True(t, f.Exists(t.Context(), "bob"))
+	assert.False(t, f.Exists(t.Context(), "alice"))
+
+	// alice added, bob removed
+	require.NoError(t, os.WriteFile(path, []byte("alice:"+string(alice)+"\n"), 0o600))
+	require.NoError(t, f.Reload())
+	assert.True(t, f.Check(t.Context(), "alice", "alice-pass"))
+	assert.False(t, f.Exists(t.Context(), "bob"))
+
+	t.Run("bad file keeps loaded users", func(t *testing.T) {
+		for _, content := range []string{"alice", "alice:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=", ":" + string(bob),
+			"alice:" + string(alice) + "\nalice:" + string(alice)} {
+			require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+			require.Error(t, f.Reload(), content)
+			assert.True(t, f.Check(t.Context(), "alice", "alice-pass"))
+		}
+	})
+
+	_, err = NewFile(filepath.Join(t.TempDir(), "missing"))
+	require.Error(t, err)
+}
+
+func TestTable(t *testing.T) {
+	eng := store.NewInMemory(time.Minute)
+	defer eng.Close()
+	tbl := NewTable(eng)
+
+	require.NoError(t, tbl.Set(t.Context(), "bob", "bob-pass"))
+	require.NoError(t, tbl.Set(t.Context(), "alice", "alice-pass"))
+	assert.True(t, tbl.Check(t.Context(), "bob", "bob-pass"))
+	assert.False(t, tbl.Check(t.Context(), "bob", "alice-pass"))
+	assert.False(t, tbl.Check(t.Context(), "carol", "bob-pass"))
+	assert.True(t, tbl.Exists(t.Context(), "alice"))
+
+	created, err := eng.LoadUser(t.Context(), "bob")
+	require.NoError(t, err)
+	require.NoError(t, tbl.Set(t.Context(), "bob", "new-pass"), "change password")
+	assert.True(t, tbl.Check(t.Context(), "bob", "new-pass"))
+	assert.False(t, tbl.Check(t.Context(), "bob", "bob-pass"))
+	changed, err := eng.LoadUser(t.Context(), "bob")
+	require.NoError(t, err)
+	assert.Equal(t, created.Created, changed.Created, "creation time kept")
+
+	list, err := tbl.List(t.Context())
+	require.NoError(t, err)
+	require.Len(t, list, 2)
+	assert.Equal(t, "alice", list[0].Name)
+
+	require.NoError(t, tbl.Remove(t.Context(), "bob"))
+	require.ErrorIs(t, tbl.Remove(t.Context(), "bob"), ErrNotFound)
+	assert.False(t, tbl.Exists(t.Context(), "bob"))
+
+	require.ErrorIs(t, tbl.Set(t.Context(), "bob:1", "pass"), ErrBadName)
+	require.ErrorIs(t, tbl.Set(t.Context(), "", "pass"), ErrBadName)
+	require.Error(t, tbl.Set(t.Context(), "carol", ""))
+}
@@ -0,0 +1,273 @@
+// Package webhook delivers signed notifications about message lifecycle events to http endpoints.
+// Payloads carry no secret content, only the key prefix, hashed client ip and timestamps.
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"sync"
+	"syscall"
+	"time"
+
+	log "github.com/go-pkgz/lgr"
+)
+
+// Event types
+const (
+	EventCreated   = "created"
+	EventAccessed  = "accessed"
+	EventPinFailed = "pin_failed"
+	EventBurned    = "burned" // removed after max wrong pin attempts
+	EventExpired   = "expired"
+)
+
+// keyPrefixLen is the number of message key characters sent out, enough to match the event with the sent link
+const keyPrefixLen = 4
+
+// Event describes what happened to a message
+type Event struct {
+	Type     string
+	Key      string    // full message key, only prefix sent out
+	Exp      time.Time // message expiration
+	Callback string    // per-message url notified in addition to configured ones, optional
+}
+
+// Payload is the json body of a webhook call
+type Payload struct {
+	Event     string    `json:"event"`
+	KeyPrefix string    `json:"key_prefix"`
+	IP        string    `json:"ip"` // hashed client ip, "-" for events without a client, like expiration
+	Time      time.Time `json:"time"`
+	Expires   time.Time `json:"expires"`
+}
+
+// Config for Dispatcher
+type Config struct {
+	URLs    []string                         // endpoints notified on every event
+	Secret  string                           // hmac key for X-Secrets-Signature header
+	Retries int                              // delivery attempts after the first failed one
+	Backoff time.Duration                    // delay before the first retry, doubled on each next one
+	Timeout time.Duration                    // single request timeout
+	IP      func(ctx context.Context) string // extracts hashed client ip from request context, optional
+	Client  *http.Client                     // optional, for testing; if nil, creates default client with Timeout
+
+	// CallbackClient delivers per-message callbacks, optional, for testing;
+	// if nil, creates client connecting to public addresses only
+	CallbackClient *http.Client
+}
+
+// Dispatcher sends webhooks asynchronously, retrying failed deliveries with backoff
+type Dispatcher struct {
+	cfg            Config
+	client         *http.Client    // for configured urls, trusted and may point to internal services
+	callbackClient *http.Client    // for per-message callbacks set by API clients
+	ctx            context.Context // canceled on Close to stop pending retries
+	cancel         context.CancelFunc
+	wg             sync.WaitGroup
+}
+
+// New makes Dispatcher with the given configuration
+func New(cfg Config) (*Dispatcher, error) {
+	if cfg.Secret == "" {
+		return nil, errors.New("webhook secret is required")
+	}
+	for _, u := range cfg.URLs {
+		if err := ValidateURL(u); err != nil {
+			return nil, err
+		}
+	}
+
+	// set defaults
+	if cfg.Timeout == 0 {
+		cfg.Timeout = 5 * time.Second
+	}
+	if cfg.Backoff == 0 {
+		cfg.Backoff = time.Second
+	}
+	client := cfg.Client
+	if client == nil {
+		client = &http.Client{Timeout: cfg.Timeout}
+	}
+	callbackClient := cfg.CallbackClient
+	if callbackClient == nil {
+		callbackClient = newCallbackClient(cfg.Timeout)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Dispatcher{cfg: cfg, client: client, callbackClient: callbackClient, ctx: ctx, cancel: cancel}, nil
+}
+
+// Send delivers the event to configured urls and the message callback in background, doesn't block the caller.
+// The hashed client ip is taken from ctx, if available.
+func (d *Dispatcher) Send(ctx context.Context, e Event) {
+	if len(d.cfg.URLs) == 0 && e.Callback == "" {
+		return
+	}
+
+	payload := Payload{Event: e.Type, KeyPrefix: e.Key, IP: "-", Time: time.Now().UTC(), Expires: e.Exp.UTC()}
+	if len(e.Key) > keyPrefixLen {
+		payload.KeyPrefix = e.Key[:keyPrefixLen]
+	}
+	if d.cfg.IP != nil {
+		payload.IP = d.cfg.IP(ctx)
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		log.Printf("[WARN] can't marshal webhook payload, %v", err)
+		return
+	}
+
+	send := func(client *http.Client, u string) {
+		d.wg.Add(1)
+		go func() {
+			defer d.wg.Done()
+			if err := d.deliver(client, u, e.Type, body); err != nil {
+				log.Printf("[WARN] webhook %s for %s to %s failed, %v", e.Type, payload.KeyPrefix, redactURL(u), err)
+			}
+		}()
+	}
+	for _, u := range d.cfg.URLs {
+		send(d.client, u)
+	}
+	if e.Callback != "" {
+		send(d.callbackClient, e.Callback)
+	}
+}
+
+// Close stops pending retries and waits for requests in flight
+func (d *Dispatcher) Close() {
+	d.cancel()
+	d.wg.Wait()
+}
+
+// deliver posts body to the url, retrying on network errors and non-2xx responses
+func (d *Dispatcher) deliver(client *http.Client, u, eventType string, body []byte) error {
+	backoff := d.cfg.Backoff
+	var err error
+	for attempt := 0; attempt <= d.cfg.Retries; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-d.ctx.Done():
+				return fmt.Errorf("canceled after %d attempts, last error: %w", attempt, err)
+			case <-time.After(backoff):
+			}
+			backoff *= 2
+		}
+		if err = d.post(client, u, eventType, body); err == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("%d attempts, last error: %w", d.cfg.Retries+1, err)
+}
+
+// post makes a single signed webhook request
+func (d *Dispatcher) post(client *http.Client, u, eventType string, body []byte) error {
+	// not bound to d.ctx, requests in flight are allowed to complete on Close
+	ctx, cancel := context.WithTimeout(context.Background(), d.cfg.Timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("make request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Secrets-Event", eventType)
+	req.Header.Set("X-Secrets-Signature", "sha256="+Sign(d.cfg.Secret, body))
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("send request: %w", err)
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// Sign returns hex-encoded hmac-sha256 of body, receivers should compare it with X-Secrets-Signature header
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// ValidateURL checks the webhook url is an absolute http or https url
+func ValidateURL(u string) error {
+	parsed, err := url.Parse(u)
+	if err != nil {
+		return fmt.Errorf("invalid webhook url: %w", err)
+	}
+	if (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return fmt.Errorf("invalid webhook url %q, must be absolute http or https url", redactURL(u))
+	}
+	return nil
+}
+
+// ValidateCallback checks the per-message callback url set by API client. In addition to ValidateURL checks,
+// it rejects hosts resolving to internal addresses, so the server can't be used to reach its private network.
+// The callback client checks the address again on connect, the host can't be re-pointed after validation.
+func ValidateCallback(ctx context.Context, u string) error {
+	if err := ValidateURL(u); err != nil {
+		return err
+	}
+	parsed, _ := url.Parse(u) // parsed already by ValidateURL
+	addrs, err := net.DefaultResolver.LookupNetIP(ctx, "ip", parsed.Hostname())
+	if err != nil {
+		return fmt.Errorf("can't resolve callback host of %s: %w", redactURL(u), err)
+	}
+	for _, addr := range addrs {
+		if internalAddr(addr) {
+			return fmt.Errorf("callback url %s points to internal address %s", redactURL(u), addr.Unmap())
+		}
+	}
+	return nil
+}
+
+// newCallbackClient makes client refusing connections to internal addresses. The check is done on the resolved
+// address the client connects to, so it covers redirects and dns records changed after validation.
+// Proxy from environment is not used, as the check would apply to the proxy address instead of the callback one.
+func newCallbackClient(timeout time.Duration) *http.Client {
+	dialer := &net.Dialer{Timeout: timeout, Control: func(_, address string, _ syscall.RawConn) error {
+		addrPort, err := netip.ParseAddrPort(address)
+		if err != nil {
+			return fmt.Errorf("invalid callback address %q: %w", address, err)
+		}
+		if internalAddr(addrPort.Addr()) {
+			return fmt.Errorf("callback to internal address %s refused", addrPort.Addr().Unmap())
+		}
+		return nil
+	}}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+	return &http.Client{Timeout: timeout, Transport: transport}
+}
+
+// internalAddr checks if the address is loopback, private, link-local, unspecified or multicast
+func internalAddr(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	return addr.IsLoopback() || addr.IsPrivate() || addr.IsLinkLocalUnicast() || addr.IsLinkLocalMulticast() ||
+		addr.IsInterfaceLocalMulticast() || addr.IsMulticast() || addr.IsUnspecified()
+}
+
+// redactURL drops everything but scheme and host, urls may carry tokens in path or query
+func redactURL(u string) string {
+	parsed, err := url.Parse(u)
+	if err != nil || parsed.Host == "" {
+		return "invalid url"
+	}
+	return parsed.Scheme + "://" + parsed.Host
+}
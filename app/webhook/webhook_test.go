@@ -0,0 +1,213 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNew(t *testing.T) {
+	_, err := New(Config{URLs: []string{"https://example.com/hook"}})
+	require.EqualError(t, err, "webhook secret is required")
+
+	_, err = New(Config{URLs: []string{"ftp://example.com/hook"}, Secret: "secret"})
+	require.Error(t, err)
+
+	d, err := New(Config{URLs: []string{"https://example.com/hook"}, Secret: "secret"})
+	require.NoError(t, err)
+	assert.Equal(t, 5*time.Second, d.cfg.Timeout)
+	assert.Equal(t, time.Second, d.cfg.Backoff)
+	d.Close()
+}
+
+func TestDispatcher_Send(t *testing.T) {
+	type call struct {
+		path      string
+		event     string
+		signature string
+		body      []byte
+	}
+	var lock sync.Mutex
+	var calls []call
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+		lock.Lock()
+		calls = append(calls, call{path: r.URL.Path, event: r.Header.Get("X-Secrets-Event"),
+			signature: r.Header.Get("X-Secrets-Signature"), body: body})
+		lock.Unlock()
+	}))
+	defer ts.Close()
+
+	type ipKey struct{}
+	d, err := New(Config{URLs: []string{ts.URL + "/global"}, Secret: "secret", CallbackClient: ts.Client(),
+		IP: func(ctx context.Context) string { return ctx.Value(ipKey{}).(string) }})
+	require.NoError(t, err)
+
+	exp := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	ctx := context.WithValue(t.Context(), ipKey{}, "a1b2c3d4")
+	d.Send(ctx, Event{Type: EventAccessed, Key: "AbCdEfGhIjKl", Exp: exp, Callback: ts.URL + "/callback"})
+	d.Close()
+
+	require.Len(t, calls, 2)
+	paths := []string{calls[0].path, calls[1].path}
+	assert.ElementsMatch(t, []string{"/global", "/callback"}, paths)
+
+	c := calls[0]
+	assert.Equal(t, EventAccessed, c.event)
+	assert.Equal(t, "sha256="+Sign("secret", c.body), c.signature)
+
+	var payload Payload
+	require.NoError(t, json.Unmarshal(c.body, &payload))
+	assert.Equal(t, EventAccessed, payload.Event)
+	assert.Equal(t, "AbCd", payload.KeyPrefix, "only key prefix sent")
+	assert.Equal(t, "a1b2c3d4", payload.IP)
+	assert.Equal(t, exp, payload.Expires)
+	assert.WithinDuration(t, time.Now(), payload.Time, 5*time.Second)
+	assert.NotContains(t, string(c.body), "AbCdEfGhIjKl")
+}
+
+func TestDispatcher_SendNoURLs(t *testing.T) {
+	d, err := New(Config{Secret: "secret"})
+	require.NoError(t, err)
+	d.Send(t.Context(), Event{Type: EventCreated, Key: "AbCdEfGhIjKl"}) // nothing to notify, shouldn't panic or block
+	d.Close()
+}
+
+func TestDispatcher_CallbackToInternalAddress(t *testing.T) {
+	var lock sync.Mutex
+	var paths []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		paths = append(paths, r.URL.Path)
+		lock.Unlock()
+	}))
+	defer ts.Close()
+
+	// configured url is trusted, callback to the same internal address is refused on connect
+	d, err := New(Config{URLs: []string{ts.URL + "/global"}, Secret: "secret"})
+	require.NoError(t, err)
+	d.Send(t.Context(), Event{Type: EventCreated, Key: "AbCdEfGhIjKl", Callback: ts.URL + "/callback"})
+	d.Close()
+	assert.Equal(t, []string{"/global"}, paths)
+
+	_, err = d.callbackClient.Get(ts.URL)
+	require.ErrorContains(t, err, "callback to internal address 127.0.0.1 refused")
+}
+
+func TestDispatcher_Retry(t *testing.T) {
+	var attempts atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		if attempts.Add(1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer ts.Close()
+
+	d, err := New(Config{URLs: []string{ts.URL}, Secret: "secret", Retries: 3, Backoff: time.Millisecond})
+	require.NoError(t, err)
+	d.Send(t.Context(), Event{Type: EventCreated, Key: "AbCdEfGhIjKl"})
+	require.Eventually(t, func() bool { return attempts.Load() == 3 }, time.Second, time.Millisecond)
+	d.Close()
+	assert.Equal(t, int32(3), attempts.Load(), "delivered on the third attempt")
+
+	// gives up after all retries
+	attempts.Store(-10)
+	d, err = New(Config{URLs: []string{ts.URL}, Secret: "secret", Retries: 2, Backoff: time.Millisecond})
+	require.NoError(t, err)
+	d.Send(t.Context(), Event{Type: EventCreated, Key: "AbCdEfGhIjKl"})
+	require.Eventually(t, func() bool { return attempts.Load() == -7 }, time.Second, time.Millisecond)
+	time.Sleep(20 * time.Millisecond)
+	d.Close()
+	assert.Equal(t, int32(-7), attempts.Load(), "first attempt and 2 retries")
+}
+
+func TestDispatcher_CloseStopsRetries(t *testing.T) {
+	var attempts atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		attempts.Add(1)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer ts.Close()
+
+	d, err := New(Config{URLs: []string{ts.URL}, Secret: "secret", Retries: 5, Backoff: time.Hour})
+	require.NoError(t, err)
+	d.Send(t.Context(), Event{Type: EventCreated, Key: "AbCdEfGhIjKl"})
+	require.Eventually(t, func() bool { return attempts.Load() == 1 }, time.Second, 10*time.Millisecond)
+
+	st := time.Now()
+	d.Close()
+	assert.Less(t, time.Since(st), time.Second, "pending retry canceled")
+	assert.Equal(t, int32(1), attempts.Load())
+}
+
+func TestSign(t *testing.T) {
+	// echo -n '{"event":"created"}' | openssl dgst -sha256 -hmac secret
+	assert.Equal(t, "74e1c80b3590da2bf380221609511ac0d4c3401a4aaa4c14dae3f899ee6f9bd0",
+		Sign("secret", []byte(`{"event":"created"}`)))
+	assert.NotEqual(t, Sign("secret", []byte("body")), Sign("other", []byte("body")))
+	assert.Len(t, Sign("secret", []byte("body")), 64)
+}
+
+func TestValidateURL(t *testing.T) {
+	tests := []struct {
+		url     string
+		wantErr bool
+	}{
+		{url: "https://example.com/hook", wantErr: false},
+		{url: "http://10.0.0.1:8080/hook?token=abc", wantErr: false},
+		{url: "example.com/hook", wantErr: true},
+		{url: "ftp://example.com/hook", wantErr: true},
+		{url: "https://", wantErr: true},
+		{url: "://bad", wantErr: true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.url, func(t *testing.T) {
+			err := ValidateURL(tc.url)
+			if tc.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+		})
+	}
+}
+
+func TestValidateCallback(t *testing.T) {
+	tests := []struct {
+		url     string
+		wantErr string
+	}{
+		{url: "https://93.184.215.14/hook"},
+		{url: "http://[2606:2800:21f:cb07:6820:80da:af6b:8b2c]:8080/hook"},
+		{url: "ftp://93.184.215.14/hook", wantErr: "must be absolute http or https url"},
+		{url: "http://127.0.0.1:8080/hook", wantErr: "internal address 127.0.0.1"},
+		{url: "http://10.1.2.3/hook", wantErr: "internal address 10.1.2.3"},
+		{url: "http://192.168.1.1/hook", wantErr: "internal address 192.168.1.1"},
+		{url: "http://169.254.169.254/latest/meta-data", wantErr: "internal address 169.254.169.254"},
+		{url: "http://0.0.0.0/hook", wantErr: "internal address 0.0.0.0"},
+		{url: "http://224.0.0.1/hook", wantErr: "internal address 224.0.0.1"},
+		{url: "http://[::1]/hook", wantErr: "internal address ::1"},
+		{url: "http://[fd00::1]/hook", wantErr: "internal address fd00::1"},
+		{url: "http://[::ffff:127.0.0.1]/hook", wantErr: "internal address 127.0.0.1"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.url, func(t *testing.T) {
+			err := ValidateCallback(t.Context(), tc.url)
+			if tc.wantErr != "" {
+				require.ErrorContains(t, err, tc.wantErr)
+				return
+			}
+			require.NoError(t, err)
+		})
+	}
+}
@@ -0,0 +1,382 @@
+// Package client is Go client of secrets REST API. It creates and retrieves secrets, with server-side encryption,
+// or zero-knowledge with content encrypted by the client the same way as crypto.js of the web UI does.
+// Links made with client encryption can be opened in the browser, and browser links can be retrieved here.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// authUser is the user name of server basic auth with the single password
+const authUser = "secrets"
+
+// errors of API calls, APIError wraps one of them
+var (
+	ErrWrongPin        = errors.New("wrong pin")
+	ErrExpired         = errors.New("secret expired or deleted")
+	ErrTooLarge        = errors.New("secret too large")
+	ErrUnauthorized    = errors.New("unauthorized")
+	ErrForbidden       = errors.New("forbidden")
+	ErrTooManyRequests = errors.New("too many requests")
+	ErrBadRequest      = errors.New("bad request")
+	ErrServer          = errors.New("server error")
+)
+
+// APIError is failed API call with the status and error message from the server.
+// Use errors.Is with ErrWrongPin, ErrExpired etc. to check the failure mode.
+type APIError struct {
+	StatusCode int
+	Message    string
+	kind       error
+}
+
+// Error returns error message with the status
+func (e *APIError) Error() string {
+	return fmt.Sprintf("%s, status %d: %s", e.kind, e.StatusCode, e.Message)
+}
+
+// Unwrap returns the failure mode, one of Err* errors
+func (e *APIError) Unwrap() error { return e.kind }
+
+// Config of the client
+type Config struct {
+	URL        string        // base url of secrets server, like https://safesecret.info
+	User       string        // basic auth user, "secrets" if empty
+	Password   string        // basic auth password, if the server requires auth
+	Token      string        // named API token, used instead of Password if set
+	Timeout    time.Duration // http timeout, 30s by default, ignored with HTTPClient
+	HTTPClient *http.Client  // optional http client
+}
+
+// Client of secrets API
+type Client struct {
+	base       string
+	user       string
+	password   string
+	token      string
+	httpClient *http.Client
+}
+
+// Params is server configuration returned by Params
+type Params struct {
+	PinSize        int   `json:"pin_size"`
+	MaxPinAttempts int   `json:"max_pin_attempts"`
+	MaxExpSecs     int   `json:"max_exp_sec"`
+	FilesEnabled   bool  `json:"files_enabled"`
+	MaxFileSize    int64 `json:"max_file_size"`
+	AllowNoPin     bool  `json:"allow_no_pin"`
+	MaxViews       int   `json:"max_views"`
+	Passphrase     bool  `json:"passphrase"`
+	MinEntropy     int   `json:"min_entropy"`
+}
+
+// Request to create text secret
+type Request struct {
+	Message     string
+	Pin         string // pin or passphrase, can be empty with ClientEnc if the server allows secrets without pin
+	Exp         time.Duration
+	MaxViews    int    // 0 for a single view
+	CallbackURL string // url notified about events of this secret, the server must allow it
+	ClientEnc   bool   // encrypt on the client, the server never sees the content
+}
+
+// FileRequest to create file secret
+type FileRequest struct {
+	Name        string
+	ContentType string // application/octet-stream if empty
+	Data        []byte
+	Pin         string
+	Exp         time.Duration
+	MaxViews    int // supported with ClientEnc only, server-side encrypted file is single view
+	ClientEnc   bool
+}
+
+// Secret is created secret
+type Secret struct {
+	Key      string
+	Exp      time.Time
+	MaxViews int
+	Token    string // management token to check status or revoke the secret, returned only once
+	EncKey   string // decryption key of client-encrypted secret, never sent to the server
+	Link     string // link to share, with #EncKey fragment for client-encrypted secret
+}
+
+// Message is retrieved secret
+type Message struct {
+	Content
+	Key       string
+	ViewsLeft int
+	ClientEnc bool   // content was encrypted by the client
+	Blob      string // encrypted content, set if client-encrypted secret retrieved without decryption key
+}
+
+// New makes client for the server
+func New(cfg Config) (*Client, error) {
+	u, err := url.Parse(cfg.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid server url %q", cfg.URL)
+	}
+	if cfg.User == "" {
+		cfg.User = authUser
+	}
+	res := &Client{base: strings.TrimSuffix(cfg.URL, "/"), user: cfg.User, password: cfg.Password, token: cfg.Token,
+		httpClient: cfg.HTTPClient}
+	if res.httpClient == nil {
+		timeout := cfg.Timeout
+		if timeout == 0 {
+			timeout = 30 * time.Second
+		}
+		res.httpClient = &http.Client{Timeout: timeout}
+	}
+	return res, nil
+}
+
+// Params returns server configuration, like pin size and limits
+func (c *Client) Params(ctx context.Context) (Params, error) {
+	var res Params
+	if err := c.call(ctx, http.MethodGet, "/api/v1/params", nil, &res); err != nil {
+		return Params{}, err
+	}
+	return res, nil
+}
+
+// Create makes text secret. With ClientEnc the message is encrypted locally and the decryption key
+// is only in the returned link fragment.
+func (c *Client) Create(ctx context.Context, req Request) (*Secret, error) {
+	var encKey string
+	msg := req.Message
+	if req.ClientEnc {
+		var err error
+		if encKey, err = GenerateKey(); err != nil {
+			return nil, err
+		}
+		if msg, err = EncryptText(req.Message, encKey); err != nil {
+			return nil, err
+		}
+	}
+	return c.create(ctx, msg, req.Pin, req.Exp, req.MaxViews, req.CallbackURL, encKey)
+}
+
+// CreateFile makes file secret. Without ClientEnc the file is uploaded as is and encrypted by the server.
+func (c *Client) CreateFile(ctx context.Context, req FileRequest) (*Secret, error) {
+	contentType := req.ContentType
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	if req.ClientEnc {
+		encKey, err := GenerateKey()
+		if err != nil {
+			return nil, err
+		}
+		blob, err := EncryptFile(req.Data, req.Name, contentType, encKey)
+		if err != nil {
+			return nil, err
+		}
+		return c.create(ctx, blob, req.Pin, req.Exp, req.MaxViews, "", encKey)
+	}
+	if req.MaxViews > 1 {
+		return nil, errors.New("max views supported for client-encrypted files only")
+	}
+
+	body := &bytes.Buffer{}
+	mw := multipart.NewWriter(body)
+	_ = mw.WriteField("exp", strconv.Itoa(int(req.Exp.Seconds())))
+	_ = mw.WriteField("pin", req.Pin)
+	fw, err := mw.CreatePart(fileHeader(req.Name, contentType))
+	if err != nil {
+		return nil, fmt.Errorf("make form: %w", err)
+	}
+	_, _ = fw.Write(req.Data)
+	if err = mw.Close(); err != nil {
+		return nil, fmt.Errorf("make form: %w", err)
+	}
+
+	var resp secretResponse
+	if err = c.do(ctx, http.MethodPost, "/api/v1/file", body, mw.FormDataContentType(), &resp); err != nil {
+		return nil, err
+	}
+	return resp.secret(c.base, ""), nil
+}
+
+// Retrieve reads the secret and removes it, or counts the view for multi-view secrets.
+// The ref is message key or the whole link. A link with #key fragment is decrypted with that key,
+// the host of the link is ignored and the client's server used. Empty pin is for secrets without pin,
+// for a secret with pin it counts as a wrong attempt.
+func (c *Client) Retrieve(ctx context.Context, ref, pin string) (*Message, error) {
+	key, encKey := ref, ""
+	if strings.Contains(ref, "/") || strings.Contains(ref, "#") {
+		u, err := url.Parse(ref)
+		if err != nil {
+			return nil, fmt.Errorf("parse link: %w", err)
+		}
+		key, encKey = path.Base(u.Path), u.Fragment
+	}
+	if key == "" || key == "." || key == "/" {
+		return nil, fmt.Errorf("no message key in %q", ref)
+	}
+
+	apiPath := "/api/v1/message/" + url.PathEscape(key)
+	if pin != "" {
+		apiPath += "/" + url.PathEscape(pin)
+	}
+	var resp struct {
+		Key         string `json:"key"`
+		Message     string `json:"message"`
+		ClientEnc   bool   `json:"client_enc"`
+		FileName    string `json:"file_name"`
+		ContentType string `json:"content_type"`
+		ViewsLeft   int    `json:"views_left"`
+	}
+	if err := c.call(ctx, http.MethodGet, apiPath, nil, &resp); err != nil {
+		return nil, err
+	}
+
+	res := &Message{Key: resp.Key, ViewsLeft: resp.ViewsLeft, ClientEnc: resp.ClientEnc}
+	switch {
+	case resp.ClientEnc && encKey == "":
+		res.Blob = resp.Message // consumed already, keep the blob for decryption by the caller
+	case resp.ClientEnc:
+		content, err := Decrypt(resp.Message, encKey)
+		if err != nil {
+			return nil, err
+		}
+		res.Content = content
+	case resp.FileName != "":
+		data, err := base64.StdEncoding.DecodeString(resp.Message)
+		if err != nil {
+			return nil, fmt.Errorf("decode file: %w", err)
+		}
+		res.Content = Content{IsFile: true, FileName: resp.FileName, ContentType: resp.ContentType, Data: data}
+	default:
+		res.Text = resp.Message
+	}
+	return res, nil
+}
+
+// secretResponse is response of secret creation
+type secretResponse struct {
+	Key      string    `json:"key"`
+	Exp      time.Time `json:"exp"`
+	MaxViews int       `json:"max_views"`
+	Token    string    `json:"token"`
+}
+
+// secret makes Secret with the link to share
+func (r secretResponse) secret(base, encKey string) *Secret {
+	res := &Secret{Key: r.Key, Exp: r.Exp, MaxViews: max(r.MaxViews, 1), Token: r.Token, EncKey: encKey,
+		Link: base + "/message/" + r.Key}
+	if encKey != "" {
+		res.Link += "#" + encKey
+	}
+	return res
+}
+
+// create posts message, already encrypted if encKey set
+func (c *Client) create(ctx context.Context, msg, pin string, exp time.Duration, maxViews int, callback, encKey string) (*Secret, error) {
+	req := struct {
+		Message   string `json:"message"`
+		Exp       int    `json:"exp"`
+		Pin       string `json:"pin"`
+		MaxViews  int    `json:"max_views,omitempty"`
+		Callback  string `json:"callback_url,omitempty"`
+		ClientEnc bool   `json:"client_enc,omitempty"`
+	}{Message: msg, Exp: int(exp.Seconds()), Pin: pin, MaxViews: maxViews, Callback: callback, ClientEnc: encKey != ""}
+
+	var resp secretResponse
+	if err := c.call(ctx, http.MethodPost, "/api/v1/message", req, &resp); err != nil {
+		return nil, err
+	}
+	return resp.secret(c.base, encKey), nil
+}
+
+// call sends req as json, if not nil, and decodes json response to resp
+func (c *Client) call(ctx context.Context, method, apiPath string, req, resp any) error {
+	var body io.Reader
+	contentType := ""
+	if req != nil {
+		data, err := json.Marshal(req)
+		if err != nil {
+			return fmt.Errorf("marshal request: %w", err)
+		}
+		body, contentType = bytes.NewReader(data), "application/json"
+	}
+	return c.do(ctx, method, apiPath, body, contentType, resp)
+}
+
+// do makes the request and decodes json response to resp, non-2xx status returned as APIError
+func (c *Client) do(ctx context.Context, method, apiPath string, body io.Reader, contentType string, resp any) error {
+	req, err := http.NewRequestWithContext(ctx, method, c.base+apiPath, body)
+	if err != nil {
+		return fmt.Errorf("make request: %w", err)
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	switch {
+	case c.token != "":
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	case c.password != "":
+		req.SetBasicAuth(c.user, c.password)
+	}
+
+	httpResp, err := c.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("%s %s: %w", method, apiPath, err)
+	}
+	defer httpResp.Body.Close()
+
+	if httpResp.StatusCode < 200 || httpResp.StatusCode >= 300 {
+		errResp := struct {
+			Error string `json:"error"`
+		}{}
+		_ = json.NewDecoder(io.LimitReader(httpResp.Body, 64*1024)).Decode(&errResp)
+		return newAPIError(httpResp.StatusCode, errResp.Error)
+	}
+	if err = json.NewDecoder(httpResp.Body).Decode(resp); err != nil {
+		return fmt.Errorf("decode response: %w", err)
+	}
+	return nil
+}
+
+// newAPIError makes APIError with failure mode detected by status and, for 400, by the server's message
+func newAPIError(status int, msg string) *APIError {
+	res := &APIError{StatusCode: status, Message: msg, kind: ErrBadRequest}
+	switch {
+	case status == http.StatusExpectationFailed, msg == "wrong pin": // wrong pin on the last attempt is 400
+		res.kind = ErrWrongPin
+	case status == http.StatusBadRequest && strings.Contains(msg, "expired"):
+		res.kind = ErrExpired
+	case status == http.StatusUnauthorized:
+		res.kind = ErrUnauthorized
+	case status == http.StatusForbidden:
+		res.kind = ErrForbidden
+	case status == http.StatusRequestEntityTooLarge:
+		res.kind = ErrTooLarge
+	case status == http.StatusTooManyRequests:
+		res.kind = ErrTooManyRequests
+	case status >= http.StatusInternalServerError:
+		res.kind = ErrServer
+	}
+	return res
+}
+
+// fileHeader makes mime header of the file part, escaped the same way as multipart.CreateFormFile does
+func fileHeader(name, contentType string) textproto.MIMEHeader {
+	escaped := strings.NewReplacer("\\", "\\\\", `"`, "\\\"").Replace(name)
+	return textproto.MIMEHeader{"Content-Disposition": {`form-data; name="file"; filename="` + escaped + `"`},
+		"Content-Type": {contentType}}
+}
@@ -0,0 +1,282 @@
+package client
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/umputun/secrets/v2/app/messager"
+	"github.com/umputun/secrets/v2/app/server"
+	"github.com/umputun/secrets/v2/app/store"
+	"github.com/umputun/secrets/v2/app/tokens"
+	"github.com/umputun/secrets/v2/app/users"
+)
+
+func TestNew(t *testing.T) {
+	_, err := New(Config{URL: "https://example.com"})
+	require.NoError(t, err)
+
+	for _, u := range []string{"", "example.com", "ftp://example.com", "https://", "http://[::1"} {
+		_, err = New(Config{URL: u})
+		require.Error(t, err, u)
+	}
+}
+
+func TestClient_Params(t *testing.T) {
+	cl, _ := prepTestServer(t, server.Config{PinSize: 5, EnableFiles: true, MaxFileSize: 1024, AllowNoPin: true, MaxViews: 3})
+	params, err := cl.Params(t.Context())
+	require.NoError(t, err)
+	assert.Equal(t, Params{PinSize: 5, MaxPinAttempts: 3, MaxExpSecs: 36000, FilesEnabled: true, MaxFileSize: 1024,
+		AllowNoPin: true, MaxViews: 3}, params)
+}
+
+func TestClient_CreateRetrieve(t *testing.T) {
+	cl, eng := prepTestServer(t, server.Config{PinSize: 5, AllowNoPin: true, MaxViews: 3})
+
+	t.Run("server-side encryption", func(t *testing.T) {
+		secret, err := cl.Create(t.Context(), Request{Message: "my secret", Pin: "12345", Exp: time.Hour, MaxViews: 2})
+		require.NoError(t, err)
+		assert.NotEmpty(t, secret.Token)
+		assert.Empty(t, secret.EncKey)
+		assert.Equal(t, 2, secret.MaxViews)
+		assert.WithinDuration(t, time.Now().Add(time.Hour), secret.Exp, time.Minute)
+		assert.True(t, strings.HasSuffix(secret.Link, "/message/"+secret.Key))
+
+		msg, err := cl.Retrieve(t.Context(), secret.Key, "12345")
+		require.NoError(t, err)
+		assert.Equal(t, "my secret", msg.Text)
+		assert.Equal(t, 1, msg.ViewsLeft)
+		assert.False(t, msg.ClientEnc)
+		assert.False(t, msg.IsFile)
+
+		msg, err = cl.Retrieve(t.Context(), secret.Link, "12345")
+		require.NoError(t, err)
+		assert.Equal(t, "my secret", msg.Text)
+		assert.Equal(t, 0, msg.ViewsLeft)
+
+		_, err = cl.Retrieve(t.Context(), secret.Key, "12345")
+		require.ErrorIs(t, err, ErrExpired)
+	})
+
+	t.Run("client encryption", func(t *testing.T) {
+		secret, err := cl.Create(t.Context(), Request{Message: "zero knowledge", Pin: "12345", Exp: time.Hour, ClientEnc: true})
+		require.NoError(t, err)
+		require.NotEmpty(t, secret.EncKey)
+		assert.True(t, strings.HasSuffix(secret.Link, "/message/"+secret.Key+"#"+secret.EncKey))
+
+		stored, err := eng.Load(t.Context(), secret.Key)
+		require.NoError(t, err)
+		assert.True(t, stored.ClientEnc)
+		assert.NotContains(t, string(stored.Data), "zero knowledge")
+
+		msg, err := cl.Retrieve(t.Context(), secret.Link, "12345")
+		require.NoError(t, err)
+		assert.True(t, msg.ClientEnc)
+		assert.Equal(t, "zero knowledge", msg.Text)
+		assert.Empty(t, msg.Blob)
+	})
+
+	t.Run("client encryption retrieved by key", func(t *testing.T) {
+		secret, err := cl.Create(t.Context(), Request{Message: "blob", Pin: "12345", Exp: time.Hour, ClientEnc: true})
+		require.NoError(t, err)
+		msg, err := cl.Retrieve(t.Context(), secret.Key, "12345")
+		require.NoError(t, err)
+		require.NotEmpty(t, msg.Blob)
+		content, err := Decrypt(msg.Blob, secret.EncKey)
+		require.NoError(t, err)
+		assert.Equal(t, "blob", content.Text)
+	})
+
+	t.Run("without pin", func(t *testing.T) {
+		secret, err := cl.Create(t.Context(), Request{Message: "no pin", Exp: time.Hour, ClientEnc: true})
+		require.NoError(t, err)
+		msg, err := cl.Retrieve(t.Context(), secret.Link, "")
+		require.NoError(t, err)
+		assert.Equal(t, "no pin", msg.Text)
+
+		_, err = cl.Create(t.Context(), Request{Message: "no pin", Exp: time.Hour})
+		require.ErrorIs(t, err, ErrBadRequest, "server-side encryption needs pin")
+	})
+
+	t.Run("bad request", func(t *testing.T) {
+		_, err := cl.Create(t.Context(), Request{Message: "msg", Pin: "12345", Exp: 100 * time.Hour})
+		require.ErrorIs(t, err, ErrBadRequest)
+		var apiErr *APIError
+		require.ErrorAs(t, err, &apiErr)
+		assert.Equal(t, 400, apiErr.StatusCode)
+		assert.Equal(t, "can't create message", apiErr.Message)
+	})
+}
+
+func TestClient_WrongPin(t *testing.T) {
+	cl, _ := prepTestServer(t, server.Config{PinSize: 5})
+	secret, err := cl.Create(t.Context(), Request{Message: "my secret", Pin: "12345", Exp: time.Hour})
+	require.NoError(t, err)
+
+	var apiErr *APIError
+	for range 2 {
+		_, err = cl.Retrieve(t.Context(), secret.Key, "11111")
+		require.ErrorIs(t, err, ErrWrongPin)
+		require.ErrorAs(t, err, &apiErr)
+		assert.Equal(t, 417, apiErr.StatusCode)
+	}
+	_, err = cl.Retrieve(t.Context(), secret.Key, "11111")
+	require.ErrorIs(t, err, ErrWrongPin, "last attempt")
+	require.ErrorAs(t, err, &apiErr)
+	assert.Equal(t, 400, apiErr.StatusCode)
+
+	_, err = cl.Retrieve(t.Context(), secret.Key, "12345")
+	require.ErrorIs(t, err, ErrExpired, "burned after max attempts")
+}
+
+func TestClient_CreateFile(t *testing.T) {
+	cl, _ := prepTestServer(t, server.Config{PinSize: 5, EnableFiles: true, MaxFileSize: 1024, MaxViews: 2})
+	data := []byte{0x00, 0xff, 0xfe, 'k', 0x0a}
+
+	t.Run("server-side encryption", func(t *testing.T) {
+		secret, err := cl.CreateFile(t.Context(), FileRequest{Name: `key "store".jks`, Data: data, Pin: "12345",
+			Exp: time.Hour})
+		require.NoError(t, err)
+		msg, err := cl.Retrieve(t.Context(), secret.Key, "12345")
+		require.NoError(t, err)
+		assert.Equal(t, Content{IsFile: true, FileName: `key "store".jks`, ContentType: "application/octet-stream",
+			Data: data}, msg.Content)
+	})
+
+	t.Run("client encryption", func(t *testing.T) {
+		secret, err := cl.CreateFile(t.Context(), FileRequest{Name: "a.txt", ContentType: "text/plain", Data: data,
+			Pin: "12345", Exp: time.Hour, MaxViews: 2, ClientEnc: true})
+		require.NoError(t, err)
+		assert.Equal(t, 2, secret.MaxViews)
+		msg, err := cl.Retrieve(t.Context(), secret.Link, "12345")
+		require.NoError(t, err)
+		assert.Equal(t, Content{IsFile: true, FileName: "a.txt", ContentType: "text/plain", Data: data}, msg.Content)
+		assert.Equal(t, 1, msg.ViewsLeft)
+	})
+
+	t.Run("too large", func(t *testing.T) {
+		_, err := cl.CreateFile(t.Context(), FileRequest{Name: "big.bin", Data: make([]byte, 1025), Pin: "12345",
+			Exp: time.Hour})
+		require.ErrorIs(t, err, ErrTooLarge)
+	})
+
+	t.Run("max views of server-side file", func(t *testing.T) {
+		_, err := cl.CreateFile(t.Context(), FileRequest{Name: "a.bin", Data: data, Pin: "12345", Exp: time.Hour,
+			MaxViews: 2})
+		require.Error(t, err)
+	})
+
+	t.Run("files disabled", func(t *testing.T) {
+		clNoFiles, _ := prepTestServer(t, server.Config{PinSize: 5})
+		_, err := clNoFiles.CreateFile(t.Context(), FileRequest{Name: "a.bin", Data: data, Pin: "12345", Exp: time.Hour})
+		require.ErrorIs(t, err, ErrForbidden)
+	})
+}
+
+func TestClient_Auth(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("passwd"), bcrypt.MinCost)
+	require.NoError(t, err)
+	cl, _ := prepTestServer(t, server.Config{PinSize: 5, AuthHash: string(hash)})
+
+	_, err = cl.Create(t.Context(), Request{Message: "my secret", Pin: "12345", Exp: time.Hour})
+	require.ErrorIs(t, err, ErrUnauthorized)
+
+	cl.password = "passwd"
+	secret, err := cl.Create(t.Context(), Request{Message: "my secret", Pin: "12345", Exp: time.Hour})
+	require.NoError(t, err)
+
+	cl.password = ""
+	msg, err := cl.Retrieve(t.Context(), secret.Key, "12345")
+	require.NoError(t, err, "retrieval doesn't need auth")
+	assert.Equal(t, "my secret", msg.Text)
+
+	t.Run("named user", func(t *testing.T) {
+		eng := store.NewInMemory(time.Minute)
+		tbl := users.NewTable(eng)
+		require.NoError(t, tbl.Set(t.Context(), "bob", "bob-pass"))
+		srv, err := server.New(messager.New(eng, messager.Crypt{Key: "123456789012345678901234567"},
+			messager.Params{MaxDuration: time.Hour, MaxPinAttempts: 3}), "test",
+			server.Config{Domain: []string{"example.com"}, Protocol: "http", PinSize: 5, MaxExpire: time.Hour})
+		require.NoError(t, err)
+		ts := httptest.NewServer(srv.WithUsers(tbl).Handler())
+		defer ts.Close()
+
+		clUser, err := New(Config{URL: ts.URL, User: "bob", Password: "bob-pass"})
+		require.NoError(t, err)
+		_, err = clUser.Create(t.Context(), Request{Message: "my secret", Pin: "12345", Exp: time.Hour})
+		require.NoError(t, err)
+
+		clUser.user = "secrets"
+		_, err = clUser.Create(t.Context(), Request{Message: "my secret", Pin: "12345", Exp: time.Hour})
+		require.ErrorIs(t, err, ErrUnauthorized)
+	})
+
+	t.Run("token", func(t *testing.T) {
+		clTk, eng := prepTestServer(t, server.Config{PinSize: 5, AuthHash: string(hash), EnableFiles: true,
+			MaxFileSize: 1024})
+		token, _, err := tokens.New(eng.(tokens.Store)).Create(t.Context(), tokens.Request{Name: "ci",
+			Scopes: []string{tokens.ScopeCreateText}, MaxExp: time.Hour})
+		require.NoError(t, err)
+
+		clTk.token, clTk.password = token, "wrong"
+		_, err = clTk.Create(t.Context(), Request{Message: "my secret", Pin: "12345", Exp: time.Hour})
+		require.NoError(t, err, "token takes precedence over password")
+		_, err = clTk.Create(t.Context(), Request{Message: "my secret", Pin: "12345", Exp: 2 * time.Hour})
+		require.ErrorIs(t, err, ErrForbidden, "exp above token limit")
+		_, err = clTk.CreateFile(t.Context(), FileRequest{Name: "a.txt", Data: []byte("data"), Pin: "12345",
+			Exp: time.Hour})
+		require.ErrorIs(t, err, ErrForbidden, "no create-file scope")
+
+		clTk.token = "sct_bad"
+		_, err = clTk.Create(t.Context(), Request{Message: "my secret", Pin: "12345", Exp: time.Hour})
+		require.ErrorIs(t, err, ErrUnauthorized)
+	})
+}
+
+func TestNewAPIError(t *testing.T) {
+	tests := []struct {
+		status int
+		msg    string
+		kind   error
+	}{
+		{status: 417, msg: "wrong pin attempt", kind: ErrWrongPin},
+		{status: 400, msg: "wrong pin", kind: ErrWrongPin},
+		{status: 400, msg: "message expired", kind: ErrExpired},
+		{status: 400, msg: "load message: message expired or deleted", kind: ErrExpired},
+		{status: 400, msg: "invalid request", kind: ErrBadRequest},
+		{status: 401, msg: "authentication required", kind: ErrUnauthorized},
+		{status: 403, msg: "file uploads disabled", kind: ErrForbidden},
+		{status: 413, kind: ErrTooLarge},
+		{status: 429, kind: ErrTooManyRequests},
+		{status: 502, kind: ErrServer},
+		{status: 404, kind: ErrBadRequest},
+	}
+	for _, tc := range tests {
+		err := newAPIError(tc.status, tc.msg)
+		require.ErrorIs(t, err, tc.kind, "%d %s", tc.status, tc.msg)
+		assert.Contains(t, err.Error(), tc.kind.Error())
+	}
+}
+
+// prepTestServer starts secrets server with in-memory store and returns client of it
+func prepTestServer(t *testing.T, cfg server.Config) (*Client, messager.Engine) {
+	t.Helper()
+	eng := store.NewInMemory(time.Minute)
+	msgr := messager.New(eng, messager.Crypt{Key: "123456789012345678901234567"}, messager.Params{
+		MaxDuration: 10 * time.Hour, MaxPinAttempts: 3, MaxFileSize: cfg.MaxFileSize, MaxViews: max(cfg.MaxViews, 1),
+	})
+	cfg.Domain, cfg.Protocol, cfg.MaxPinAttempts, cfg.MaxExpire = []string{"example.com"}, "http", 3, 10*time.Hour
+	srv, err := server.New(msgr, "test", cfg)
+	require.NoError(t, err)
+	ts := httptest.NewServer(srv.WithTokens(tokens.New(eng)).Handler())
+	t.Cleanup(ts.Close)
+
+	cl, err := New(Config{URL: ts.URL})
+	require.NoError(t, err)
+	return cl, eng
+}
@@ -0,0 +1,152 @@
+package client
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"unicode/utf8"
+)
+
+// type bytes of the payload, same as TYPE_TEXT and TYPE_FILE in crypto.js of the web UI
+const (
+	typeText byte = 0x00
+	typeFile byte = 0x01
+)
+
+const (
+	keySize  = 16 // AES-128
+	ivSize   = 12
+	tagSize  = 16
+	minBlob  = ivSize + tagSize + 1 // iv, tag and type byte
+	lenField = 2                    // big-endian length of file name and content type
+)
+
+// Content is decrypted content of a blob, either text or file
+type Content struct {
+	IsFile      bool
+	Text        string // set for text content
+	FileName    string // set for file content
+	ContentType string // set for file content
+	Data        []byte // file data
+}
+
+// GenerateKey makes random 128-bit key, encoded as 22 chars base64url like crypto.js generateKey
+func GenerateKey() (string, error) {
+	key := make([]byte, keySize)
+	if _, err := rand.Read(key); err != nil {
+		return "", fmt.Errorf("generate key: %w", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(key), nil
+}
+
+// EncryptText encrypts text, the result is base64url(IV || ciphertext || tag) of 0x00 || utf8(text) payload
+func EncryptText(text, key string) (string, error) {
+	payload := make([]byte, 0, 1+len(text))
+	payload = append(payload, typeText)
+	payload = append(payload, text...)
+	return seal(payload, key)
+}
+
+// EncryptFile encrypts file with its metadata, payload is
+// 0x01 || len_be16(fileName) || fileName || len_be16(contentType) || contentType || data
+func EncryptFile(data []byte, fileName, contentType, key string) (string, error) {
+	if len(fileName) > math.MaxUint16 || len(contentType) > math.MaxUint16 {
+		return "", errors.New("file name or content type too long")
+	}
+	payload := make([]byte, 0, 1+lenField+len(fileName)+lenField+len(contentType)+len(data))
+	payload = append(payload, typeFile)
+	payload = binary.BigEndian.AppendUint16(payload, uint16(len(fileName))) //nolint:gosec // checked above
+	payload = append(payload, fileName...)
+	payload = binary.BigEndian.AppendUint16(payload, uint16(len(contentType))) //nolint:gosec // checked above
+	payload = append(payload, contentType...)
+	payload = append(payload, data...)
+	return seal(payload, key)
+}
+
+// Decrypt decrypts blob made by EncryptText or EncryptFile, or by crypto.js in browser.
+// Returns error on wrong key or corrupted blob.
+func Decrypt(blob, key string) (Content, error) {
+	data, err := base64.RawURLEncoding.DecodeString(blob)
+	if err != nil {
+		return Content{}, fmt.Errorf("decode blob: %w", err)
+	}
+	if len(data) < minBlob {
+		return Content{}, errors.New("ciphertext too short")
+	}
+	gcm, err := makeGCM(key)
+	if err != nil {
+		return Content{}, err
+	}
+	payload, err := gcm.Open(nil, data[:ivSize], data[ivSize:], nil)
+	if err != nil {
+		return Content{}, fmt.Errorf("decrypt: %w", err)
+	}
+	if len(payload) == 0 {
+		return Content{}, errors.New("empty payload")
+	}
+
+	switch payload[0] {
+	case typeText:
+		if !utf8.Valid(payload[1:]) {
+			return Content{}, errors.New("text is not valid utf8")
+		}
+		return Content{Text: string(payload[1:])}, nil
+	case typeFile:
+		rest := payload[1:]
+		fileName, rest, err := readField(rest)
+		if err != nil {
+			return Content{}, fmt.Errorf("file name: %w", err)
+		}
+		contentType, rest, err := readField(rest)
+		if err != nil {
+			return Content{}, fmt.Errorf("content type: %w", err)
+		}
+		return Content{IsFile: true, FileName: fileName, ContentType: contentType, Data: rest}, nil
+	default:
+		return Content{}, fmt.Errorf("unknown content type %d", payload[0])
+	}
+}
+
+// seal encrypts payload with random IV and returns base64url(IV || ciphertext || tag)
+func seal(payload []byte, key string) (string, error) {
+	gcm, err := makeGCM(key)
+	if err != nil {
+		return "", err
+	}
+	iv := make([]byte, ivSize)
+	if _, err := rand.Read(iv); err != nil {
+		return "", fmt.Errorf("generate iv: %w", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(gcm.Seal(iv, iv, payload, nil)), nil
+}
+
+// makeGCM makes AES-GCM cipher from base64url key
+func makeGCM(key string) (cipher.AEAD, error) {
+	keyBytes, err := base64.RawURLEncoding.DecodeString(key)
+	if err != nil || len(keyBytes) != keySize {
+		return nil, errors.New("key must be 16 bytes encoded as base64url")
+	}
+	block, err := aes.NewCipher(keyBytes)
+	if err != nil {
+		return nil, fmt.Errorf("make cipher: %w", err)
+	}
+	return cipher.NewGCM(block)
+}
+
+// readField reads big-endian 16-bit length prefixed string, returns the string and the rest of data
+func readField(data []byte) (field string, rest []byte, err error) {
+	if len(data) < lenField {
+		return "", nil, errors.New("truncated payload, missing length")
+	}
+	size := int(binary.BigEndian.Uint16(data))
+	data = data[lenField:]
+	if len(data) < size {
+		return "", nil, errors.New("truncated payload")
+	}
+	return string(data[:size]), data[size:], nil
+}
@@ -0,0 +1,117 @@
+package client
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// blobs made by crypto.js encrypt and encryptFile with testKey
+const (
+	testKey      = "AAECAwQFBgcICQoLDA0ODw"
+	jsTextBlob   = "wYpfUvj3M3iqyZpexKHHKRkmogMI7obI76HopbZ5jcr3ieAbiHK1j3T2xv4osATFcb7Tjhb40ZnLDg"
+	jsFileBlob   = "rzICU4NtEwxLqG8zvtBfJs09hkbezxOUaKJFbxNjwLEQ46EWURgMgBc9WNVyEl7IBJWV5Wu-sZIAOEt_qhU_m0YSXVYQ2hPO5w"
+	jsTextSecret = "secret text, юникод ✓"
+)
+
+func TestGenerateKey(t *testing.T) {
+	key, err := GenerateKey()
+	require.NoError(t, err)
+	assert.Len(t, key, 22)
+	raw, err := base64.RawURLEncoding.DecodeString(key)
+	require.NoError(t, err)
+	assert.Len(t, raw, 16)
+
+	key2, err := GenerateKey()
+	require.NoError(t, err)
+	assert.NotEqual(t, key, key2)
+}
+
+func TestDecrypt_CryptoJS(t *testing.T) {
+	t.Run("text", func(t *testing.T) {
+		res, err := Decrypt(jsTextBlob, testKey)
+		require.NoError(t, err)
+		assert.Equal(t, Content{Text: jsTextSecret}, res)
+	})
+
+	t.Run("file", func(t *testing.T) {
+		res, err := Decrypt(jsFileBlob, testKey)
+		require.NoError(t, err)
+		assert.Equal(t, Content{IsFile: true, FileName: "файл.bin", ContentType: "application/octet-stream",
+			Data: []byte{0, 255, 128, 10}}, res)
+	})
+
+	t.Run("wrong key", func(t *testing.T) {
+		key, err := GenerateKey()
+		require.NoError(t, err)
+		_, err = Decrypt(jsTextBlob, key)
+		require.Error(t, err)
+	})
+}
+
+func TestEncryptDecrypt(t *testing.T) {
+	key, err := GenerateKey()
+	require.NoError(t, err)
+
+	t.Run("text", func(t *testing.T) {
+		blob, err := EncryptText("hello", key)
+		require.NoError(t, err)
+		assert.NotContains(t, blob, "=")
+		raw, err := base64.RawURLEncoding.DecodeString(blob)
+		require.NoError(t, err)
+		assert.Len(t, raw, 12+1+5+16, "iv, type byte, text and tag")
+
+		res, err := Decrypt(blob, key)
+		require.NoError(t, err)
+		assert.Equal(t, Content{Text: "hello"}, res)
+
+		blob2, err := EncryptText("hello", key)
+		require.NoError(t, err)
+		assert.NotEqual(t, blob, blob2, "random iv")
+	})
+
+	t.Run("file", func(t *testing.T) {
+		blob, err := EncryptFile([]byte{1, 2, 3}, "a.txt", "text/plain", key)
+		require.NoError(t, err)
+		res, err := Decrypt(blob, key)
+		require.NoError(t, err)
+		assert.Equal(t, Content{IsFile: true, FileName: "a.txt", ContentType: "text/plain", Data: []byte{1, 2, 3}}, res)
+	})
+
+	t.Run("file name too long", func(t *testing.T) {
+		_, err := EncryptFile(nil, strings.Repeat("a", 70000), "text/plain", key)
+		require.Error(t, err)
+	})
+}
+
+func TestDecrypt_Errors(t *testing.T) {
+	key, err := GenerateKey()
+	require.NoError(t, err)
+	truncated, err := seal([]byte{typeFile, 0x00, 0x10, 'a'}, key)
+	require.NoError(t, err)
+	unknown, err := seal([]byte{0x05, 'a'}, key)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name string
+		blob string
+		key  string
+		err  string
+	}{
+		{name: "not base64url", blob: "not+base64/", key: key, err: "decode blob"},
+		{name: "too short", blob: "YWJj", key: key, err: "ciphertext too short"},
+		{name: "bad key", blob: jsTextBlob, key: "short", err: "key must be 16 bytes"},
+		{name: "truncated file", blob: truncated, key: key, err: "truncated payload"},
+		{name: "unknown type", blob: unknown, key: key, err: "unknown content type"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := Decrypt(tc.blob, tc.key)
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), tc.err)
+		})
+	}
+}